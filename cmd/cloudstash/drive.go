@@ -0,0 +1,337 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/paddlesteamer/cloudstash/internal/config"
+	"github.com/paddlesteamer/cloudstash/internal/control"
+	"github.com/paddlesteamer/cloudstash/internal/manager"
+)
+
+// driveCmd adds, removes or lists the drives of the vault, or moves
+// the files of a drive to another one through the running cloudstash
+func driveCmd(cfgDir string, args []string) error {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s drive [command]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Commands:")
+		fmt.Fprintln(os.Stderr, "  list\t\t\t\t\tlist drives, default")
+		fmt.Fprintln(os.Stderr, "  add [--name <name>] <provider>\t\tauthorize a new drive")
+		fmt.Fprintln(os.Stderr, "  remove [--migrate-to <drive>] <drive>\tremove a drive which doesn't have any files")
+		fmt.Fprintln(os.Stderr, "  migrate --from <drive> --to <drive>\tmove all files and the database to another drive")
+	}
+
+	cmd := "list"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "list":
+		return listDrives(cfgDir)
+	case "add":
+		return addDrive(cfgDir, args)
+	case "remove":
+		return removeDrive(cfgDir, args)
+	case "migrate":
+		return migrate(cfgDir, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	return nil
+}
+
+// listDrives lists the drives in the configuration, along with the files in
+// them if cloudstash is running
+func listDrives(cfgDir string) error {
+	cfg, err := config.ReadConfig(cfgDir)
+	if err != nil {
+		return fmt.Errorf("couldn't read configuration: %v", err)
+	}
+
+	client, err := newClient(cfgDir)
+	if err != nil {
+		return err
+	}
+
+	infos, err := client.ListDrives()
+	if err != nil && err != control.ErrNotRunning {
+		return fmt.Errorf("couldn't list drives: %v", err)
+	}
+
+	running := err == nil
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	if running {
+		fmt.Fprintln(w, "NAME\tID\tPROVIDER\tFILES\tREPLICAS\tAVAILABLE\tDATABASE")
+	} else {
+		fmt.Fprintln(w, "NAME\tID\tPROVIDER")
+	}
+
+	for _, d := range cfg.Drives {
+		// drives get their ids on the first run after they are added
+		id := d.ID
+		if id == "" {
+			id = "-"
+		}
+
+		if !running {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", d.GetName(), id, d.Provider)
+			continue
+		}
+
+		info := findDriveInfo(infos, d.GetName())
+		if info == nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t-\t\n", d.GetName(), id, d.Provider)
+			continue
+		}
+
+		available := "-"
+		if info.Available >= 0 {
+			available = formatBytes(info.Available)
+		}
+
+		db := ""
+		if info.Database {
+			db = "yes"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", d.GetName(), info.ID, d.Provider, info.Files, info.Replicas,
+			available, db)
+	}
+
+	return w.Flush()
+}
+
+// addDrive authorizes a new drive and adds it to the configuration
+func addDrive(cfgDir string, args []string) error {
+	flags := flag.NewFlagSet("add", flag.ExitOnError)
+	name := flags.String("name", "", "Name of the drive, the provider by default.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s drive add [--name <name>] <provider>\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Providers: %s\n\n", strings.Join(config.Providers, ", "))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.ReadConfig(cfgDir)
+	if err != nil {
+		return fmt.Errorf("couldn't read configuration: %v", err)
+	}
+
+	provider := flags.Arg(0)
+
+	if cfg.FindDrive((&config.DriveCfg{Provider: provider, Name: *name}).GetName()) != nil {
+		return fmt.Errorf("there is already a drive with that name, choose another one with --name")
+	}
+
+	d, err := config.AuthorizeDrive(provider, *name)
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.AddDrive(*d); err != nil {
+		return err
+	}
+
+	if err := config.WriteConfig(cfgDir, cfg); err != nil {
+		return fmt.Errorf("couldn't write configuration: %v", err)
+	}
+
+	fmt.Printf("added drive %s\n", d.GetName())
+
+	if isRunning(cfgDir) {
+		fmt.Println("restart cloudstash to use it")
+	}
+
+	return nil
+}
+
+// removeDrive removes a drive from the configuration. It is refused if files
+// are stored in the drive, unless they are migrated to another one first.
+func removeDrive(cfgDir string, args []string) error {
+	flags := flag.NewFlagSet("remove", flag.ExitOnError)
+	migrateTo := flags.String("migrate-to", "", "Drive to move the files in the removed drive to.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s drive remove [--migrate-to <drive>] <drive>\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	name := flags.Arg(0)
+
+	cfg, err := config.ReadConfig(cfgDir)
+	if err != nil {
+		return fmt.Errorf("couldn't read configuration: %v", err)
+	}
+
+	if cfg.FindDrive(name) == nil {
+		return fmt.Errorf("there isn't a drive named %s", name)
+	}
+
+	if len(cfg.Drives) == 1 {
+		return fmt.Errorf("%s is the only drive", name)
+	}
+
+	if shards := cfg.DataShards + cfg.ParityShards; cfg.DataShards > 0 && cfg.ParityShards > 0 && shards >= len(cfg.Drives) {
+		return fmt.Errorf("erasure coding needs %d drives", shards)
+	}
+
+	// files in the drive are only known by the running cloudstash
+	client, err := newClient(cfgDir)
+	if err != nil {
+		return err
+	}
+
+	info, err := driveInfo(client, name)
+	if err != nil {
+		return err
+	}
+
+	if info.InUse() && *migrateTo != "" {
+		res, err := client.MigrateDrive(name, *migrateTo)
+		if err != nil {
+			return fmt.Errorf("couldn't migrate %s: %v", name, err)
+		}
+
+		printMigration(res)
+
+		if info, err = driveInfo(client, name); err != nil {
+			return err
+		}
+	}
+
+	if info.InUse() {
+		return fmt.Errorf("%d files and %d replicas are stored in %s, move them with --migrate-to <drive>",
+			info.Files, info.Replicas, name)
+	}
+
+	if err := cfg.RemoveDrive(name); err != nil {
+		return err
+	}
+
+	if err := config.WriteConfig(cfgDir, cfg); err != nil {
+		return fmt.Errorf("couldn't write configuration: %v", err)
+	}
+
+	fmt.Printf("removed drive %s, restart cloudstash to stop using it\n", name)
+
+	return nil
+}
+
+func driveInfo(client *control.Client, name string) (*manager.DriveInfo, error) {
+	infos, err := client.ListDrives()
+	if err == control.ErrNotRunning {
+		return nil, fmt.Errorf("cloudstash should be running to check the files in %s", name)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list drives: %v", err)
+	}
+
+	info := findDriveInfo(infos, name)
+	if info == nil {
+		return nil, fmt.Errorf("%s isn't used by the running cloudstash, restart it first", name)
+	}
+
+	return info, nil
+}
+
+func findDriveInfo(infos []manager.DriveInfo, name string) *manager.DriveInfo {
+	for i := range infos {
+		if infos[i].Name == name {
+			return &infos[i]
+		}
+	}
+
+	return nil
+}
+
+// isRunning returns whether cloudstash is running with the configuration in cfgDir
+func isRunning(cfgDir string) bool {
+	client, err := newClient(cfgDir)
+	if err != nil {
+		return false
+	}
+
+	_, err = client.GetStatus()
+
+	return err != control.ErrNotRunning
+}
+
+func migrate(cfgDir string, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "Drive to move the files from, i.e. dropbox.")
+	to := flags.String("to", "", "Drive to move the files to, i.e. gdrive.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s drive migrate --from <drive> --to <drive>\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *from == "" || *to == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, err := newClient(cfgDir)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.MigrateDrive(*from, *to)
+	if err != nil {
+		return fmt.Errorf("couldn't migrate %s: %v", *from, err)
+	}
+
+	printMigration(res)
+
+	if res.Database {
+		fmt.Printf("moved the database to %s\n", *to)
+	}
+
+	return nil
+}
+
+// rebalance moves files between the drives through the running cloudstash
+// so that their available space is even
+func rebalance(cfgDir string) error {
+	client, err := newClient(cfgDir)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Rebalance()
+	if err != nil {
+		return fmt.Errorf("couldn't rebalance drives: %v", err)
+	}
+
+	printMigration(res)
+
+	return nil
+}
+
+func printMigration(res *manager.Migration) {
+	fmt.Printf("moved %d files\n", res.Moved)
+
+	if res.Skipped > 0 || res.Failed > 0 {
+		fmt.Printf("%d files have pending changes and %d couldn't be moved, run it again to move them\n",
+			res.Skipped, res.Failed)
+	}
+}
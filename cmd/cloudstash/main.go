@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/paddlesteamer/cloudstash/internal/common"
 	"github.com/paddlesteamer/cloudstash/internal/config"
+	"github.com/paddlesteamer/cloudstash/internal/control"
 	"github.com/paddlesteamer/cloudstash/internal/crypto"
 	"github.com/paddlesteamer/cloudstash/internal/drive"
 	"github.com/paddlesteamer/cloudstash/internal/fs"
@@ -24,103 +30,492 @@ import (
 func main() {
 	log.SetLevel(log.DebugLevel)
 
-	cfgDir, mntDir := parseFlags()
+	cfgDir, mntDir, profile := parseFlags()
+	if profile != config.DefaultProfile && !config.IsValidProfile(profile) {
+		fmt.Fprintf(os.Stderr, "invalid profile name: %s\n", profile)
+		os.Exit(2)
+	}
+
+	profileDir := config.GetProfileDir(cfgDir, profile)
+
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+		mount(cfgDir, mntDir, []string{profile})
+	case "mount":
+		profiles, err := parseProfiles(flag.Args()[1:], profile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+
+		mount(cfgDir, mntDir, profiles)
+	case "profiles":
+		if err := listProfiles(cfgDir, mntDir); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "status":
+		if err := status(profileDir); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "rm":
+		if err := rm(profileDir, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "trash":
+		if err := trash(profileDir, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "versions":
+		if err := versions(profileDir, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "snapshot":
+		if err := snapshot(profileDir, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "drive":
+		if err := driveCmd(profileDir, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "rebalance":
+		if err := rebalance(profileDir); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// stateLockFileName is the file locked in the state directory by the process using it
+const stateLockFileName = "lock"
+
+// vault is a mounted vault of a profile
+type vault struct {
+	profile string
+	cfg     *config.Cfg
+	m       *manager.Manager
+	srv     *control.Server
+	lock    *os.File // lock of the state directory
+}
+
+// mount mounts the vaults of profiles in one process and blocks until they
+// are unmounted. Vaults using the same accounts share their drive clients
+// and upload slots.
+func mount(cfgDir, mntDir string, profiles []string) {
+	pool := drive.NewPool()
+
+	vaults := []*vault{}
+	mounted := map[string]string{}
+
+	defer func() {
+		for _, v := range vaults {
+			v.close()
+		}
+	}()
+
+	for _, profile := range profiles {
+		v, err := openVault(cfgDir, mntDir, profile, pool)
+		if err != nil {
+			log.Errorf("couldn't open vault of profile %s: %v", profile, err)
+			return
+		}
+
+		vaults = append(vaults, v)
+
+		if other, ok := mounted[v.cfg.MountPoint]; ok {
+			log.Errorf("profiles %s and %s have the same mount point %s", other, profile, v.cfg.MountPoint)
+			return
+		}
+
+		mounted[v.cfg.MountPoint] = profile
+	}
+
+	mountpoints := make([]string, len(vaults))
+	for i, v := range vaults {
+		mountpoints[i] = v.cfg.MountPoint
+	}
+
+	// unmount when SIGINT, SIGTERM or SIGQUIT is received
+	signalCh := make(chan os.Signal, 1)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	go handleSignal(signalCh, &wg, mountpoints...)
+
+	// mount the filesystems
+	mwg := sync.WaitGroup{}
+	mwg.Add(len(vaults))
+
+	for _, v := range vaults {
+		go func(v *vault) {
+			defer mwg.Done()
+
+			fuse.MountAndRun([]string{os.Args[0], v.cfg.MountPoint}, fs.NewCloudStashFs(v.m))
+		}(v)
+	}
+
+	mwg.Wait()
+
+	// wait for signal handler to return
+	wg.Wait()
+}
+
+// openVault reads the configuration of profile, creating it if it doesn't exist,
+// and starts its manager and control server
+func openVault(cfgDir, mntDir string, profile string, pool *drive.Pool) (*vault, error) {
+	dir := config.GetProfileDir(cfgDir, profile)
 
 	// read existing or create new configuration file
-	cfg, err := configure(cfgDir, mntDir)
+	cfg, err := configure(dir, mntDir, profile)
 	if err != nil {
-		log.Errorf("configuration error: %v", err)
-		return
+		return nil, fmt.Errorf("configuration error: %v", err)
 	}
 
 	// create mount directory
 	if err := os.MkdirAll(cfg.MountPoint, 0755); err != nil {
-		log.Errorf("could not create mount directory: %v", err)
-		return
+		return nil, fmt.Errorf("could not create mount directory: %v", err)
+	}
+
+	log.Infof("mount point of %s: %s", profile, cfg.MountPoint)
+
+	stateDir, err := config.GetStateDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the manager changes the state directory as soon as it is created,
+	// it shouldn't be created while another process uses the directory
+	lock, err := lockStateDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &vault{profile: profile, cfg: cfg, lock: lock}
+
+	if err := v.start(dir, stateDir, pool); err != nil {
+		lock.Close()
+
+		return nil, err
 	}
 
-	log.Infof("mount point: %s", cfg.MountPoint)
+	return v, nil
+}
+
+// start starts the manager and the control server of the vault, whose
+// configuration is in dir and local state is in stateDir
+func (v *vault) start(dir string, stateDir string, pool *drive.Pool) error {
+	cfg := v.cfg
 
-	drives, err := collectDrives(cfg)
+	drives, renames, err := collectDrives(cfg, pool)
 	if err != nil {
-		log.Errorf("couldn't collect drives: %v", err)
-		return
+		return fmt.Errorf("couldn't collect drives: %v", err)
 	}
 
+	placement, err := placementPolicy(cfg.Placement)
+	if err != nil {
+		return fmt.Errorf("configuration error: %v", err)
+	}
+
+	cipher := crypto.NewCipher(cfg.EncryptionKey)
+
+	opts := manager.Options{
+		Retention: manager.Retention{
+			Trash:      cfg.GetTrashRetention(),
+			Versions:   cfg.GetVersionCount(),
+			VersionAge: cfg.GetVersionRetention(),
+		},
+		Chunking:    cfg.Chunking,
+		Compression: cfg.Compression,
+		Replicas:    cfg.GetReplicas(),
+		CacheLimit:  cfg.GetCacheLimit(),
+		Placement:   placement,
+		Renames:     renames,
+
+		DataShards:   cfg.DataShards,
+		ParityShards: cfg.ParityShards,
+	}
+
+	var m *manager.Manager
+
 	dbDrv, err := findDBDrive(drives)
 	if err != nil && err != common.ErrNotFound {
-		log.Errorf("couldn't search for db file: %v", err)
-		return
+		log.Warningf("couldn't search for db file, starting in offline mode: %v", err)
+
+		m, err = manager.NewOfflineManager(drives, cipher, stateDir, opts)
+	} else {
+		m, err = manager.NewManager(drives, dbDrv, cipher, stateDir, opts)
 	}
 
-	cipher := crypto.NewCipher(cfg.EncryptionKey)
+	if err != nil {
+		return fmt.Errorf("couldn't initialize manager: %v", err)
+	}
 
-	m, err := manager.NewManager(drives, dbDrv, cipher)
+	// IDs of the drives are saved once their files are renamed
+	if len(renames) > 0 {
+		if err := config.WriteConfig(dir, cfg); err != nil {
+			log.Warningf("couldn't save drive ids: %v", err)
+		}
+	}
+
+	srv, err := control.NewServer(control.SocketPath(stateDir), m)
 	if err != nil {
-		log.Errorf("couldn't initialize manager: %v", err)
-		return
+		m.Clean()
+
+		return fmt.Errorf("couldn't start control server: %v", err)
 	}
-	defer m.Clean()
 
-	// unmount when SIGINT, SIGTERM or SIGQUIT is received
-	signalCh := make(chan os.Signal, 1)
-	wg := sync.WaitGroup{}
-	wg.Add(1)
+	v.m = m
+	v.srv = srv
 
-	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	return nil
+}
 
-	go handleSignal(signalCh, &wg, cfg.MountPoint)
+// close stops the control server, uploads the remaining changes
+// and releases the state directory
+func (v *vault) close() {
+	v.srv.Close()
+	v.m.Clean()
+	v.lock.Close()
+}
 
-	// mount the filesystem
-	fs := fs.NewCloudStashFs(m)
-	fuse.MountAndRun([]string{os.Args[0], cfg.MountPoint}, fs)
+// lockStateDir takes an exclusive lock on stateDir so that only one process
+// uses it at a time. The lock is released when the returned file is closed
+// or the process exits.
+func lockStateDir(stateDir string) (*os.File, error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create state directory: %v", err)
+	}
 
-	// wait for signal handler to return
-	wg.Wait()
+	path := filepath.Join(stateDir, stateLockFileName)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open lock file %s: %v", path, err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("another cloudstash is already running with the state directory %s", stateDir)
+		}
+
+		return nil, fmt.Errorf("couldn't lock state directory: %v", err)
+	}
+
+	return f, nil
 }
 
 // parseFlags parses the command-line flags.
-func parseFlags() (cfgDir, mntDir string) {
+func parseFlags() (cfgDir, mntDir, profile string) {
 	flag.StringVar(&cfgDir, "c", "", "Application config directory, optional.")
 	flag.StringVar(&mntDir, "m", "", "Application mount directory, optional.")
+	flag.StringVar(&profile, "p", config.DefaultProfile, "Profile to use, optional.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Commands:")
+		fmt.Fprintln(flag.CommandLine.Output(), "  mount\t\tmount the vaults of several profiles, e.g. mount work personal")
+		fmt.Fprintln(flag.CommandLine.Output(), "  profiles\tlist profiles with their mount points")
+		fmt.Fprintln(flag.CommandLine.Output(), "  status\tshow transfers in progress and changes waiting to be uploaded")
+		fmt.Fprintln(flag.CommandLine.Output(), "  rm [-r]\tmove files, or directories with their contents, to the trash in one step")
+		fmt.Fprintln(flag.CommandLine.Output(), "  trash\t\tlist, restore or purge removed files")
+		fmt.Fprintln(flag.CommandLine.Output(), "  versions\tlist or restore earlier versions of a file")
+		fmt.Fprintln(flag.CommandLine.Output(), "  snapshot\tcreate, list, mount or delete snapshots of the vault")
+		fmt.Fprintln(flag.CommandLine.Output(), "  drive		add, remove or list drives, or move the files of a drive to another one")
+		fmt.Fprintln(flag.CommandLine.Output(), "  rebalance	move files between drives to even out their available space")
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	return cfgDir, mntDir
+	return cfgDir, mntDir, profile
 }
 
-func configure(cfgDir, mntDir string) (cfg *config.Cfg, err error) {
+// configure reads the configuration of profile in cfgDir, or creates it
+// with the answers of the user if it doesn't exist
+func configure(cfgDir, mntDir string, profile string) (cfg *config.Cfg, err error) {
 	if config.DoesConfigExist(cfgDir) {
 		return config.ReadConfig(cfgDir)
 	}
 
+	if profile != config.DefaultProfile {
+		fmt.Printf("Setting up profile %s\n", profile)
+	}
+
 	fmt.Print("Enter encryption secret: ")
 	secret, err := terminal.ReadPassword(int(syscall.Stdin))
 	if err != nil {
 		return nil, fmt.Errorf("could not read encryption secret from terminal")
 	}
 
-	return config.NewConfig(cfgDir, mntDir, crypto.DeriveKey(secret))
+	stdin := bufio.NewReader(os.Stdin)
+
+	fmt.Printf("\nEnter drives to use (%s): ", strings.Join(config.Providers, ", "))
+	line, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not read drives from terminal")
+	}
+
+	providers := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+
+	if len(providers) == 0 {
+		providers = config.Providers
+	}
+
+	fmt.Print("Enter vault name, empty for the default vault: ")
+	vault, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not read vault name from terminal")
+	}
+
+	vault = strings.TrimSpace(vault)
+
+	if vault != "" && !config.IsValidVault(vault) {
+		return nil, fmt.Errorf("vault name should only have letters, digits, '-', '_' and '.'")
+	}
+
+	return config.NewConfig(cfgDir, config.GetMountPoint(mntDir, profile), crypto.DeriveKey(secret), providers, vault)
 }
 
-// collectDrives returns a slice of clients for each enabled drive.
-func collectDrives(cfg *config.Cfg) ([]drive.Drive, error) {
+// collectDrives returns a slice of clients for each enabled drive, created in pool.
+// Drives without IDs get the ones stored in them, the URLs of their files
+// should be renamed with the returned map from their names to their IDs.
+// If the ID of a drive can't be read, it is identified by its name until
+// the next run.
+func collectDrives(cfg *config.Cfg, pool *drive.Pool) ([]drive.Drive, map[string]string, error) {
 	drives := []drive.Drive{}
+	renames := map[string]string{}
+	names := map[string]bool{}
+	ids := map[string]string{}
 
-	if cfg.Dropbox != nil {
-		dbox := drive.NewDropboxClient(cfg.Dropbox)
-		drives = append(drives, dbox)
+	for i := range cfg.Drives {
+		d := &cfg.Drives[i]
+		name := d.GetName()
+
+		if names[name] {
+			return nil, nil, fmt.Errorf("there are several drives named %s", name)
+		}
+
+		names[name] = true
+
+		id := d.ID
+		if id == "" {
+			// files of the drive are stored with its name before it has an ID
+			id = name
+		}
+
+		drv, err := newDriveClient(pool, id, cfg.Vault, d)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if d.ID == "" {
+			newID, err := drive.LoadID(drv)
+			if err != nil {
+				log.Warningf("couldn't get id of drive %s, using its name: %v", name, err)
+			} else if drv, err = newDriveClient(pool, newID, cfg.Vault, d); err != nil {
+				return nil, nil, err
+			} else {
+				d.ID = newID
+
+				if newID != name {
+					renames[name] = newID
+				}
+			}
+		}
+
+		if other, ok := ids[drv.GetID()]; ok {
+			return nil, nil, fmt.Errorf("drives %s and %s are the same drive", other, name)
+		}
+
+		ids[drv.GetID()] = name
+
+		drives = append(drives, drv)
 	}
 
-	if cfg.GDrive != nil {
-		gdrive, err := drive.NewGDriveClient(cfg.GDrive)
+	if len(drives) == 0 {
+		return nil, nil, fmt.Errorf("there aren't any drives, add one with `drive add`")
+	}
+
+	return drives, renames, nil
+}
+
+// newDriveClient returns a client of d identified by id, storing files in the folder of vault.
+// The client shares its connection and upload slots with the other clients of the account in pool.
+func newDriveClient(pool *drive.Pool, id string, vault string, d *config.DriveCfg) (drive.Drive, error) {
+	switch {
+	case d.Provider == config.ProviderDropbox && d.Dropbox != nil:
+		return pool.NewDropboxClient(id, d.GetName(), vault, d.Dropbox), nil
+	case d.Provider == config.ProviderGDrive && d.GDrive != nil:
+		gdrive, err := pool.NewGDriveClient(id, d.GetName(), vault, d.GDrive)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't create gdrive client: %v", err)
 		}
 
-		drives = append(drives, gdrive)
+		return gdrive, nil
 	}
 
-	return drives, nil
+	return nil, fmt.Errorf("drive %s doesn't have credentials of %s", d.GetName(), d.Provider)
+}
+
+// newClient returns a client of the control socket of cloudstash running
+// with the configuration in cfgDir
+func newClient(cfgDir string) (*control.Client, error) {
+	stateDir, err := config.GetStateDir(cfgDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return control.NewClient(control.SocketPath(stateDir)), nil
+}
+
+// placementPolicy returns the placement policy in the configuration
+func placementPolicy(cfg *config.Placement) (manager.PlacementPolicy, error) {
+	if cfg == nil {
+		return manager.MostFree{}, nil
+	}
+
+	fallback := manager.MostFree{}
+
+	switch cfg.Policy {
+	case "", "most-free":
+		return manager.MostFree{}, nil
+	case "round-robin":
+		return &manager.RoundRobin{}, nil
+	case "weighted":
+		return manager.Weighted{Weights: cfg.Weights}, nil
+	case "size":
+		classes := make([]manager.SizeClass, len(cfg.SizeClasses))
+		for i, c := range cfg.SizeClasses {
+			classes[i] = manager.SizeClass{MaxSize: c.MaxSize, Drive: c.Drive}
+		}
+
+		return manager.BySize{Classes: classes, Fallback: fallback}, nil
+	case "path":
+		return manager.ByPath{Prefixes: cfg.Paths, Fallback: fallback}, nil
+	case "pinned":
+		if cfg.Drive == "" {
+			return nil, fmt.Errorf("pinned placement needs a drive")
+		}
+
+		return manager.Pinned{Drive: cfg.Drive, Fallback: fallback}, nil
+	}
+
+	return nil, fmt.Errorf("unknown placement policy %s", cfg.Policy)
 }
 
 // findDBDrive searches for database file in drives and returns it if found
@@ -142,26 +537,24 @@ func findDBDrive(drives []drive.Drive) (drive.Drive, error) {
 	return nil, common.ErrNotFound
 }
 
-func handleSignal(ch chan os.Signal, wg *sync.WaitGroup, mountpoint string) {
+func handleSignal(ch chan os.Signal, wg *sync.WaitGroup, mountpoints ...string) {
 	defer wg.Done()
 
 	_ = <-ch
 
 	done := make(chan bool)
-	umount(mountpoint, done)
-
-	for {
-		time.Sleep(5 * time.Second)
+	for _, mountpoint := range mountpoints {
+		go umount(mountpoint, done)
+	}
 
+	for remaining := len(mountpoints); remaining > 0; {
 		select {
 		case _ = <-done:
-			return
-		default:
+			remaining--
+		case <-time.After(5 * time.Second):
 			log.Warning("mounted device appears to be busy...")
-			continue
 		}
 	}
-
 }
 
 func umount(mountpoint string, ch chan bool) {
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLockStateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudstash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lock, err := lockStateDir(dir)
+	if err != nil {
+		t.Fatalf("couldn't lock state directory: %v", err)
+	}
+
+	if _, err := lockStateDir(dir); err == nil {
+		t.Fatalf("state directory is locked twice")
+	}
+
+	lock.Close()
+
+	lock, err = lockStateDir(dir)
+	if err != nil {
+		t.Fatalf("released lock can't be taken again: %v", err)
+	}
+
+	lock.Close()
+}
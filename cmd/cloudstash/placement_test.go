@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/config"
+	"github.com/paddlesteamer/cloudstash/internal/manager"
+)
+
+func TestPlacementPolicy(t *testing.T) {
+	p, err := placementPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := p.(manager.MostFree); !ok {
+		t.Errorf("default policy is %T, expected MostFree", p)
+	}
+
+	p, err = placementPolicy(&config.Placement{
+		Policy:      "size",
+		SizeClasses: []config.SizeClass{{MaxSize: 1024, Drive: "dropbox"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, ok := p.(manager.BySize); !ok || len(s.Classes) != 1 || s.Classes[0].Drive != "dropbox" {
+		t.Errorf("size policy isn't parsed: %+v", p)
+	}
+
+	if _, err := placementPolicy(&config.Placement{Policy: "pinned"}); err == nil {
+		t.Errorf("pinned policy without a drive is accepted")
+	}
+
+	if _, err := placementPolicy(&config.Placement{Policy: "fastest"}); err == nil {
+		t.Errorf("unknown policy is accepted")
+	}
+}
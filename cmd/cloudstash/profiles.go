@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/paddlesteamer/cloudstash/internal/config"
+)
+
+// parseProfiles returns the profiles given to the mount command without
+// duplicates, or the selected profile if none is given
+func parseProfiles(args []string, profile string) ([]string, error) {
+	if len(args) == 0 {
+		return []string{profile}, nil
+	}
+
+	profiles := []string{}
+	seen := map[string]bool{}
+
+	for _, p := range args {
+		if p != config.DefaultProfile && !config.IsValidProfile(p) {
+			return nil, fmt.Errorf("invalid profile name: %s", p)
+		}
+
+		if seen[p] {
+			continue
+		}
+
+		seen[p] = true
+		profiles = append(profiles, p)
+	}
+
+	return profiles, nil
+}
+
+// listProfiles prints the configured profiles with their mount points
+func listProfiles(cfgDir, mntDir string) error {
+	profiles, err := config.ListProfiles(cfgDir)
+	if err != nil {
+		return err
+	}
+
+	if len(profiles) == 0 {
+		fmt.Println("there aren't any profiles, run cloudstash to create the default one")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tMOUNT POINT\tSTATUS")
+
+	for _, profile := range profiles {
+		dir := config.GetProfileDir(cfgDir, profile)
+
+		mountPoint := config.GetMountPoint(mntDir, profile)
+		if cfg, err := config.ReadConfig(dir); err == nil {
+			mountPoint = cfg.MountPoint
+		}
+
+		state := "stopped"
+		if isRunning(dir) {
+			state = "running"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n", profile, mountPoint, state)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/config"
+)
+
+func TestParseProfiles(t *testing.T) {
+	profiles, err := parseProfiles(nil, "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(profiles, []string{"work"}) {
+		t.Errorf("selected profile isn't mounted without arguments: %v", profiles)
+	}
+
+	profiles, err = parseProfiles([]string{"work", config.DefaultProfile, "work"}, "personal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(profiles, []string{"work", config.DefaultProfile}) {
+		t.Errorf("profiles are %v, expected work and default once", profiles)
+	}
+
+	if _, err := parseProfiles([]string{"work", "../other"}, "work"); err == nil {
+		t.Errorf("invalid profile is accepted")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/paddlesteamer/cloudstash/internal/config"
+	"github.com/paddlesteamer/cloudstash/internal/control"
+)
+
+// rm moves the files at the provided paths under the mount point to the trash
+// through the running cloudstash. Directories are removed in a single step with
+// -r instead of removing their contents one by one through the filesystem.
+func rm(cfgDir string, args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ExitOnError)
+	recursive := flags.Bool("r", false, "Remove directories and their contents.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s rm [-r] <path>...\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.ReadConfig(cfgDir)
+	if err != nil {
+		return fmt.Errorf("couldn't read configuration: %v", err)
+	}
+
+	client, err := newClient(cfgDir)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+
+	for _, arg := range flags.Args() {
+		path, err := vaultPath(cfg.MountPoint, arg)
+		if err != nil {
+			return err
+		}
+
+		e, err := client.RemovePath(path, *recursive)
+		if err == control.ErrNotRunning {
+			return err
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't remove %s: %v\n", arg, err)
+			failed = true
+
+			continue
+		}
+
+		fmt.Printf("moved %s to trash as %s\n", arg, e.ID)
+	}
+
+	if failed {
+		return fmt.Errorf("some of the files couldn't be removed")
+	}
+
+	return nil
+}
+
+// vaultPath returns path of the file at p relative to the root of the
+// filesystem mounted at mountPoint
+func vaultPath(mountPoint string, p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", fmt.Errorf("couldn't resolve %s: %v", p, err)
+	}
+
+	rel, err := filepath.Rel(mountPoint, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s isn't under the mount point %s", p, mountPoint)
+	}
+
+	return "/" + filepath.ToSlash(rel), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/config"
+	"github.com/paddlesteamer/cloudstash/internal/control"
+	"github.com/paddlesteamer/cloudstash/internal/crypto"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/fs"
+	"github.com/paddlesteamer/cloudstash/internal/manager"
+	"github.com/paddlesteamer/go-fuse-c/fuse"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// snapshot creates, lists or deletes the snapshots of the vault through the
+// running cloudstash, or mounts one of them read-only
+func snapshot(cfgDir string, args []string) error {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s snapshot [command]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Commands:")
+		fmt.Fprintln(os.Stderr, "  list\t\t\tlist snapshots, default")
+		fmt.Fprintln(os.Stderr, "  create [name]\t\tfreeze the vault as it is now")
+		fmt.Fprintln(os.Stderr, "  mount <id> <dir>\tmount the snapshot read-only until interrupted")
+		fmt.Fprintln(os.Stderr, "  delete <id>...\tdelete snapshots and the files only they reference")
+	}
+
+	cmd := "list"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	client, err := newClient(cfgDir)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "list":
+		return listSnapshots(client)
+	case "create":
+		if len(args) > 1 {
+			usage()
+			os.Exit(2)
+		}
+
+		name := ""
+		if len(args) == 1 {
+			name = args[0]
+		}
+
+		s, err := client.CreateSnapshot(name)
+		if err != nil {
+			return fmt.Errorf("couldn't create snapshot: %v", err)
+		}
+
+		fmt.Printf("created snapshot %s of %d files\n", s.ID, s.Files)
+	case "mount":
+		if len(args) != 2 {
+			usage()
+			os.Exit(2)
+		}
+
+		return mountSnapshot(cfgDir, args[0], args[1])
+	case "delete":
+		if len(args) == 0 {
+			usage()
+			os.Exit(2)
+		}
+
+		for _, id := range args {
+			released, err := client.DeleteSnapshot(id)
+			if err != nil {
+				return fmt.Errorf("couldn't delete %s: %v", id, err)
+			}
+
+			fmt.Printf("deleted snapshot %s, %d files are released\n", id, released)
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	return nil
+}
+
+func listSnapshots(client *control.Client) error {
+	snapshots, err := client.ListSnapshots()
+	if err != nil {
+		return fmt.Errorf("couldn't list snapshots: %v", err)
+	}
+
+	if len(snapshots) == 0 {
+		fmt.Println("there aren't any snapshots")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "ID\tNAME\tCREATED\tDEVICE\tFILES")
+
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", s.ID, s.Name, s.Created.Format(time.RFC3339), s.Device, s.Files)
+	}
+
+	return w.Flush()
+}
+
+// mountSnapshot mounts the snapshot with id read-only at dir and blocks until
+// it is unmounted. It doesn't need a running cloudstash, the database and the
+// snapshot are fetched into a temporary directory which is removed afterwards.
+func mountSnapshot(cfgDir string, id string, dir string) error {
+	cfg, err := config.ReadConfig(cfgDir)
+	if err != nil {
+		return fmt.Errorf("couldn't read configuration: %v", err)
+	}
+
+	drives, renames, err := collectDrives(cfg, drive.NewPool())
+	if err != nil {
+		return fmt.Errorf("couldn't collect drives: %v", err)
+	}
+
+	if len(renames) > 0 {
+		return fmt.Errorf("drives don't have ids yet, run cloudstash once first")
+	}
+
+	dbDrv, err := findDBDrive(drives)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return fmt.Errorf("couldn't find database in drives")
+		}
+
+		return err
+	}
+
+	stateDir, err := config.GetStateDir(cfgDir)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir(stateDir, "snapshot-")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	m, err := manager.NewSnapshotManager(drives, dbDrv, crypto.NewCipher(cfg.EncryptionKey), tmpDir, id)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return fmt.Errorf("%s: no such snapshot", id)
+		}
+
+		return fmt.Errorf("couldn't load snapshot: %v", err)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("couldn't create mount directory: %v", err)
+	}
+
+	log.Infof("snapshot %s is mounted at %s", id, dir)
+
+	// unmount when SIGINT, SIGTERM or SIGQUIT is received
+	signalCh := make(chan os.Signal, 1)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	go handleSignal(signalCh, &wg, dir)
+
+	fuse.MountAndRun([]string{os.Args[0], dir}, fs.NewReadOnlyCloudStashFs(m))
+
+	wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/config"
+	"github.com/paddlesteamer/cloudstash/internal/control"
+	"github.com/paddlesteamer/cloudstash/internal/manager"
+)
+
+// status prints the transfers in progress and the changes waiting to be
+// uploaded. If cloudstash isn't running, it reads the journal directly.
+func status(cfgDir string) error {
+	stateDir, err := config.GetStateDir(cfgDir)
+	if err != nil {
+		return err
+	}
+
+	st, err := control.NewClient(control.SocketPath(stateDir)).GetStatus()
+	if err == control.ErrNotRunning {
+		uploads, err := manager.ReadPendingUploads(stateDir)
+		if err != nil {
+			return fmt.Errorf("couldn't read journal: %v", err)
+		}
+
+		fmt.Println("cloudstash isn't running, pending changes will be uploaded when it is mounted again")
+
+		st = &manager.Status{Pending: uploads}
+	} else if err != nil {
+		return fmt.Errorf("couldn't get status: %v", err)
+	}
+
+	if st.Offline {
+		fmt.Println("offline: remote drives are unreachable")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	if len(st.Transfers) > 0 {
+		fmt.Fprintln(w, "TRANSFER\tFILE\tPROGRESS\tRATE\tETA")
+
+		for _, t := range st.Transfers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s/s\t%s\n", t.Direction, transferName(t), transferProgress(t),
+				formatBytes(int64(t.Rate)), transferETA(t))
+		}
+
+		fmt.Fprintln(w)
+	}
+
+	if len(st.Pending) > 0 {
+		fmt.Fprintln(w, "FILE\tCHANGED\tSTATE\tATTEMPTS\tLAST ERROR")
+
+		for _, u := range st.Pending {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", uploadName(u), u.Updated.Format(time.RFC3339),
+				uploadState(u), u.Attempts, u.LastError)
+		}
+
+		fmt.Fprintln(w)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if st.IsIdle() {
+		fmt.Println("all changes are uploaded, it is safe to unmount")
+	} else if len(st.Pending) > 0 {
+		fmt.Printf("%d changes (%s) waiting to be uploaded\n", len(st.Pending), formatBytes(st.PendingBytes))
+	}
+
+	return nil
+}
+
+func uploadName(u manager.PendingUpload) string {
+	if u.Delayed {
+		return fmt.Sprintf("<unused %s>", u.RemotePath)
+	}
+
+	if u.Delete {
+		return fmt.Sprintf("<deleted inode %d>", u.Inode)
+	}
+
+	return inodeName(u.Inode, u.Path)
+}
+
+func transferName(t manager.Transfer) string {
+	return inodeName(t.Inode, t.Path)
+}
+
+func inodeName(inode int64, path string) string {
+	if inode == 0 {
+		return "<database>"
+	}
+
+	if path == "" {
+		return fmt.Sprintf("<inode %d>", inode)
+	}
+
+	return path
+}
+
+func uploadState(u manager.PendingUpload) string {
+	if u.Failed {
+		return "failed"
+	}
+
+	if u.Deferred {
+		return "waiting for database upload"
+	}
+
+	if wait := time.Until(u.NextAttempt); wait > 0 && u.Delayed {
+		return fmt.Sprintf("deleted in %s", wait.Round(time.Second))
+	}
+
+	if wait := time.Until(u.NextAttempt); wait > 0 {
+		return fmt.Sprintf("retry in %s", wait.Round(time.Second))
+	}
+
+	return "pending"
+}
+
+func transferProgress(t manager.Transfer) string {
+	if t.Size <= 0 {
+		return formatBytes(t.Done)
+	}
+
+	return fmt.Sprintf("%s / %s (%d%%)", formatBytes(t.Done), formatBytes(t.Size), t.Done*100/t.Size)
+}
+
+func transferETA(t manager.Transfer) string {
+	if t.ETA <= 0 {
+		return "-"
+	}
+
+	return t.ETA.Round(time.Second).String()
+}
+
+// formatBytes returns n in a human readable form, i.e. 1.5 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/control"
+)
+
+// trash lists, restores or purges the entries in the trash
+// through the running cloudstash
+func trash(cfgDir string, args []string) error {
+	flags := flag.NewFlagSet("trash", flag.ExitOnError)
+	all := flags.Bool("all", false, "Purge all entries in the trash.")
+	flags.Usage = func() {
+		out := flags.Output()
+
+		fmt.Fprintf(out, "Usage: %s trash [command]\n\n", os.Args[0])
+		fmt.Fprintln(out, "Commands:")
+		fmt.Fprintln(out, "  list\t\t\tlist removed files, default")
+		fmt.Fprintln(out, "  restore <id>...\tmove files back to their original paths")
+		fmt.Fprintln(out, "  purge <id>...\t\tremove files permanently")
+		fmt.Fprintln(out, "  purge -all\t\tempty the trash")
+	}
+
+	cmd := "list"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	// flags follow the command, i.e. `purge -all`
+	flags.Parse(args)
+
+	client, err := newClient(cfgDir)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "list":
+		return listTrash(client)
+	case "restore":
+		if flags.NArg() == 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+
+		for _, id := range flags.Args() {
+			path, err := client.RestoreTrash(id)
+			if err != nil {
+				return fmt.Errorf("couldn't restore %s: %v", id, err)
+			}
+
+			fmt.Printf("restored %s to %s\n", id, path)
+		}
+	case "purge":
+		if *all {
+			removed, err := client.PurgeTrash("", true)
+			if err != nil {
+				return fmt.Errorf("couldn't empty trash: %v", err)
+			}
+
+			fmt.Printf("purged %d files\n", removed)
+			return nil
+		}
+
+		if flags.NArg() == 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+
+		for _, id := range flags.Args() {
+			removed, err := client.PurgeTrash(id, false)
+			if err != nil {
+				return fmt.Errorf("couldn't purge %s: %v", id, err)
+			}
+
+			fmt.Printf("purged %s (%d files)\n", id, removed)
+		}
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	return nil
+}
+
+func listTrash(client *control.Client) error {
+	entries, err := client.ListTrash()
+	if err != nil {
+		return fmt.Errorf("couldn't list trash: %v", err)
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("trash is empty")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "ID\tPATH\tSIZE\tDELETED\tDEVICE")
+
+	for _, e := range entries {
+		size := "-"
+		if e.Type == common.DrvFile {
+			size = formatBytes(e.Size)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.ID, e.Path, size, e.Deleted.Format(time.RFC3339), e.Device)
+	}
+
+	return w.Flush()
+}
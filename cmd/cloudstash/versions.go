@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/config"
+)
+
+// versions lists or restores the earlier versions of a file
+// through the running cloudstash
+func versions(cfgDir string, args []string) error {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s versions [restore] <path> [id]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Commands:")
+		fmt.Fprintln(os.Stderr, "  <path>\t\t\tlist earlier versions of the file")
+		fmt.Fprintln(os.Stderr, "  restore <path> <id>\treplace content of the file with its version")
+	}
+
+	if len(args) == 0 || (args[0] == "restore" && len(args) != 3) || (args[0] != "restore" && len(args) != 1) {
+		usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.ReadConfig(cfgDir)
+	if err != nil {
+		return fmt.Errorf("couldn't read configuration: %v", err)
+	}
+
+	client, err := newClient(cfgDir)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "restore" {
+		path, err := vaultPath(cfg.MountPoint, args[1])
+		if err != nil {
+			return err
+		}
+
+		if err := client.RestoreVersion(path, args[2]); err != nil {
+			return fmt.Errorf("couldn't restore %s: %v", args[2], err)
+		}
+
+		fmt.Printf("restored %s to version %s\n", args[1], args[2])
+		return nil
+	}
+
+	path, err := vaultPath(cfg.MountPoint, args[0])
+	if err != nil {
+		return err
+	}
+
+	list, err := client.ListVersions(path)
+	if err != nil {
+		return fmt.Errorf("couldn't list versions: %v", err)
+	}
+
+	if len(list) == 0 {
+		fmt.Printf("%s has no earlier versions\n", args[0])
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "ID\tSIZE\tSAVED\tMD5")
+
+	for _, v := range list {
+		hash := v.Hash
+		if hash == "" {
+			hash = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", v.ID(), formatBytes(v.Size), v.Time.Format(time.RFC3339), hash)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,105 @@
+package chunker
+
+import (
+	"bufio"
+	"io"
+)
+
+// Sizes of the chunks. Cut points are searched with a stricter mask before
+// AvgSize and a looser one after it, so that sizes are close to AvgSize.
+const (
+	MinSize = 256 * 1024
+	AvgSize = 1024 * 1024
+	MaxSize = 4 * 1024 * 1024
+)
+
+// top bits of the gear hash depend on the last 64 bytes
+const (
+	maskS = uint64(1<<22-1) << (64 - 22)
+	maskL = uint64(1<<18-1) << (64 - 18)
+)
+
+// gear maps bytes to random values. It is generated from a fixed seed,
+// so that the same content is split into the same chunks everywhere.
+var gear [256]uint64
+
+func init() {
+	seed := uint64(0x636c6f7564737461) // "cloudsta"
+
+	for i := range gear {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits content into chunks at the points determined by the content
+// itself (FastCDC), so an insertion or a deletion only changes the chunks
+// around it and the same data is split into the same chunks in other files.
+type Chunker struct {
+	r *bufio.Reader
+}
+
+// NewChunker returns a chunker which splits content read from r
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: bufio.NewReaderSize(r, MaxSize)}
+}
+
+// Next returns the next chunk. It returns io.EOF when there isn't any data left.
+func (c *Chunker) Next() ([]byte, error) {
+	data, err := c.r.Peek(MaxSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+
+	chunk := make([]byte, cut(data))
+	copy(chunk, data)
+
+	if _, err := c.r.Discard(len(chunk)); err != nil {
+		return nil, err
+	}
+
+	return chunk, nil
+}
+
+// cut returns the length of the chunk at the beginning of data
+func cut(data []byte) int {
+	n := len(data)
+	if n <= MinSize {
+		return n
+	}
+
+	normal := AvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var h uint64
+
+	i := MinSize
+
+	for ; i < normal; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskS == 0 {
+			return i + 1
+		}
+	}
+
+	for ; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskL == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,106 @@
+package chunker
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func randomContent(n int, seed int64) []byte {
+	content := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(content)
+
+	return content
+}
+
+func split(t *testing.T, content []byte) [][]byte {
+	c := NewChunker(bytes.NewReader(content))
+	chunks := [][]byte{}
+
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("couldn't get next chunk: %v", err)
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+func TestChunkSizes(t *testing.T) {
+	content := randomContent(20*AvgSize, 1)
+	chunks := split(t, content)
+
+	if len(chunks) < 2 {
+		t.Fatalf("content is split into %d chunks", len(chunks))
+	}
+
+	for i, chunk := range chunks {
+		if len(chunk) > MaxSize {
+			t.Errorf("chunk %d is larger than MaxSize: %d", i, len(chunk))
+		}
+
+		if len(chunk) < MinSize && i < len(chunks)-1 {
+			t.Errorf("chunk %d is smaller than MinSize: %d", i, len(chunk))
+		}
+	}
+
+	if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, content) {
+		t.Errorf("joined chunks differ from the content")
+	}
+}
+
+func TestSmallContent(t *testing.T) {
+	if chunks := split(t, nil); len(chunks) != 0 {
+		t.Errorf("empty content is split into %d chunks", len(chunks))
+	}
+
+	content := randomContent(MinSize, 2)
+
+	chunks := split(t, content)
+	if len(chunks) != 1 || !bytes.Equal(chunks[0], content) {
+		t.Errorf("content of MinSize is split into %d chunks", len(chunks))
+	}
+}
+
+func TestUniformContent(t *testing.T) {
+	// the hash doesn't find any cut points, chunks are cut at MaxSize
+	content := make([]byte, 2*MaxSize+1)
+
+	chunks := split(t, content)
+	if len(chunks) != 3 || len(chunks[0]) != MaxSize || len(chunks[2]) != 1 {
+		t.Errorf("uniform content isn't cut at MaxSize")
+	}
+}
+
+func TestInsertion(t *testing.T) {
+	content := randomContent(16*AvgSize, 3)
+
+	// a few bytes inserted at the beginning only change the chunks around them
+	changed := append([]byte("inserted"), content...)
+
+	before := map[string]bool{}
+	for _, chunk := range split(t, content) {
+		before[string(chunk)] = true
+	}
+
+	chunks := split(t, changed)
+
+	shared := 0
+	for _, chunk := range chunks {
+		if before[string(chunk)] {
+			shared++
+		}
+	}
+
+	if shared < len(chunks)-2 {
+		t.Errorf("%d of %d chunks are shared after an insertion", shared, len(chunks))
+	}
+}
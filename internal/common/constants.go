@@ -3,8 +3,9 @@ package common
 import "github.com/paddlesteamer/go-fuse-c/fuse"
 
 const (
-	DrvFile   = fuse.S_IFREG
-	DrvFolder = fuse.S_IFDIR
+	DrvFile    = fuse.S_IFREG
+	DrvFolder  = fuse.S_IFDIR
+	DrvSymlink = fuse.S_IFLNK
 
 	DatabaseFileName = "cloudstash.sqlite3"
 
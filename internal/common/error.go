@@ -3,6 +3,10 @@ package common
 import "errors"
 
 var (
-	ErrNotFound    = errors.New("file/folder doesn't exist")
-	ErrDirNotEmpty = errors.New("directory isn't empty")
+	ErrNotFound     = errors.New("file/folder doesn't exist")
+	ErrDirNotEmpty  = errors.New("directory isn't empty")
+	ErrExists       = errors.New("already exists")
+	ErrIsDir        = errors.New("is a directory")
+	ErrNotDir       = errors.New("isn't a directory")
+	ErrSubdirectory = errors.New("directory can't be moved into itself")
 )
@@ -37,8 +37,8 @@ func ParseURL(fileURL string) (*FileURL, error) {
 	}, nil
 }
 
-func NewTempCacheFile() (*os.File, error) {
-	tmpfile, err := ioutil.TempFile(os.TempDir(), cacheFilePrefix)
+func NewTempCacheFile(dir string) (*os.File, error) {
+	tmpfile, err := ioutil.TempFile(dir, cacheFilePrefix)
 
 	return tmpfile, err
 }
@@ -0,0 +1,104 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// header precedes the encrypted content of compressed files. Files stored
+// without compression start with a MAC, which doesn't match it in practice.
+var header = []byte{0x63, 0x73, 0x67, 0x7a, 0x00, 0x01, 0xfe, 0xc5}
+
+// a sample of the content is compressed first, the content
+// is compressed if the sample shrinks below maxRatio of its size
+const (
+	sampleSize = 64 * 1024
+	maxRatio   = 0.9
+)
+
+// NewCompressReader returns a reader of the content of r compressed with
+// gzip. If a sample from the beginning of the content doesn't compress well,
+// i.e. it is already compressed, the content is returned as it is. Returns
+// whether the content is compressed.
+func NewCompressReader(r io.Reader) (io.Reader, bool, error) {
+	sample := make([]byte, sampleSize)
+
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+
+	sample = sample[:n]
+	content := io.MultiReader(bytes.NewReader(sample), r)
+
+	if !compressible(sample) {
+		return content, false, nil
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		zw := gzip.NewWriter(pw)
+
+		_, err := io.Copy(zw, content)
+		if err == nil {
+			err = zw.Close()
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	return pr, true, nil
+}
+
+func compressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+
+	if _, err := zw.Write(sample); err != nil {
+		return false
+	}
+
+	if err := zw.Close(); err != nil {
+		return false
+	}
+
+	return float64(buf.Len()) < float64(len(sample))*maxRatio
+}
+
+// NewDecompressReader returns a reader of the decompressed content
+func NewDecompressReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// WriteHeader returns a reader of the header followed by the content of r
+func WriteHeader(r io.Reader) io.Reader {
+	return io.MultiReader(bytes.NewReader(header), r)
+}
+
+// ReadHeader consumes the header from r if it starts with it. Returns
+// the rest of the content and whether the header is found.
+func ReadHeader(r io.Reader) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+
+	b, err := br.Peek(len(header))
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+
+	if !bytes.Equal(b, header) {
+		return br, false, nil
+	}
+
+	if _, err := br.Discard(len(header)); err != nil {
+		return nil, false, err
+	}
+
+	return br, true, nil
+}
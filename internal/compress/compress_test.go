@@ -0,0 +1,99 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+// roundTrip compresses data, if it compresses well, and reads it back
+func roundTrip(t *testing.T, data []byte) ([]byte, bool) {
+	r, compressed, err := NewCompressReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !compressed {
+		return stored, false
+	}
+
+	dr, err := NewDecompressReader(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadAll(dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content, true
+}
+
+func TestCompress(t *testing.T) {
+	text := bytes.Repeat([]byte("compressible text "), 10000)
+
+	content, compressed := roundTrip(t, text)
+	if !compressed {
+		t.Errorf("text isn't compressed")
+	}
+
+	if !bytes.Equal(content, text) {
+		t.Errorf("text is changed by compression")
+	}
+
+	random := make([]byte, 2*sampleSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	content, compressed = roundTrip(t, random)
+	if compressed {
+		t.Errorf("random content is compressed")
+	}
+
+	if !bytes.Equal(content, random) {
+		t.Errorf("random content is changed")
+	}
+
+	if _, compressed := roundTrip(t, []byte{}); compressed {
+		t.Errorf("empty content is compressed")
+	}
+}
+
+func TestHeader(t *testing.T) {
+	r, found, err := ReadHeader(WriteHeader(bytes.NewReader([]byte("content"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !found || string(rest) != "content" {
+		t.Errorf("header isn't read: %v, '%s'", found, rest)
+	}
+
+	// shorter than the header
+	r, found, err = ReadHeader(bytes.NewReader([]byte("mac")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rest, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found || string(rest) != "mac" {
+		t.Errorf("content without header is changed: %v, '%s'", found, rest)
+	}
+}
@@ -3,9 +3,12 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/paddlesteamer/cloudstash/internal/auth/dropbox"
 	"github.com/paddlesteamer/cloudstash/internal/auth/gdrive"
@@ -19,19 +22,218 @@ type DropboxCredentials struct {
 	AccessToken string
 }
 
+// DriveCfg is a drive of the vault. ID identifies it in the vault, it is
+// read from the drive on the first run. Name is how the user refers to it,
+// it is the name of the provider by default.
+type DriveCfg struct {
+	ID       string `json:",omitempty"`
+	Provider string
+	Name     string              `json:",omitempty"`
+	Dropbox  *DropboxCredentials `json:",omitempty"`
+	GDrive   *oauth2.Token       `json:",omitempty"`
+}
+
+const (
+	ProviderDropbox = "dropbox"
+	ProviderGDrive  = "gdrive"
+)
+
+// Providers are the supported drive providers
+var Providers = []string{ProviderDropbox, ProviderGDrive}
+
 type Cfg struct {
 	EncryptionKey string
 	MountPoint    string
-	Dropbox       *DropboxCredentials
-	GDrive        *oauth2.Token
+	Drives        []DriveCfg
+
+	// Vault is the folder the files of the vault are stored in the drives,
+	// so that several vaults can share the same accounts. Files are stored
+	// in the root, or in the app folder, if it isn't set.
+	Vault string `json:",omitempty"`
+
+	// Dropbox and GDrive are the credentials of the drives in the configuration
+	// files written by earlier versions, they are moved into Drives when read
+	Dropbox *DropboxCredentials `json:",omitempty"`
+	GDrive  *oauth2.Token       `json:",omitempty"`
+
+	// TrashRetentionDays is the number of days removed files are kept
+	// in the trash, defaults to 30. Negative keeps them until purged.
+	TrashRetentionDays int `json:",omitempty"`
+
+	// VersionCount is the number of earlier versions kept for each file,
+	// defaults to 10. Negative disables versions unless VersionRetentionDays
+	// is set. VersionRetentionDays is the number of days earlier versions
+	// are kept regardless of their count.
+	VersionCount         int `json:",omitempty"`
+	VersionRetentionDays int `json:",omitempty"`
+
+	// Chunking splits new content of files into chunks by their content, so
+	// that only the changed chunks are uploaded and the same data is stored once
+	Chunking bool `json:",omitempty"`
+
+	// Compression compresses new content of files before it is encrypted,
+	// unless a sample of it shows that it doesn't compress well
+	Compression bool `json:",omitempty"`
+
+	// Replicas is the number of drives each file is stored in, 1 if it isn't set
+	Replicas int `json:",omitempty"`
+
+	// DataShards and ParityShards enable erasure coding, files are split into
+	// DataShards pieces and ParityShards are added in separate drives, any
+	// DataShards of them are enough to read the file. Replicas is ignored.
+	DataShards   int `json:",omitempty"`
+	ParityShards int `json:",omitempty"`
+
+	// Placement chooses the drive of new files, the one with
+	// the most available space if it isn't set
+	Placement *Placement `json:",omitempty"`
+
+	// CacheLimitMB is the maximum size of the cached files in megabytes,
+	// unlimited if it isn't set. Files which are open or have changes
+	// waiting to be uploaded are kept regardless.
+	CacheLimitMB int `json:",omitempty"`
+}
+
+// Placement is the policy choosing the drive of new files. Policy is one of
+// most-free, round-robin, weighted, size, path and pinned. Drives are referred
+// by their names. Files which don't match any of SizeClasses, Paths or
+// Drive are stored in the drive with the most available space.
+type Placement struct {
+	Policy string
+
+	// Weights are the relative shares of the drives for weighted, 1 by default
+	Weights map[string]int `json:",omitempty"`
+
+	// SizeClasses are tried in order for size, the first one the file fits in is used
+	SizeClasses []SizeClass `json:",omitempty"`
+
+	// Paths are the drives of the directories for path, like {"/photos": "gdrive"}
+	Paths map[string]string `json:",omitempty"`
+
+	// Drive is the drive of all files for pinned
+	Drive string `json:",omitempty"`
 }
 
+// SizeClass is the drive of the files up to MaxSize bytes, 0 means any size
+type SizeClass struct {
+	MaxSize int64 `json:",omitempty"`
+	Drive   string
+}
+
+const (
+	defaultTrashRetentionDays = 30
+	defaultVersionCount       = 10
+)
+
 const (
 	cfgFile         = "config.json"
 	cfgFolder       = "cloudstash"
+	stateFolder     = "state"
+	profilesFolder  = "profiles"
 	mountFolderName = "cloudstash"
 )
 
+// DefaultProfile is the profile whose configuration is in the config directory itself
+const DefaultProfile = "default"
+
+// GetTrashRetention returns how long removed files are kept in the trash,
+// zero if they should be kept until purged
+func (cfg *Cfg) GetTrashRetention() time.Duration {
+	days := cfg.TrashRetentionDays
+	if days == 0 {
+		days = defaultTrashRetentionDays
+	}
+
+	if days < 0 {
+		return 0
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// GetVersionCount returns the number of earlier versions kept for each file
+func (cfg *Cfg) GetVersionCount() int {
+	if cfg.VersionCount == 0 {
+		return defaultVersionCount
+	}
+
+	if cfg.VersionCount < 0 {
+		return 0
+	}
+
+	return cfg.VersionCount
+}
+
+// GetVersionRetention returns how long earlier versions are kept regardless of their count
+func (cfg *Cfg) GetVersionRetention() time.Duration {
+	if cfg.VersionRetentionDays < 0 {
+		return 0
+	}
+
+	return time.Duration(cfg.VersionRetentionDays) * 24 * time.Hour
+}
+
+// GetName returns the name of the drive
+func (d *DriveCfg) GetName() string {
+	if d.Name == "" {
+		return d.Provider
+	}
+
+	return d.Name
+}
+
+// FindDrive returns the drive with name, nil if there isn't one
+func (cfg *Cfg) FindDrive(name string) *DriveCfg {
+	for i := range cfg.Drives {
+		if cfg.Drives[i].GetName() == name {
+			return &cfg.Drives[i]
+		}
+	}
+
+	return nil
+}
+
+// AddDrive adds d to the drives, its name should be unique
+func (cfg *Cfg) AddDrive(d DriveCfg) error {
+	if cfg.FindDrive(d.GetName()) != nil {
+		return fmt.Errorf("there is already a drive named %s", d.GetName())
+	}
+
+	cfg.Drives = append(cfg.Drives, d)
+
+	return nil
+}
+
+// RemoveDrive removes the drive with name
+func (cfg *Cfg) RemoveDrive(name string) error {
+	for i := range cfg.Drives {
+		if cfg.Drives[i].GetName() == name {
+			cfg.Drives = append(cfg.Drives[:i], cfg.Drives[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("there isn't a drive named %s", name)
+}
+
+// GetReplicas returns the number of drives each file is stored in
+func (cfg *Cfg) GetReplicas() int {
+	if cfg.Replicas < 1 {
+		return 1
+	}
+
+	return cfg.Replicas
+}
+
+// GetCacheLimit returns the maximum size of the cached files in bytes, 0 if unlimited
+func (cfg *Cfg) GetCacheLimit() int64 {
+	if cfg.CacheLimitMB < 1 {
+		return 0
+	}
+
+	return int64(cfg.CacheLimitMB) << 20
+}
+
 func DoesConfigExist(dir string) bool {
 	path := getConfigPath(dir)
 	_, err := os.Stat(path)
@@ -57,37 +259,105 @@ func ReadConfig(dir string) (*Cfg, error) {
 		return nil, fmt.Errorf("unable to parse config json: %v", err)
 	}
 
+	if cfg.Dropbox != nil {
+		cfg.Drives = append(cfg.Drives, DriveCfg{Provider: ProviderDropbox, Dropbox: cfg.Dropbox})
+		cfg.Dropbox = nil
+	}
+
+	if cfg.GDrive != nil {
+		cfg.Drives = append(cfg.Drives, DriveCfg{Provider: ProviderGDrive, GDrive: cfg.GDrive})
+		cfg.GDrive = nil
+	}
+
+	if cfg.Vault != "" && !isValidName(cfg.Vault) {
+		return nil, fmt.Errorf("invalid vault name %s, it should only have letters, digits, '-', '_' and '.'", cfg.Vault)
+	}
+
 	return &cfg, nil
 }
 
-func NewConfig(cfgDir, mntDir string, secret string) (cfg *Cfg, err error) {
-	dbxToken, err := dropbox.GetToken(common.DropboxAppKey)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't get dropbox access token: %v", err)
-	}
+// IsValidVault returns whether vault can be used as a folder name in all drives
+func IsValidVault(vault string) bool {
+	return isValidName(vault)
+}
 
-	gdrvCfg, _ := google.ConfigFromJSON([]byte(common.GDriveCredentials), drive.DriveFileScope)
+// IsValidProfile returns whether profile can be used as a profile name
+func IsValidProfile(profile string) bool {
+	return isValidName(profile)
+}
 
-	gdrvToken, err := gdrive.GetToken(gdrvCfg)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't get dropbox access token: %v", err)
+func isValidName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
 	}
 
+	for _, c := range name {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// NewConfig authorizes the drives of providers and writes the new configuration
+// of the vault, the default one if vault is empty, mounted at mountPoint
+func NewConfig(cfgDir, mountPoint string, secret string, providers []string, vault string) (cfg *Cfg, err error) {
 	cfg = &Cfg{
 		EncryptionKey: secret,
-		MountPoint:    getMountPoint(mntDir),
-		Dropbox:       &DropboxCredentials{dbxToken},
-		GDrive:        gdrvToken,
+		MountPoint:    mountPoint,
+		Vault:         vault,
 	}
 
-	if err := writeConfig(cfgDir, cfg); err != nil {
+	for _, provider := range providers {
+		d, err := AuthorizeDrive(provider, "")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := cfg.AddDrive(*d); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := WriteConfig(cfgDir, cfg); err != nil {
 		return nil, fmt.Errorf("couldn't create config file: %v", err)
 	}
 
 	return cfg, nil
 }
 
-func writeConfig(dir string, cfg *Cfg) error {
+// AuthorizeDrive gets the credentials of a drive of provider named name
+// from the user through the browser
+func AuthorizeDrive(provider string, name string) (*DriveCfg, error) {
+	d := &DriveCfg{Provider: provider, Name: name}
+
+	switch provider {
+	case ProviderDropbox:
+		token, err := dropbox.GetToken(common.DropboxAppKey)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get dropbox access token: %v", err)
+		}
+
+		d.Dropbox = &DropboxCredentials{token}
+	case ProviderGDrive:
+		gdrvCfg, _ := google.ConfigFromJSON([]byte(common.GDriveCredentials), drive.DriveFileScope)
+
+		token, err := gdrive.GetToken(gdrvCfg)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get gdrive access token: %v", err)
+		}
+
+		d.GDrive = token
+	default:
+		return nil, fmt.Errorf("unknown provider %s, it should be one of %s", provider, strings.Join(Providers, ", "))
+	}
+
+	return d, nil
+}
+
+// WriteConfig writes cfg to the configuration file in dir
+func WriteConfig(dir string, cfg *Cfg) error {
 	path := getConfigPath(dir)
 
 	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
@@ -110,10 +380,12 @@ func writeConfig(dir string, cfg *Cfg) error {
 }
 
 func getConfigPath(dir string) string {
-	if dir != "" {
-		dir = strings.TrimRight(dir, "/")
+	return fmt.Sprintf("%s/%s", getConfigDir(dir), cfgFile)
+}
 
-		return fmt.Sprintf("%s/%s", dir, cfgFile)
+func getConfigDir(dir string) string {
+	if dir != "" {
+		return strings.TrimRight(dir, "/")
 	}
 
 	cfgDir, err := os.UserConfigDir()
@@ -121,19 +393,82 @@ func getConfigPath(dir string) string {
 		cfgDir = "~/.config"
 	}
 
-	return fmt.Sprintf("%s/%s/%s", cfgDir, cfgFolder, cfgFile)
+	return fmt.Sprintf("%s/%s", cfgDir, cfgFolder)
+}
+
+// GetProfileDir returns the config directory of profile, it is
+// under the config directory dir. Configuration of the default
+// profile is in dir itself.
+func GetProfileDir(dir string, profile string) string {
+	if profile == DefaultProfile {
+		return dir
+	}
+
+	return fmt.Sprintf("%s/%s/%s", getConfigDir(dir), profilesFolder, profile)
 }
 
-func getMountPoint(dir string) string {
+// ListProfiles returns the profiles with a configuration in the config directory dir
+func ListProfiles(dir string) ([]string, error) {
+	profiles := []string{}
+
+	if DoesConfigExist(dir) {
+		profiles = append(profiles, DefaultProfile)
+	}
+
+	files, err := ioutil.ReadDir(fmt.Sprintf("%s/%s", getConfigDir(dir), profilesFolder))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return profiles, nil
+		}
+
+		return nil, fmt.Errorf("couldn't list profiles: %v", err)
+	}
+
+	for _, fi := range files {
+		if fi.IsDir() && DoesConfigExist(GetProfileDir(dir, fi.Name())) {
+			profiles = append(profiles, fi.Name())
+		}
+	}
+
+	return profiles, nil
+}
+
+// GetStateDir returns the directory where the local state, i.e. the local copy
+// of the database and the cached files, is kept. If a config directory is
+// provided, the state is kept under it. Otherwise user's cache directory is used.
+func GetStateDir(dir string) (string, error) {
+	if dir != "" {
+		dir = strings.TrimRight(dir, "/")
+
+		return fmt.Sprintf("%s/%s", dir, stateFolder), nil
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("couldn't find user's cache directory, specify a config directory with -c: %v", err)
+	}
+
+	return fmt.Sprintf("%s/%s", cacheDir, cfgFolder), nil
+}
+
+// GetMountPoint returns the mount point of profile in dir, or in the home
+// directory if dir is empty. Profiles other than the default one are mounted
+// in folders named after them.
+func GetMountPoint(dir string, profile string) string {
+	folder := mountFolderName
+	if profile != DefaultProfile {
+		folder = fmt.Sprintf("%s-%s", mountFolderName, profile)
+	}
+
 	if dir == "" {
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
 			homeDir = "~"
 		}
 
-		return fmt.Sprintf("%s/%s", homeDir, mountFolderName)
+		return fmt.Sprintf("%s/%s", homeDir, folder)
 	}
 
 	dir = strings.TrimRight(dir, "/")
-	return fmt.Sprintf("%s/%s", dir, mountFolderName)
+	return fmt.Sprintf("%s/%s", dir, folder)
 }
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func newTestConfigDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cloudstash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func TestReadLegacyConfig(t *testing.T) {
+	dir := newTestConfigDir(t)
+
+	// written by a version which only supports one drive of each provider
+	legacy := `{"EncryptionKey": "key", "Dropbox": {"AccessToken": "dbx"}, "GDrive": {"access_token": "gdrv"}}`
+
+	if err := ioutil.WriteFile(filepath.Join(dir, cfgFile), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Dropbox != nil || cfg.GDrive != nil {
+		t.Errorf("credentials are kept out of the drives")
+	}
+
+	dbx := cfg.FindDrive(ProviderDropbox)
+	if dbx == nil || dbx.Dropbox == nil || dbx.Dropbox.AccessToken != "dbx" {
+		t.Errorf("dropbox credentials aren't moved into the drives: %+v", cfg.Drives)
+	}
+
+	gdrv := cfg.FindDrive(ProviderGDrive)
+	if gdrv == nil || gdrv.GDrive == nil || gdrv.GDrive.AccessToken != "gdrv" {
+		t.Errorf("gdrive credentials aren't moved into the drives: %+v", cfg.Drives)
+	}
+
+	// and they are written in the new format
+	if err := WriteConfig(dir, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err = ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Drives) != 2 {
+		t.Errorf("%d drives are read back, expected 2", len(cfg.Drives))
+	}
+}
+
+func TestDriveNames(t *testing.T) {
+	cfg := &Cfg{}
+
+	drives := []DriveCfg{
+		{Provider: ProviderGDrive, GDrive: &oauth2.Token{}},
+		{Provider: ProviderGDrive, Name: "work", GDrive: &oauth2.Token{}},
+	}
+
+	for _, d := range drives {
+		if err := cfg.AddDrive(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a drive is named after its provider by default
+	if err := cfg.AddDrive(DriveCfg{Provider: ProviderGDrive}); err == nil {
+		t.Errorf("drive with the same name is added")
+	}
+
+	if d := cfg.FindDrive("work"); d == nil || d.Provider != ProviderGDrive {
+		t.Errorf("named drive isn't found: %+v", d)
+	}
+
+	if err := cfg.RemoveDrive(ProviderGDrive); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Drives) != 1 || cfg.Drives[0].GetName() != "work" {
+		t.Errorf("wrong drive is removed: %+v", cfg.Drives)
+	}
+
+	if err := cfg.RemoveDrive(ProviderGDrive); err == nil {
+		t.Errorf("missing drive is removed")
+	}
+}
+
+func TestVault(t *testing.T) {
+	for vault, valid := range map[string]bool{
+		"team":      true,
+		"test-1.0_": true,
+		"":          false,
+		".":         false,
+		"..":        false,
+		"a/b":       false,
+		"a b":       false,
+		"a'b":       false,
+	} {
+		if IsValidVault(vault) != valid {
+			t.Errorf("IsValidVault(%q) isn't %v", vault, valid)
+		}
+	}
+
+	dir := newTestConfigDir(t)
+
+	// it is used as a folder in the drives
+	if err := ioutil.WriteFile(filepath.Join(dir, cfgFile), []byte(`{"Vault": "../other"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadConfig(dir); err == nil {
+		t.Errorf("configuration with an invalid vault is read")
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	dir := newTestConfigDir(t)
+
+	if d := GetProfileDir(dir, DefaultProfile); d != dir {
+		t.Errorf("default profile is in %s", d)
+	}
+
+	work := GetProfileDir(dir, "work")
+	if work != filepath.Join(dir, profilesFolder, "work") {
+		t.Errorf("profile is in %s", work)
+	}
+
+	for _, d := range []string{dir, work} {
+		if err := WriteConfig(d, &Cfg{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a folder without a configuration isn't a profile
+	if err := os.MkdirAll(GetProfileDir(dir, "empty"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	profiles, err := ListProfiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(profiles) != 2 || profiles[0] != DefaultProfile || profiles[1] != "work" {
+		t.Errorf("profiles are %v", profiles)
+	}
+
+	if mnt := GetMountPoint("/mnt", DefaultProfile); mnt != "/mnt/cloudstash" {
+		t.Errorf("mount point of default profile is %s", mnt)
+	}
+
+	if mnt := GetMountPoint("/mnt/", "work"); mnt != "/mnt/cloudstash-work" {
+		t.Errorf("mount point of profile is %s", mnt)
+	}
+}
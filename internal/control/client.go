@@ -0,0 +1,222 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/paddlesteamer/cloudstash/internal/manager"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+)
+
+// ErrNotRunning is returned when there isn't a running cloudstash to talk to
+var ErrNotRunning = errors.New("cloudstash isn't running")
+
+// Client talks to the control API of a running cloudstash
+type Client struct {
+	client *http.Client
+}
+
+// NewClient returns a client of the control socket at path
+func NewClient(path string) *Client {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		d := net.Dialer{}
+		return d.DialContext(ctx, "unix", path)
+	}
+
+	return &Client{
+		client: &http.Client{
+			Transport: &http.Transport{DialContext: dial},
+		},
+	}
+}
+
+// GetStatus returns the transfers in progress and the pending uploads
+func (c *Client) GetStatus() (*manager.Status, error) {
+	status := &manager.Status{}
+
+	if err := c.do(http.MethodGet, statusPath, nil, status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// RemovePath moves the file or directory at path, relative to the root of
+// the filesystem, to the trash and returns its trash entry
+func (c *Client) RemovePath(path string, recursive bool) (*sqlite.TrashEntry, error) {
+	res := removeResponse{}
+
+	if err := c.do(http.MethodPost, removePath, removeRequest{path, recursive}, &res); err != nil {
+		return nil, err
+	}
+
+	return res.Entry, nil
+}
+
+// ListTrash returns the entries in the trash
+func (c *Client) ListTrash() ([]sqlite.TrashEntry, error) {
+	entries := []sqlite.TrashEntry{}
+
+	if err := c.do(http.MethodGet, trashPath, nil, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// RestoreTrash restores the trash entry with id and returns its new path
+func (c *Client) RestoreTrash(id string) (string, error) {
+	res := restoreResponse{}
+
+	if err := c.do(http.MethodPost, trashRestorePath, restoreRequest{id}, &res); err != nil {
+		return "", err
+	}
+
+	return res.Path, nil
+}
+
+// PurgeTrash removes the trash entry with id, or all entries if all is true,
+// permanently. Returns the number of removed files and directories.
+func (c *Client) PurgeTrash(id string, all bool) (int, error) {
+	res := purgeResponse{}
+
+	if err := c.do(http.MethodPost, trashPurgePath, purgeRequest{id, all}, &res); err != nil {
+		return 0, err
+	}
+
+	return res.Removed, nil
+}
+
+// ListVersions returns the earlier versions of the file at path,
+// newest ones come first
+func (c *Client) ListVersions(path string) ([]sqlite.Version, error) {
+	versions := []sqlite.Version{}
+
+	if err := c.do(http.MethodPost, versionsPath, versionsRequest{path}, &versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// RestoreVersion replaces content of the file at path with its earlier version with id
+func (c *Client) RestoreVersion(path string, id string) error {
+	return c.do(http.MethodPost, versionRestorePath, versionRestoreRequest{path, id}, &struct{}{})
+}
+
+// ListSnapshots returns the snapshots ordered by their creation times
+func (c *Client) ListSnapshots() ([]sqlite.Snapshot, error) {
+	snapshots := []sqlite.Snapshot{}
+
+	if err := c.do(http.MethodGet, snapshotsPath, nil, &snapshots); err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+// CreateSnapshot creates a snapshot of the vault named name
+func (c *Client) CreateSnapshot(name string) (*sqlite.Snapshot, error) {
+	s := &sqlite.Snapshot{}
+
+	if err := c.do(http.MethodPost, snapshotCreatePath, snapshotCreateRequest{name}, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// DeleteSnapshot deletes the snapshot with id and returns the number of
+// remote files which are deleted since they aren't referenced anymore
+func (c *Client) DeleteSnapshot(id string) (int, error) {
+	res := snapshotDeleteResponse{}
+
+	if err := c.do(http.MethodPost, snapshotDeletePath, snapshotDeleteRequest{id}, &res); err != nil {
+		return 0, err
+	}
+
+	return res.Released, nil
+}
+
+// ListDrives returns the drives of the vault and what is stored in them
+func (c *Client) ListDrives() ([]manager.DriveInfo, error) {
+	drives := []manager.DriveInfo{}
+
+	if err := c.do(http.MethodGet, drivesPath, nil, &drives); err != nil {
+		return nil, err
+	}
+
+	return drives, nil
+}
+
+// MigrateDrive moves the remote files and the database in the drive from to the drive to
+func (c *Client) MigrateDrive(from string, to string) (*manager.Migration, error) {
+	res := &manager.Migration{}
+
+	if err := c.do(http.MethodPost, driveMigratePath, migrateRequest{from, to}, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Rebalance moves remote files from the drives with less available space to the ones with more
+func (c *Client) Rebalance() (*manager.Migration, error) {
+	res := &manager.Migration{}
+
+	if err := c.do(http.MethodPost, rebalancePath, struct{}{}, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// do sends body, if not nil, encoded in json and decodes the response into v
+func (c *Client) do(method string, path string, body interface{}, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		buf := &bytes.Buffer{}
+		if err := json.NewEncoder(buf).Encode(body); err != nil {
+			return fmt.Errorf("couldn't encode request: %v", err)
+		}
+
+		r = buf
+	}
+
+	req, err := http.NewRequest(method, "http://cloudstash"+path, r)
+	if err != nil {
+		return fmt.Errorf("couldn't create request: %v", err)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return ErrNotRunning
+		}
+
+		return fmt.Errorf("couldn't send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		e := errorResponse{}
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+			return fmt.Errorf("request failed with status %d", res.StatusCode)
+		}
+
+		return errors.New(e.Error)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("couldn't parse response: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,465 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/manager"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	socketFileName = "cloudstash.sock"
+
+	statusPath       = "/status"
+	removePath       = "/remove"
+	trashPath        = "/trash"
+	trashRestorePath = "/trash/restore"
+	trashPurgePath   = "/trash/purge"
+
+	versionsPath       = "/versions"
+	versionRestorePath = "/versions/restore"
+
+	snapshotsPath      = "/snapshots"
+	snapshotCreatePath = "/snapshots/create"
+	snapshotDeletePath = "/snapshots/delete"
+
+	drivesPath       = "/drives"
+	driveMigratePath = "/drives/migrate"
+	rebalancePath    = "/rebalance"
+)
+
+// Server serves the control API of a running cloudstash over a unix socket.
+// It is used by the command-line to inspect and manage the mounted vault.
+type Server struct {
+	path string
+	srv  *http.Server
+}
+
+type errorResponse struct {
+	Error string
+}
+
+type removeRequest struct {
+	Path      string
+	Recursive bool
+}
+
+type removeResponse struct {
+	Entry *sqlite.TrashEntry
+}
+
+type restoreRequest struct {
+	ID string
+}
+
+type restoreResponse struct {
+	Path string
+}
+
+type purgeRequest struct {
+	ID  string
+	All bool // purge all entries instead of the one with ID
+}
+
+type purgeResponse struct {
+	Removed int
+}
+
+type versionsRequest struct {
+	Path string
+}
+
+type versionRestoreRequest struct {
+	Path string
+	ID   string
+}
+
+type snapshotCreateRequest struct {
+	Name string
+}
+
+type snapshotDeleteRequest struct {
+	ID string
+}
+
+type snapshotDeleteResponse struct {
+	Released int // remote files which aren't referenced anymore
+}
+
+type migrateRequest struct {
+	From string
+	To   string
+}
+
+// SocketPath returns path of the control socket in the state directory
+func SocketPath(stateDir string) string {
+	return filepath.Join(stateDir, socketFileName)
+}
+
+// NewServer starts serving control API of m on the unix socket at path
+func NewServer(path string, m *manager.Manager) (*Server, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+
+		return nil, fmt.Errorf("another cloudstash is already running with the same state directory")
+	}
+
+	// remove the socket left by a crashed process
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("couldn't remove stale socket: %v", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %v", path, err)
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+
+		return nil, fmt.Errorf("couldn't set permissions of socket: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(statusPath, statusHandler(m))
+	mux.Handle(removePath, removeHandler(m))
+	mux.Handle(trashPath, trashHandler(m))
+	mux.Handle(trashRestorePath, restoreHandler(m))
+	mux.Handle(trashPurgePath, purgeHandler(m))
+	mux.Handle(versionsPath, versionsHandler(m))
+	mux.Handle(versionRestorePath, versionRestoreHandler(m))
+	mux.Handle(snapshotsPath, snapshotsHandler(m))
+	mux.Handle(snapshotCreatePath, snapshotCreateHandler(m))
+	mux.Handle(snapshotDeletePath, snapshotDeleteHandler(m))
+	mux.Handle(drivesPath, drivesHandler(m))
+	mux.Handle(driveMigratePath, migrateHandler(m))
+	mux.Handle(rebalancePath, rebalanceHandler(m))
+
+	s := &Server{
+		path: path,
+		srv:  &http.Server{Handler: mux},
+	}
+
+	go func() {
+		if err := s.srv.Serve(l); err != http.ErrServerClosed {
+			log.Errorf("control server is crashed: %v", err)
+		}
+	}()
+
+	return s, nil
+}
+
+// Close stops the server and removes the socket
+func (s *Server) Close() {
+	if err := s.srv.Close(); err != nil {
+		log.Warningf("couldn't close control server: %v", err)
+	}
+
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		log.Warningf("couldn't remove socket '%s': %v", s.path, err)
+	}
+}
+
+func statusHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, m.GetStatus())
+	})
+}
+
+func removeHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := removeRequest{}
+		if !readRequest(w, r, &req) {
+			return
+		}
+
+		e, err := m.RemovePath(req.Path, req.Recursive)
+		if err != nil {
+			switch err {
+			case common.ErrNotFound:
+				writeError(w, http.StatusNotFound, fmt.Errorf("%s: no such file or directory", req.Path))
+			case common.ErrIsDir:
+				writeError(w, http.StatusBadRequest, fmt.Errorf("%s: is a directory", req.Path))
+			default:
+				writeError(w, http.StatusInternalServerError, err)
+			}
+
+			return
+		}
+
+		writeResponse(w, removeResponse{Entry: e})
+	})
+}
+
+func trashHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entries, err := m.ListTrash()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeResponse(w, entries)
+	})
+}
+
+func restoreHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := restoreRequest{}
+		if !readRequest(w, r, &req) {
+			return
+		}
+
+		path, err := m.RestoreTrash(req.ID)
+		if err != nil {
+			if err == common.ErrNotFound {
+				writeError(w, http.StatusNotFound, fmt.Errorf("%s: no such entry in trash", req.ID))
+				return
+			}
+
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeResponse(w, restoreResponse{Path: path})
+	})
+}
+
+func purgeHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := purgeRequest{}
+		if !readRequest(w, r, &req) {
+			return
+		}
+
+		var removed int
+		var err error
+
+		if req.All {
+			removed, err = m.PurgeTrashBefore(time.Now())
+		} else {
+			removed, err = m.PurgeTrash(req.ID)
+		}
+
+		if err != nil {
+			if err == common.ErrNotFound {
+				writeError(w, http.StatusNotFound, fmt.Errorf("%s: no such entry in trash", req.ID))
+				return
+			}
+
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeResponse(w, purgeResponse{Removed: removed})
+	})
+}
+
+func versionsHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := versionsRequest{}
+		if !readRequest(w, r, &req) {
+			return
+		}
+
+		md, ok := lookupFile(w, m, req.Path)
+		if !ok {
+			return
+		}
+
+		versions, err := m.ListVersions(md.Inode)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeResponse(w, versions)
+	})
+}
+
+func versionRestoreHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := versionRestoreRequest{}
+		if !readRequest(w, r, &req) {
+			return
+		}
+
+		md, ok := lookupFile(w, m, req.Path)
+		if !ok {
+			return
+		}
+
+		if err := m.RestoreVersion(md.Inode, req.ID); err != nil {
+			if err == common.ErrNotFound {
+				writeError(w, http.StatusNotFound, fmt.Errorf("%s: no such version", req.ID))
+				return
+			}
+
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeResponse(w, struct{}{})
+	})
+}
+
+func snapshotsHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshots, err := m.ListSnapshots()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeResponse(w, snapshots)
+	})
+}
+
+func snapshotCreateHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := snapshotCreateRequest{}
+		if !readRequest(w, r, &req) {
+			return
+		}
+
+		s, err := m.CreateSnapshot(req.Name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeResponse(w, s)
+	})
+}
+
+func snapshotDeleteHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := snapshotDeleteRequest{}
+		if !readRequest(w, r, &req) {
+			return
+		}
+
+		released, err := m.DeleteSnapshot(req.ID)
+		if err != nil {
+			if err == common.ErrNotFound {
+				writeError(w, http.StatusNotFound, fmt.Errorf("%s: no such snapshot", req.ID))
+				return
+			}
+
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeResponse(w, snapshotDeleteResponse{Released: released})
+	})
+}
+
+func drivesHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		drives, err := m.ListDrives()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeResponse(w, drives)
+	})
+}
+
+func migrateHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := migrateRequest{}
+		if !readRequest(w, r, &req) {
+			return
+		}
+
+		res, err := m.MigrateDrive(req.From, req.To)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeResponse(w, res)
+	})
+}
+
+func rebalanceHandler(m *manager.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := struct{}{}
+		if !readRequest(w, r, &req) {
+			return
+		}
+
+		res, err := m.Rebalance()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeResponse(w, res)
+	})
+}
+
+// lookupFile returns metadata of the regular file at path. If it fails,
+// the error is written to w and false is returned.
+func lookupFile(w http.ResponseWriter, m *manager.Manager, path string) (*sqlite.Metadata, bool) {
+	md, err := m.LookupPath(path)
+	if err != nil {
+		if err == common.ErrNotFound {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s: no such file or directory", path))
+			return nil, false
+		}
+
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	if md.Type != common.DrvFile {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%s: isn't a regular file", path))
+		return nil, false
+	}
+
+	return md, true
+}
+
+// readRequest decodes body of the POST request r into v. If it fails,
+// the error is written to w and false is returned.
+func readRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s isn't allowed", r.Method))
+		return false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("couldn't parse request: %v", err))
+		return false
+	}
+
+	return true
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(errorResponse{Error: err.Error()}); err != nil {
+		log.Warningf("couldn't write control response: %v", err)
+	}
+}
+
+func writeResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warningf("couldn't write control response: %v", err)
+	}
+}
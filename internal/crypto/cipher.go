@@ -66,14 +66,15 @@ func (c *Cipher) encrypt(r io.Reader, w io.WriteCloser) {
 
 	chunk := make([]byte, chunkSize)
 	for {
-		n, err := r.Read(chunk)
-		if err != nil && err != io.EOF {
+		// decrypt expects full chunks, r may return less, i.e. if it is a pipe
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			log.Errorf("couldn't read from file: %v", err)
 
 			return
 		}
 
-		brk := err == io.EOF
+		brk := err != nil
 
 		if brk && n == 0 {
 			break
@@ -178,3 +179,15 @@ func (c *Cipher) computeHMAC(chunk []byte) []byte {
 	mac.Write(chunk)
 	return mac.Sum(nil)
 }
+
+// ChunkID returns the identifier of the chunk with data. It is a keyed hash,
+// so the same data has the same identifier without revealing anything about it.
+func (c *Cipher) ChunkID(data []byte) string {
+	key := hmac.New(sha256.New, c.key)
+	key.Write([]byte("chunk"))
+
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -21,6 +21,10 @@ type Metadata struct {
 // Drive is the interface every remote drive client should implement
 type Drive interface {
 
+	// GetID returns the ID of the drive in the vault, it is the scheme
+	// of the URLs of files in the drive
+	GetID() string
+
 	// GetProviderName returns name of the drive. i.e. dropbox
 	GetProviderName() string
 
@@ -67,7 +71,7 @@ type Drive interface {
 // GetURL creates URL of remote file
 // i.e. dropbox://filename.ext
 func GetURL(drv Drive, name string) string {
-	scheme := drv.GetProviderName()
+	scheme := drv.GetID()
 
 	if name[0] == '/' {
 		name = name[1:]
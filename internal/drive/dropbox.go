@@ -20,33 +20,46 @@ import (
 
 // Dropbox is holds necessary info about dropbox client
 type Dropbox struct {
+	id      string
+	name    string
+	vault   string // folder of the vault, files are in the root if it is empty
 	client  files.Client
 	account users.Client
+	uploads chan struct{} // upload slots of the account, unlimited if nil
 
 	mu sync.Mutex
 }
 
-// NewDropboxClient creates a new Dropbox client.
-func NewDropboxClient(conf *config.DropboxCredentials) *Dropbox {
+// NewDropboxClient creates a new Dropbox client named name, identified by id in the vault.
+// Files are stored in the folder named vault, or in the root if vault is empty.
+func NewDropboxClient(id string, name string, vault string, conf *config.DropboxCredentials) *Dropbox {
 	dbxConfig := dropbox.Config{
 		Token: conf.AccessToken,
 		// LogLevel: dropbox.LogDebug,
 	}
 
 	return &Dropbox{
+		id:      id,
+		name:    name,
+		vault:   vault,
 		client:  files.New(dbxConfig),
 		account: users.New(dbxConfig),
 	}
 }
 
-// GetProviderName returns 'dropbox'
+// GetID returns ID of the drive
+func (d *Dropbox) GetID() string {
+	return d.id
+}
+
+// GetProviderName returns name of the drive, 'dropbox' by default
 func (d *Dropbox) GetProviderName() string {
-	return "dropbox"
+	return d.name
 }
 
 // GetFile returns ReadCloser of remote file on dropbox
 func (d *Dropbox) GetFile(name string) (io.ReadCloser, error) {
-	name = getPath(name)
+	name = d.getPath(name)
 
 	args := files.NewDownloadArg(name)
 	_, r, err := d.client.Download(args)
@@ -64,7 +77,7 @@ func (d *Dropbox) GetFile(name string) (io.ReadCloser, error) {
 
 // PutFile uploads a new file.
 func (d *Dropbox) PutFile(name string, content io.Reader) error {
-	name = getPath(name)
+	name = d.getPath(name)
 
 	if err := d.DeleteFile(name); err != nil && err != common.ErrNotFound {
 		return fmt.Errorf("couldn't delete file from dropbox before upload: %v", err)
@@ -81,7 +94,7 @@ func (d *Dropbox) PutFile(name string, content io.Reader) error {
 
 // GetFileMetadata gets the file metadata given the file path.
 func (d *Dropbox) GetFileMetadata(name string) (*Metadata, error) {
-	name = getPath(name)
+	name = d.getPath(name)
 
 	args := &files.GetMetadataArg{
 		Path: name,
@@ -106,7 +119,7 @@ func (d *Dropbox) GetFileMetadata(name string) (*Metadata, error) {
 
 // DeleteFile deletes file from dropbox
 func (d *Dropbox) DeleteFile(name string) error {
-	name = getPath(name)
+	name = d.getPath(name)
 
 	dargs := files.NewDeleteArg(name)
 	if _, err := d.client.DeleteV2(dargs); err != nil {
@@ -122,8 +135,8 @@ func (d *Dropbox) DeleteFile(name string) error {
 
 // MoveFile renames file on dropbox
 func (d *Dropbox) MoveFile(name string, newName string) error {
-	name = getPath(name)
-	newName = getPath(newName)
+	name = d.getPath(name)
+	newName = d.getPath(newName)
 
 	args := files.NewRelocationArg(name, newName)
 	if _, err := d.client.MoveV2(args); err != nil {
@@ -140,7 +153,7 @@ func (d *Dropbox) MoveFile(name string, newName string) error {
 func (d *Dropbox) Lock() error {
 	d.mu.Lock()
 
-	lfile := getPath(lockFile)
+	lfile := d.getPath(lockFile)
 
 	sTime := time.Now()
 	lockHash := ""
@@ -273,10 +286,16 @@ func (d *Dropbox) GetAvailableSpace() (int64, error) {
 	return int64(res.Allocation.Individual.Allocated - res.Used), nil
 }
 
-func getPath(name string) string {
+// getPath returns the path of the file named name in the folder of the vault.
+// Names starting with '/' are already paths.
+func (d *Dropbox) getPath(name string) string {
 	if name[0] == '/' {
 		return name
 	}
 
+	if d.vault != "" {
+		return fmt.Sprintf("/%s/%s", d.vault, name)
+	}
+
 	return fmt.Sprintf("/%s", name)
 }
@@ -0,0 +1,24 @@
+package drive
+
+import (
+	"testing"
+)
+
+func TestDropboxPath(t *testing.T) {
+	d := &Dropbox{}
+
+	if path := d.getPath("file.dat"); path != "/file.dat" {
+		t.Errorf("path of the default vault is %s", path)
+	}
+
+	d.vault = "team"
+
+	if path := d.getPath("file.dat"); path != "/team/file.dat" {
+		t.Errorf("path in the vault is %s", path)
+	}
+
+	// paths aren't changed
+	if path := d.getPath("/team/file.dat"); path != "/team/file.dat" {
+		t.Errorf("path is changed to %s", path)
+	}
+}
@@ -18,16 +18,24 @@ import (
 
 // GDrive is google drive client
 type GDrive struct {
+	id           string
+	name         string
+	vault        string // folder of the vault in the app folder, files are in the app folder if it is empty
 	srv          *drive.Service
-	rootFolderID string
+	uploads      chan struct{} // upload slots of the account, unlimited if nil
+	rootFolderID string        // folder of the vault
+	rootMu       sync.Mutex
 
 	mu     sync.Mutex
 	lockID string
 }
 
-// NewGDriveClient creates app folder on google drive if it doesn;t exists
-// and returns GDrive client
-func NewGDriveClient(token *oauth2.Token) (*GDrive, error) {
+// NewGDriveClient returns GDrive client. App folder is created on google drive
+// on first use if it doesn't exist, so that the client can be created while
+// google drive is unreachable. Drive is identified by id in the vault.
+// Files are stored in the folder named vault in the app folder, or in the
+// app folder itself if vault is empty.
+func NewGDriveClient(id string, name string, vault string, token *oauth2.Token) (*GDrive, error) {
 	config, _ := google.ConfigFromJSON([]byte(common.GDriveCredentials), drive.DriveFileScope)
 
 	client := config.Client(context.Background(), token)
@@ -37,37 +45,22 @@ func NewGDriveClient(token *oauth2.Token) (*GDrive, error) {
 		return nil, fmt.Errorf("couldn't create GDrive service: %v", err)
 	}
 
-	drv := &GDrive{
-		srv: srv,
-	}
-
-	folder, err := drv.getFileID(common.GDriveAppFolder)
-	if err != nil && err != common.ErrNotFound {
-		return nil, fmt.Errorf("couldn't query for root folder: %v", err)
-	}
-
-	if err == common.ErrNotFound {
-		f := &drive.File{
-			Name:     common.GDriveAppFolder,
-			MimeType: "application/vnd.google-apps.folder",
-		}
-
-		finfo, err := srv.Files.Create(f).Do()
-		if err != nil {
-			return nil, fmt.Errorf("couldn't create app directory on gdrive: %v", err)
-		}
-
-		folder = finfo.Id
-	}
-
-	drv.rootFolderID = folder
+	return &GDrive{
+		id:    id,
+		name:  name,
+		vault: vault,
+		srv:   srv,
+	}, nil
+}
 
-	return drv, nil
+// GetID returns ID of the drive
+func (g *GDrive) GetID() string {
+	return g.id
 }
 
-// GetProviderName returns 'gdrive'
+// GetProviderName returns name of the drive, 'gdrive' by default
 func (g *GDrive) GetProviderName() string {
-	return "gdrive"
+	return g.name
 }
 
 // GetFile returns ReadCloser of remote file on google drive
@@ -106,9 +99,14 @@ func (g *GDrive) PutFile(name string, content io.Reader) error {
 		}
 	}
 
+	rootFolderID, err := g.getRootFolderID()
+	if err != nil {
+		return fmt.Errorf("couldn't get app folder: %v", err)
+	}
+
 	f := &drive.File{
 		Name:    name,
-		Parents: []string{g.rootFolderID},
+		Parents: []string{rootFolderID},
 	}
 
 	if _, err := g.srv.Files.Create(f).Media(content).Do(); err != nil {
@@ -193,15 +191,22 @@ func (g *GDrive) MoveFile(name string, newName string) error {
 func (g *GDrive) Lock() error {
 	g.mu.Lock()
 
+	rootFolderID, err := g.getRootFolderID()
+	if err != nil {
+		g.mu.Unlock()
+		return fmt.Errorf("couldn't get app folder: %v", err)
+	}
+
 	sTime := time.Now()
 	lockID := ""
 
 	query := g.srv.Files.List().PageSize(10).
-		Q(fmt.Sprintf("name='%s' and trashed=false", lockFile)).Fields("files(id, name)")
+		Q(fmt.Sprintf("name='%s' and '%s' in parents and trashed=false", lockFile, rootFolderID)).
+		Fields("files(id, name)")
 
 	f := &drive.File{
 		Name:    lockFile,
-		Parents: []string{g.rootFolderID},
+		Parents: []string{rootFolderID},
 	}
 
 	for {
@@ -302,9 +307,79 @@ func (g *GDrive) GetAvailableSpace() (int64, error) {
 	return res.StorageQuota.Limit - res.StorageQuota.Usage, nil
 }
 
+// getRootFolderID returns id of the folder of the vault on google drive
+// and creates the folder if it doesn't exist
+func (g *GDrive) getRootFolderID() (string, error) {
+	g.rootMu.Lock()
+	defer g.rootMu.Unlock()
+
+	if g.rootFolderID != "" {
+		return g.rootFolderID, nil
+	}
+
+	folder, err := g.getFolderID(common.GDriveAppFolder, "")
+	if err != nil {
+		return "", err
+	}
+
+	if g.vault != "" {
+		folder, err = g.getFolderID(g.vault, folder)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	g.rootFolderID = folder
+
+	return folder, nil
+}
+
+// getFolderID returns id of the folder named name in the parent folder,
+// or anywhere if parent is empty, and creates the folder if it doesn't exist
+func (g *GDrive) getFolderID(name string, parent string) (string, error) {
+	folder, err := g.queryFileID(name, parent)
+	if err != nil && err != common.ErrNotFound {
+		return "", fmt.Errorf("couldn't query for folder %s: %v", name, err)
+	}
+
+	if err == nil {
+		return folder, nil
+	}
+
+	f := &drive.File{
+		Name:     name,
+		MimeType: "application/vnd.google-apps.folder",
+	}
+
+	if parent != "" {
+		f.Parents = []string{parent}
+	}
+
+	finfo, err := g.srv.Files.Create(f).Do()
+	if err != nil {
+		return "", fmt.Errorf("couldn't create folder %s on gdrive: %v", name, err)
+	}
+
+	return finfo.Id, nil
+}
+
+// getFileID returns id of the file named name in the folder of the vault
 func (g *GDrive) getFileID(name string) (string, error) {
-	res, err := g.srv.Files.List().PageSize(10).
-		Q(fmt.Sprintf("name='%s' and trashed=false", name)).Fields("files(id, name)").Do()
+	rootFolderID, err := g.getRootFolderID()
+	if err != nil {
+		return "", fmt.Errorf("couldn't get app folder: %v", err)
+	}
+
+	return g.queryFileID(name, rootFolderID)
+}
+
+func (g *GDrive) queryFileID(name string, parent string) (string, error) {
+	q := fmt.Sprintf("name='%s' and trashed=false", name)
+	if parent != "" {
+		q = fmt.Sprintf("name='%s' and '%s' in parents and trashed=false", name, parent)
+	}
+
+	res, err := g.srv.Files.List().PageSize(10).Q(q).Fields("files(id, name)").Do()
 	if err != nil {
 		return "", fmt.Errorf("couldn't query file %s: %v", name, err)
 	}
@@ -0,0 +1,77 @@
+package drive
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// idFile keeps the ID of the drive so that every device using
+// the drive identifies it the same way
+const idFile = "cloudstash.id"
+
+// LoadID returns the ID stored in drv. If there isn't one,
+// a new ID is created and stored in drv.
+func LoadID(drv Drive) (string, error) {
+	reader, err := drv.GetFile(idFile)
+	if err == nil {
+		defer reader.Close()
+
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return "", fmt.Errorf("couldn't read id file: %v", err)
+		}
+
+		id := strings.TrimSpace(string(content))
+		if !IsValidID(id) {
+			return "", fmt.Errorf("id file has an invalid id '%s'", id)
+		}
+
+		return id, nil
+	}
+
+	if err != common.ErrNotFound {
+		return "", fmt.Errorf("couldn't get id file: %v", err)
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	if err := drv.PutFile(idFile, strings.NewReader(id)); err != nil {
+		return "", fmt.Errorf("couldn't upload id file: %v", err)
+	}
+
+	return id, nil
+}
+
+// IsValidID returns whether id can be used as the scheme of URLs
+func IsValidID(id string) bool {
+	if id == "" || id[0] < 'a' || id[0] > 'z' {
+		return false
+	}
+
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newID() (string, error) {
+	b := make([]byte, 6)
+
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", fmt.Errorf("couldn't generate drive id: %v", err)
+	}
+
+	return "d" + hex.EncodeToString(b), nil
+}
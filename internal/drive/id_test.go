@@ -0,0 +1,81 @@
+package drive
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// fileDrive keeps the files in memory, the other methods aren't implemented
+type fileDrive struct {
+	Drive
+	files map[string][]byte
+}
+
+func (d *fileDrive) GetFile(name string) (io.ReadCloser, error) {
+	data, ok := d.files[name]
+	if !ok {
+		return nil, common.ErrNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (d *fileDrive) PutFile(name string, content io.Reader) error {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	d.files[name] = data
+
+	return nil
+}
+
+func TestLoadID(t *testing.T) {
+	drv := &fileDrive{files: map[string][]byte{}}
+
+	id, err := LoadID(drv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsValidID(id) {
+		t.Errorf("new id %s isn't valid", id)
+	}
+
+	// every device gets the same id
+	loaded, err := LoadID(drv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded != id {
+		t.Errorf("id is changed from %s to %s", id, loaded)
+	}
+
+	drv.files[idFile] = []byte("Not/An:ID")
+
+	if _, err := LoadID(drv); err == nil {
+		t.Errorf("invalid id is loaded")
+	}
+}
+
+func TestIsValidID(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"dropbox":  true,
+		"d0a1b2":   true,
+		"":         false,
+		"1drive":   false,
+		"Drive":    false,
+		"my-drive": false,
+		"a://b":    false,
+	} {
+		if IsValidID(id) != valid {
+			t.Errorf("IsValidID(%q) isn't %v", id, valid)
+		}
+	}
+}
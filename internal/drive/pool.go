@@ -0,0 +1,123 @@
+package drive
+
+import (
+	"sync"
+
+	"github.com/paddlesteamer/cloudstash/internal/config"
+	"golang.org/x/oauth2"
+)
+
+// accountUploads is the maximum number of simultaneous uploads to an
+// account by all vaults using it
+const accountUploads = 4
+
+// Pool creates the clients of the drives of several vaults. Clients of the
+// same account share the connection to it and its upload slots, even if
+// they are authorized separately.
+type Pool struct {
+	mu      sync.Mutex
+	dropbox map[string]*Dropbox // first client of each account
+	gdrive  map[string]*GDrive
+}
+
+// NewPool creates an empty pool
+func NewPool() *Pool {
+	return &Pool{
+		dropbox: map[string]*Dropbox{},
+		gdrive:  map[string]*GDrive{},
+	}
+}
+
+// NewDropboxClient creates a Dropbox client like NewDropboxClient,
+// sharing the connection of the clients of the same account
+func (p *Pool) NewDropboxClient(id string, name string, vault string, conf *config.DropboxCredentials) *Dropbox {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	drv := NewDropboxClient(id, name, vault, conf)
+
+	key := conf.AccessToken
+	if res, err := drv.account.GetCurrentAccount(); err == nil {
+		key = res.AccountId
+	}
+
+	if shared, ok := p.dropbox[key]; ok {
+		drv.client = shared.client
+		drv.account = shared.account
+		drv.uploads = shared.uploads
+
+		return drv
+	}
+
+	drv.uploads = make(chan struct{}, accountUploads)
+	p.dropbox[key] = drv
+
+	return drv
+}
+
+// NewGDriveClient creates a GDrive client like NewGDriveClient,
+// sharing the connection of the clients of the same account
+func (p *Pool) NewGDriveClient(id string, name string, vault string, token *oauth2.Token) (*GDrive, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	drv, err := NewGDriveClient(id, name, vault, token)
+	if err != nil {
+		return nil, err
+	}
+
+	key := token.RefreshToken
+	if res, err := drv.srv.About.Get().Fields("user(permissionId)").Do(); err == nil && res.User != nil {
+		key = res.User.PermissionId
+	}
+
+	if shared, ok := p.gdrive[key]; ok {
+		drv.srv = shared.srv
+		drv.uploads = shared.uploads
+
+		return drv, nil
+	}
+
+	drv.uploads = make(chan struct{}, accountUploads)
+	p.gdrive[key] = drv
+
+	return drv, nil
+}
+
+// uploadLimiter is implemented by the clients which share the upload
+// slots of their accounts
+type uploadLimiter interface {
+	acquireUpload() func()
+}
+
+func (d *Dropbox) acquireUpload() func() {
+	return acquire(d.uploads)
+}
+
+func (g *GDrive) acquireUpload() func() {
+	return acquire(g.uploads)
+}
+
+// AcquireUpload takes an upload slot of the account of drv and returns the
+// function releasing it. Clients which aren't created by a Pool aren't limited.
+// A slot should be taken for a whole upload, including the ones it fans out to
+// other drives, and a second one shouldn't be waited for while it is held.
+func AcquireUpload(drv Drive) func() {
+	if l, ok := drv.(uploadLimiter); ok {
+		return l.acquireUpload()
+	}
+
+	return func() {}
+}
+
+// acquire takes one of slots and returns the function releasing it.
+// It doesn't wait if slots is nil.
+func acquire(slots chan struct{}) func() {
+	if slots == nil {
+		return func() {}
+	}
+
+	slots <- struct{}{}
+
+	return func() { <-slots }
+}
@@ -0,0 +1,41 @@
+package drive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcquireUpload(t *testing.T) {
+	// clients of the same account share the slots
+	slots := make(chan struct{}, 1)
+	a := &Dropbox{uploads: slots}
+	b := &GDrive{uploads: slots}
+
+	release := AcquireUpload(a)
+
+	acquired := make(chan func())
+	go func() {
+		acquired <- AcquireUpload(b)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("slot is taken while the account has none left")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+
+	select {
+	case release = <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatalf("slot isn't taken after it is released")
+	}
+
+	// clients which aren't created by a pool aren't limited
+	for _, drv := range []Drive{&Dropbox{}, &fileDrive{}} {
+		AcquireUpload(drv)
+		AcquireUpload(drv)
+	}
+}
@@ -0,0 +1,332 @@
+package erasure
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// BlockSize is the size of the blocks written to each shard for a stripe
+// of the content. The last stripe is shorter, so that small contents
+// aren't padded to a full stripe.
+const BlockSize = 64 * 1024
+
+// Code is a systematic Reed-Solomon code over GF(2^8). The content is split
+// into Data shards and Parity shards are computed from them; any Data of
+// the shards are enough to reconstruct the content.
+type Code struct {
+	Data   int
+	Parity int
+	matrix [][]byte // rows are the coefficients of each shard, the first Data rows are the identity
+}
+
+// NewCode creates a Code with data and parity shards
+func NewCode(data int, parity int) (*Code, error) {
+	if data < 1 || parity < 0 || data+parity > 256 {
+		return nil, fmt.Errorf("invalid number of shards: %d data, %d parity", data, parity)
+	}
+
+	n := data + parity
+
+	// any data rows of a vandermonde matrix are independent,
+	// multiplying with the inverse of its top keeps them so
+	vand := make([][]byte, n)
+	for r := range vand {
+		vand[r] = make([]byte, data)
+
+		for c := range vand[r] {
+			vand[r][c] = gfPow(byte(r), c)
+		}
+	}
+
+	top, err := invert(vand[:data])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Code{
+		Data:   data,
+		Parity: parity,
+		matrix: mulMatrix(vand, top),
+	}, nil
+}
+
+// Shards returns the total number of shards
+func (c *Code) Shards() int {
+	return c.Data + c.Parity
+}
+
+// encode computes parity shards from the data shards of the same size
+func (c *Code) encode(shards [][]byte) {
+	for i := c.Data; i < c.Shards(); i++ {
+		out := shards[i]
+
+		for j := range out {
+			out[j] = 0
+		}
+
+		for d := 0; d < c.Data; d++ {
+			mulAdd(c.matrix[i][d], shards[d], out)
+		}
+	}
+}
+
+// reconstruct computes the missing data shards, the ones which are nil,
+// from the others. Parity shards aren't reconstructed.
+func (c *Code) reconstruct(shards [][]byte, size int) error {
+	present := []int{}
+	missing := false
+
+	for i, s := range shards {
+		if s != nil && len(present) < c.Data {
+			present = append(present, i)
+		}
+
+		if s == nil && i < c.Data {
+			missing = true
+		}
+	}
+
+	if !missing {
+		return nil
+	}
+
+	if len(present) < c.Data {
+		return fmt.Errorf("not enough shards, %d of %d are needed", len(present), c.Data)
+	}
+
+	sub := make([][]byte, c.Data)
+	for r, i := range present {
+		sub[r] = c.matrix[i]
+	}
+
+	dec, err := invert(sub)
+	if err != nil {
+		return err
+	}
+
+	for d := 0; d < c.Data; d++ {
+		if shards[d] != nil {
+			continue
+		}
+
+		out := make([]byte, size)
+
+		for r, i := range present {
+			mulAdd(dec[d][r], shards[i], out)
+		}
+
+		shards[d] = out
+	}
+
+	return nil
+}
+
+// blockSize returns the size of the blocks of a stripe with n bytes of content
+func (c *Code) blockSize(n int) int {
+	if n >= c.Data*BlockSize {
+		return BlockSize
+	}
+
+	return (n + c.Data - 1) / c.Data
+}
+
+// Split reads the content from r and writes its shards to writers, one
+// for each shard in order. Returns the size of the content.
+func (c *Code) Split(r io.Reader, writers []io.Writer) (int64, error) {
+	if len(writers) != c.Shards() {
+		return 0, fmt.Errorf("%d writers for %d shards", len(writers), c.Shards())
+	}
+
+	buf := make([]byte, c.Data*BlockSize)
+	parity := make([][]byte, c.Parity)
+
+	for i := range parity {
+		parity[i] = make([]byte, BlockSize)
+	}
+
+	var size int64
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return size, err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		size += int64(n)
+
+		block := c.blockSize(n)
+
+		// last stripe is padded with zeros
+		for i := n; i < c.Data*block; i++ {
+			buf[i] = 0
+		}
+
+		shards := make([][]byte, c.Shards())
+
+		for i := 0; i < c.Data; i++ {
+			shards[i] = buf[i*block : (i+1)*block]
+		}
+
+		for i := range parity {
+			shards[c.Data+i] = parity[i][:block]
+		}
+
+		c.encode(shards)
+
+		for i, w := range writers {
+			if _, err := w.Write(shards[i]); err != nil {
+				return size, fmt.Errorf("couldn't write shard %d: %v", i, err)
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return size, nil
+}
+
+// Join returns a reader of the content of size bytes from the readers of its
+// shards in order, nil for the missing ones. Only Data of the shards are read
+// at a time; when one of them fails, it is treated as missing and the next
+// one of the others is read from the same position instead.
+func (c *Code) Join(readers []io.Reader, size int64) io.Reader {
+	j := &joinReader{
+		code:      c,
+		readers:   readers,
+		active:    make([]bool, len(readers)),
+		remaining: size,
+	}
+
+	for i, r := range readers {
+		if r != nil && j.activeCount() < c.Data {
+			j.active[i] = true
+		}
+	}
+
+	return j
+}
+
+type joinReader struct {
+	code      *Code
+	readers   []io.Reader
+	active    []bool // readers which are read for each stripe
+	offset    int64  // bytes read from each active shard
+	remaining int64
+	buf       []byte // decoded content which isn't read yet
+}
+
+func (j *joinReader) Read(p []byte) (int, error) {
+	if len(j.buf) == 0 {
+		if j.remaining == 0 {
+			return 0, io.EOF
+		}
+
+		if err := j.nextStripe(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, j.buf)
+	j.buf = j.buf[n:]
+
+	return n, nil
+}
+
+func (j *joinReader) activeCount() int {
+	n := 0
+
+	for _, a := range j.active {
+		if a {
+			n++
+		}
+	}
+
+	return n
+}
+
+// readBlock reads the next block of shard i, the reader is dropped if it fails
+func (j *joinReader) readBlock(i int, block int) []byte {
+	s := make([]byte, block)
+
+	if _, err := io.ReadFull(j.readers[i], s); err != nil {
+		j.readers[i] = nil
+		j.active[i] = false
+
+		return nil
+	}
+
+	return s
+}
+
+// activate starts reading shard i, which isn't read yet, from the current offset
+func (j *joinReader) activate(i int) bool {
+	if _, err := io.CopyN(ioutil.Discard, j.readers[i], j.offset); err != nil {
+		j.readers[i] = nil
+
+		return false
+	}
+
+	j.active[i] = true
+
+	return true
+}
+
+func (j *joinReader) nextStripe() error {
+	c := j.code
+
+	n := c.Data * BlockSize
+	if j.remaining < int64(n) {
+		n = int(j.remaining)
+	}
+
+	block := c.blockSize(n)
+	shards := make([][]byte, c.Shards())
+	present := 0
+
+	for i := range j.readers {
+		if !j.active[i] {
+			continue
+		}
+
+		if shards[i] = j.readBlock(i, block); shards[i] != nil {
+			present++
+		}
+	}
+
+	// the shards which aren't read yet replace the failed ones
+	for i := range j.readers {
+		if present == c.Data {
+			break
+		}
+
+		if j.readers[i] == nil || j.active[i] || !j.activate(i) {
+			continue
+		}
+
+		if shards[i] = j.readBlock(i, block); shards[i] != nil {
+			present++
+		}
+	}
+
+	if err := c.reconstruct(shards, block); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, c.Data*block)
+	for i := 0; i < c.Data; i++ {
+		buf = append(buf, shards[i]...)
+	}
+
+	j.buf = buf[:n]
+	j.offset += int64(block)
+	j.remaining -= int64(n)
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func split(t *testing.T, c *Code, content []byte) [][]byte {
+	bufs := make([]*bytes.Buffer, c.Shards())
+	writers := make([]io.Writer, c.Shards())
+
+	for i := range bufs {
+		bufs[i] = &bytes.Buffer{}
+		writers[i] = bufs[i]
+	}
+
+	size, err := c.Split(bytes.NewReader(content), writers)
+	if err != nil {
+		t.Fatalf("couldn't split content: %v", err)
+	}
+
+	if size != int64(len(content)) {
+		t.Fatalf("split %d bytes, expected %d", size, len(content))
+	}
+
+	shards := make([][]byte, len(bufs))
+	for i, b := range bufs {
+		shards[i] = b.Bytes()
+	}
+
+	return shards
+}
+
+func join(c *Code, readers []io.Reader, size int64) ([]byte, error) {
+	return ioutil.ReadAll(c.Join(readers, size))
+}
+
+func randomContent(n int) []byte {
+	content := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(content)
+
+	return content
+}
+
+// failingReader returns an error after n bytes
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+
+	n, err := f.r.Read(p)
+	f.n -= n
+
+	return n, err
+}
+
+func TestNewCode(t *testing.T) {
+	for _, tc := range []struct {
+		data   int
+		parity int
+		valid  bool
+	}{
+		{1, 0, true},
+		{2, 1, true},
+		{10, 4, true},
+		{0, 1, false},
+		{2, -1, false},
+		{200, 57, false},
+	} {
+		_, err := NewCode(tc.data, tc.parity)
+		if (err == nil) != tc.valid {
+			t.Errorf("NewCode(%d, %d): unexpected error %v", tc.data, tc.parity, err)
+		}
+	}
+}
+
+func TestSplitJoin(t *testing.T) {
+	for _, tc := range []struct {
+		data   int
+		parity int
+		size   int
+	}{
+		{2, 1, 0},
+		{2, 1, 1},
+		{2, 1, 1000},
+		{3, 2, 3*BlockSize - 1},
+		{3, 2, 3 * BlockSize},
+		{4, 2, 10*BlockSize + 123},
+	} {
+		c, err := NewCode(tc.data, tc.parity)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content := randomContent(tc.size)
+		shards := split(t, c, content)
+
+		readers := make([]io.Reader, len(shards))
+		for i, s := range shards {
+			readers[i] = bytes.NewReader(s)
+		}
+
+		got, err := join(c, readers, int64(tc.size))
+		if err != nil {
+			t.Fatalf("%d+%d, %d bytes: couldn't join shards: %v", tc.data, tc.parity, tc.size, err)
+		}
+
+		if !bytes.Equal(got, content) {
+			t.Errorf("%d+%d, %d bytes: joined content differs", tc.data, tc.parity, tc.size)
+		}
+	}
+}
+
+func TestJoinMissingShards(t *testing.T) {
+	c, err := NewCode(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := randomContent(5*BlockSize + 77)
+	shards := split(t, c, content)
+
+	// every combination of at most two missing shards
+	for a := -1; a < c.Shards(); a++ {
+		for b := a + 1; b < c.Shards(); b++ {
+			readers := make([]io.Reader, len(shards))
+
+			for i, s := range shards {
+				if i != a && i != b {
+					readers[i] = bytes.NewReader(s)
+				}
+			}
+
+			got, err := join(c, readers, int64(len(content)))
+			if err != nil {
+				t.Fatalf("shards %d and %d missing: couldn't join shards: %v", a, b, err)
+			}
+
+			if !bytes.Equal(got, content) {
+				t.Errorf("shards %d and %d missing: joined content differs", a, b)
+			}
+		}
+	}
+
+	readers := []io.Reader{bytes.NewReader(shards[0]), nil, nil, nil, bytes.NewReader(shards[4])}
+	if _, err := join(c, readers, int64(len(content))); err == nil {
+		t.Errorf("content is joined from 2 of 3 needed shards")
+	}
+}
+
+func TestJoinFailingShard(t *testing.T) {
+	c, err := NewCode(2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := randomContent(6*BlockSize + 5)
+	shards := split(t, c, content)
+
+	// data shards fail in the middle of different stripes, both parity shards replace them
+	readers := []io.Reader{
+		&failingReader{r: bytes.NewReader(shards[0]), n: BlockSize + 10},
+		&failingReader{r: bytes.NewReader(shards[1]), n: 2 * BlockSize},
+		bytes.NewReader(shards[2]),
+		bytes.NewReader(shards[3]),
+	}
+
+	got, err := join(c, readers, int64(len(content)))
+	if err != nil {
+		t.Fatalf("couldn't join shards: %v", err)
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Errorf("joined content differs")
+	}
+
+	readers = []io.Reader{
+		&failingReader{r: bytes.NewReader(shards[0]), n: BlockSize},
+		bytes.NewReader(shards[1]),
+		&failingReader{r: bytes.NewReader(shards[2]), n: 0},
+		nil,
+	}
+
+	if _, err := join(c, readers, int64(len(content))); err == nil {
+		t.Errorf("content is joined without enough shards")
+	}
+}
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+
+	return n, err
+}
+
+func TestJoinReadsDataShards(t *testing.T) {
+	c, err := NewCode(2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := randomContent(4*BlockSize + 5)
+	shards := split(t, c, content)
+
+	counters := make([]*countingReader, len(shards))
+	readers := make([]io.Reader, len(shards))
+
+	for i, s := range shards {
+		counters[i] = &countingReader{r: bytes.NewReader(s)}
+		readers[i] = counters[i]
+	}
+
+	got, err := join(c, readers, int64(len(content)))
+	if err != nil {
+		t.Fatalf("couldn't join shards: %v", err)
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Errorf("joined content differs")
+	}
+
+	for i := c.Data; i < c.Shards(); i++ {
+		if counters[i].n > 0 {
+			t.Errorf("parity shard %d is read while data shards are available", i)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package erasure
+
+import "fmt"
+
+// arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1
+var (
+	expTable [510]byte
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		logTable[x] = byte(i)
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+
+	for i := 255; i < len(expTable); i++ {
+		expTable[i] = expTable[i-255]
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+
+	if a == 0 {
+		return 0
+	}
+
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// mulAdd adds c*in to out
+func mulAdd(c byte, in []byte, out []byte) {
+	t := &mulTable[c]
+
+	for i, b := range in {
+		out[i] ^= t[b]
+	}
+}
+
+func mulMatrix(a [][]byte, b [][]byte) [][]byte {
+	out := make([][]byte, len(a))
+
+	for r := range a {
+		out[r] = make([]byte, len(b[0]))
+
+		for c := range out[r] {
+			var v byte
+
+			for i := range b {
+				v ^= mulTable[a[r][i]][b[i][c]]
+			}
+
+			out[r][c] = v
+		}
+	}
+
+	return out
+}
+
+// invert returns the inverse of the square matrix m with Gauss-Jordan elimination
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+
+	// m augmented with the identity
+	work := make([][]byte, n)
+	for r := range work {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+
+		if pivot == n {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+
+		work[c], work[pivot] = work[pivot], work[c]
+
+		if v := work[c][c]; v != 1 {
+			inv := gfInv(v)
+
+			for i := range work[c] {
+				work[c][i] = mulTable[inv][work[c][i]]
+			}
+		}
+
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+
+			mulAdd(work[r][c], work[c], work[r])
+		}
+	}
+
+	inv := make([][]byte, n)
+	for r := range inv {
+		inv[r] = work[r][n:]
+	}
+
+	return inv, nil
+}
@@ -2,8 +2,9 @@ package fs
 
 import (
 	"io"
-	"os"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/paddlesteamer/cloudstash/internal/common"
 	"github.com/paddlesteamer/cloudstash/internal/manager"
@@ -14,18 +15,30 @@ import (
 )
 
 type CloudStashFs struct {
-	manager *manager.Manager
+	manager  *manager.Manager
+	versions *versionTable
+	readOnly bool
 
 	fuse.DefaultFileSystem
 }
 
 func NewCloudStashFs(m *manager.Manager) *CloudStashFs {
-	return &CloudStashFs{manager: m}
+	return &CloudStashFs{manager: m, versions: newVersionTable()}
+}
+
+// NewReadOnlyCloudStashFs returns a filesystem which doesn't allow
+// any changes, i.e. to mount a snapshot
+func NewReadOnlyCloudStashFs(m *manager.Manager) *CloudStashFs {
+	return &CloudStashFs{manager: m, versions: newVersionTable(), readOnly: true}
 }
 
 func (fs *CloudStashFs) GetAttr(ino int64, info *fuse.FileInfo) (*fuse.InoAttr, fuse.Status) {
 	log.Debugf("getattr ino: %d", ino)
 
+	if isVirtual(ino) {
+		return fs.getVersionAttr(ino)
+	}
+
 	md, err := fs.manager.GetMetadata(ino)
 	if err != nil {
 		if err == common.ErrNotFound {
@@ -40,12 +53,10 @@ func (fs *CloudStashFs) GetAttr(ino int64, info *fuse.FileInfo) (*fuse.InoAttr,
 }
 
 func (fs *CloudStashFs) SetAttr(ino int64, attr *fuse.InoAttr, mask fuse.SetAttrMask, fi *fuse.FileInfo) (*fuse.InoAttr, fuse.Status) {
-	log.Debugf("setattr ino: %d", ino)
-
-	if mask&fuse.SET_ATTR_MODE == 0 {
-		log.Warning("only mode change is supported")
+	log.Debugf("setattr ino: %d mask: %#x", ino, mask)
 
-		return nil, fuse.ENOSYS
+	if fs.readOnly || isVirtual(ino) {
+		return nil, fuse.EROFS
 	}
 
 	md, err := fs.manager.GetMetadata(ino)
@@ -58,12 +69,55 @@ func (fs *CloudStashFs) SetAttr(ino int64, attr *fuse.InoAttr, mask fuse.SetAttr
 		return nil, fuse.EIO
 	}
 
-	md.Mode = attr.Mode
+	if mask&fuse.SET_ATTR_SIZE != 0 {
+		if md.Type == common.DrvFolder {
+			return nil, fuse.EISDIR
+		}
 
-	err = fs.manager.UpdateMetadata(md)
-	if err != nil {
-		log.Errorf("couldn't set attr of inode %d: %v", ino, md.Inode)
-		return nil, fuse.EIO
+		if err := fs.manager.Truncate(md, attr.Size); err != nil {
+			log.Errorf("couldn't truncate file of inode %d: %v", ino, err)
+			return nil, fuse.EIO
+		}
+
+		// size and hash are updated
+		md, err = fs.manager.GetMetadata(ino)
+		if err != nil {
+			log.Errorf("couldn't get metadata of inode %d: %v", ino, err)
+			return nil, fuse.EIO
+		}
+	}
+
+	if mask&fuse.SET_ATTR_MODE != 0 {
+		md.Mode = attr.Mode & 07777
+	}
+
+	if mask&fuse.SET_ATTR_UID != 0 && attr.UID != nil {
+		md.UID = *attr.UID
+	}
+
+	if mask&fuse.SET_ATTR_GID != 0 && attr.GID != nil {
+		md.GID = *attr.GID
+	}
+
+	now := time.Now()
+
+	if mask&fuse.SET_ATTR_ATIME_NOW != 0 {
+		md.ATime = now
+	} else if mask&fuse.SET_ATTR_ATIME != 0 {
+		md.ATime = attr.ATime
+	}
+
+	if mask&fuse.SET_ATTR_MTIME_NOW != 0 {
+		md.MTime = now
+	} else if mask&fuse.SET_ATTR_MTIME != 0 {
+		md.MTime = attr.MTime
+	}
+
+	if mask&^fuse.SET_ATTR_SIZE != 0 {
+		if err := fs.manager.UpdateMetadata(md); err != nil {
+			log.Errorf("couldn't set attr of inode %d: %v", ino, err)
+			return nil, fuse.EIO
+		}
 	}
 
 	return newInode(md), fuse.OK
@@ -72,6 +126,24 @@ func (fs *CloudStashFs) SetAttr(ino int64, attr *fuse.InoAttr, mask fuse.SetAttr
 func (fs *CloudStashFs) Lookup(parent int64, name string) (*fuse.Entry, fuse.Status) {
 	log.Debugf("lookup parent: %d, name: %s", parent, name)
 
+	if isVirtual(parent) {
+		return fs.lookupVersion(parent, name)
+	}
+
+	if parent == rootInode && name == versionsDirName {
+		attr, status := fs.getVersionAttr(rootInode | versionDirBit)
+		if status != fuse.OK {
+			return nil, status
+		}
+
+		return &fuse.Entry{
+			Ino:          attr.Ino,
+			Attr:         attr,
+			AttrTimeout:  1.0,
+			EntryTimeout: 1.0,
+		}, fuse.OK
+	}
+
 	parentmd, err := fs.manager.GetMetadata(parent)
 	if err != nil {
 		if err == common.ErrNotFound {
@@ -108,6 +180,10 @@ func (fs *CloudStashFs) Lookup(parent int64, name string) (*fuse.Entry, fuse.Sta
 func (fs *CloudStashFs) ReadDir(ino int64, fi *fuse.FileInfo, off int64, size int, w fuse.DirEntryWriter) fuse.Status {
 	log.Debugf("readdir ino %d", ino)
 
+	if isVirtual(ino) {
+		return fs.readVersionDir(ino, off, w)
+	}
+
 	dirmd, err := fs.manager.GetMetadata(ino)
 	if err != nil {
 		if err == common.ErrNotFound {
@@ -124,14 +200,14 @@ func (fs *CloudStashFs) ReadDir(ino int64, fi *fuse.FileInfo, off int64, size in
 
 	var next int64 = 1
 	if off < 1 {
-		w.Add(".", dirmd.Inode, dirmd.Mode, next)
+		w.Add(".", dirmd.Inode, dirmd.Type|dirmd.Mode, next)
 	}
 	next++
 
 	if off < 2 {
 		// special case: root dir
 		if dirmd.Inode == 1 {
-			w.Add("..", dirmd.Inode, dirmd.Mode, next)
+			w.Add("..", dirmd.Inode, dirmd.Type|dirmd.Mode, next)
 		} else {
 			md, err := fs.manager.GetMetadata(dirmd.Parent)
 			if err != nil {
@@ -140,7 +216,7 @@ func (fs *CloudStashFs) ReadDir(ino int64, fi *fuse.FileInfo, off int64, size in
 				return fuse.EIO
 			}
 
-			w.Add("..", md.Inode, md.Mode, next)
+			w.Add("..", md.Inode, md.Type|md.Mode, next)
 		}
 	}
 	next++
@@ -163,7 +239,7 @@ func (fs *CloudStashFs) ReadDir(ino int64, fi *fuse.FileInfo, off int64, size in
 			continue
 		}
 
-		w.Add(md.Name, md.Inode, md.Mode, next+int64(i))
+		w.Add(md.Name, md.Inode, md.Type|md.Mode, next+int64(i))
 	}
 
 	return fuse.OK
@@ -172,6 +248,10 @@ func (fs *CloudStashFs) ReadDir(ino int64, fi *fuse.FileInfo, off int64, size in
 func (fs *CloudStashFs) Rmdir(parent int64, name string) fuse.Status {
 	log.Debugf("rmdir ino: %d name: %s", parent, name)
 
+	if fs.isReadOnly(parent, name) {
+		return fuse.EROFS
+	}
+
 	parentmd, err := fs.manager.GetMetadata(parent)
 	if err != nil {
 		if err == common.ErrNotFound {
@@ -211,6 +291,10 @@ func (fs *CloudStashFs) Rmdir(parent int64, name string) fuse.Status {
 func (fs *CloudStashFs) Create(parent int64, name string, mode int, fi *fuse.FileInfo) (*fuse.Entry, fuse.Status) {
 	log.Debugf("create parent: %d name: %s, mode: %#o", parent, name, mode)
 
+	if fs.isReadOnly(parent, name) {
+		return nil, fuse.EROFS
+	}
+
 	if !isValidName(name) {
 		return nil, fuse.EPERM
 	}
@@ -221,6 +305,14 @@ func (fs *CloudStashFs) Create(parent int64, name string, mode int, fi *fuse.Fil
 		return nil, fuse.EIO
 	}
 
+	fh, err := fs.manager.OpenHandle(md, openFlags(fi.Flags))
+	if err != nil {
+		log.Errorf("couldn't open created file: %v", err)
+		return nil, fuse.EIO
+	}
+
+	fi.Handle = fh
+
 	return &fuse.Entry{
 		Ino:          md.Inode,
 		Attr:         newInode(md),
@@ -232,6 +324,10 @@ func (fs *CloudStashFs) Create(parent int64, name string, mode int, fi *fuse.Fil
 func (fs *CloudStashFs) Open(ino int64, fi *fuse.FileInfo) fuse.Status {
 	log.Debugf("open ino: %d", ino)
 
+	if isVirtual(ino) {
+		return fs.openVersion(ino, fi)
+	}
+
 	md, err := fs.manager.GetMetadata(ino)
 	if err != nil {
 		if err == common.ErrNotFound {
@@ -246,12 +342,33 @@ func (fs *CloudStashFs) Open(ino int64, fi *fuse.FileInfo) fuse.Status {
 		return fuse.EISDIR
 	}
 
+	if fs.readOnly && openFlags(fi.Flags) != syscall.O_RDONLY {
+		return fuse.EROFS
+	}
+
+	fh, err := fs.manager.OpenHandle(md, openFlags(fi.Flags))
+	if err != nil {
+		log.Errorf("couldn't open file of inode %d: %v", ino, err)
+		return fuse.EIO
+	}
+
+	fi.Handle = fh
+
 	return fuse.OK
 }
 
 func (fs *CloudStashFs) OpenDir(ino int64, fi *fuse.FileInfo) fuse.Status {
 	log.Debugf("open dir ino: %d", ino)
 
+	if isVirtual(ino) {
+		if ino&versionDirBit == 0 {
+			return fuse.ENOTDIR
+		}
+
+		_, status := fs.getVersionAttr(ino)
+		return status
+	}
+
 	md, err := fs.manager.GetMetadata(ino)
 	if err != nil {
 		if err == common.ErrNotFound {
@@ -272,33 +389,9 @@ func (fs *CloudStashFs) OpenDir(ino int64, fi *fuse.FileInfo) fuse.Status {
 func (fs *CloudStashFs) Write(p []byte, ino int64, off int64, fi *fuse.FileInfo) (int, fuse.Status) {
 	log.Debugf("write ino: %d len: %d off: %d", ino, len(p), off)
 
-	md, err := fs.manager.GetMetadata(ino)
-	if err != nil {
-		if err == common.ErrNotFound {
-			return 0, fuse.ENOENT
-		}
-
-		log.Errorf("couldn't get metadata of inode %d: %v", ino, err)
-		return 0, fuse.EIO
-	}
-
-	writer, err := fs.manager.OpenFile(md, os.O_WRONLY)
+	n, err := fs.manager.WriteHandle(fi.Handle, p, off)
 	if err != nil {
-		log.Errorf("couldn't get writer: %v", err)
-
-		return 0, fuse.EIO
-	}
-	defer writer.Close()
-
-	_, err = writer.Seek(off, 0)
-	if err != nil {
-		log.Errorf("couldn't seek to provided offset %d: %v", off, err)
-		return 0, fuse.EIO
-	}
-
-	n, err := writer.Write(p)
-	if err != nil {
-		log.Errorf("couldn't write to file: %v", err)
+		log.Errorf("couldn't write to file of inode %d: %v", ino, err)
 		return n, fuse.EIO
 	}
 
@@ -308,7 +401,7 @@ func (fs *CloudStashFs) Write(p []byte, ino int64, off int64, fi *fuse.FileInfo)
 func (fs *CloudStashFs) Flush(ino int64, fi *fuse.FileInfo) fuse.Status {
 	log.Debugf("flush ino: %d", ino)
 
-	if err := fs.manager.UpdateMetadataFromCache(ino); err != nil {
+	if err := fs.manager.FlushHandle(fi.Handle); err != nil {
 		log.Errorf("flush called on file but couldn't update metadata in db: %v", err)
 		return fuse.EIO
 	}
@@ -319,52 +412,25 @@ func (fs *CloudStashFs) Flush(ino int64, fi *fuse.FileInfo) fuse.Status {
 func (fs *CloudStashFs) Read(ino int64, size int64, off int64, fi *fuse.FileInfo) ([]byte, fuse.Status) {
 	log.Debugf("read ino: %d size: %d off: %d", ino, size, off)
 
-	md, err := fs.manager.GetMetadata(ino)
-	if err != nil {
-		if err == common.ErrNotFound {
-			return nil, fuse.ENOENT
-		}
-
-		log.Errorf("couldn't get metadata of inode %d: %v", ino, err)
-		return nil, fuse.EIO
-	}
-
-	reader, err := fs.manager.OpenFile(md, os.O_RDONLY)
-	if err != nil {
-		log.Errorf("couldn't get reader: %v", err)
-		return nil, fuse.EIO
-	}
-	defer reader.Close()
-
-	if off+size > md.Size {
-		size = md.Size - off
-	}
-
-	_, err = reader.Seek(off, 0)
-	if err != nil {
-		log.Errorf("couldn't seek to provided offset %d: %v", off, err)
-		return nil, fuse.EIO
-	}
-
 	data := make([]byte, size)
 
-	n, err := reader.Read(data)
+	// short read is only expected at the end of file
+	n, err := fs.manager.ReadHandle(fi.Handle, data, off)
 	if err != nil && err != io.EOF {
-		log.Errorf("couldn't read from reader: %v", err)
+		log.Errorf("couldn't read from file of inode %d: %v", ino, err)
 		return nil, fuse.EIO
 	}
 
-	if int64(n) != size {
-		log.Errorf("couldn't read full. expected %d, read %d", size, n)
-		return nil, fuse.EIO
-	}
-
-	return data, fuse.OK
+	return data[:n], fuse.OK
 }
 
 func (fs *CloudStashFs) Mkdir(parent int64, name string, mode int) (*fuse.Entry, fuse.Status) {
 	log.Debugf("mkdir parent: %d name: %s", parent, name)
 
+	if fs.isReadOnly(parent, name) {
+		return nil, fuse.EROFS
+	}
+
 	if !isValidName(name) {
 		return nil, fuse.EPERM
 	}
@@ -386,6 +452,10 @@ func (fs *CloudStashFs) Mkdir(parent int64, name string, mode int) (*fuse.Entry,
 func (fs *CloudStashFs) Unlink(parent int64, name string) fuse.Status {
 	log.Debugf("unlink parent: %d name: %s", parent, name)
 
+	if fs.isReadOnly(parent, name) {
+		return fuse.EROFS
+	}
+
 	parentmd, err := fs.manager.GetMetadata(parent)
 	if err != nil {
 		if err == common.ErrNotFound {
@@ -422,6 +492,10 @@ func (fs *CloudStashFs) Unlink(parent int64, name string) fuse.Status {
 func (fs *CloudStashFs) Rename(oparent int64, oname string, tparent int64, tname string) fuse.Status {
 	log.Debugf("rename p: %d name: %s", oparent, oname)
 
+	if fs.isReadOnly(oparent, oname) || fs.isReadOnly(tparent, tname) {
+		return fuse.EROFS
+	}
+
 	if !isValidName(tname) {
 		return fuse.EPERM
 	}
@@ -450,20 +524,22 @@ func (fs *CloudStashFs) Rename(oparent int64, oname string, tparent int64, tname
 		return fuse.ENOTDIR
 	}
 
-	md, err := fs.manager.Lookup(oparent, oname)
-	if err != nil {
-		if err == common.ErrNotFound {
+	if err := fs.manager.Rename(oparent, oname, tparent, tname); err != nil {
+		switch err {
+		case common.ErrNotFound:
 			return fuse.ENOENT
+		case common.ErrExists:
+			return fuse.EEXIST
+		case common.ErrIsDir:
+			return fuse.EISDIR
+		case common.ErrNotDir:
+			return fuse.ENOTDIR
+		case common.ErrDirNotEmpty:
+			return fuse.ENOTEMPTY
+		case common.ErrSubdirectory:
+			return fuse.EINVAL
 		}
 
-		log.Errorf("couldn't lookup for '%s' under %d: %v", oname, oparent, err)
-		return fuse.EIO
-	}
-
-	md.Parent = tparent
-	md.Name = tname
-
-	if err := fs.manager.UpdateMetadata(md); err != nil {
 		log.Errorf("couldn't rename file %s under inode %d: %v", oname, oparent, err)
 		return fuse.EIO
 	}
@@ -482,6 +558,11 @@ func (fs *CloudStashFs) StatFS(ino int64) (*fuse.StatVFS, fuse.Status) {
 func (fs *CloudStashFs) Release(ino int64, fi *fuse.FileInfo) fuse.Status {
 	log.Debugf("release ino: %d", ino)
 
+	if err := fs.manager.ReleaseHandle(fi.Handle); err != nil {
+		log.Errorf("couldn't release file of inode %d: %v", ino, err)
+		return fuse.EIO
+	}
+
 	return fuse.OK
 }
 
@@ -492,9 +573,64 @@ func (fs *CloudStashFs) ReleaseDir(ino int64, fi *fuse.FileInfo) fuse.Status {
 }
 
 func (fs *CloudStashFs) Link(ino int64, newparent int64, name string) (*fuse.Entry, fuse.Status) {
-	log.Debugf("link ino: %d", ino)
+	log.Debugf("link ino: %d parent: %d name: %s", ino, newparent, name)
 
-	return nil, fuse.EPERM
+	if isVirtual(ino) || fs.isReadOnly(newparent, name) {
+		return nil, fuse.EROFS
+	}
+
+	if !isValidName(name) {
+		return nil, fuse.EPERM
+	}
+
+	md, err := fs.manager.GetMetadata(ino)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return nil, fuse.ENOENT
+		}
+
+		log.Errorf("couldn't get metadata of inode %d: %v", ino, err)
+		return nil, fuse.EIO
+	}
+
+	// hard links to directories aren't allowed
+	if md.Type == common.DrvFolder {
+		return nil, fuse.EPERM
+	}
+
+	parentmd, err := fs.manager.GetMetadata(newparent)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return nil, fuse.ENOENT
+		}
+
+		log.Errorf("couldn't get parent metadata: %v", err)
+		return nil, fuse.EIO
+	}
+
+	if parentmd.Type != common.DrvFolder {
+		return nil, fuse.ENOTDIR
+	}
+
+	if _, err := fs.manager.Lookup(newparent, name); err == nil {
+		return nil, fuse.EEXIST
+	} else if err != common.ErrNotFound {
+		log.Errorf("couldn't lookup for '%s' under %d: %v", name, newparent, err)
+		return nil, fuse.EIO
+	}
+
+	md, err = fs.manager.Link(ino, newparent, name)
+	if err != nil {
+		log.Errorf("couldn't link inode %d: %v", ino, err)
+		return nil, fuse.EIO
+	}
+
+	return &fuse.Entry{
+		Ino:          md.Inode,
+		Attr:         newInode(md),
+		AttrTimeout:  1.0,
+		EntryTimeout: 1.0,
+	}, fuse.OK
 }
 
 func (fs *CloudStashFs) Mknod(p int64, name string, mode int, rdev int) (*fuse.Entry, fuse.Status) {
@@ -506,13 +642,64 @@ func (fs *CloudStashFs) Mknod(p int64, name string, mode int, rdev int) (*fuse.E
 func (fs *CloudStashFs) ReadLink(ino int64) (string, fuse.Status) {
 	log.Debugf("readlink ino: %d", ino)
 
-	return "", fuse.EPERM
+	if isVirtual(ino) {
+		return "", fuse.EINVAL
+	}
+
+	md, err := fs.manager.GetMetadata(ino)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return "", fuse.ENOENT
+		}
+
+		log.Errorf("couldn't get metadata of inode %d: %v", ino, err)
+		return "", fuse.EIO
+	}
+
+	if md.Type != common.DrvSymlink {
+		return "", fuse.EINVAL
+	}
+
+	return md.Target, fuse.OK
 }
 
 func (fs *CloudStashFs) Symlink(link string, p int64, name string) (*fuse.Entry, fuse.Status) {
-	log.Debugf("symlink name: %s", name)
+	log.Debugf("symlink parent: %d name: %s link: %s", p, name, link)
 
-	return nil, fuse.EPERM
+	if fs.isReadOnly(p, name) {
+		return nil, fuse.EROFS
+	}
+
+	if !isValidName(name) {
+		return nil, fuse.EPERM
+	}
+
+	parentmd, err := fs.manager.GetMetadata(p)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return nil, fuse.ENOENT
+		}
+
+		log.Errorf("couldn't get parent metadata: %v", err)
+		return nil, fuse.EIO
+	}
+
+	if parentmd.Type != common.DrvFolder {
+		return nil, fuse.ENOTDIR
+	}
+
+	md, err := fs.manager.CreateSymlink(p, name, link)
+	if err != nil {
+		log.Errorf("couldn't create symlink: %v", err)
+		return nil, fuse.EIO
+	}
+
+	return &fuse.Entry{
+		Ino:          md.Inode,
+		Attr:         newInode(md),
+		AttrTimeout:  1.0,
+		EntryTimeout: 1.0,
+	}, fuse.OK
 }
 
 func (fs *CloudStashFs) Access(ino int64, mode int) fuse.Status {
@@ -544,43 +731,139 @@ func (fs *CloudStashFs) Forget(ino int64, n int) {
 func (fs *CloudStashFs) GetXAttr(ino int64, name string, out []byte) (int, fuse.Status) {
 	log.Debugf("getxattr ino: %d, name: %s", ino, name)
 
-	return 0, fuse.ENOSYS
+	if isVirtual(ino) {
+		return 0, fuse.ENODATA
+	}
+
+	value, err := fs.manager.GetXAttr(ino, name)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return 0, fuse.ENODATA
+		}
+
+		log.Errorf("couldn't get extended attribute '%s' of inode %d: %v", name, ino, err)
+		return 0, fuse.EIO
+	}
+
+	if len(out) < len(value) {
+		return 0, fuse.ERANGE
+	}
+
+	return copy(out, value), fuse.OK
 }
 
 func (fs *CloudStashFs) GetXAttrSize(ino int64, name string) (int, fuse.Status) {
 	log.Debugf("getxattrsize ino: %d, name: %s", ino, name)
 
-	return 0, fuse.ENOSYS
+	if isVirtual(ino) {
+		return 0, fuse.ENODATA
+	}
+
+	value, err := fs.manager.GetXAttr(ino, name)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return 0, fuse.ENODATA
+		}
+
+		log.Errorf("couldn't get extended attribute '%s' of inode %d: %v", name, ino, err)
+		return 0, fuse.EIO
+	}
+
+	return len(value), fuse.OK
 }
 
 func (fs *CloudStashFs) ListXAttrs(ino int64) ([]string, fuse.Status) {
 	log.Debugf("listxattrs ino: %d", ino)
 
-	return nil, fuse.ENOSYS
+	if isVirtual(ino) {
+		return nil, fuse.OK
+	}
+
+	names, err := fs.manager.ListXAttrs(ino)
+	if err != nil {
+		log.Errorf("couldn't list extended attributes of inode %d: %v", ino, err)
+		return nil, fuse.EIO
+	}
+
+	return names, fuse.OK
 }
 
 func (fs *CloudStashFs) RemoveXAttr(ino int64, name string) fuse.Status {
 	log.Debugf("removexattr ino: %d, name: %s", ino, name)
 
-	return fuse.ENOSYS
+	if fs.readOnly || isVirtual(ino) {
+		return fuse.EROFS
+	}
+
+	if err := fs.manager.RemoveXAttr(ino, name); err != nil {
+		if err == common.ErrNotFound {
+			return fuse.ENODATA
+		}
+
+		log.Errorf("couldn't remove extended attribute '%s' of inode %d: %v", name, ino, err)
+		return fuse.EIO
+	}
+
+	return fuse.OK
 }
 
 func (fs *CloudStashFs) SetXAttr(ino int64, name string, value []byte, flags int) fuse.Status {
 	log.Debugf("setxattr ino: %d, name: %s", ino, name)
 
-	return fuse.ENOSYS
+	if fs.readOnly || isVirtual(ino) {
+		return fuse.EROFS
+	}
+
+	// value points to the buffer of fuse, it shouldn't be kept
+	err := fs.manager.SetXAttr(ino, name, append([]byte{}, value...), flags)
+	if err != nil {
+		switch err {
+		case common.ErrExists:
+			return fuse.EEXIST
+		case common.ErrNotFound:
+			return fuse.ENODATA
+		}
+
+		log.Errorf("couldn't set extended attribute '%s' of inode %d: %v", name, ino, err)
+		return fuse.EIO
+	}
+
+	return fuse.OK
 }
 
 func newInode(md *sqlite.Metadata) *fuse.InoAttr {
 	inode := &fuse.InoAttr{
 		Ino:     md.Inode,
 		NLink:   md.NLink,
+		ATime:   md.ATime,
+		MTime:   md.MTime,
+		CTime:   md.CTime,
 		Timeout: 1.0,
 	}
 
-	if md.Type == common.DrvFolder {
+	// access time isn't updated on reads
+	if inode.ATime.Before(md.MTime) {
+		inode.ATime = md.MTime
+	}
+
+	// otherwise the owner of the mount is used
+	if md.UID >= 0 {
+		uid := md.UID
+		inode.UID = &uid
+	}
+
+	if md.GID >= 0 {
+		gid := md.GID
+		inode.GID = &gid
+	}
+
+	switch md.Type {
+	case common.DrvFolder:
 		inode.Mode = fuse.S_IFDIR | md.Mode
-	} else {
+	case common.DrvSymlink:
+		inode.Mode = fuse.S_IFLNK | md.Mode
+		inode.Size = int64(len(md.Target))
+	default:
 		inode.Mode = fuse.S_IFREG | md.Mode
 		inode.Size = md.Size
 	}
@@ -588,6 +871,12 @@ func newInode(md *sqlite.Metadata) *fuse.InoAttr {
 	return inode
 }
 
+// openFlags returns the flags to open cached file with. Only the access
+// mode is kept, since the kernel handles appends and truncation itself.
+func openFlags(flags int) int {
+	return flags & syscall.O_ACCMODE
+}
+
 // isValidName returns if provided name is allowed in filesystem.
 // '/' character in name is not allowed.
 // '.' and '..' as name also is not allowed.
@@ -0,0 +1,146 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/crypto"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/manager"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+)
+
+const testRootInode = 1
+
+// memDrive is a drive which keeps the files in memory
+type memDrive struct {
+	files map[string][]byte
+	mu    sync.Mutex
+}
+
+func (d *memDrive) GetID() string {
+	return "mem"
+}
+
+func (d *memDrive) GetProviderName() string {
+	return "mem"
+}
+
+func (d *memDrive) GetFile(name string) (io.ReadCloser, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, ok := d.files[name]
+	if !ok {
+		return nil, common.ErrNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (d *memDrive) PutFile(name string, content io.Reader) error {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.files[name] = data
+
+	return nil
+}
+
+func (d *memDrive) GetFileMetadata(name string) (*drive.Metadata, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, ok := d.files[name]
+	if !ok {
+		return nil, common.ErrNotFound
+	}
+
+	return &drive.Metadata{Name: name, Size: uint64(len(data)), Hash: fmt.Sprintf("%x", md5.Sum(data))}, nil
+}
+
+func (d *memDrive) DeleteFile(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.files, name)
+
+	return nil
+}
+
+func (d *memDrive) MoveFile(name string, newName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.files[newName] = d.files[name]
+	delete(d.files, name)
+
+	return nil
+}
+
+func (d *memDrive) Lock() error {
+	return nil
+}
+
+func (d *memDrive) Unlock() error {
+	return nil
+}
+
+func (d *memDrive) ComputeHash(r io.Reader, hchan chan string, echan chan error) {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		echan <- err
+		return
+	}
+
+	hchan <- fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func (d *memDrive) GetAvailableSpace() (int64, error) {
+	return 1 << 30, nil
+}
+
+// newTestFs returns a filesystem of a new vault on an in-memory drive
+func newTestFs(t *testing.T) *CloudStashFs {
+	dir, err := ioutil.TempDir("", "cloudstash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	drv := &memDrive{files: map[string][]byte{}}
+	cipher := crypto.NewCipher(strings.Repeat("ab", 32))
+
+	m, err := manager.NewManager([]drive.Drive{drv}, nil, cipher, dir, manager.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(m.Clean)
+
+	return NewCloudStashFs(m)
+}
+
+// createTestFile creates an empty file in the root directory
+func createTestFile(t *testing.T, fs *CloudStashFs, name string) *sqlite.Metadata {
+	md, err := fs.manager.CreateFile(testRootInode, name, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return md
+}
@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/go-fuse-c/fuse"
+)
+
+func TestRenameReplacesTarget(t *testing.T) {
+	fs := newTestFs(t)
+
+	src := createTestFile(t, fs, "src")
+	createTestFile(t, fs, "dst")
+
+	if st := fs.Rename(testRootInode, "src", testRootInode, "dst"); st != fuse.OK {
+		t.Fatalf("rename over a file returned %v", st)
+	}
+
+	md, err := fs.manager.Lookup(testRootInode, "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.Inode != src.Inode {
+		t.Errorf("target isn't replaced, it is inode %d", md.Inode)
+	}
+
+	if _, err := fs.manager.Lookup(testRootInode, "src"); err != common.ErrNotFound {
+		t.Errorf("source is still found: %v", err)
+	}
+
+	children, err := fs.manager.GetDirectoryContent(testRootInode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(children) != 1 {
+		t.Errorf("replaced file isn't removed: %+v", children)
+	}
+}
+
+func TestRenameErrors(t *testing.T) {
+	fs := newTestFs(t)
+
+	dir, err := fs.manager.AddDirectory(testRootInode, "dir", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := fs.manager.AddDirectory(dir.Inode, "sub", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.manager.AddDirectory(testRootInode, "empty", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	createTestFile(t, fs, "file")
+
+	for _, c := range []struct {
+		desc      string
+		parent    int64
+		name      string
+		newParent int64
+		newName   string
+		expected  fuse.Status
+	}{
+		{"directory into itself", testRootInode, "dir", dir.Inode, "dir", fuse.EINVAL},
+		{"directory into its subdirectory", testRootInode, "dir", sub.Inode, "dir", fuse.EINVAL},
+		{"file over a directory", testRootInode, "file", testRootInode, "empty", fuse.EISDIR},
+		{"directory over a file", testRootInode, "empty", testRootInode, "file", fuse.ENOTDIR},
+		{"directory over a non-empty one", testRootInode, "empty", testRootInode, "dir", fuse.ENOTEMPTY},
+		{"missing file", testRootInode, "missing", testRootInode, "other", fuse.ENOENT},
+		{"file to itself", testRootInode, "file", testRootInode, "file", fuse.OK},
+	} {
+		if st := fs.Rename(c.parent, c.name, c.newParent, c.newName); st != c.expected {
+			t.Errorf("rename of %s returned %v, expected %v", c.desc, st, c.expected)
+		}
+	}
+
+	// an empty directory can be replaced
+	if st := fs.Rename(dir.Inode, "sub", testRootInode, "empty"); st != fuse.OK {
+		t.Errorf("rename over an empty directory returned %v", st)
+	}
+}
@@ -0,0 +1,321 @@
+package fs
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+	"github.com/paddlesteamer/go-fuse-c/fuse"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// versionsDirName is the read-only directory under the root which mirrors the
+// tree of the filesystem. Each file is a directory in it, which contains the
+// earlier versions of the file named by their IDs.
+const versionsDirName = ".versions"
+
+const (
+	rootInode = 1
+
+	versionDirBit  = 1 << 62 // directory mirroring the inode in lower bits
+	versionFileBit = 1 << 61 // version allocated in versionTable
+)
+
+type versionKey struct {
+	inode int64
+	id    string
+}
+
+// versionTable assigns inode numbers to the versions shown in the filesystem
+type versionTable struct {
+	inodes map[int64]versionKey
+	keys   map[versionKey]int64
+	next   int64
+	mu     sync.Mutex
+}
+
+func newVersionTable() *versionTable {
+	return &versionTable{
+		inodes: map[int64]versionKey{},
+		keys:   map[versionKey]int64{},
+	}
+}
+
+func (t *versionTable) inode(k versionKey) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ino, ok := t.keys[k]; ok {
+		return ino
+	}
+
+	t.next++
+
+	ino := versionFileBit | t.next
+	t.inodes[ino] = k
+	t.keys[k] = ino
+
+	return ino
+}
+
+func (t *versionTable) get(ino int64) (versionKey, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	k, ok := t.inodes[ino]
+
+	return k, ok
+}
+
+// isVirtual returns whether ino belongs to the versions directory
+func isVirtual(ino int64) bool {
+	return ino&(versionDirBit|versionFileBit) != 0
+}
+
+// isReadOnly returns whether the entry 'name' under parent
+// can't be created, removed or renamed
+func (fs *CloudStashFs) isReadOnly(parent int64, name string) bool {
+	return fs.readOnly || isVirtual(parent) || (parent == rootInode && name == versionsDirName)
+}
+
+// getVersionAttr returns attributes of the virtual inode ino
+func (fs *CloudStashFs) getVersionAttr(ino int64) (*fuse.InoAttr, fuse.Status) {
+	if ino&versionDirBit != 0 {
+		md, err := fs.manager.GetMetadata(ino &^ versionDirBit)
+		if err != nil {
+			if err == common.ErrNotFound {
+				return nil, fuse.ENOENT
+			}
+
+			log.Errorf("couldn't get metadata of inode %d: %v", ino&^versionDirBit, err)
+			return nil, fuse.EIO
+		}
+
+		return newVersionDirInode(ino, md), fuse.OK
+	}
+
+	k, ok := fs.versions.get(ino)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	md, err := fs.manager.GetMetadata(k.inode)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return nil, fuse.ENOENT
+		}
+
+		log.Errorf("couldn't get metadata of inode %d: %v", k.inode, err)
+		return nil, fuse.EIO
+	}
+
+	v, err := fs.manager.GetVersion(k.inode, k.id)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return nil, fuse.ENOENT
+		}
+
+		log.Errorf("couldn't get version %s of inode %d: %v", k.id, k.inode, err)
+		return nil, fuse.EIO
+	}
+
+	return newVersionInode(ino, md, v), fuse.OK
+}
+
+// lookupVersion looks for name in the virtual directory parent
+func (fs *CloudStashFs) lookupVersion(parent int64, name string) (*fuse.Entry, fuse.Status) {
+	if parent&versionDirBit == 0 {
+		return nil, fuse.ENOTDIR
+	}
+
+	target := parent &^ versionDirBit
+
+	parentmd, err := fs.manager.GetMetadata(target)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return nil, fuse.ENOENT
+		}
+
+		log.Errorf("couldn't get parent metadata: %v", err)
+		return nil, fuse.EIO
+	}
+
+	var ino int64
+
+	switch parentmd.Type {
+	case common.DrvFolder:
+		md, err := fs.manager.Lookup(target, name)
+		if err != nil {
+			if err == common.ErrNotFound {
+				return nil, fuse.ENOENT
+			}
+
+			log.Errorf("couldn't lookup for '%s' under %d: %v", name, target, err)
+			return nil, fuse.EIO
+		}
+
+		if md.Type == common.DrvSymlink {
+			return nil, fuse.ENOENT
+		}
+
+		ino = md.Inode | versionDirBit
+	case common.DrvFile:
+		if _, err := fs.manager.GetVersion(target, name); err != nil {
+			if err == common.ErrNotFound {
+				return nil, fuse.ENOENT
+			}
+
+			log.Errorf("couldn't get version %s of inode %d: %v", name, target, err)
+			return nil, fuse.EIO
+		}
+
+		ino = fs.versions.inode(versionKey{target, name})
+	default:
+		return nil, fuse.ENOENT
+	}
+
+	attr, status := fs.getVersionAttr(ino)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	return &fuse.Entry{
+		Ino:          ino,
+		Attr:         attr,
+		AttrTimeout:  1.0,
+		EntryTimeout: 1.0,
+	}, fuse.OK
+}
+
+// readVersionDir lists the virtual directory ino. Directories and files
+// are listed as directories in it, versions of a file as regular files.
+func (fs *CloudStashFs) readVersionDir(ino int64, off int64, w fuse.DirEntryWriter) fuse.Status {
+	if ino&versionDirBit == 0 {
+		return fuse.ENOTDIR
+	}
+
+	target := ino &^ versionDirBit
+
+	md, err := fs.manager.GetMetadata(target)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return fuse.ENOENT
+		}
+
+		log.Errorf("couldn't get directory metadata: %v", err)
+		return fuse.EIO
+	}
+
+	parent := md.Parent | versionDirBit
+	if target == rootInode {
+		parent = rootInode
+	}
+
+	type entry struct {
+		name string
+		ino  int64
+		mode int
+	}
+
+	entries := []entry{
+		{".", ino, fuse.S_IFDIR | 0555},
+		{"..", parent, fuse.S_IFDIR | 0555},
+	}
+
+	switch md.Type {
+	case common.DrvFolder:
+		mdList, err := fs.manager.GetDirectoryContent(target)
+		if err != nil {
+			log.Errorf("couldn't get directory content: %v", err)
+			return fuse.EIO
+		}
+
+		for _, md := range mdList {
+			if md.Type == common.DrvSymlink {
+				continue
+			}
+
+			entries = append(entries, entry{md.Name, md.Inode | versionDirBit, fuse.S_IFDIR | 0555})
+		}
+	case common.DrvFile:
+		versions, err := fs.manager.ListVersions(target)
+		if err != nil {
+			log.Errorf("couldn't list versions of inode %d: %v", target, err)
+			return fuse.EIO
+		}
+
+		for _, v := range versions {
+			k := versionKey{target, v.ID()}
+			entries = append(entries, entry{k.id, fs.versions.inode(k), fuse.S_IFREG | 0444})
+		}
+	}
+
+	for i, e := range entries {
+		if int64(i) < off {
+			continue
+		}
+
+		if !w.Add(e.name, e.ino, e.mode, int64(i)+1) {
+			break
+		}
+	}
+
+	return fuse.OK
+}
+
+// openVersion opens the version ino for reading
+func (fs *CloudStashFs) openVersion(ino int64, fi *fuse.FileInfo) fuse.Status {
+	if ino&versionDirBit != 0 {
+		return fuse.EISDIR
+	}
+
+	if fi.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return fuse.EROFS
+	}
+
+	k, ok := fs.versions.get(ino)
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	fh, err := fs.manager.OpenVersionHandle(k.inode, k.id)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return fuse.ENOENT
+		}
+
+		log.Errorf("couldn't open version %s of inode %d: %v", k.id, k.inode, err)
+		return fuse.EIO
+	}
+
+	fi.Handle = fh
+
+	return fuse.OK
+}
+
+func newVersionDirInode(ino int64, md *sqlite.Metadata) *fuse.InoAttr {
+	inode := newInode(md)
+
+	inode.Ino = ino
+	inode.Mode = fuse.S_IFDIR | 0555
+	inode.NLink = 2
+	inode.Size = 0
+
+	return inode
+}
+
+func newVersionInode(ino int64, md *sqlite.Metadata, v *sqlite.Version) *fuse.InoAttr {
+	inode := newInode(md)
+
+	inode.Ino = ino
+	inode.Mode = fuse.S_IFREG | (md.Mode & 0444)
+	inode.NLink = 1
+	inode.Size = v.Size
+	inode.ATime = v.Time
+	inode.MTime = v.Time
+	inode.CTime = v.Time
+
+	return inode
+}
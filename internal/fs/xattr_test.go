@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+	"github.com/paddlesteamer/go-fuse-c/fuse"
+)
+
+func TestXAttr(t *testing.T) {
+	fs := newTestFs(t)
+	md := createTestFile(t, fs, "file")
+
+	if _, st := fs.GetXAttr(md.Inode, "user.missing", make([]byte, 16)); st != fuse.ENODATA {
+		t.Errorf("getxattr of missing attribute returned %v", st)
+	}
+
+	if st := fs.SetXAttr(md.Inode, "user.key", []byte("value"), 0); st != fuse.OK {
+		t.Fatalf("setxattr returned %v", st)
+	}
+
+	if n, st := fs.GetXAttrSize(md.Inode, "user.key"); st != fuse.OK || n != 5 {
+		t.Errorf("size of attribute is %d, %v", n, st)
+	}
+
+	// buffer is too small for the value
+	if _, st := fs.GetXAttr(md.Inode, "user.key", make([]byte, 4)); st != fuse.ERANGE {
+		t.Errorf("getxattr with a small buffer returned %v", st)
+	}
+
+	out := make([]byte, 16)
+	if n, st := fs.GetXAttr(md.Inode, "user.key", out); st != fuse.OK || string(out[:n]) != "value" {
+		t.Errorf("getxattr returned %q, %v", out[:n], st)
+	}
+
+	if names, st := fs.ListXAttrs(md.Inode); st != fuse.OK || len(names) != 1 || names[0] != "user.key" {
+		t.Errorf("listxattr returned %v, %v", names, st)
+	}
+
+	if st := fs.RemoveXAttr(md.Inode, "user.key"); st != fuse.OK {
+		t.Fatalf("removexattr returned %v", st)
+	}
+
+	if st := fs.RemoveXAttr(md.Inode, "user.key"); st != fuse.ENODATA {
+		t.Errorf("removexattr of missing attribute returned %v", st)
+	}
+}
+
+func TestSetXAttrFlags(t *testing.T) {
+	fs := newTestFs(t)
+	md := createTestFile(t, fs, "file")
+
+	if st := fs.SetXAttr(md.Inode, "user.key", []byte("a"), sqlite.XAttrReplace); st != fuse.ENODATA {
+		t.Errorf("replacing missing attribute returned %v", st)
+	}
+
+	if st := fs.SetXAttr(md.Inode, "user.key", []byte("a"), sqlite.XAttrCreate); st != fuse.OK {
+		t.Fatalf("creating attribute returned %v", st)
+	}
+
+	if st := fs.SetXAttr(md.Inode, "user.key", []byte("b"), sqlite.XAttrCreate); st != fuse.EEXIST {
+		t.Errorf("creating existing attribute returned %v", st)
+	}
+
+	// the value passed by fuse isn't kept
+	value := []byte("c")
+	if st := fs.SetXAttr(md.Inode, "user.key", value, sqlite.XAttrReplace); st != fuse.OK {
+		t.Fatalf("replacing attribute returned %v", st)
+	}
+
+	value[0] = 'x'
+
+	out := make([]byte, 1)
+	if _, st := fs.GetXAttr(md.Inode, "user.key", out); st != fuse.OK || out[0] != 'c' {
+		t.Errorf("value of attribute is %q", out)
+	}
+}
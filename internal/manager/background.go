@@ -1,9 +1,10 @@
 package manager
 
 import (
+	"crypto/md5"
+	"fmt"
 	"io"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/paddlesteamer/cloudstash/internal/common"
@@ -32,14 +33,27 @@ func watchRemoteChanges(m *Manager) {
 // and updates local database file if necessary
 func checkChanges(m *Manager) bool {
 	mdata, err := m.db.extDrive.GetFileMetadata(common.DatabaseFileName)
+	if err == common.ErrNotFound && relocateDatabase(m) {
+		return false
+	}
+
 	if err != nil {
 		log.Errorf("couldn't get metadata of remote DB file: %v", err)
+
+		m.setOffline(true)
 		return false
 	}
 
+	m.setOffline(false)
+
 	m.db.wLock()
 	defer m.db.wUnlock()
 
+	// local changes will be merged with the remote ones on upload
+	if m.db.dirty {
+		return false
+	}
+
 	if mdata.Hash == m.db.hash {
 		return false
 	}
@@ -72,7 +86,7 @@ func checkChanges(m *Manager) bool {
 
 	hs := crypto.NewHashStream(m.db.extDrive)
 
-	_, err = io.Copy(file, m.cipher.NewDecryptReader(reader))
+	_, err = io.Copy(file, m.cipher.NewDecryptReader(hs.NewHashReader(reader)))
 	if err != nil {
 		log.Errorf("couldn't copy contents of updated db file to local file: %v", err)
 
@@ -134,20 +148,99 @@ func checkChanges(m *Manager) bool {
 		return false
 	}
 
-	if err := os.Remove(m.db.path); err != nil {
-		log.Warningf("couldn't remove file '%s' from filesystem: %v", m.db.path, err)
+	if err := db.Migrate(); err != nil {
+		log.Errorf("couldn't migrate the downloaded database file: %v", err)
+
+		if err := os.Remove(file.Name()); err != nil {
+			log.Warningf("couldn't remove file '%s' from filesystem: %v", file.Name(), err)
+		}
+
+		if err := m.db.extDrive.Unlock(); err != nil {
+			log.Errorf("couldn't release remote lock: %v", err)
+		}
+
+		return false
+	}
+
+	// it may be uploaded by a client which doesn't know the ids of the drives
+	renamed, err := renameDriveURLs(db, m.db.renames)
+	if err != nil {
+		log.Errorf("couldn't rename drives in the downloaded database file: %v", err)
+
+		if err := os.Remove(file.Name()); err != nil {
+			log.Warningf("couldn't remove file '%s' from filesystem: %v", file.Name(), err)
+		}
+
+		if err := m.db.extDrive.Unlock(); err != nil {
+			log.Errorf("couldn't release remote lock: %v", err)
+		}
+
+		return false
+	}
+
+	db.Close()
+
+	err = m.db.restoreDatabase(file.Name())
+
+	if err := os.Remove(file.Name()); err != nil {
+		log.Warningf("couldn't remove file '%s' from filesystem: %v", file.Name(), err)
 	}
 
 	if err := m.db.extDrive.Unlock(); err != nil {
 		log.Errorf("couldn't release remote lock: %v", err)
 	}
 
+	if err != nil {
+		log.Errorf("couldn't replace local DB with the updated one: %v", err)
+		return false
+	}
+
 	m.db.hash = hash
-	m.db.path = file.Name()
+
+	if err := m.db.saveState(); err != nil {
+		log.Warningf("couldn't save database state: %v", err)
+	}
+
+	if renamed {
+		m.notifyChangeInDatabase()
+	}
 
 	return true
 }
 
+// relocateDatabase searches the other drives for the database when it
+// isn't in its drive, i.e. it is moved by another client. Returns false
+// if it isn't found.
+func relocateDatabase(m *Manager) bool {
+	for _, drv := range m.drives {
+		if drv == m.db.extDrive {
+			continue
+		}
+
+		if _, err := drv.GetFileMetadata(common.DatabaseFileName); err != nil {
+			continue
+		}
+
+		m.db.wLock()
+		defer m.db.wUnlock()
+
+		log.Infof("database is moved to %s", drv.GetProviderName())
+
+		m.db.extDrive = drv
+
+		// it is fetched or merged on the next check
+		m.db.hash = ""
+
+		if err := m.db.saveState(); err != nil {
+			log.Warningf("couldn't save database state: %v", err)
+		}
+
+		return true
+	}
+
+	return false
+}
+
 func updateCache(m *Manager) {
 	m.db.rLock()
 	defer m.db.rUnlock()
@@ -195,206 +288,308 @@ func processLocalChanges(m *Manager) {
 
 // processChanges uploads changed local files to remote drive
 // if forceAll is provided, it ignores access time
-// and uploads all files in the tracker
+// and uploads all files in the tracker.
+// Changes in the journal which aren't in the tracker, i.e. failed uploads
+// or changes left by the previous run, are retried when their backoff
+// period is over. forceAll ignores the backoff period as well.
 func processChanges(m *Manager, flag int) {
-	var items map[string]zcache.Item
-
 	if flag == forceAll {
-		items = m.tracker.DeleteAll()
+		m.tracker.DeleteAll()
 	} else {
-		items = m.tracker.DeleteFunc(accessFilter)
+		m.tracker.DeleteFunc(accessFilter)
 	}
 
-	if len(items) == 0 {
+	// changes are already in the journal, they will be
+	// uploaded when drives are reachable again
+	if m.IsOffline() {
 		return
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(len(items))
+	// tracker entries which are deleted above are in the journal too
+	entries := []trackerEntry{}
+	for _, entry := range m.journal.getReady(flag == forceAll) {
+		if _, found := m.tracker.Get(entry.cachePath); found {
+			continue
+		}
 
-	for _, it := range items {
-		entry := it.Object.(trackerEntry)
+		entries = append(entries, entry)
+	}
 
-		go processItem(entry.cachePath, entry.remotePath, m, &wg)
+	if len(entries) == 0 {
+		return
 	}
 
 	// wait for all uploads to complete otherwise
 	// the next processChanges call may conflict with this one
-	wg.Wait()
+	runUploads(m, entries)
 }
 
-func processItem(local string, url string, m *Manager, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	isDBFile := local == m.db.path
+// processItem uploads the change and removes it from the journal.
+// If upload fails, the error is recorded in the journal to retry later.
+func processItem(entry trackerEntry, m *Manager) {
+	var err error
+
+	switch {
+	case entry.delete:
+		err = deleteFile(entry, m)
+	case entry.cachePath == m.db.path:
+		err = uploadDatabase(m)
+	default:
+		err = uploadFile(entry, m)
+	}
 
-	u, err := common.ParseURL(url)
 	if err != nil {
-		log.Errorf("couldn't parse url %s. skipping: %v", url, err)
+		log.Errorf("couldn't upload %s: %v", entry.remotePath, err)
 
+		m.journal.fail(entry.key(), err)
 		return
 	}
 
+	m.journal.complete(entry.key(), entry.accessTime)
+}
+
+// uploadFile encrypts and uploads cached file to the remote drive
+func uploadFile(entry trackerEntry, m *Manager) error {
+	// it is uploaded after it is moved, or to the original if the move is aborted
+	if m.moves.has(entry.remotePath) {
+		return fmt.Errorf("%s is being moved to another drive", entry.remotePath)
+	}
+
+	u, err := common.ParseURL(entry.remotePath)
+	if err != nil {
+		return permanentError{fmt.Errorf("couldn't parse url %s: %v", entry.remotePath, err)}
+	}
+
 	drv, err := m.getDriveClient(u.Scheme)
 	if err != nil {
-		log.Errorf("couldn't find drive client of %s: %v", u.Scheme, err)
+		return permanentError{fmt.Errorf("couldn't find drive client of %s: %v", u.Scheme, err)}
+	}
 
-		return
+	file, err := os.Open(entry.cachePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return permanentError{fmt.Errorf("cached file %s is lost: %v", entry.cachePath, err)}
+		}
+
+		return fmt.Errorf("couldn't open file %s: %v", entry.cachePath, err)
+	}
+	defer file.Close()
+
+	var size int64
+	if fi, err := file.Stat(); err == nil {
+		size = fi.Size()
 	}
 
-	if isDBFile {
-		if err := m.db.extDrive.Lock(); err != nil {
-			log.Errorf("couldn't acquire remote lock: %v", err)
-			return
+	keepVersion := m.retention.keepsVersions()
+
+	// content referenced by a snapshot is kept even if versions aren't
+	keep := keepVersion
+	if !keep {
+		keep, err = m.isSnapshotBlob(entry.remotePath)
+		if err != nil {
+			return err
 		}
+	}
 
-		m.db.wLock()
-		defer m.db.wUnlock()
+	// the new content may be stored differently than the previous one
+	chunks, err := m.getChunkList(entry.remotePath)
+	if err != nil {
+		return err
+	}
+
+	chunked := len(chunks) > 0
 
-		md, err := drv.GetFileMetadata(u.Name)
+	sharded, err := m.isSharded(entry.remotePath)
+	if err != nil {
+		return err
+	}
+
+	// previous content is moved instead of being overwritten
+	vurl := ""
+	if keep {
+		vurl, err = m.archiveContent(drv, entry.inode, entry.remotePath, keepVersion)
 		if err != nil {
-			log.Errorf("couldn't get metadata of DB file: %v", err)
+			return fmt.Errorf("couldn't keep previous content: %v", err)
+		}
+	}
 
-			if err := m.db.extDrive.Unlock(); err != nil {
-				log.Errorf("couldn't release remote lock: %v", err)
-			}
+	h := md5.New()
 
-			// re-add to tracker
-			m.notifyChangeInDatabase()
-			return
+	r, done := m.progress.track(io.TeeReader(file, h), entry.inode, directionUpload, size)
+	defer done()
+
+	if m.chunking {
+		err = m.uploadChunks(drv, entry.remotePath, r)
+	} else {
+		var encoded io.Reader
+
+		encoded, err = m.encodeReader(r)
+		if err == nil {
+			err = m.putFile(drv, u.Name, encoded)
 		}
+	}
 
-		if md.Hash != m.db.hash {
-			log.Warning("remote DB file is also changed")
+	if err != nil {
+		if vurl != "" {
+			m.unarchiveContent(drv, entry.remotePath, vurl)
+		}
 
-			remoteDb, err := common.NewTempDBFile()
-			if err != nil {
-				log.Errorf("couldn't create file for remote DB: %v", err)
+		return fmt.Errorf("couldn't upload file: %v", err)
+	}
 
-				if err := m.db.extDrive.Unlock(); err != nil {
-					log.Errorf("couldn't release remote lock: %v", err)
-				}
+	if !keep {
+		switch {
+		case chunked && !m.chunking:
+			if _, err := m.releaseChunkList(entry.remotePath); err != nil {
+				log.Warningf("couldn't release previous chunks of %s: %v", entry.remotePath, err)
+			}
+		case sharded && m.chunking:
+			if _, err := m.releaseShards(entry.remotePath); err != nil {
+				log.Warningf("couldn't release previous shards of %s: %v", entry.remotePath, err)
+			}
+		case !chunked && !sharded && (m.chunking || m.erasure != nil):
+			if err := m.deleteReplicas(entry.remotePath); err != nil {
+				log.Warningf("couldn't delete previous replicas of %s: %v", entry.remotePath, err)
+			}
 
-				// re-add to tracker
-				m.notifyChangeInDatabase()
-				return
+			if err := drv.DeleteFile(u.Name); err != nil && err != common.ErrNotFound {
+				log.Warningf("couldn't delete previous content of %s: %v", entry.remotePath, err)
 			}
+		}
+	}
 
-			reader, err := drv.GetFile(common.DatabaseFileName)
-			if err != nil {
-				log.Errorf("couldn't download remote copy of the DB: %v", err)
+	if keepVersion {
+		m.recordVersion(entry.inode, entry.remotePath, size, fmt.Sprintf("%x", h.Sum(nil)))
+	}
 
-				remoteDb.Close()
+	return nil
+}
 
-				if err := os.Remove(remoteDb.Name()); err != nil {
-					log.Warningf("couldn't remove DB file '%s': %v", remoteDb.Name(), err)
-				}
+// deleteFile deletes the file of a removed inode from the remote drive
+func deleteFile(entry trackerEntry, m *Manager) error {
+	u, err := common.ParseURL(entry.remotePath)
+	if err != nil {
+		return permanentError{fmt.Errorf("couldn't parse url %s: %v", entry.remotePath, err)}
+	}
 
-				if err := m.db.extDrive.Unlock(); err != nil {
-					log.Errorf("couldn't release remote lock: %v", err)
-				}
+	// it is deleted when the last snapshot referencing it is deleted
+	protected, err := m.isSnapshotBlob(entry.remotePath)
+	if err != nil {
+		return err
+	}
 
-				// re-add to tracker
-				m.notifyChangeInDatabase()
-				return
-			}
-			defer reader.Close()
+	if protected {
+		log.Debugf("%s is referenced by a snapshot, it isn't deleted", entry.remotePath)
+		return nil
+	}
 
-			if _, err := io.Copy(remoteDb, reader); err != nil {
-				log.Errorf("couldn't copy contents of remote DB: %v", err)
+	// the file may be referenced again, i.e. by a database merged after
+	// it is released or by a file moved back to it
+	if entry.delayed {
+		referenced, err := m.isReferenced(entry.remotePath)
+		if err != nil {
+			return err
+		}
 
-				remoteDb.Close()
+		if referenced {
+			log.Debugf("%s is referenced again, it isn't deleted", entry.remotePath)
+			return nil
+		}
+	}
 
-				if err := os.Remove(remoteDb.Name()); err != nil {
-					log.Warningf("couldn't remove DB file '%s': %v", remoteDb.Name(), err)
-				}
+	// chunks of the content are deleted unless another file uses them
+	chunked, err := m.releaseChunkList(entry.remotePath)
+	if err != nil {
+		return err
+	}
 
-				if err := m.db.extDrive.Unlock(); err != nil {
-					log.Errorf("couldn't release remote lock: %v", err)
-				}
+	if chunked {
+		return nil
+	}
 
-				// re-add to tracker
-				m.notifyChangeInDatabase()
-				return
-			}
+	sharded, err := m.releaseShards(entry.remotePath)
+	if err != nil {
+		return err
+	}
 
-			remoteDb.Close()
+	if sharded {
+		return nil
+	}
 
-			if err := m.db.merge(remoteDb.Name(), m.cache); err != nil {
-				log.Errorf("couldn't merge local DB with the remote one: %v", err)
+	// replicas are deleted even if the drive of the file is gone
+	if err := m.deleteReplicas(entry.remotePath); err != nil {
+		return err
+	}
 
-				if err == errDatabaseBricked {
-					// if local database is broken, fallback to remote database
-					// this is a very dirty thing to do but it's if it comes to this
-					// this is our best option
+	drv, err := m.getDriveClient(u.Scheme)
+	if err != nil {
+		return permanentError{fmt.Errorf("couldn't find drive client of %s: %v", u.Scheme, err)}
+	}
 
-					if err := os.Remove(m.db.path); err != nil {
-						log.Warningf("couldn't remove DB file '%s': %v", m.db.path, err)
-					}
+	// i.e. a snapshot whose upload failed
+	if err := drv.DeleteFile(u.Name); err != nil && err != common.ErrNotFound {
+		return fmt.Errorf("couldn't delete file: %v", err)
+	}
 
-					if err := m.db.extDrive.Unlock(); err != nil {
-						log.Errorf("couldn't release remote lock: %v", err)
-					}
+	return nil
+}
 
-					m.db.path = remoteDb.Name()
-					return
-				}
+// uploadDatabase uploads local database to its drive. If the remote database
+// is also changed, it is merged into the local one before upload.
+func uploadDatabase(m *Manager) error {
+	drv := m.db.extDrive
 
-				if err := os.Remove(remoteDb.Name()); err != nil {
-					log.Warningf("couldn't remove DB file '%s': %v", remoteDb.Name(), err)
-				}
+	if err := drv.Lock(); err != nil {
+		return fmt.Errorf("couldn't acquire remote lock: %v", err)
+	}
 
-				if err := m.db.extDrive.Unlock(); err != nil {
-					log.Errorf("couldn't release remote lock: %v", err)
-				}
+	defer func() {
+		if err := drv.Unlock(); err != nil {
+			log.Errorf("couldn't release remote lock: %v", err)
+		}
+	}()
 
-				// there is an error but database file isn't lost. try again next time
-				// re-add to tracker
-				m.notifyChangeInDatabase()
-				return
-			}
+	m.db.wLock()
+	defer m.db.wUnlock()
 
-			// make a conflicted copy just in case
-			err = drv.MoveFile(common.DatabaseFileName,
-				common.GenerateConflictedFileName(common.DatabaseFileName))
-			if err != nil {
-				// log and ignore
-				log.Warningf("unable to rename remote DB file: %v", err)
-			}
-		}
+	md, err := drv.GetFileMetadata(common.DatabaseFileName)
+	if err != nil {
+		return fmt.Errorf("couldn't get metadata of DB file: %v", err)
 	}
 
-	file, err := os.Open(local)
-	if err != nil {
-		log.Errorf("couldn't open file %s: %v", local, err)
+	if md.Hash != m.db.hash {
+		log.Warning("remote DB file is also changed")
 
-		if isDBFile {
-			if err := m.db.extDrive.Unlock(); err != nil {
-				log.Errorf("couldn't release remote lock: %v", err)
+		if err := mergeRemoteDatabase(m, md.Hash); err != nil {
+			if err == errDatabaseBricked {
+				// local database is replaced with the remote one,
+				// there is nothing left to upload
+				return nil
 			}
+
+			return err
 		}
+	}
 
-		// re-add to tracker
-		m.notifyChangeInFile(local, url)
-		return
+	file, err := os.Open(m.db.path)
+	if err != nil {
+		return fmt.Errorf("couldn't open file %s: %v", m.db.path, err)
 	}
 	defer file.Close()
 
-	hs := crypto.NewHashStream(drv)
+	var size int64
+	if fi, err := file.Stat(); err == nil {
+		size = fi.Size()
+	}
 
-	err = drv.PutFile(u.Name, hs.NewHashReader(m.cipher.NewEncryptReader(file)))
-	if err != nil {
-		log.Errorf("couldn't upload file: %v", err)
+	r, done := m.progress.track(file, 0, directionUpload, size)
+	defer done()
 
-		if isDBFile {
-			if err := m.db.extDrive.Unlock(); err != nil {
-				log.Errorf("couldn't release remote lock: %v", err)
-			}
-		}
+	hs := crypto.NewHashStream(drv)
 
-		// re-add to tracker
-		m.notifyChangeInFile(local, url)
-		return
+	err = drv.PutFile(common.DatabaseFileName, hs.NewHashReader(m.cipher.NewEncryptReader(r)))
+	if err != nil {
+		return fmt.Errorf("couldn't upload file: %v", err)
 	}
 
 	hash, err := hs.GetComputedHash()
@@ -402,22 +597,87 @@ func processItem(local string, url string, m *Manager, wg *sync.WaitGroup) {
 		// log it and continue
 		log.Errorf("couldn't compute hash of file: %v", err)
 
-		if isDBFile {
-			if err := m.db.extDrive.Unlock(); err != nil {
-				log.Errorf("couldn't release remote lock: %v", err)
-			}
-		}
-
 		// this will force download of database
 		hash = ""
 	}
 
-	if isDBFile {
-		m.db.hash = hash
+	m.db.hash = hash
+	m.db.dirty = false
 
-		if err := m.db.extDrive.Unlock(); err != nil {
-			log.Errorf("couldn't release remote lock: %v", err)
+	if err := m.db.saveState(); err != nil {
+		log.Warningf("couldn't save database state: %v", err)
+	}
+
+	// the files whose deletions are delayed aren't referenced by the uploaded database
+	m.journal.release(deletionDelay)
+
+	return nil
+}
+
+// mergeRemoteDatabase downloads the remote database and merges it into the
+// local one. If the local database is broken, it is replaced with the remote
+// one and errDatabaseBricked is returned. It should be called with the remote
+// lock acquired and the database locked.
+func mergeRemoteDatabase(m *Manager, remoteHash string) error {
+	drv := m.db.extDrive
+
+	remoteDb, err := common.NewTempDBFile()
+	if err != nil {
+		return fmt.Errorf("couldn't create file for remote DB: %v", err)
+	}
+	defer func() {
+		if err := os.Remove(remoteDb.Name()); err != nil {
+			log.Warningf("couldn't remove DB file '%s': %v", remoteDb.Name(), err)
 		}
+	}()
+
+	reader, err := drv.GetFile(common.DatabaseFileName)
+	if err != nil {
+		remoteDb.Close()
+
+		return fmt.Errorf("couldn't download remote copy of the DB: %v", err)
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(remoteDb, m.cipher.NewDecryptReader(reader))
+	remoteDb.Close()
+
+	if err != nil {
+		return fmt.Errorf("couldn't copy contents of remote DB: %v", err)
+	}
+
+	if err := m.db.merge(remoteDb.Name(), m.moveInode, m.renameRemote); err != nil {
+		if err != errDatabaseBricked {
+			// database file isn't lost. try again next time
+			return fmt.Errorf("couldn't merge local DB with the remote one: %v", err)
+		}
+
+		log.Errorf("couldn't merge local DB with the remote one: %v", err)
+
+		// if local database is broken, fallback to remote database
+		// this is a very dirty thing to do but it's if it comes to this
+		// this is our best option
+		if err := m.db.restoreDatabase(remoteDb.Name()); err != nil {
+			return fmt.Errorf("couldn't fallback to remote DB: %v", err)
+		}
+
+		m.db.hash = remoteHash
+		m.db.dirty = false
+
+		if err := m.db.saveState(); err != nil {
+			log.Warningf("couldn't save database state: %v", err)
+		}
+
+		return errDatabaseBricked
+	}
+
+	// make a conflicted copy just in case
+	err = drv.MoveFile(common.DatabaseFileName,
+		common.GenerateConflictedFileName(common.DatabaseFileName))
+	if err != nil {
+		// log and ignore
+		log.Warningf("unable to rename remote DB file: %v", err)
 	}
 
+	return nil
 }
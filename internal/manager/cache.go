@@ -1,9 +1,15 @@
 package manager
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"time"
 
+	"github.com/paddlesteamer/cloudstash/internal/common"
 	"zgo.at/zcache"
 
 	log "github.com/sirupsen/logrus"
@@ -32,26 +38,251 @@ const (
 	cacheExpiration = 30 * time.Minute
 	cleanupInterval = 5 * time.Minute
 	cacheForever    = 0
+
+	cacheLimitInterval = time.Minute // cache size is checked for the written files
 )
 
-func newCache() *zcache.Cache {
+const (
+	cacheFolderName    = "cache"
+	cacheIndexFileName = "cache.json"
+)
+
+func newCache(onEvicted func(string, interface{})) *zcache.Cache {
 	c := zcache.New(cacheExpiration, cleanupInterval)
-	c.OnEvicted(expirationHandler)
+	c.OnEvicted(onEvicted)
 	return c
 }
 
-func expirationHandler(ino string, ent interface{}) {
+// evictCacheEntry is called when an entry is removed from the cache.
+// If the cached file is open or has changes that aren't uploaded yet,
+// the entry is put back. Otherwise, the cached file is deleted.
+func (m *Manager) evictCacheEntry(ino string, ent interface{}) {
 	entry := ent.(cacheEntry)
 
+	if entry.path == "" {
+		return
+	}
+
+	// the entry is moved to another inode
+	for _, it := range m.cache.Items() {
+		if it.Object.(cacheEntry).path == entry.path {
+			return
+		}
+	}
+
+	if entry.status == fileAvailable &&
+		(m.handles.isOpen(common.ToInt64(ino)) || m.hasPendingUpload(entry.path)) {
+		m.cache.Set(ino, entry, cacheExpiration)
+		return
+	}
+
 	if err := os.Remove(entry.path); err != nil {
 		log.Warningf("couldn't delete cached file %s: %v", entry.path, err)
 	}
 }
 
+// limitCache keeps the size of the cached files under the cache limit.
+// It is checked whenever a file is downloaded, and periodically for the
+// files which grow as they are written.
+func limitCache(m *Manager) {
+	ticker := time.NewTicker(cacheLimitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.cacheGrown:
+		}
+
+		m.trimCache()
+	}
+}
+
+// notifyCacheGrown tells limitCache to check the size of the cache
+func (m *Manager) notifyCacheGrown() {
+	select {
+	case m.cacheGrown <- struct{}{}:
+	default:
+	}
+}
+
+// trimCache removes the least recently used cached files until their total
+// size is under the cache limit. Files which are open or have changes that
+// aren't uploaded yet are kept, so the limit may be exceeded because of them.
+func (m *Manager) trimCache() {
+	type cachedFile struct {
+		ino        string
+		size       int64
+		expiration int64
+	}
+
+	var total int64
+
+	files := []cachedFile{}
+	seen := map[string]bool{}
+
+	for ino, it := range m.cache.Items() {
+		entry := it.Object.(cacheEntry)
+		if entry.status != fileAvailable || seen[entry.path] {
+			continue
+		}
+
+		seen[entry.path] = true
+
+		fi, err := os.Stat(entry.path)
+		if err != nil {
+			continue
+		}
+
+		total += fi.Size()
+
+		if m.handles.isOpen(common.ToInt64(ino)) || m.hasPendingUpload(entry.path) {
+			continue
+		}
+
+		files = append(files, cachedFile{ino: ino, size: fi.Size(), expiration: it.Expiration})
+	}
+
+	if total <= m.cacheLimit {
+		return
+	}
+
+	// entries expire later as they are used
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].expiration < files[b].expiration
+	})
+
+	for _, f := range files {
+		if total <= m.cacheLimit {
+			break
+		}
+
+		m.cache.Delete(f.ino)
+
+		total -= f.size
+	}
+}
+
+// cacheIndexEntry is the persisted form of cacheEntry
+type cacheIndexEntry struct {
+	Path string
+	Hash string
+}
+
+// saveCacheIndex writes available cache entries to the local state directory
+// so that they can be used in the next run, even if the drives are unreachable
+func (m *Manager) saveCacheIndex() error {
+	index := map[string]cacheIndexEntry{}
+
+	for ino, it := range m.cache.Items() {
+		entry := it.Object.(cacheEntry)
+		if entry.status != fileAvailable {
+			continue
+		}
+
+		index[ino] = cacheIndexEntry{
+			Path: entry.path,
+			Hash: entry.hash,
+		}
+	}
+
+	return writeJSONFile(filepath.Join(m.stateDir, cacheIndexFileName), index)
+}
+
+// restoreCache restores cache entries saved by the previous run and the ones
+// with pending uploads in the journal. Entries whose content is changed
+// in the database and files which aren't referenced anymore are removed.
+func (m *Manager) restoreCache() error {
+	index := map[string]cacheIndexEntry{}
+
+	f, err := os.Open(filepath.Join(m.stateDir, cacheIndexFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("couldn't open cache index: %v", err)
+	}
+
+	if err == nil {
+		err = json.NewDecoder(f).Decode(&index)
+		f.Close()
+
+		if err != nil {
+			log.Warningf("couldn't parse cache index, ignoring: %v", err)
+		}
+	}
+
+	pending := map[string]bool{}
+	for _, entry := range m.journal.getAll() {
+		if entry.inode == 0 {
+			continue
+		}
+
+		pending[common.ToString(entry.inode)] = true
+		index[common.ToString(entry.inode)] = cacheIndexEntry{
+			Path: entry.cachePath,
+		}
+	}
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	used := map[string]bool{}
+
+	for ino, entry := range index {
+		if _, err := os.Stat(entry.Path); err != nil {
+			continue
+		}
+
+		md, err := db.Get(common.ToInt64(ino))
+		if err != nil {
+			continue
+		}
+
+		if !pending[ino] && md.Hash != entry.Hash {
+			continue
+		}
+
+		used[entry.Path] = true
+		m.cache.Set(ino, newCacheEntry(entry.Path, fileAvailable, md.Hash), cacheExpiration)
+	}
+
+	files, err := ioutil.ReadDir(m.cacheDir)
+	if err != nil {
+		return fmt.Errorf("couldn't list cache directory: %v", err)
+	}
+
+	for _, fi := range files {
+		path := filepath.Join(m.cacheDir, fi.Name())
+		if used[path] {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			log.Warningf("couldn't delete stale cached file %s: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
 type trackerEntry struct {
+	inode      int64
 	cachePath  string
 	remotePath string
 	accessTime time.Time
+	delete     bool // remote file is deleted instead of uploaded
+	delayed    bool // remote file is deleted a while after the database is uploaded
+}
+
+// key returns the key of the entry in the journal. Deletions don't have
+// cached files, they are kept by their remote paths.
+func (e trackerEntry) key() string {
+	if e.delete {
+		return e.remotePath
+	}
+
+	return e.cachePath
 }
 
 const idleTimeThreshold time.Duration = 10 * time.Second
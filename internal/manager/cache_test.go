@@ -0,0 +1,39 @@
+package manager
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+func TestCacheLimit(t *testing.T) {
+	m := newTestManager(t, newMemDrive("mem"))
+
+	data := bytes.Repeat([]byte("x"), 1024)
+
+	old := writeTestFile(t, m, "old", data)
+	recent := writeTestFile(t, m, "recent", data)
+
+	// it has a change waiting to be uploaded
+	pending := writeTestFile(t, m, "pending", data)
+	m.journal.add(trackerEntry{inode: pending, cachePath: cachedPath(t, m, pending), remotePath: "mem://pending"})
+
+	m.cacheLimit = 2 * int64(len(data))
+	m.trimCache()
+
+	if _, found := m.cache.Get(common.ToString(old)); found {
+		t.Errorf("least recently used file is kept in the cache")
+	}
+
+	for _, inode := range []int64{recent, pending} {
+		if _, found := m.cache.Get(common.ToString(inode)); !found {
+			t.Errorf("inode %d is removed from the cache", inode)
+		}
+	}
+
+	// it is downloaded again when it is read
+	if content := readTestFile(t, m, "old"); content != string(data) {
+		t.Errorf("content of removed file is changed")
+	}
+}
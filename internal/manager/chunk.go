@@ -0,0 +1,302 @@
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/paddlesteamer/cloudstash/internal/chunker"
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// uploadChunks splits the content read from r into chunks, uploads the ones
+// which aren't stored yet to drv and makes them the content at url. The chunks
+// of the previous content which aren't used anymore are deleted.
+func (m *Manager) uploadChunks(drv drive.Drive, url string, r io.Reader) (err error) {
+	c := chunker.NewChunker(r)
+	ids := []string{}
+
+	// chunks stored for the content are released unless another one uses them
+	defer func() {
+		if err != nil && len(ids) > 0 {
+			m.releaseChunks(ids)
+		}
+	}()
+
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("couldn't read file: %v", err)
+		}
+
+		id, err := m.storeChunk(drv, data)
+		if err != nil {
+			return err
+		}
+
+		ids = append(ids, id)
+	}
+
+	// empty content is a single empty chunk, so that it has a chunk list
+	if len(ids) == 0 {
+		id, err := m.storeChunk(drv, []byte{})
+		if err != nil {
+			return err
+		}
+
+		ids = append(ids, id)
+	}
+
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	released, err := db.SetChunkList(url, ids)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return fmt.Errorf("a chunk is deleted during upload")
+		}
+
+		return fmt.Errorf("couldn't set chunks of %s: %v", url, err)
+	}
+
+	m.notifyChangeInDatabase()
+
+	// other clients may have used them in contents they haven't uploaded yet
+	for _, ch := range released {
+		m.scheduleDelayedDeletion(ch.URL)
+	}
+
+	return nil
+}
+
+// storeChunk uploads data to drv if there isn't a chunk with
+// the same content already and returns its id
+func (m *Manager) storeChunk(drv drive.Drive, data []byte) (string, error) {
+	id := m.cipher.ChunkID(data)
+
+	if _, err := m.getChunk(id); err == nil {
+		return id, nil
+	} else if err != common.ErrNotFound {
+		return "", err
+	}
+
+	name := common.ObfuscateFileName(id)
+
+	r, err := m.encodeReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.putFile(drv, name, r); err != nil {
+		return "", fmt.Errorf("couldn't upload chunk: %v", err)
+	}
+
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return "", fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	ch := &sqlite.Chunk{
+		ID:   id,
+		URL:  drive.GetURL(drv, name),
+		Size: int64(len(data)),
+	}
+
+	inserted, err := db.InsertChunk(ch)
+	if err != nil {
+		return "", err
+	}
+
+	// another upload stored the same chunk in the meantime,
+	// the copy uploaded here isn't referenced
+	if !inserted {
+		m.scheduleDeletion(0, ch.URL)
+	}
+
+	return id, nil
+}
+
+func (m *Manager) getChunk(id string) (*sqlite.Chunk, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	return db.GetChunk(id)
+}
+
+// getChunkList returns the chunks of the content at url,
+// an empty list if it isn't chunked
+func (m *Manager) getChunkList(url string) ([]sqlite.Chunk, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	chunks, err := db.GetChunkList(url)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get chunks of %s: %v", url, err)
+	}
+
+	return chunks, nil
+}
+
+// releaseChunkList removes the chunk list of the content at url and schedules
+// deletion of the chunks which aren't used anymore. Returns false if the
+// content isn't chunked.
+func (m *Manager) releaseChunkList(url string) (bool, error) {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return false, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	released, found, err := db.DeleteChunkList(url)
+	if err != nil {
+		return false, fmt.Errorf("couldn't delete chunks of %s: %v", url, err)
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	m.notifyChangeInDatabase()
+
+	for _, ch := range released {
+		m.scheduleDelayedDeletion(ch.URL)
+	}
+
+	return true, nil
+}
+
+// releaseChunks removes the chunks with ids which aren't used by any content
+// and schedules their deletion, i.e. the ones stored by a failed upload. All
+// unused chunks are released if ids is nil. Errors are only logged, they are
+// released again on the next run.
+func (m *Manager) releaseChunks(ids []string) {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		log.Warningf("couldn't connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	var released []sqlite.Chunk
+
+	if ids == nil {
+		released, err = db.ReleaseUnusedChunks()
+	} else {
+		released, err = db.ReleaseChunks(ids)
+	}
+
+	if err != nil {
+		log.Warningf("couldn't release unused chunks: %v", err)
+		return
+	}
+
+	if len(released) == 0 {
+		return
+	}
+
+	m.notifyChangeInDatabase()
+
+	for _, ch := range released {
+		m.scheduleDelayedDeletion(ch.URL)
+	}
+}
+
+// chunkReader reads the content of chunks in order, downloading them one by one
+type chunkReader struct {
+	m      *Manager
+	chunks []sqlite.Chunk
+	r      io.Reader // content of the current chunk
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.r == nil {
+			if len(cr.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			data, err := cr.m.downloadChunk(&cr.chunks[0])
+			if err != nil {
+				return 0, err
+			}
+
+			cr.chunks = cr.chunks[1:]
+			cr.r = bytes.NewReader(data)
+		}
+
+		n, err := cr.r.Read(p)
+		if err == io.EOF {
+			cr.r = nil
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+// downloadChunk downloads the chunk and verifies its content
+func (m *Manager) downloadChunk(ch *sqlite.Chunk) ([]byte, error) {
+	reader, err := m.getFile(ch.URL)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get chunk '%s' from storage: %v", ch.URL, err)
+	}
+	defer reader.Close()
+
+	r, err := m.decodeReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read chunk '%s': %v", ch.URL, err)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read chunk '%s': %v", ch.URL, err)
+	}
+
+	if m.cipher.ChunkID(data) != ch.ID {
+		return nil, fmt.Errorf("chunk '%s' might be altered", ch.URL)
+	}
+
+	return data, nil
+}
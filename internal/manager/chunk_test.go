@@ -0,0 +1,176 @@
+package manager
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// chunkCount returns the number of chunks used in the database of m
+func chunkCount(t *testing.T, m *Manager) int {
+	db, err := m.getSqliteClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	count, err := db.GetUsedChunkCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestChunkedUpload(t *testing.T) {
+	m := newTestManager(t, newMemDrive("mem"))
+	m.chunking = true
+
+	data := bytes.Repeat([]byte("chunked content "), 1<<14)
+
+	writeTestFile(t, m, "a", data)
+
+	count := chunkCount(t, m)
+
+	// b is stored with the chunks of a
+	writeTestFile(t, m, "b", data)
+
+	if chunkCount(t, m) != count {
+		t.Errorf("chunks of same content are stored again")
+	}
+
+	writeTestFile(t, m, "c", append(data, "more"...))
+
+	if chunkCount(t, m) == count {
+		t.Errorf("new chunk isn't stored")
+	}
+
+	for _, name := range []string{"a", "b"} {
+		if content := readTestFile(t, m, name); content != string(data) {
+			t.Errorf("content of %s is changed", name)
+		}
+	}
+}
+
+func TestStoreChunkTwice(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+
+	data := []byte("same chunk")
+
+	var stored []string
+
+	// another upload stores the same chunk while it is uploaded
+	drv.onPut = func(name string) {
+		stored = append(stored, name)
+
+		if len(stored) == 1 {
+			if _, err := m.storeChunk(drv, data); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	id, err := m.storeChunk(drv, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drv.onPut = nil
+
+	processChanges(m, forceAll)
+
+	ch, err := m.getChunk(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 2 {
+		t.Fatalf("chunk is uploaded %d times, expected 2", len(stored))
+	}
+
+	if !drv.has(ch.URL) {
+		t.Errorf("stored chunk is deleted")
+	}
+
+	if drv.has(drv.name + "://" + stored[0]) {
+		t.Errorf("copy of the chunk which isn't stored is kept")
+	}
+}
+
+func TestReleasedChunkDeletion(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+	m.chunking = true
+
+	inode := writeTestFile(t, m, "file", []byte("old content"))
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := m.getChunkList(md.URL)
+	if err != nil || len(chunks) != 1 {
+		t.Fatalf("couldn't get chunks of the file: %v, %v", chunks, err)
+	}
+
+	old := chunks[0].URL
+
+	rewriteTestFile(t, m, inode, []byte("new content"))
+
+	if u, found := pendingDeletion(m, old); !found || !u.Delayed {
+		t.Fatalf("deletion of the released chunk isn't delayed: %+v", u)
+	}
+
+	// the database without the chunk is uploaded
+	processChanges(m, forceAll)
+
+	if !drv.has(old) {
+		t.Fatalf("released chunk is deleted before the delay")
+	}
+
+	if u, found := pendingDeletion(m, old); !found || u.Deferred {
+		t.Errorf("deletion of the released chunk isn't scheduled: %+v", u)
+	}
+
+	expireDeletions(m)
+	processChanges(m, forceAll)
+
+	if drv.has(old) {
+		t.Errorf("released chunk isn't deleted after the delay")
+	}
+}
+
+func TestReleaseUnusedChunks(t *testing.T) {
+	m := newTestManager(t, newMemDrive("mem"))
+	m.chunking = true
+
+	writeTestFile(t, m, "file", []byte("used content"))
+
+	// a chunk left by an upload interrupted before its chunk list is set
+	id, err := m.storeChunk(m.drives[0], []byte("unused content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := m.getChunk(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.releaseChunks(nil)
+
+	if _, err := m.getChunk(id); err != common.ErrNotFound {
+		t.Errorf("unused chunk isn't released: %v", err)
+	}
+
+	if u, found := pendingDeletion(m, ch.URL); !found || !u.Deferred {
+		t.Errorf("deletion of the unused chunk isn't scheduled: %+v", u)
+	}
+
+	if content := readTestFile(t, m, "file"); content != "used content" {
+		t.Errorf("content of the file is '%s'", content)
+	}
+}
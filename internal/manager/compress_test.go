@@ -0,0 +1,48 @@
+package manager
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+	m.compression = true
+
+	data := bytes.Repeat([]byte("compressible content "), 1<<12)
+
+	inode := writeTestFile(t, m, "compressed", data)
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := drv.GetFileMetadata(strings.TrimPrefix(md.URL, drv.name+"://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Size >= uint64(len(data)) {
+		t.Errorf("stored size %d isn't smaller than %d", stored.Size, len(data))
+	}
+
+	if content := readTestFile(t, m, "compressed"); content != string(data) {
+		t.Errorf("content is changed by compression")
+	}
+
+	// files which are already stored are read after it is disabled
+	m.compression = false
+
+	if content := readTestFile(t, m, "compressed"); content != string(data) {
+		t.Errorf("compressed file isn't read with compression disabled")
+	}
+
+	writeTestFile(t, m, "plain", data)
+
+	if content := readTestFile(t, m, "plain"); content != string(data) {
+		t.Errorf("content of file stored without compression is changed")
+	}
+}
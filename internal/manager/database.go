@@ -1,47 +1,63 @@
 package manager
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/paddlesteamer/cloudstash/internal/common"
 	"github.com/paddlesteamer/cloudstash/internal/crypto"
 	"github.com/paddlesteamer/cloudstash/internal/drive"
 	"github.com/paddlesteamer/cloudstash/internal/sqlite"
-	"zgo.at/zcache"
 
 	log "github.com/sirupsen/logrus"
 )
 
 var errDatabaseBricked = errors.New("database file is broken")
 
+const dbStateFileName = "database.json"
+
 type database struct {
 	path     string       // local path of database
 	hash     string       // content hash of database computed by extDrive.ComputeHash
+	dirty    bool         // whether local database has changes that aren't uploaded yet
 	extDrive drive.Drive  // drive client for remote operations
 	mux      sync.RWMutex // used in database queries, executions since go-sqlite3 isn't thread safe
+
+	// renames are the old url schemes of the drives and their ids,
+	// applied to the remote databases as well
+	renames map[string]string
 }
 
-// newDB creates new database and uploads it
-func newDB(extDrive drive.Drive, cipher *crypto.Cipher) (*database, error) {
-	file, err := common.NewTempDBFile()
-	if err != nil {
-		return nil, fmt.Errorf("could not create DB file: %v", err)
+// databaseState is saved next to the local copy of the database
+// so that the copy can be used when the remote drives are unreachable
+type databaseState struct {
+	Hash  string
+	Drive string
+	Dirty bool
+}
+
+// newDB creates new database in dir and uploads it
+func newDB(extDrive drive.Drive, cipher *crypto.Cipher, dir string) (*database, error) {
+	path := filepath.Join(dir, common.DatabaseFileName)
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("couldn't remove old DB file: %v", err)
 	}
-	file.Close()
 
-	if err := sqlite.InitDB(file.Name()); err != nil {
+	if err := sqlite.InitDB(path); err != nil {
 		return nil, fmt.Errorf("could not initialize DB: %v", err)
 	}
 
-	// reopen file
-	file, err = os.Open(file.Name())
+	file, err := os.Open(path)
 	if err != nil {
-		if err := os.Remove(file.Name()); err != nil {
-			log.Warningf("couldn't remove file '%s' from filesystem: %v", file.Name(), err)
+		if err := os.Remove(path); err != nil {
+			log.Warningf("couldn't remove file '%s' from filesystem: %v", path, err)
 		}
 
 		return nil, fmt.Errorf("could not open intitialized DB: %v", err)
@@ -68,15 +84,21 @@ func newDB(extDrive drive.Drive, cipher *crypto.Cipher) (*database, error) {
 		return nil, fmt.Errorf("couldn't compute hash of newly installed DB: %v", err)
 	}
 
-	return &database{
-		path:     file.Name(),
+	db := &database{
+		path:     path,
 		hash:     hash,
 		extDrive: extDrive,
-	}, nil
+	}
+
+	if err := db.saveState(); err != nil {
+		log.Warningf("couldn't save database state: %v", err)
+	}
+
+	return db, nil
 }
 
-// fetchDB fetches database from remote storage
-func fetchDB(extDrive drive.Drive, cipher *crypto.Cipher) (*database, error) {
+// fetchDB fetches database from remote storage into dir
+func fetchDB(extDrive drive.Drive, cipher *crypto.Cipher, dir string) (*database, error) {
 	file, err := common.NewTempDBFile()
 	if err != nil {
 		return nil, fmt.Errorf("could not create DB file: %v", err)
@@ -128,29 +150,129 @@ func fetchDB(extDrive drive.Drive, cipher *crypto.Cipher) (*database, error) {
 		return nil, fmt.Errorf("couldn't verify the downloaded database file")
 	}
 
-	return &database{
-		path:     file.Name(),
+	if err := db.Migrate(); err != nil {
+		if err := os.Remove(file.Name()); err != nil {
+			log.Warningf("couldn't remove file '%s' from filesystem: %v", file.Name(), err)
+		}
+
+		return nil, fmt.Errorf("couldn't migrate the downloaded database file: %v", err)
+	}
+
+	d := &database{
+		path:     filepath.Join(dir, common.DatabaseFileName),
 		hash:     hash,
 		extDrive: extDrive,
+	}
+
+	err = d.restoreDatabase(file.Name())
+
+	if err := os.Remove(file.Name()); err != nil {
+		log.Warningf("couldn't remove file '%s' from filesystem: %v", file.Name(), err)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("couldn't copy downloaded DB file: %v", err)
+	}
+
+	if err := d.saveState(); err != nil {
+		log.Warningf("couldn't save database state: %v", err)
+	}
+
+	return d, nil
+}
+
+// loadDB loads the local copy of the database in dir which is left
+// by the previous run. Returns common.ErrNotFound if there isn't any.
+func loadDB(drives []drive.Drive, dir string, renames map[string]string) (*database, error) {
+	path := filepath.Join(dir, common.DatabaseFileName)
+
+	f, err := os.Open(filepath.Join(dir, dbStateFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, common.ErrNotFound
+		}
+
+		return nil, fmt.Errorf("couldn't open database state file: %v", err)
+	}
+	defer f.Close()
+
+	state := databaseState{}
+
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return nil, fmt.Errorf("couldn't parse database state file: %v", err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, common.ErrNotFound
+		}
+
+		return nil, fmt.Errorf("couldn't get stats of local DB file: %v", err)
+	}
+
+	if id, ok := renames[state.Drive]; ok {
+		state.Drive = id
+	}
+
+	var extDrive drive.Drive
+	for _, drv := range drives {
+		if drv.GetID() == state.Drive {
+			extDrive = drv
+			break
+		}
+	}
+
+	if extDrive == nil {
+		return nil, fmt.Errorf("drive '%s' of the local DB isn't configured", state.Drive)
+	}
+
+	db, err := sqlite.NewClient(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to local DB file: %v", err)
+	}
+	defer db.Close()
+
+	if !db.IsValidDatabase() {
+		return nil, fmt.Errorf("couldn't verify the local database file")
+	}
+
+	if err := db.Migrate(); err != nil {
+		return nil, fmt.Errorf("couldn't migrate the local database file: %v", err)
+	}
+
+	return &database{
+		path:     path,
+		hash:     state.Hash,
+		dirty:    state.Dirty,
+		extDrive: extDrive,
 	}, nil
 }
 
-// clean deletes database file from local filesystem
-// It should be called on exit
-func (db *database) clean() {
-	if err := os.Remove(db.path); err != nil {
-		log.Warningf("couldn't remove file '%s' from filesystem: %v", db.path, err)
+// saveState writes the database state next to the local database file.
+// It should be called whenever hash or dirty is changed.
+func (db *database) saveState() error {
+	state := databaseState{
+		Hash:  db.hash,
+		Drive: db.extDrive.GetID(),
+		Dirty: db.dirty,
 	}
+
+	return writeJSONFile(filepath.Join(filepath.Dir(db.path), dbStateFileName), state)
 }
 
 // merge tries to merge two databases. returns error if it can not
-// and restores local database.
+// and restores local database from the backup taken before the merge.
 // the rules of merge are:
-// - if a file is changed or relocated on remote database, the changes are ignored
+// - if a file is changed on remote database, the changes are ignored
+// - if a file is moved to another remote file on remote database, its new url is used
 // - if a file is removed from remote database, it is added again
-// - if a new file is added to remote database, it is added to local database too
+// - if a new file is added to remote database, it is added to local database with all of its names
+// - if a new name conflicts with a local one, it is renamed as a conflicted copy
 // - remote database's inode numbers are used in local db in order to get synchronized with other clients
-func (db *database) merge(path string, cache *zcache.Cache) error {
+// - timestamps of the same file are merged, the latest access, modification and change times are kept
+// onMove is called for each local inode which is moved to a new number and
+// onRename for each local url which is changed to the one in remote database.
+func (db *database) merge(path string, onMove func(int64, int64), onRename func(string, string)) error {
 	// backup local copy just in case
 	backup, err := db.backupDatabase()
 	if err != nil {
@@ -168,56 +290,199 @@ func (db *database) merge(path string, cache *zcache.Cache) error {
 		return fmt.Errorf("couldn't connect to local copy of remote DB: %v", err)
 	}
 
-	if err := merge(localDb, remoteDb, cache); err != nil {
-		return fmt.Errorf("couldn't merge databases: %v", err)
+	// remote database may be uploaded by an older version
+	if err := remoteDb.Migrate(); err != nil {
+		localDb.Close()
+		remoteDb.Close()
+
+		return fmt.Errorf("couldn't migrate remote DB: %v", err)
 	}
 
-	if err := db.restoreDatabase(backup); err != nil {
-		log.Errorf("critical error! database may be bricked: %v", err)
+	if _, err := renameDriveURLs(remoteDb, db.renames); err != nil {
+		localDb.Close()
+		remoteDb.Close()
 
-		return errDatabaseBricked
+		return fmt.Errorf("couldn't rename drives in remote DB: %v", err)
+	}
+
+	// the backup is only restored when the merge fails, the merged
+	// database is kept otherwise
+	if err := merge(localDb, remoteDb, onMove, onRename); err != nil {
+		if err := db.restoreDatabase(backup); err != nil {
+			log.Errorf("critical error! database may be bricked: %v", err)
+
+			return errDatabaseBricked
+		}
+
+		return fmt.Errorf("couldn't merge databases: %v", err)
 	}
 
 	return nil
 }
 
-func merge(local *sqlite.Client, remote *sqlite.Client, cache *zcache.Cache) error {
+const (
+	mergeChunkSize   = 1000 // rows
+	mergeThreadLimit = 32
+)
+
+// merger keeps the state shared by the goroutines merging chunks of rows
+type merger struct {
+	local    *sqlite.Client
+	remote   *sqlite.Client
+	onMove   func(int64, int64)
+	onRename func(string, string)
+	next     int64          // next inode number free in both databases
+	added    map[int64]bool // remote inodes which are added to local database
+	newer    []int64        // inodes in both databases changed later in remote one
+	mu       sync.Mutex
+}
+
+func merge(local *sqlite.Client, remote *sqlite.Client, onMove func(int64, int64), onRename func(string, string)) error {
 	defer local.Close()
 	defer remote.Close()
 
-	rowCount, err := remote.GetRowCount()
+	lmax, err := local.GetMaxInode()
 	if err != nil {
-		return fmt.Errorf("couldn't get row count: %v", err)
+		return err
 	}
 
-	chunkSize := 1000 //rows
-	threadLimit := 32
+	rmax, err := remote.GetMaxInode()
+	if err != nil {
+		return err
+	}
 
-	offset := 0
-	thCount := 0
+	if rmax > lmax {
+		lmax = rmax
+	}
 
-	mu := sync.RWMutex{}
-	wg := sync.WaitGroup{}
-	errChan := make(chan error)
+	mg := &merger{
+		local:    local,
+		remote:   remote,
+		onMove:   onMove,
+		onRename: onRename,
+		next:     lmax + 1,
+		added:    map[int64]bool{},
+	}
 
-	for offset < rowCount {
-		if (rowCount - offset) < chunkSize {
-			chunkSize = rowCount - offset
-		}
+	// inodes first, so that the names are added to the right inodes
+	count, err := remote.GetInodeCount()
+	if err != nil {
+		return fmt.Errorf("couldn't get inode count: %v", err)
+	}
 
-		mdList, err := remote.GetRows(chunkSize, offset)
-		if err != nil {
-			return fmt.Errorf("couldn't get rows: %v", err)
-		}
+	if err := processChunks(count, mg.mergeInodes); err != nil {
+		return fmt.Errorf("couldn't merge inodes: %v", err)
+	}
+
+	if err := mg.mergeLinks(); err != nil {
+		return fmt.Errorf("couldn't merge names: %v", err)
+	}
+
+	count, err = remote.GetDentryCount()
+	if err != nil {
+		return fmt.Errorf("couldn't get entry count: %v", err)
+	}
+
+	if err := processChunks(count, mg.mergeDentries); err != nil {
+		return fmt.Errorf("couldn't merge entries: %v", err)
+	}
+
+	count, err = remote.GetXAttrCount()
+	if err != nil {
+		return fmt.Errorf("couldn't get extended attribute count: %v", err)
+	}
+
+	if err := processChunks(count, mg.mergeXAttrs); err != nil {
+		return fmt.Errorf("couldn't merge extended attributes: %v", err)
+	}
+
+	if err := mg.mergeTrash(); err != nil {
+		return fmt.Errorf("couldn't merge trash: %v", err)
+	}
+
+	count, err = remote.GetVersionCount()
+	if err != nil {
+		return fmt.Errorf("couldn't get version count: %v", err)
+	}
+
+	if err := processChunks(count, mg.mergeVersions); err != nil {
+		return fmt.Errorf("couldn't merge versions: %v", err)
+	}
+
+	if err := mg.mergeSnapshots(); err != nil {
+		return fmt.Errorf("couldn't merge snapshots: %v", err)
+	}
+
+	count, err = remote.GetSnapshotBlobCount()
+	if err != nil {
+		return fmt.Errorf("couldn't get snapshot file count: %v", err)
+	}
+
+	if err := processChunks(count, mg.mergeSnapshotBlobs); err != nil {
+		return fmt.Errorf("couldn't merge snapshot files: %v", err)
+	}
+
+	count, err = remote.GetUsedChunkCount()
+	if err != nil {
+		return fmt.Errorf("couldn't get chunk count: %v", err)
+	}
+
+	if err := processChunks(count, mg.mergeChunks); err != nil {
+		return fmt.Errorf("couldn't merge chunks: %v", err)
+	}
+
+	count, err = remote.GetChunkListCount()
+	if err != nil {
+		return fmt.Errorf("couldn't get chunk list count: %v", err)
+	}
+
+	if err := processChunks(count, mg.mergeChunkLists); err != nil {
+		return fmt.Errorf("couldn't merge chunk lists: %v", err)
+	}
+
+	count, err = remote.GetReplicaCount()
+	if err != nil {
+		return fmt.Errorf("couldn't get replica count: %v", err)
+	}
+
+	if err := processChunks(count, mg.mergeReplicas); err != nil {
+		return fmt.Errorf("couldn't merge replicas: %v", err)
+	}
+
+	count, err = remote.GetShardedCount()
+	if err != nil {
+		return fmt.Errorf("couldn't get sharded content count: %v", err)
+	}
+
+	if err := processChunks(count, mg.mergeSharded); err != nil {
+		return fmt.Errorf("couldn't merge shards: %v", err)
+	}
+
+	return nil
+}
 
-		offset += chunkSize
+// processChunks calls process for each chunk of rowCount rows, chunks
+// are processed in parallel up to the thread limit
+func processChunks(rowCount int, process func(limit int, offset int) error) error {
+	wg := sync.WaitGroup{}
+	errChan := make(chan error, mergeThreadLimit)
+
+	thCount := 0
 
-		go processChunk(mdList, local, cache, &wg, &mu, errChan)
+	for offset := 0; offset < rowCount; offset += mergeChunkSize {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+
+			if err := process(mergeChunkSize, offset); err != nil {
+				errChan <- err
+			}
+		}(offset)
 
 		thCount++
 
 		// don't start more go routines if thread limit is reached
-		if thCount == threadLimit {
+		if thCount == mergeThreadLimit || offset+mergeChunkSize >= rowCount {
 			wg.Wait()
 			thCount = 0
 
@@ -230,77 +495,490 @@ func merge(local *sqlite.Client, remote *sqlite.Client, cache *zcache.Cache) err
 		}
 	}
 
-	if thCount > 0 {
-		wg.Wait()
+	return nil
+}
+
+func (mg *merger) mergeInodes(limit int, offset int) error {
+	mdList, err := mg.remote.GetInodes(limit, offset)
+	if err != nil {
+		return fmt.Errorf("couldn't get inodes: %v", err)
+	}
+
+	for i := range mdList {
+		mg.mu.Lock()
+		err := mg.mergeInode(&mdList[i])
+		mg.mu.Unlock()
 
-		select {
-		case err := <-errChan:
-			return fmt.Errorf("couldn't process chunks: %v", err)
-		default:
-			// continue
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func processChunk(mdList []sqlite.Metadata, local *sqlite.Client, cache *zcache.Cache, wg *sync.WaitGroup, mu *sync.RWMutex, errChan chan error) {
-	wg.Add(1)
-	defer wg.Done()
+// mergeInode merges remote inode md into local database.
+// It should be called with mg.mu locked.
+func (mg *merger) mergeInode(md *sqlite.Metadata) error {
+	lmd, err := mg.local.GetInode(md.Inode)
+	if err != nil && err != common.ErrNotFound {
+		return fmt.Errorf("couldn't get metadata of inode %d: %v", md.Inode, err)
+	}
 
-	for _, md := range mdList {
-		mu.RLock()
-		lmd, err := local.Get(md.Inode)
-		if err != nil && err != common.ErrNotFound {
-			errChan <- fmt.Errorf("couldn't get metadata of inode %d: %v", md.Inode, err)
-			mu.RUnlock()
+	if err == common.ErrNotFound {
+		// force insert with inode
+		if err := mg.local.ForceInsertInode(md); err != nil {
+			return fmt.Errorf("couldn't force insert inode: %v", err)
+		}
 
-			return
+		mg.added[md.Inode] = true
+		return nil
+	}
+
+	same, err := mg.isSameFile(lmd, md)
+	if err != nil {
+		return err
+	}
+
+	if !same {
+		// both clients created a file with the same inode number.
+		// local file is moved to a new inode and remote one takes
+		// its place, otherwise the other clients may have wrong files
+		// in their caches.
+		newInode := mg.next
+		mg.next++
+
+		if err := mg.local.MoveInode(md.Inode, newInode); err != nil {
+			return fmt.Errorf("couldn't move inode %d: %v", md.Inode, err)
 		}
-		mu.RUnlock()
 
-		if err == common.ErrNotFound {
-			// force insert with inode
-			mu.Lock()
-			if err := local.ForceInsert(&md); err != nil {
-				errChan <- fmt.Errorf("couldn't force insert row: %v", err)
-				mu.Unlock()
+		if err := mg.local.ForceInsertInode(md); err != nil {
+			return fmt.Errorf("couldn't force insert inode: %v", err)
+		}
 
-				return
-			}
+		mg.added[md.Inode] = true
+		mg.onMove(md.Inode, newInode)
 
-			mu.Unlock()
-			continue
+		return nil
+	}
+
+	// another client moved it to another remote file
+	if lmd.URL != md.URL && lmd.URL != "" && md.URL != "" {
+		if _, err := mg.local.RenameURL(lmd.URL, md.URL); err != nil {
+			return fmt.Errorf("couldn't rename %s: %v", lmd.URL, err)
+		}
+
+		mg.onRename(lmd.URL, md.URL)
+		lmd.URL = md.URL
+	}
+
+	// names are taken from the database which changed the inode later,
+	// i.e. a file removed remotely is moved to the trash locally as well
+	if lmd.Inode != rootInode && md.CTime.After(lmd.CTime) {
+		mg.newer = append(mg.newer, md.Inode)
+	}
+
+	if mergeTimes(lmd, md) {
+		if err := mg.local.Update(lmd); err != nil {
+			return fmt.Errorf("couldn't update inode: %v", err)
 		}
+	}
 
-		if lmd.Name != md.Name && lmd.Parent != md.Parent && lmd.Hash != md.Hash {
-			// assuming it is a complete different file
-			// replace local row with the remote one and
-			// re-insert local row with a new inode
-			// if we don't do this way, the other client's cache may have
-			// wrong files.
-			// it is important to delete this inode from local cache.
+	return nil
+}
 
-			mu.Lock()
-			if err := local.Update(&md); err != nil {
-				errChan <- fmt.Errorf("couldn't update row: %v", err)
-				mu.Unlock()
+// isSameFile returns whether local and remote inodes with the same number
+// belong to the same file. Files are identified by their remote names or
+// their creation times since they may be moved to other remote files,
+// the others by their creation times or their names.
+func (mg *merger) isSameFile(local *sqlite.Metadata, remote *sqlite.Metadata) (bool, error) {
+	if local.Inode == rootInode {
+		return true, nil
+	}
+
+	if local.Type != remote.Type {
+		return false, nil
+	}
+
+	if local.Type == common.DrvFile {
+		return local.URL == remote.URL || (!local.CrTime.IsZero() && local.CrTime.Equal(remote.CrTime)), nil
+	}
 
-				return
+	if local.CrTime.Equal(remote.CrTime) {
+		return true, nil
+	}
+
+	llinks, err := mg.local.GetLinks(local.Inode)
+	if err != nil {
+		return false, fmt.Errorf("couldn't get names of inode %d: %v", local.Inode, err)
+	}
+
+	rlinks, err := mg.remote.GetLinks(remote.Inode)
+	if err != nil {
+		return false, fmt.Errorf("couldn't get names of inode %d: %v", remote.Inode, err)
+	}
+
+	for _, l := range llinks {
+		for _, r := range rlinks {
+			if l.Parent == r.Parent && l.Name == r.Name {
+				return true, nil
 			}
+		}
+	}
+
+	return false, nil
+}
+
+// mergeLinks replaces the local names of the inodes which are changed later
+// in remote database with the remote ones. A directory which would be moved
+// under itself keeps its local names.
+func (mg *merger) mergeLinks() error {
+	for _, inode := range mg.newer {
+		links, err := mg.remote.GetLinks(inode)
+		if err != nil {
+			return fmt.Errorf("couldn't get names of inode %d: %v", inode, err)
+		}
+
+		if err := mg.local.ReplaceLinks(inode, links); err != nil {
+			if err == common.ErrSubdirectory {
+				log.Warningf("names of directory %d aren't merged, it would be moved under itself", inode)
+				continue
+			}
+
+			return fmt.Errorf("couldn't replace names of inode %d: %v", inode, err)
+		}
+	}
+
+	return nil
+}
+
+// mergeDentries adds names of the inodes which are added from remote database.
+// Names of the inodes which already exist in local database are merged by
+// mergeLinks.
+func (mg *merger) mergeDentries(limit int, offset int) error {
+	dentries, err := mg.remote.GetDentries(limit, offset)
+	if err != nil {
+		return fmt.Errorf("couldn't get entries: %v", err)
+	}
+
+	for _, d := range dentries {
+		mg.mu.Lock()
+		err := mg.mergeDentry(d)
+		mg.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeDentry should be called with mg.mu locked
+func (mg *merger) mergeDentry(d sqlite.Dentry) error {
+	if !mg.added[d.Inode] {
+		return nil
+	}
+
+	name := d.Name
+
+	if _, err := mg.local.Search(d.Parent, name); err == nil {
+		name = common.GenerateConflictedFileName(name)
+	} else if err != common.ErrNotFound {
+		return fmt.Errorf("couldn't search for '%s' under %d: %v", name, d.Parent, err)
+	}
+
+	if err := mg.local.Link(d.Inode, d.Parent, name); err != nil {
+		return fmt.Errorf("couldn't add entry '%s' under %d: %v", name, d.Parent, err)
+	}
+
+	return nil
+}
+
+// mergeXAttrs adds extended attributes of the inodes which are added from
+// remote database, and the ones missing in local database of the others.
+// Values of the attributes which exist in both databases aren't changed.
+func (mg *merger) mergeXAttrs(limit int, offset int) error {
+	xattrs, err := mg.remote.GetXAttrs(limit, offset)
+	if err != nil {
+		return fmt.Errorf("couldn't get extended attributes: %v", err)
+	}
+
+	for _, x := range xattrs {
+		mg.mu.Lock()
+		err := mg.mergeXAttr(x)
+		mg.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-			if err := local.Insert(lmd); err != nil {
-				errChan <- fmt.Errorf("couldn't insert row: %v", err)
-				mu.Unlock()
+// mergeXAttr should be called with mg.mu locked
+func (mg *merger) mergeXAttr(x sqlite.XAttr) error {
+	flags := sqlite.XAttrCreate
+	if mg.added[x.Inode] {
+		flags = 0
+	}
 
-				return
+	err := mg.local.SetXAttr(x.Inode, x.Name, x.Value, flags)
+	if err != nil && err != common.ErrExists {
+		return fmt.Errorf("couldn't set extended attribute '%s' of %d: %v", x.Name, x.Inode, err)
+	}
+
+	return nil
+}
+
+// mergeTrash adds the trash entries of remote database whose entries under
+// sqlite.TrashParent are added to local database
+func (mg *merger) mergeTrash() error {
+	entries, err := mg.remote.GetTrash()
+	if err != nil {
+		return fmt.Errorf("couldn't get trash entries: %v", err)
+	}
+
+	for i := range entries {
+		if _, err := mg.local.Search(sqlite.TrashParent, entries[i].ID); err != nil {
+			if err == common.ErrNotFound {
+				continue
 			}
 
-			mu.Unlock()
+			return fmt.Errorf("couldn't search for trash entry %s: %v", entries[i].ID, err)
+		}
 
-			cache.Delete(common.ToString(md.Inode))
+		if err := mg.local.InsertTrashEntry(&entries[i]); err != nil {
+			return err
 		}
 	}
+
+	return nil
+}
+
+// mergeVersions adds the versions of remote database missing in local
+// database. Versions are identified by their remote files or their upload
+// times, so the ones which exist in both databases aren't changed.
+func (mg *merger) mergeVersions(limit int, offset int) error {
+	versions, err := mg.remote.GetVersionRows(limit, offset)
+	if err != nil {
+		return fmt.Errorf("couldn't get versions: %v", err)
+	}
+
+	for i := range versions {
+		mg.mu.Lock()
+		err := mg.mergeVersion(&versions[i])
+		mg.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeVersion adds remote version v to local database. A local version of
+// the same file uploaded at the same time is moved to the remote file of v
+// by another client, its url is changed. It should be called with mg.mu locked.
+func (mg *merger) mergeVersion(v *sqlite.Version) error {
+	versions, err := mg.local.GetVersions(v.Inode)
+	if err != nil {
+		return fmt.Errorf("couldn't get versions of inode %d: %v", v.Inode, err)
+	}
+
+	for _, lv := range versions {
+		if lv.URL == v.URL || !lv.Time.Equal(v.Time) {
+			continue
+		}
+
+		if _, err := mg.local.RenameURL(lv.URL, v.URL); err != nil {
+			return fmt.Errorf("couldn't rename %s: %v", lv.URL, err)
+		}
+
+		mg.onRename(lv.URL, v.URL)
+
+		return nil
+	}
+
+	if err := mg.local.InsertVersion(v); err != nil {
+		return fmt.Errorf("couldn't insert version %s: %v", v.URL, err)
+	}
+
+	return nil
+}
+
+// mergeSnapshots adds the snapshots of remote database missing in local database
+func (mg *merger) mergeSnapshots() error {
+	snapshots, err := mg.remote.GetSnapshots()
+	if err != nil {
+		return fmt.Errorf("couldn't get snapshots: %v", err)
+	}
+
+	for i := range snapshots {
+		if err := mg.local.InsertSnapshot(&snapshots[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeSnapshotBlobs adds the files referenced by the snapshots of remote
+// database. If a file is moved to keep it in remote database, its location
+// is updated in local database as well.
+func (mg *merger) mergeSnapshotBlobs(limit int, offset int) error {
+	blobs, err := mg.remote.GetSnapshotBlobs(limit, offset)
+	if err != nil {
+		return fmt.Errorf("couldn't get snapshot files: %v", err)
+	}
+
+	for i := range blobs {
+		mg.mu.Lock()
+		err := mg.local.InsertSnapshotBlob(&blobs[i])
+		mg.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeChunks adds the chunks of remote database missing in local database.
+// Only the ones referenced by chunk lists are added, the others may be
+// released and deleted by other clients.
+func (mg *merger) mergeChunks(limit int, offset int) error {
+	chunks, err := mg.remote.GetUsedChunks(limit, offset)
+	if err != nil {
+		return fmt.Errorf("couldn't get chunks: %v", err)
+	}
+
+	for i := range chunks {
+		mg.mu.Lock()
+		_, err := mg.local.InsertChunk(&chunks[i])
+		mg.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeChunkLists adds the chunk lists of remote database whose contents
+// aren't chunked in local database. Lists which exist in both aren't changed.
+func (mg *merger) mergeChunkLists(limit int, offset int) error {
+	urls, err := mg.remote.GetChunkListURLs(limit, offset)
+	if err != nil {
+		return fmt.Errorf("couldn't get chunk lists: %v", err)
+	}
+
+	for _, url := range urls {
+		chunks, err := mg.remote.GetChunkList(url)
+		if err != nil {
+			return fmt.Errorf("couldn't get chunks of %s: %v", url, err)
+		}
+
+		ids := make([]string, len(chunks))
+		for i := range chunks {
+			ids[i] = chunks[i].ID
+		}
+
+		if err := mg.mergeChunkList(url, ids); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (mg *merger) mergeChunkList(url string, ids []string) error {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	local, err := mg.local.GetChunkList(url)
+	if err != nil {
+		return fmt.Errorf("couldn't get chunks of %s: %v", url, err)
+	}
+
+	if len(local) > 0 {
+		return nil
+	}
+
+	if _, err := mg.local.SetChunkList(url, ids); err != nil {
+		return fmt.Errorf("couldn't set chunks of %s: %v", url, err)
+	}
+
+	return nil
+}
+
+// mergeReplicas adds the replicas of remote database missing in local database
+func (mg *merger) mergeReplicas(limit int, offset int) error {
+	replicas, err := mg.remote.GetReplicaRows(limit, offset)
+	if err != nil {
+		return fmt.Errorf("couldn't get replicas: %v", err)
+	}
+
+	for _, r := range replicas {
+		mg.mu.Lock()
+		err := mg.local.AddReplica(r.URL, r.Drive)
+		mg.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeSharded adds the sharded contents of remote database which
+// aren't sharded in local database
+func (mg *merger) mergeSharded(limit int, offset int) error {
+	contents, err := mg.remote.GetShardedRows(limit, offset)
+	if err != nil {
+		return fmt.Errorf("couldn't get sharded contents: %v", err)
+	}
+
+	for i := range contents {
+		mg.mu.Lock()
+		err := mg.local.InsertSharded(&contents[i])
+		mg.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeTimes updates timestamps of local with the ones of remote if they are
+// later, creation time is kept if it is earlier. Returns whether local is changed.
+func mergeTimes(local *sqlite.Metadata, remote *sqlite.Metadata) bool {
+	changed := false
+
+	for _, t := range []struct{ l, r *time.Time }{
+		{&local.ATime, &remote.ATime},
+		{&local.MTime, &remote.MTime},
+		{&local.CTime, &remote.CTime},
+	} {
+		if t.r.After(*t.l) {
+			*t.l = *t.r
+			changed = true
+		}
+	}
+
+	if !remote.CrTime.IsZero() && (local.CrTime.IsZero() || remote.CrTime.Before(local.CrTime)) {
+		local.CrTime = remote.CrTime
+		changed = true
+	}
+
+	return changed
 }
 
 // backupDatabase creates a copy of current database and returns its path
@@ -0,0 +1,288 @@
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+)
+
+// newTestDatabases returns the paths of two empty databases, the local
+// and the remote one
+func newTestDatabases(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "cloudstash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	local := filepath.Join(dir, "local.sqlite3")
+	remote := filepath.Join(dir, "remote.sqlite3")
+
+	for _, path := range []string{local, remote} {
+		if err := sqlite.InitDB(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return local, remote
+}
+
+func openTestDatabase(t *testing.T, path string) *sqlite.Client {
+	db, err := sqlite.NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func insertTestRows(t *testing.T, path string, rows ...sqlite.Metadata) {
+	db := openTestDatabase(t, path)
+	defer db.Close()
+
+	for i := range rows {
+		if err := db.ForceInsertInode(&rows[i]); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Link(rows[i].Inode, rows[i].Parent, rows[i].Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func insertTestChunks(t *testing.T, db *sqlite.Client, ids ...string) {
+	for _, id := range ids {
+		if _, err := db.InsertChunk(&sqlite.Chunk{ID: id, URL: "drive://" + id, Size: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// insertSharedChunk adds chunk c used by the content at drive://shared
+// to the databases at paths
+func insertSharedChunk(t *testing.T, paths ...string) {
+	for _, path := range paths {
+		db := openTestDatabase(t, path)
+		insertTestChunks(t, db, "c")
+
+		if _, err := db.SetChunkList("drive://shared", []string{"c"}); err != nil {
+			t.Fatal(err)
+		}
+
+		db.Close()
+	}
+}
+
+// mergeTestDatabases merges remote into local and returns the inodes
+// moved by the merge
+func mergeTestDatabases(t *testing.T, local string, remote string) (*sqlite.Client, map[int64]int64) {
+	moved := map[int64]int64{}
+	onMove := func(inode int64, newInode int64) {
+		moved[inode] = newInode
+	}
+
+	db := &database{path: local}
+	if err := db.merge(remote, onMove, func(string, string) {}); err != nil {
+		t.Fatalf("couldn't merge databases: %v", err)
+	}
+
+	merged := openTestDatabase(t, local)
+	t.Cleanup(merged.Close)
+
+	return merged, moved
+}
+
+func TestMergeAddsRemoteFiles(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	insertTestRows(t, local, sqlite.Metadata{Inode: 2, Name: "local", Parent: 1, Type: common.DrvFile, URL: "drive://local"})
+	insertTestRows(t, remote, sqlite.Metadata{Inode: 3, Name: "remote", Parent: 1, Type: common.DrvFile, URL: "drive://remote"})
+
+	db, _ := mergeTestDatabases(t, local, remote)
+
+	for inode, name := range map[int64]string{2: "local", 3: "remote"} {
+		md, err := db.Get(inode)
+		if err != nil {
+			t.Fatalf("inode %d is missing after merge: %v", inode, err)
+		}
+
+		if md.Name != name {
+			t.Errorf("inode %d is %s, expected %s", inode, md.Name, name)
+		}
+	}
+}
+
+func TestMergeConflictingInode(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	// both clients created a file with inode 2
+	insertTestRows(t, local, sqlite.Metadata{Inode: 2, Name: "a", Parent: 1, Type: common.DrvFile, URL: "drive://a"})
+	insertTestRows(t, remote, sqlite.Metadata{Inode: 2, Name: "b", Parent: 1, Type: common.DrvFile, URL: "drive://b"})
+
+	db, moved := mergeTestDatabases(t, local, remote)
+
+	// remote file keeps its inode
+	md, err := db.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.Name != "b" || md.URL != "drive://b" {
+		t.Errorf("inode 2 isn't the remote file: %+v", md)
+	}
+
+	// and the local one is moved to a new inode
+	md, err = db.Search(1, "a")
+	if err != nil {
+		t.Fatalf("local file is lost: %v", err)
+	}
+
+	if md.Inode == 2 || md.URL != "drive://a" || moved[2] != md.Inode {
+		t.Errorf("local file isn't moved: %+v, moved: %v", md, moved)
+	}
+}
+
+func TestMergeIgnoresRemoteRename(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	// names are only taken from remote if it changed the inode later
+
+	insertTestRows(t, local, sqlite.Metadata{Inode: 2, Name: "a", Parent: 1, Type: common.DrvFile, URL: "drive://a"})
+	insertTestRows(t, remote, sqlite.Metadata{Inode: 2, Name: "renamed", Parent: 1, Type: common.DrvFile, URL: "drive://a"})
+
+	db, moved := mergeTestDatabases(t, local, remote)
+
+	if len(moved) != 0 {
+		t.Errorf("same file is moved: %v", moved)
+	}
+
+	if _, err := db.Search(1, "a"); err != nil {
+		t.Errorf("local name is lost: %v", err)
+	}
+
+	if _, err := db.Search(1, "renamed"); err != common.ErrNotFound {
+		t.Errorf("remote name is added: %v", err)
+	}
+}
+
+func TestMergeReleasedChunk(t *testing.T) {
+	local, remote := newTestDatabases(t)
+	insertSharedChunk(t, local, remote)
+
+	// another client releases c while a local content uses it too
+	db := openTestDatabase(t, remote)
+
+	released, _, err := db.DeleteChunkList("drive://shared")
+	if err != nil || len(released) != 1 {
+		t.Fatalf("couldn't release chunk: %v", err)
+	}
+
+	db.Close()
+
+	db = openTestDatabase(t, local)
+
+	if _, err := db.SetChunkList("drive://local", []string{"c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	db, _ = mergeTestDatabases(t, local, remote)
+
+	chunks, err := db.GetChunkList("drive://local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(chunks) != 1 || chunks[0].ID != "c" {
+		t.Fatalf("local content lost its chunk: %v", chunks)
+	}
+
+	// the client which released it doesn't delete it after the merged database is uploaded
+	referenced, err := db.IsReferenced(chunks[0].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !referenced {
+		t.Errorf("chunk used by a local content isn't referenced")
+	}
+}
+
+func TestMergeUnusedChunks(t *testing.T) {
+	local, remote := newTestDatabases(t)
+	insertSharedChunk(t, local, remote)
+
+	// chunks of a remote content and of a remote upload which failed
+	db := openTestDatabase(t, remote)
+	insertTestChunks(t, db, "used", "unused")
+
+	if _, err := db.SetChunkList("drive://remote", []string{"c", "used"}); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	// c is released locally, the remote content still uses it
+	db = openTestDatabase(t, local)
+
+	if _, _, err := db.DeleteChunkList("drive://shared"); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	db, _ = mergeTestDatabases(t, local, remote)
+
+	for _, id := range []string{"c", "used"} {
+		if _, err := db.GetChunk(id); err != nil {
+			t.Errorf("chunk %s used by a remote content isn't merged: %v", id, err)
+		}
+	}
+
+	if _, err := db.GetChunk("unused"); err != common.ErrNotFound {
+		t.Errorf("unused chunk is merged: %v", err)
+	}
+
+	chunks, err := db.GetChunkList("drive://remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(chunks) != 2 {
+		t.Errorf("remote content has %d chunks, expected 2", len(chunks))
+	}
+}
+
+func TestMergeRenamesDrives(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	// remote database is uploaded by a client which doesn't know the id of drive a
+	insertTestRows(t, local, sqlite.Metadata{Inode: 2, Name: "f", Parent: 1, Type: common.DrvFile, URL: "d1://f"})
+	insertTestRows(t, remote, sqlite.Metadata{Inode: 2, Name: "f", Parent: 1, Type: common.DrvFile, URL: "a://f"})
+
+	db := &database{path: local, renames: map[string]string{"a": "d1"}}
+
+	renames := map[string]string{}
+	if err := db.merge(remote, func(int64, int64) {}, func(url string, newURL string) { renames[url] = newURL }); err != nil {
+		t.Fatal(err)
+	}
+
+	merged := openTestDatabase(t, local)
+	defer merged.Close()
+
+	md, err := merged.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.URL != "d1://f" || len(renames) != 0 {
+		t.Errorf("remote url isn't renamed before the merge: %+v, renames: %v", md, renames)
+	}
+}
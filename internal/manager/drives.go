@@ -0,0 +1,136 @@
+package manager
+
+import (
+	"fmt"
+
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DriveInfo is a drive of the vault and what is stored in it
+type DriveInfo struct {
+	ID        string
+	Name      string
+	Files     int   // remote files in the drive referenced by the database
+	Replicas  int   // replicas of the remote files in other drives
+	Available int64 // available space, -1 if it is unknown
+	Database  bool  // whether the database is stored in the drive
+}
+
+// ListDrives returns the drives of the vault
+func (m *Manager) ListDrives() ([]DriveInfo, error) {
+	drives := m.driveSpaces()
+
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	infos := make([]DriveInfo, len(drives))
+
+	for i, d := range drives {
+		id, name := d.Drive.GetID(), d.Drive.GetProviderName()
+
+		files, err := db.GetDriveURLCount(id)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't count files in %s: %v", name, err)
+		}
+
+		replicas, err := db.GetDriveReplicaCount(id)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't count replicas in %s: %v", name, err)
+		}
+
+		infos[i] = DriveInfo{
+			ID:        id,
+			Name:      name,
+			Files:     files,
+			Replicas:  replicas,
+			Available: d.Available,
+			Database:  d.Drive == m.db.extDrive,
+		}
+	}
+
+	return infos, nil
+}
+
+// getDriveByName returns the drive named name
+func (m *Manager) getDriveByName(name string) (drive.Drive, error) {
+	for _, drv := range m.drives {
+		if drv.GetProviderName() == name {
+			return drv, nil
+		}
+	}
+
+	return nil, fmt.Errorf("couldn't find drive %s", name)
+}
+
+// InUse returns whether anything is stored in the drive
+func (d *DriveInfo) InUse() bool {
+	return d.Files > 0 || d.Replicas > 0 || d.Database
+}
+
+// renameDrives changes the schemes of the urls of the drives in renames
+// to their ids, in the database and in the journal
+func (m *Manager) renameDrives(renames map[string]string) error {
+	if len(renames) == 0 {
+		return nil
+	}
+
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	m.db.renames = renames
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	renamed, err := renameDriveURLs(db, renames)
+	if err != nil {
+		return err
+	}
+
+	for name, id := range renames {
+		m.journal.renameScheme(name, id)
+	}
+
+	if err := m.db.saveState(); err != nil {
+		log.Warningf("couldn't save database state: %v", err)
+	}
+
+	if renamed {
+		m.notifyChangeInDatabase()
+	}
+
+	return nil
+}
+
+// renameDriveURLs changes the schemes of the urls of the drives in renames
+// to their ids in db. Returns whether any of them is changed.
+func renameDriveURLs(db *sqlite.Client, renames map[string]string) (bool, error) {
+	renamed := false
+
+	for name, id := range renames {
+		n, err := db.RenameDrive(name, id)
+		if err != nil {
+			return false, err
+		}
+
+		if n > 0 {
+			log.Infof("drive %s is identified by %s now, %d references are renamed", name, id, n)
+
+			renamed = true
+		}
+	}
+
+	return renamed, nil
+}
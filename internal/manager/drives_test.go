@@ -0,0 +1,114 @@
+package manager
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+)
+
+func TestListDrives(t *testing.T) {
+	m, _, _ := newTestReplicaManager(t)
+
+	writeTestFile(t, m, "a", []byte("first"))
+	writeTestFile(t, m, "b", []byte("second"))
+
+	infos, err := m.ListDrives()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 2 {
+		t.Fatalf("%d drives are listed, expected 2", len(infos))
+	}
+
+	for _, info := range infos {
+		// files are in one of the drives and their replicas in the other one
+		if info.Files+info.Replicas != 2 || !info.InUse() {
+			t.Errorf("drive %s has %d files and %d replicas", info.Name, info.Files, info.Replicas)
+		}
+
+		if info.Database != (info.Name == "a") {
+			t.Errorf("database is listed in drive %s: %v", info.Name, info.Database)
+		}
+
+		if info.Available <= 0 {
+			t.Errorf("available space of drive %s is %d", info.Name, info.Available)
+		}
+	}
+
+	if (&DriveInfo{Name: "empty"}).InUse() {
+		t.Errorf("empty drive is in use")
+	}
+}
+
+func TestRenameDrives(t *testing.T) {
+	a := newMemDrive("a")
+	m := newTestManager(t, a)
+
+	// the file is stored before the drive has an id
+	inode := writeTestFile(t, m, "file", []byte("renamed"))
+
+	a.id = "d1"
+
+	if err := m.renameDrives(map[string]string{"a": "d1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(md.URL, "d1://") || !a.has(md.URL) {
+		t.Errorf("url isn't renamed: %s", md.URL)
+	}
+
+	if content := readTestFile(t, m, "file"); content != "renamed" {
+		t.Errorf("content of renamed file is '%s'", content)
+	}
+}
+
+func TestMigrateDriveByName(t *testing.T) {
+	a := newMemDrive("a")
+	b := newMemDrive("b")
+	a.id, b.id = "da", "db"
+
+	m := newTestManager(t, a)
+	m.drives = []drive.Drive{a}
+
+	inode := writeTestFile(t, m, "file", []byte("moved"))
+
+	m.drives = []drive.Drive{a, b}
+	m.quotas.refresh(m.drives)
+
+	// drives are given by their names, files are referred to by their ids
+	res, err := m.MigrateDrive("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Moved != 1 {
+		t.Errorf("%d files are moved, expected 1", res.Moved)
+	}
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(md.URL, "db://") || !b.has(md.URL) {
+		t.Errorf("file isn't moved to b: %s", md.URL)
+	}
+
+	infos, err := m.ListDrives()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, info := range infos {
+		if info.ID != "d"+info.Name {
+			t.Errorf("drive %s is listed with id %s", info.Name, info.ID)
+		}
+	}
+}
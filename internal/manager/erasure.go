@@ -0,0 +1,239 @@
+package manager
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/erasure"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// putShards splits the content read from r into shards and uploads each of
+// them to a different drive as the content at url. All of the shards should be
+// uploaded. The shards of the previous content are deleted.
+func (m *Manager) putShards(url string, r io.Reader) error {
+	code := m.erasure
+
+	u, err := common.ParseURL(url)
+	if err != nil {
+		return fmt.Errorf("couldn't parse url %s: %v", url, err)
+	}
+
+	drives := m.drivesBySpace(nil)
+	if len(drives) < code.Shards() {
+		return fmt.Errorf("%d drives are reachable, %d are needed for shards", len(drives), code.Shards())
+	}
+
+	drives = drives[:code.Shards()]
+
+	names := make([]string, len(drives))
+	writers := make([]io.Writer, len(drives))
+	pipes := make([]*io.PipeWriter, len(drives))
+	errs := make([]error, len(drives))
+
+	wg := sync.WaitGroup{}
+
+	for i, drv := range drives {
+		names[i] = common.ObfuscateFileName(fmt.Sprintf("%s.%d", u.Name, i))
+
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		pipes[i] = pw
+
+		wg.Add(1)
+		go func(i int, drv drive.Drive) {
+			defer wg.Done()
+
+			errs[i] = drv.PutFile(names[i], pr)
+
+			// the shard isn't read anymore, the split shouldn't wait for it
+			pr.CloseWithError(fmt.Errorf("upload is stopped"))
+		}(i, drv)
+	}
+
+	size, err := code.Split(r, writers)
+
+	for _, pw := range pipes {
+		pw.CloseWithError(err)
+	}
+
+	wg.Wait()
+
+	for i := range errs {
+		if err == nil && errs[i] != nil {
+			err = fmt.Errorf("couldn't upload shard to %s: %v", drives[i].GetProviderName(), errs[i])
+		}
+	}
+
+	if err != nil {
+		// uploaded shards aren't referenced
+		for i, drv := range drives {
+			if errs[i] == nil {
+				drv.DeleteFile(names[i])
+			}
+		}
+
+		return err
+	}
+
+	s := &sqlite.Sharded{
+		URL:       url,
+		Size:      size,
+		Data:      code.Data,
+		Parity:    code.Parity,
+		Locations: make([]string, len(drives)),
+	}
+
+	for i, drv := range drives {
+		s.Locations[i] = drive.GetURL(drv, names[i])
+	}
+
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	old, err := db.SetSharded(s)
+	if err != nil {
+		return fmt.Errorf("couldn't set shards of %s: %v", url, err)
+	}
+
+	m.notifyChangeInDatabase()
+
+	for _, l := range old {
+		m.scheduleDeletion(0, l)
+	}
+
+	return nil
+}
+
+// openShards returns a reader of the sharded content. All of the available
+// shards are opened; data shards are read if they are available, parity
+// shards replace the ones which aren't or which fail while they are read.
+func (m *Manager) openShards(s *sqlite.Sharded) (io.ReadCloser, error) {
+	code, err := erasure.NewCode(s.Data, s.Parity)
+	if err != nil {
+		return nil, err
+	}
+
+	sr := &shardReader{}
+	readers := make([]io.Reader, len(s.Locations))
+
+	for i, l := range s.Locations {
+		if l == "" {
+			continue
+		}
+
+		u, err := common.ParseURL(l)
+		if err != nil {
+			log.Warningf("couldn't parse shard url %s: %v", l, err)
+			continue
+		}
+
+		drv, err := m.getDriveClient(u.Scheme)
+		if err != nil {
+			log.Warningf("couldn't find drive client of shard %s: %v", l, err)
+			continue
+		}
+
+		reader, err := drv.GetFile(u.Name)
+		if err != nil {
+			log.Warningf("couldn't get shard %d of %s: %v", i, s.URL, err)
+			continue
+		}
+
+		readers[i] = reader
+		sr.closers = append(sr.closers, reader)
+	}
+
+	if len(sr.closers) < s.Data {
+		sr.Close()
+
+		return nil, fmt.Errorf("%d of %d needed shards are available", len(sr.closers), s.Data)
+	}
+
+	sr.Reader = code.Join(readers, s.Size)
+
+	return sr, nil
+}
+
+type shardReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (sr *shardReader) Close() error {
+	for _, c := range sr.closers {
+		c.Close()
+	}
+
+	return nil
+}
+
+// getSharded returns the shards of the content at url,
+// common.ErrNotFound if it isn't sharded
+func (m *Manager) getSharded(url string) (*sqlite.Sharded, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	return db.GetSharded(url)
+}
+
+// isSharded returns whether the content at url is sharded
+func (m *Manager) isSharded(url string) (bool, error) {
+	_, err := m.getSharded(url)
+	if err == common.ErrNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("couldn't get shards of %s: %v", url, err)
+	}
+
+	return true, nil
+}
+
+// releaseShards removes the shards of the content at url and schedules
+// their deletion. Returns false if the content isn't sharded.
+func (m *Manager) releaseShards(url string) (bool, error) {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return false, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	locations, found, err := db.DeleteSharded(url)
+	if err != nil {
+		return false, fmt.Errorf("couldn't delete shards of %s: %v", url, err)
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	m.notifyChangeInDatabase()
+
+	for _, l := range locations {
+		m.scheduleDeletion(0, l)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,142 @@
+package manager
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/erasure"
+)
+
+// newTestErasureManager returns a manager which splits remote files
+// into 2 data and 1 parity shards on 3 drives
+func newTestErasureManager(t *testing.T) (*Manager, []*memDrive) {
+	drvs := []*memDrive{newMemDrive("a"), newMemDrive("b"), newMemDrive("c")}
+
+	m := newTestManager(t, drvs[0])
+	m.drives = []drive.Drive{drvs[0], drvs[1], drvs[2]}
+
+	code, err := erasure.NewCode(2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.erasure = code
+
+	return m, drvs
+}
+
+// shardFile returns the drive and the name of the shard at url
+func shardFile(t *testing.T, drvs []*memDrive, url string) (*memDrive, string) {
+	u, err := common.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range drvs {
+		if d.name == u.Scheme {
+			return d, u.Name
+		}
+	}
+
+	t.Fatalf("shard %s isn't in a drive", url)
+
+	return nil, ""
+}
+
+func TestErasureCoding(t *testing.T) {
+	m, drvs := newTestErasureManager(t)
+
+	data := bytes.Repeat([]byte("sharded content "), 1<<12)
+
+	inode := writeTestFile(t, m, "file", data)
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := m.getSharded(md.URL)
+	if err != nil {
+		t.Fatalf("file isn't sharded: %v", err)
+	}
+
+	if len(s.Locations) != 3 {
+		t.Fatalf("file has %d shards, expected 3", len(s.Locations))
+	}
+
+	schemes := map[string]bool{}
+
+	for _, l := range s.Locations {
+		d, _ := shardFile(t, drvs, l)
+		schemes[d.name] = true
+	}
+
+	if len(schemes) != 3 {
+		t.Errorf("shards aren't stored in different drives: %v", s.Locations)
+	}
+
+	// any single drive can be lost
+	for i, l := range s.Locations {
+		d, name := shardFile(t, drvs, l)
+
+		shard := d.files[name]
+		if err := d.DeleteFile(name); err != nil {
+			t.Fatal(err)
+		}
+
+		if content := readTestFile(t, m, "file"); content != string(data) {
+			t.Errorf("content is changed without shard %d", i)
+		}
+
+		d.files[name] = shard
+	}
+
+	// and the content isn't readable without two of them
+	for _, l := range s.Locations[:2] {
+		d, name := shardFile(t, drvs, l)
+		d.DeleteFile(name)
+	}
+
+	if _, err := m.downloadFile(md); err == nil {
+		t.Errorf("content is read with a single shard")
+	}
+}
+
+func TestReleaseShards(t *testing.T) {
+	m, drvs := newTestErasureManager(t)
+
+	inode := writeTestFile(t, m, "file", []byte("content"))
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := m.getSharded(md.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := m.RemovePath("/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.PurgeTrash(e.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first pass releases the shards, the second one deletes them
+	processChanges(m, forceAll)
+	processChanges(m, forceAll)
+
+	for _, l := range s.Locations {
+		for _, d := range drvs {
+			if d.has(l) {
+				t.Errorf("shard %s isn't deleted", l)
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fileHandle is a file opened through the filesystem. The cached file
+// is kept open until the handle is released.
+type fileHandle struct {
+	inode     int64
+	file      *os.File
+	dirty     bool // written since the last flush
+	temporary bool // file is removed when the handle is released
+}
+
+// handleTable keeps the open file handles and the number
+// of handles open for each inode
+type handleTable struct {
+	nextID  uint64
+	handles map[uint64]*fileHandle
+	refs    map[int64]int
+	mu      sync.Mutex
+}
+
+func newHandleTable() *handleTable {
+	return &handleTable{
+		handles: map[uint64]*fileHandle{},
+		refs:    map[int64]int{},
+	}
+}
+
+// isOpen returns whether there is an open handle of inode
+func (t *handleTable) isOpen(inode int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.refs[inode] > 0
+}
+
+func (t *handleTable) add(h *fileHandle) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+
+	t.handles[t.nextID] = h
+	t.refs[h.inode]++
+
+	return t.nextID
+}
+
+func (t *handleTable) get(id uint64) (*fileHandle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.handles[id]
+	if !ok {
+		return nil, fmt.Errorf("invalid file handle %d", id)
+	}
+
+	return h, nil
+}
+
+func (t *handleTable) remove(id uint64) (*fileHandle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.handles[id]
+	if !ok {
+		return nil, fmt.Errorf("invalid file handle %d", id)
+	}
+
+	delete(t.handles, id)
+
+	t.refs[h.inode]--
+	if t.refs[h.inode] == 0 {
+		delete(t.refs, h.inode)
+	}
+
+	return h, nil
+}
+
+// moveInode changes inode number of the handles of inode to newInode
+func (t *handleTable) moveInode(inode int64, newInode int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, h := range t.handles {
+		if h.inode == inode {
+			h.inode = newInode
+		}
+	}
+
+	if n, ok := t.refs[inode]; ok {
+		t.refs[newInode] = n
+		delete(t.refs, inode)
+	}
+}
+
+// OpenHandle opens file with provided flag and returns a handle to be used
+// in subsequent reads and writes. The file is kept open and its cache entry
+// doesn't expire until the handle is released.
+func (m *Manager) OpenHandle(md *sqlite.Metadata, flag int) (uint64, error) {
+	file, err := m.OpenFile(md, flag)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.handles.add(&fileHandle{inode: md.Inode, file: file}), nil
+}
+
+// ReadHandle reads len(p) bytes from the file at offset off. It returns
+// less bytes than requested only at the end of the file.
+func (m *Manager) ReadHandle(id uint64, p []byte, off int64) (int, error) {
+	h, err := m.handles.get(id)
+	if err != nil {
+		return 0, err
+	}
+
+	return h.file.ReadAt(p, off)
+}
+
+// WriteHandle writes p to the file at offset off. Changes are
+// committed to the database when the handle is flushed.
+func (m *Manager) WriteHandle(id uint64, p []byte, off int64) (int, error) {
+	h, err := m.handles.get(id)
+	if err != nil {
+		return 0, err
+	}
+
+	m.handles.mu.Lock()
+	h.dirty = true
+	m.handles.mu.Unlock()
+
+	return h.file.WriteAt(p, off)
+}
+
+// FlushHandle updates metadata of the file and schedules its upload
+// if it is written through the handle since the last flush
+func (m *Manager) FlushHandle(id uint64) error {
+	h, err := m.handles.get(id)
+	if err != nil {
+		return err
+	}
+
+	m.handles.mu.Lock()
+	dirty := h.dirty
+	h.dirty = false
+	m.handles.mu.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	if err := m.UpdateMetadataFromCache(h.inode); err != nil {
+		m.handles.mu.Lock()
+		h.dirty = true
+		m.handles.mu.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// ReleaseHandle flushes and closes the file. When the last handle of
+// the file is released, the cache entry starts to expire again.
+func (m *Manager) ReleaseHandle(id uint64) error {
+	ferr := m.FlushHandle(id)
+
+	h, err := m.handles.remove(id)
+	if err != nil {
+		return err
+	}
+
+	if err := h.file.Close(); err != nil {
+		log.Warningf("couldn't close cached file %s: %v", h.file.Name(), err)
+	}
+
+	if h.temporary {
+		if err := os.Remove(h.file.Name()); err != nil {
+			log.Warningf("couldn't remove file %s: %v", h.file.Name(), err)
+		}
+
+		return ferr
+	}
+
+	if !m.handles.isOpen(h.inode) {
+		m.cache.Touch(common.ToString(h.inode), cacheExpiration)
+	}
+
+	return ferr
+}
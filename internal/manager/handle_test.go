@@ -0,0 +1,99 @@
+package manager
+
+import (
+	"os"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+func TestHandleLifetime(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+
+	md, err := m.CreateFile(testRootInode, "file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := m.OpenHandle(md, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.WriteHandle(id, []byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the written content is read through the same file
+	p := make([]byte, 5)
+	if n, _ := m.ReadHandle(id, p, 0); string(p[:n]) != "hello" {
+		t.Errorf("read %q through the handle", p[:n])
+	}
+
+	if err := m.FlushHandle(id); err != nil {
+		t.Fatal(err)
+	}
+
+	processChanges(m, forceAll)
+
+	updated, err := m.GetMetadata(md.Inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Size != 5 || !drv.has(updated.URL) {
+		t.Errorf("flushed file isn't uploaded: %+v", updated)
+	}
+
+	// the cached file isn't deleted while the handle is open,
+	// even if there is nothing to upload
+	path := cachedPath(t, m, md.Inode)
+
+	m.cache.Delete(common.ToString(md.Inode))
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("cached file of open handle is deleted: %v", err)
+	}
+
+	if err := m.ReleaseHandle(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.ReadHandle(id, p, 0); err == nil {
+		t.Errorf("released handle is still valid")
+	}
+
+	m.cache.Delete(common.ToString(md.Inode))
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("cached file isn't deleted after the handle is released: %v", err)
+	}
+}
+
+func TestHandleRefs(t *testing.T) {
+	handles := newHandleTable()
+
+	a := handles.add(&fileHandle{inode: 2})
+	b := handles.add(&fileHandle{inode: 2})
+
+	if _, err := handles.remove(a); err != nil {
+		t.Fatal(err)
+	}
+
+	if !handles.isOpen(2) {
+		t.Errorf("inode isn't open while it has another handle")
+	}
+
+	if _, err := handles.remove(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if handles.isOpen(2) {
+		t.Errorf("inode is open after all of its handles are removed")
+	}
+
+	if _, err := handles.remove(b); err == nil {
+		t.Errorf("handle is removed twice")
+	}
+}
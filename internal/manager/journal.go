@@ -0,0 +1,456 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const journalFileName = "journal.json"
+
+// journal keeps the local changes until they are uploaded to remote drives.
+// Changes are written to the journal as soon as they are made and removed
+// once the upload succeeds. It is persisted to the local state directory
+// so that the changes survive crashes and the periods the drives are
+// unreachable.
+type journal struct {
+	path    string
+	entries map[string]PendingUpload
+	mu      sync.Mutex
+}
+
+// PendingUpload is a local change waiting to be uploaded
+type PendingUpload struct {
+	Inode       int64 // 0 for the database
+	Path        string
+	CachePath   string
+	RemotePath  string
+	Updated     time.Time // time of the last change
+	Attempts    int       // number of failed upload attempts
+	LastError   string
+	NextAttempt time.Time // upload isn't retried before this time
+	Failed      bool      // upload is given up until the next change
+	Delete      bool      // remote file is deleted instead of uploaded
+	Delayed     bool      // other clients may still use the remote file
+	Deferred    bool      // deletion waits for the database to be uploaded
+}
+
+// newJournal loads the journal at path, if it doesn't exist
+// returns an empty one. A journal which can't be parsed, i.e. one left
+// truncated by a crash, is moved aside and an empty one is returned.
+func newJournal(path string) (*journal, error) {
+	j := &journal{
+		path:    path,
+		entries: map[string]PendingUpload{},
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, nil
+		}
+
+		return nil, fmt.Errorf("couldn't open journal file: %v", err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&j.entries); err != nil {
+		broken := fmt.Sprintf("%s.broken-%d", path, time.Now().Unix())
+
+		log.Warningf("couldn't parse journal file, moving it to %s and starting with an empty journal: %v", broken, err)
+
+		if err := os.Rename(path, broken); err != nil {
+			return nil, fmt.Errorf("couldn't move journal file aside: %v", err)
+		}
+
+		j.entries = map[string]PendingUpload{}
+	}
+
+	return j, nil
+}
+
+// ReadPendingUploads reads the journal in stateDir without a running Manager,
+// i.e. to inspect the changes left by a crashed process
+func ReadPendingUploads(stateDir string) ([]PendingUpload, error) {
+	j, err := newJournal(filepath.Join(stateDir, journalFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	uploads := j.list()
+
+	path := filepath.Join(stateDir, common.DatabaseFileName)
+	if _, err := os.Stat(path); err != nil {
+		return uploads, nil
+	}
+
+	db, err := sqlite.NewClient(path)
+	if err != nil {
+		return uploads, nil
+	}
+	defer db.Close()
+
+	fillPaths(db, uploads)
+
+	return uploads, nil
+}
+
+// add adds entry to the journal or updates the existing one. A change of an
+// entry which is already pending is only kept in memory, the one on the disk
+// is enough to upload it after a crash. Otherwise every metadata change would
+// rewrite the whole journal for the database entry.
+func (j *journal) add(entry trackerEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	u, pending := j.entries[entry.key()]
+	pending = pending && u.Inode == entry.inode && u.RemotePath == entry.remotePath && u.Delete == entry.delete &&
+		u.Delayed == entry.delayed && u.Deferred == entry.delayed
+
+	// a new change deserves a new chance
+	if u.Failed {
+		pending = false
+
+		u.Failed = false
+		u.Attempts = 0
+		u.NextAttempt = time.Time{}
+	}
+
+	u.Inode = entry.inode
+	u.CachePath = entry.cachePath
+	u.RemotePath = entry.remotePath
+	u.Updated = entry.accessTime
+	u.Delete = entry.delete
+	u.Delayed = entry.delayed
+	u.Deferred = entry.delayed
+
+	j.entries[entry.key()] = u
+
+	if !pending {
+		j.save()
+	}
+}
+
+// fail records a failed upload attempt of the entry with key and schedules
+// the next attempt. If err is permanent or there are too many attempts, the upload
+// is marked as failed and isn't retried until the file is changed again.
+func (j *journal) fail(key string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	u, ok := j.entries[key]
+	if !ok {
+		return
+	}
+
+	u.Attempts++
+	u.LastError = err.Error()
+	u.NextAttempt = time.Now().Add(backoff(u.Attempts))
+
+	if isPermanent(err) || u.Attempts >= maxAttempts {
+		u.Failed = true
+
+		logFailure(u)
+	}
+
+	j.entries[key] = u
+
+	j.save()
+}
+
+// complete removes the entry with key from the journal if it hasn't been
+// changed after updated, otherwise the newer change is kept to be uploaded
+func (j *journal) complete(key string, updated time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	u, ok := j.entries[key]
+	if !ok || u.Updated.After(updated) {
+		return
+	}
+
+	delete(j.entries, key)
+
+	j.save()
+}
+
+// remove removes entry of cachePath from the journal
+func (j *journal) remove(cachePath string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, ok := j.entries[cachePath]; !ok {
+		return
+	}
+
+	delete(j.entries, cachePath)
+
+	j.save()
+}
+
+// moveInode changes inode number of the entries of inode to newInode
+func (j *journal) moveInode(inode int64, newInode int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	changed := false
+
+	for path, u := range j.entries {
+		if u.Inode == inode {
+			u.Inode = newInode
+			j.entries[path] = u
+
+			changed = true
+		}
+	}
+
+	if changed {
+		j.save()
+	}
+}
+
+// release schedules the delayed deletions which wait for the database
+// to be uploaded, they are made after delay
+func (j *journal) release(delay time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	changed := false
+
+	for key, u := range j.entries {
+		if u.Deferred {
+			u.Deferred = false
+			u.NextAttempt = time.Now().Add(delay)
+			j.entries[key] = u
+
+			changed = true
+		}
+	}
+
+	if changed {
+		j.save()
+	}
+}
+
+// renameRemote changes the remote paths of the uploads to url to newURL.
+// They are marked as updated so that an upload in progress doesn't
+// complete them.
+func (j *journal) renameRemote(url string, newURL string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	changed := false
+
+	for key, u := range j.entries {
+		if !u.Delete && u.RemotePath == url {
+			u.RemotePath = newURL
+			u.Updated = time.Now()
+			j.entries[key] = u
+
+			changed = true
+		}
+	}
+
+	if changed {
+		j.save()
+	}
+}
+
+// renameScheme changes the scheme of the remote paths of the entries
+// from scheme to newScheme
+func (j *journal) renameScheme(scheme string, newScheme string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	prefix := scheme + "://"
+	changed := false
+
+	for key, u := range j.entries {
+		if !strings.HasPrefix(u.RemotePath, prefix) {
+			continue
+		}
+
+		u.RemotePath = newScheme + "://" + strings.TrimPrefix(u.RemotePath, prefix)
+
+		// deletions are kept by their remote paths
+		delete(j.entries, key)
+		if u.Delete {
+			key = u.RemotePath
+		}
+
+		j.entries[key] = u
+
+		changed = true
+	}
+
+	if changed {
+		j.save()
+	}
+}
+
+// has returns whether there is an entry of cachePath in the journal
+func (j *journal) has(cachePath string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, ok := j.entries[cachePath]
+
+	return ok
+}
+
+// hasRemote returns whether there is an entry uploading to or deleting url
+func (j *journal) hasRemote(url string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, u := range j.entries {
+		if u.RemotePath == url {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getAll returns all entries in the journal as tracker entries
+func (j *journal) getAll() []trackerEntry {
+	return j.getReady(true)
+}
+
+// getReady returns entries which aren't failed and whose next attempt time
+// has come. If force is true, all entries are returned regardless of them,
+// except the delayed deletions which are never made early.
+func (j *journal) getReady(force bool) []trackerEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+
+	entries := make([]trackerEntry, 0, len(j.entries))
+	for _, u := range j.entries {
+		if u.Deferred || (u.Delayed && now.Before(u.NextAttempt)) {
+			continue
+		}
+
+		if !force && (u.Failed || now.Before(u.NextAttempt)) {
+			continue
+		}
+
+		entries = append(entries, trackerEntry{
+			inode:      u.Inode,
+			cachePath:  u.CachePath,
+			remotePath: u.RemotePath,
+			accessTime: u.Updated,
+			delete:     u.Delete,
+			delayed:    u.Delayed,
+		})
+	}
+
+	return entries
+}
+
+// list returns all entries in the journal ordered by the time of change
+func (j *journal) list() []PendingUpload {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	uploads := make([]PendingUpload, 0, len(j.entries))
+	for _, u := range j.entries {
+		uploads = append(uploads, u)
+	}
+
+	sort.Slice(uploads, func(a, b int) bool {
+		return uploads[a].Updated.Before(uploads[b].Updated)
+	})
+
+	return uploads
+}
+
+// save writes journal to the disk. Errors are only logged since the journal
+// is still valid in memory. It should be called with j.mu locked.
+func (j *journal) save() {
+	if err := writeJSONFile(j.path, j.entries); err != nil {
+		log.Errorf("couldn't save journal: %v", err)
+	}
+}
+
+// fillPaths sets Path of uploads by looking up their inodes in db
+func fillPaths(db *sqlite.Client, uploads []PendingUpload) {
+	for i := range uploads {
+		if uploads[i].Inode == 0 {
+			continue
+		}
+
+		path, err := getPath(db, uploads[i].Inode)
+		if err != nil {
+			continue
+		}
+
+		uploads[i].Path = path
+	}
+}
+
+// writeJSONFile encodes v into a temporary file and then moves it to path
+// so that the file at path is never left half written
+func writeJSONFile(path string, v interface{}) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("couldn't create file: %v", err)
+	}
+
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+
+		return fmt.Errorf("couldn't encode to json: %v", err)
+	}
+
+	// the content should be on disk before it replaces the previous file,
+	// otherwise a crash may leave an empty file
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+
+		return fmt.Errorf("couldn't sync file: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+
+		return fmt.Errorf("couldn't write file: %v", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+
+		return fmt.Errorf("couldn't move file to %s: %v", path, err)
+	}
+
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("couldn't sync directory of %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// syncDir flushes the entries of dir, i.e. a rename in it, to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,255 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestJournal(t *testing.T) *journal {
+	dir, err := ioutil.TempDir("", "cloudstash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	j, err := newJournal(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return j
+}
+
+// reloadJournal reads the journal j from the disk as if it was a new run
+func reloadJournal(t *testing.T, j *journal) *journal {
+	loaded, err := newJournal(j.path)
+	if err != nil {
+		t.Fatalf("couldn't load journal: %v", err)
+	}
+
+	return loaded
+}
+
+func readyURLs(j *journal, force bool) map[string]bool {
+	urls := map[string]bool{}
+	for _, e := range j.getReady(force) {
+		urls[e.remotePath] = true
+	}
+
+	return urls
+}
+
+func TestJournalPersistence(t *testing.T) {
+	j := newTestJournal(t)
+
+	j.add(trackerEntry{inode: 2, cachePath: "/cache/a", remotePath: "drive://a"})
+	j.add(trackerEntry{inode: 3, cachePath: "/cache/b", remotePath: "drive://b"})
+	j.add(trackerEntry{inode: 2, cachePath: "/cache/a", remotePath: "drive://c"})
+	j.remove("/cache/b")
+
+	loaded := reloadJournal(t, j)
+
+	if loaded.has("/cache/b") {
+		t.Errorf("removed entry is loaded")
+	}
+
+	entries := loaded.getAll()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+
+	e := entries[0]
+	if e.inode != 2 || e.cachePath != "/cache/a" || e.remotePath != "drive://c" {
+		t.Errorf("entry isn't replaced: %+v", e)
+	}
+}
+
+func TestJournalMissingFile(t *testing.T) {
+	j := newTestJournal(t)
+
+	if len(j.getAll()) != 0 {
+		t.Errorf("new journal isn't empty")
+	}
+
+	// removing a missing entry doesn't create the file
+	j.remove("/cache/a")
+
+	if _, err := os.Stat(j.path); !os.IsNotExist(err) {
+		t.Errorf("journal file is written without changes: %v", err)
+	}
+}
+
+func TestJournalFailedAttempts(t *testing.T) {
+	j := newTestJournal(t)
+
+	changed := time.Now()
+	j.add(trackerEntry{inode: 2, cachePath: "/cache/a", remotePath: "drive://a", accessTime: changed})
+
+	j.fail("/cache/a", errors.New("drive is unreachable"))
+	j.fail("/cache/a", errors.New("quota exceeded"))
+
+	// failures of unknown entries are ignored
+	j.fail("/cache/b", errors.New("drive is unreachable"))
+
+	uploads := reloadJournal(t, j).list()
+	if len(uploads) != 1 {
+		t.Fatalf("expected 1 pending upload, got %d", len(uploads))
+	}
+
+	if u := uploads[0]; u.Attempts != 2 || u.LastError != "quota exceeded" {
+		t.Errorf("failed attempts aren't recorded: %+v", u)
+	}
+}
+
+func TestJournalCompleteKeepsNewerChange(t *testing.T) {
+	j := newTestJournal(t)
+
+	uploaded := time.Now()
+	j.add(trackerEntry{inode: 2, cachePath: "/cache/a", remotePath: "drive://a", accessTime: uploaded})
+
+	// the file is changed again while it is being uploaded
+	j.add(trackerEntry{inode: 2, cachePath: "/cache/a", remotePath: "drive://a", accessTime: uploaded.Add(time.Second)})
+
+	j.complete("/cache/a", uploaded)
+
+	if !j.has("/cache/a") {
+		t.Fatalf("newer change is removed by the completed upload")
+	}
+
+	j.complete("/cache/a", uploaded.Add(time.Second))
+
+	if j.has("/cache/a") || reloadJournal(t, j).has("/cache/a") {
+		t.Errorf("completed upload isn't removed")
+	}
+}
+
+func TestJournalCoalescesPendingChanges(t *testing.T) {
+	j := newTestJournal(t)
+
+	j.add(trackerEntry{cachePath: "/state/db", remotePath: "drive://db", accessTime: time.Now()})
+
+	saved, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more changes of the pending database don't rewrite the journal
+	for i := 0; i < 10; i++ {
+		j.add(trackerEntry{cachePath: "/state/db", remotePath: "drive://db", accessTime: time.Now()})
+	}
+
+	data, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(saved, data) {
+		t.Errorf("journal is rewritten for a pending entry")
+	}
+
+	// but a change of its remote path does
+	j.add(trackerEntry{cachePath: "/state/db", remotePath: "drive://moved", accessTime: time.Now()})
+
+	if u := reloadJournal(t, j).list(); len(u) != 1 || u[0].RemotePath != "drive://moved" {
+		t.Errorf("new remote path isn't saved: %+v", u)
+	}
+}
+
+func TestBrokenJournal(t *testing.T) {
+	j := newTestJournal(t)
+
+	// i.e. a journal truncated by a crash
+	if err := ioutil.WriteFile(j.path, []byte(`{"/cache/a":{"Ino`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := reloadJournal(t, j)
+
+	if len(loaded.list()) != 0 {
+		t.Errorf("broken journal isn't replaced with an empty one")
+	}
+
+	broken, err := filepath.Glob(j.path + ".broken-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(broken) != 1 {
+		t.Errorf("broken journal isn't moved aside: %v", broken)
+	}
+}
+
+func TestDelayedDeletion(t *testing.T) {
+	j := newTestJournal(t)
+
+	j.add(trackerEntry{remotePath: "drive://released", accessTime: time.Now(), delete: true, delayed: true})
+	j.add(trackerEntry{remotePath: "drive://removed", accessTime: time.Now(), delete: true})
+
+	// it waits for the database to be uploaded even if all changes are forced
+	if ready := readyURLs(j, true); ready["drive://released"] || !ready["drive://removed"] {
+		t.Errorf("ready entries before database upload: %v", ready)
+	}
+
+	j.release(time.Hour)
+
+	if ready := readyURLs(j, true); ready["drive://released"] {
+		t.Errorf("delayed deletion is ready before the delay is over")
+	}
+
+	j.release(0)
+
+	// released entries aren't released again
+	if ready := readyURLs(j, false); ready["drive://released"] {
+		t.Errorf("delayed deletion is released by another database upload")
+	}
+
+	u := j.entries["drive://released"]
+	u.NextAttempt = time.Now().Add(-time.Second)
+	j.entries["drive://released"] = u
+
+	if ready := readyURLs(j, false); !ready["drive://released"] {
+		t.Errorf("delayed deletion isn't ready after the delay")
+	}
+
+	// it survives a restart
+	loaded := reloadJournal(t, j)
+
+	if u := loaded.entries["drive://released"]; !u.Delayed || u.Deferred {
+		t.Errorf("delayed deletion isn't persisted: %+v", u)
+	}
+}
+
+func TestJournalRenameScheme(t *testing.T) {
+	j := newTestJournal(t)
+
+	j.add(trackerEntry{inode: 2, cachePath: "/cache/a", remotePath: "dropbox://a"})
+	j.add(trackerEntry{remotePath: "dropbox://b", delete: true})
+	j.add(trackerEntry{remotePath: "gdrive://c", delete: true})
+
+	j.renameScheme("dropbox", "d1")
+
+	loaded := reloadJournal(t, j)
+
+	if u, ok := loaded.entries["/cache/a"]; !ok || u.RemotePath != "d1://a" {
+		t.Errorf("upload isn't renamed: %+v", u)
+	}
+
+	// deletions are looked up by their remote paths
+	if u, ok := loaded.entries["d1://b"]; !ok || !u.Delete {
+		t.Errorf("deletion isn't renamed: %v", loaded.entries)
+	}
+
+	if _, ok := loaded.entries["dropbox://b"]; ok {
+		t.Errorf("deletion is kept with its old remote path")
+	}
+
+	if u, ok := loaded.entries["gdrive://c"]; !ok || u.RemotePath != "gdrive://c" {
+		t.Errorf("entry of another drive is changed: %+v", u)
+	}
+}
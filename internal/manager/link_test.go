@@ -0,0 +1,134 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+)
+
+func TestLink(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+
+	inode := writeTestFile(t, m, "file", []byte("content"))
+
+	dir, err := m.AddDirectory(testRootInode, "dir", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := m.Link(inode, dir.Inode, "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if link.Inode != inode {
+		t.Errorf("link has a different inode %d", link.Inode)
+	}
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.NLink != 2 {
+		t.Errorf("nlink of linked file is %d", md.NLink)
+	}
+
+	// removing one of the names keeps the file
+	if err := m.RemoveFile(&sqlite.Metadata{Inode: inode, Parent: testRootInode, Name: "file"}); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err = m.GetMetadata(inode)
+	if err != nil {
+		t.Fatalf("file is removed with one of its names: %v", err)
+	}
+
+	if md.NLink != 1 {
+		t.Errorf("nlink after unlink is %d", md.NLink)
+	}
+
+	if _, err := m.Lookup(testRootInode, "file"); err != common.ErrNotFound {
+		t.Errorf("removed name is found: %v", err)
+	}
+
+	if !drv.has(md.URL) {
+		t.Errorf("remote content is deleted while the file has a name")
+	}
+}
+
+func TestMergeLinkedFile(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	insertTestRows(t, remote, sqlite.Metadata{Inode: 2, Name: "a", Parent: 1, Type: common.DrvFile, URL: "drive://a"})
+
+	db := openTestDatabase(t, remote)
+	if err := db.Link(2, 1, "b"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	merged, _ := mergeTestDatabases(t, local, remote)
+
+	for _, name := range []string{"a", "b"} {
+		md, err := merged.Search(1, name)
+		if err != nil {
+			t.Fatalf("name %s of remote file is lost: %v", name, err)
+		}
+
+		if md.Inode != 2 {
+			t.Errorf("name %s is linked to inode %d", name, md.Inode)
+		}
+	}
+}
+
+func TestMergeConflictingName(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	// both clients created a file with the same name
+	insertTestRows(t, local, sqlite.Metadata{Inode: 2, Name: "file", Parent: 1, Type: common.DrvFile, URL: "drive://a"})
+	insertTestRows(t, remote, sqlite.Metadata{Inode: 3, Name: "file", Parent: 1, Type: common.DrvFile, URL: "drive://b"})
+
+	db, _ := mergeTestDatabases(t, local, remote)
+
+	children, err := db.GetChildren(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(children) != 2 {
+		t.Fatalf("expected 2 files, got %+v", children)
+	}
+
+	for _, md := range children {
+		if md.Inode == 2 && md.Name != "file" {
+			t.Errorf("local file is renamed to %s", md.Name)
+		}
+
+		if md.Inode == 3 && md.Name == "file" {
+			t.Errorf("remote file isn't renamed")
+		}
+	}
+}
+
+func TestJournalMoveInode(t *testing.T) {
+	j := newTestJournal(t)
+
+	j.add(trackerEntry{inode: 2, cachePath: "/cache/a", remotePath: "drive://a", accessTime: time.Now()})
+	j.moveInode(2, 5)
+
+	if u := reloadJournal(t, j).entries["/cache/a"]; u.Inode != 5 {
+		t.Errorf("inode of journal entry isn't moved: %+v", u)
+	}
+
+	handles := newHandleTable()
+	handles.add(&fileHandle{inode: 2})
+	handles.moveInode(2, 5)
+
+	if handles.isOpen(2) || !handles.isOpen(5) {
+		t.Errorf("handles aren't moved to the new inode")
+	}
+}
@@ -4,11 +4,17 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/compress"
 	"github.com/paddlesteamer/cloudstash/internal/crypto"
 	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/erasure"
 	"github.com/paddlesteamer/cloudstash/internal/sqlite"
 	"zgo.at/zcache"
 
@@ -19,61 +25,298 @@ import (
 // It is responsible for keeping track of drives, cache, database, etc.
 // It is used by the `fs` package
 type Manager struct {
-	drives  []drive.Drive
-	db      *database
-	cache   *zcache.Cache
-	tracker *zcache.Cache
-	cipher  *crypto.Cipher
+	drives   []drive.Drive
+	db       *database
+	cache    *zcache.Cache
+	tracker  *zcache.Cache
+	journal  *journal
+	progress *progress
+	handles  *handleTable
+	cipher   *crypto.Cipher
+	stateDir string // local directory of database copy, journal and cache
+	cacheDir string
+	device   string // name of this host, recorded in trash entries
+
+	cacheLimit int64         // maximum size of cached files, unlimited if 0
+	cacheGrown chan struct{} // signals limitCache that a file is downloaded
+
+	retention   Retention
+	chunking    bool
+	compression bool
+	replicas    int
+	erasure     *erasure.Code     // nil if erasure coding is disabled
+	locations   map[string]string // current urls of the files of a mounted snapshot
+	placement   PlacementPolicy
+	quotas      *quotaCache
+	moves       *moves
+
+	offline int32 // accessed atomically, 1 if remote drives are unreachable
+}
+
+// Options are the settings of a Manager chosen by the user
+type Options struct {
+	Retention   Retention
+	Chunking    bool // new content of files is split into chunks stored once
+	Compression bool // new content of files is compressed if it compresses well
+	Replicas    int  // number of drives each remote file is stored in
+
+	// CacheLimit is the maximum size of cached files in bytes, unlimited if 0.
+	// Files which are open or have changes waiting to be uploaded are kept.
+	CacheLimit int64
 
-	availableSpace int64
+	// Placement chooses the drive of new files, MostFree if it isn't set
+	Placement PlacementPolicy
+
+	// Renames are the url schemes of the drives which are identified by
+	// new ids, mapped to their ids. Urls are renamed on start.
+	Renames map[string]string
+
+	// remote files are split into DataShards and ParityShards shards
+	// in separate drives if both are set, instead of being replicated
+	DataShards   int
+	ParityShards int
 }
 
+const rootInode = 1
+
 // NewManager creates a new Manager struct with provided
-// parameters and starts background processes
-func NewManager(drives []drive.Drive, dbDrv drive.Drive, cipher *crypto.Cipher) (*Manager, error) {
-	m := &Manager{
-		drives:  drives,
-		cache:   newCache(),
-		tracker: newTracker(),
-		cipher:  cipher,
+// parameters and starts background processes.
+// stateDir is where the local copy of the database, cached files and
+// the journal of pending changes are kept. If the database can't be
+// fetched, it falls back to offline mode with the local copy.
+// opts tells how the files are stored and how long they are kept.
+func NewManager(drives []drive.Drive, dbDrv drive.Drive, cipher *crypto.Cipher, stateDir string,
+	opts Options) (*Manager, error) {
+	m, err := newManager(drives, cipher, stateDir, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	var db *database
+	local, lerr := loadDB(drives, stateDir, opts.Renames)
+	if lerr != nil && lerr != common.ErrNotFound {
+		log.Warningf("couldn't load local copy of DB: %v", lerr)
+	}
 
-	// DB doesn't exist
-	if dbDrv == nil {
+	switch {
+	case lerr == nil && local.dirty:
+		// changes of the previous run haven't been uploaded yet,
+		// local copy is merged with the remote one on upload
+		m.db = local
+	case dbDrv == nil:
+		// DB doesn't exist
 		drv := m.selectDrive()
 
-		d, err := newDB(drv, cipher)
+		db, err := newDB(drv, cipher, stateDir)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't intialize DB: %v", err)
 		}
 
-		db = d
-	} else {
-		d, err := fetchDB(dbDrv, cipher)
+		m.db = db
+	default:
+		db, err := fetchDB(dbDrv, cipher, stateDir)
 		if err != nil {
-			return nil, fmt.Errorf("couldn't fetch DB: %v", err)
+			if lerr != nil {
+				return nil, fmt.Errorf("couldn't fetch DB: %v", err)
+			}
+
+			log.Warningf("couldn't fetch DB, using local copy: %v", err)
+
+			db = local
+			m.setOffline(true)
 		}
 
-		db = d
+		m.db = db
+	}
+
+	if err := m.renameDrives(opts.Renames); err != nil {
+		return nil, err
+	}
+
+	m.start()
+
+	return m, nil
+}
+
+// NewOfflineManager creates a new Manager from the local copy of the database
+// to be used while remote drives are unreachable. Changes are kept in the
+// journal and uploaded when the drives are reachable again.
+func NewOfflineManager(drives []drive.Drive, cipher *crypto.Cipher, stateDir string,
+	opts Options) (*Manager, error) {
+	m, err := newManager(drives, cipher, stateDir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := loadDB(drives, stateDir, opts.Renames)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load local copy of DB: %v", err)
 	}
 
 	m.db = db
+	m.setOffline(true)
+
+	if err := m.renameDrives(opts.Renames); err != nil {
+		return nil, err
+	}
+
+	m.start()
+
+	return m, nil
+}
+
+func newManager(drives []drive.Drive, cipher *crypto.Cipher, stateDir string,
+	opts Options) (*Manager, error) {
+	device, err := os.Hostname()
+	if err != nil {
+		log.Warningf("couldn't get hostname: %v", err)
+	}
+
+	m := &Manager{
+		drives:   drives,
+		tracker:  newTracker(),
+		progress: newProgress(),
+		handles:  newHandleTable(),
+		cipher:   cipher,
+		stateDir: stateDir,
+		cacheDir: filepath.Join(stateDir, cacheFolderName),
+		device:   device,
+
+		cacheLimit: opts.CacheLimit,
+		cacheGrown: make(chan struct{}, 1),
+
+		retention:   opts.Retention,
+		chunking:    opts.Chunking,
+		compression: opts.Compression,
+		replicas:    opts.Replicas,
+		placement:   opts.Placement,
+		quotas:      newQuotaCache(),
+		moves:       newMoves(),
+	}
+
+	if m.replicas < 1 {
+		m.replicas = 1
+	}
+
+	if m.placement == nil {
+		m.placement = MostFree{}
+	}
+
+	if opts.DataShards > 0 && opts.ParityShards > 0 {
+		code, err := erasure.NewCode(opts.DataShards, opts.ParityShards)
+		if err != nil {
+			return nil, err
+		}
+
+		if code.Shards() > len(drives) {
+			return nil, fmt.Errorf("%d shards need as many drives, there are %d", code.Shards(), len(drives))
+		}
+
+		m.erasure = code
+	}
+
+	m.cache = newCache(m.evictCacheEntry)
+
+	if err := os.MkdirAll(m.cacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create cache directory: %v", err)
+	}
+
+	j, err := newJournal(filepath.Join(stateDir, journalFileName))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load journal: %v", err)
+	}
+
+	m.journal = j
+
+	return m, nil
+}
+
+// start restores the state of the previous run and starts background processes
+func (m *Manager) start() {
+	if err := m.restoreCache(); err != nil {
+		log.Warningf("couldn't restore cache: %v", err)
+	}
+
+	// chunks left by the uploads interrupted in the previous run
+	m.releaseChunks(nil)
+
+	if pending := len(m.journal.list()); pending > 0 {
+		log.Infof("replaying %d pending uploads from the journal", pending)
+	}
+
+	if m.db.dirty {
+		m.notifyChangeInDatabase()
+	}
 
 	go watchRemoteChanges(m)
 	go processLocalChanges(m)
+	go purgeExpiredTrash(m)
+	go repairReplicas(m)
+	go refreshQuotas(m)
 
-	return m, nil
+	if m.cacheLimit > 0 {
+		go limitCache(m)
+	}
 }
 
-// Clean clean ups cached files and process remaining file changes
+// Clean process remaining file changes and saves the cache index for the next run.
+// Changes that couldn't be uploaded are kept in the journal.
 func (m *Manager) Clean() {
 	processChanges(m, forceAll)
 
-	m.cache.DeleteAll()
+	if err := m.saveCacheIndex(); err != nil {
+		log.Warningf("couldn't save cache index, cleaning cache: %v", err)
+
+		m.cache.DeleteAll()
+	}
+}
+
+// GetPendingUploads returns local changes waiting to be uploaded
+func (m *Manager) GetPendingUploads() []PendingUpload {
+	return m.GetStatus().Pending
+}
+
+// GetStatus returns the transfers in progress and
+// the local changes waiting to be uploaded
+func (m *Manager) GetStatus() Status {
+	status := Status{
+		Offline:   m.IsOffline(),
+		Transfers: m.progress.list(),
+		Pending:   m.journal.list(),
+	}
+
+	for _, u := range status.Pending {
+		if fi, err := os.Stat(u.CachePath); err == nil {
+			status.PendingBytes += fi.Size()
+		}
+	}
+
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return status
+	}
+	defer db.Close()
+
+	fillPaths(db, status.Pending)
+
+	for i, t := range status.Transfers {
+		if t.Inode == 0 {
+			continue
+		}
+
+		if path, err := getPath(db, t.Inode); err == nil {
+			status.Transfers[i].Path = path
+		}
+	}
+
+	return status
+}
 
-	m.db.clean()
+// IsOffline returns whether remote drives are unreachable
+func (m *Manager) IsOffline() bool {
+	return atomic.LoadInt32(&m.offline) == 1
 }
 
 // Lookup searches provided directory for a file provided with 'name' parameter
@@ -170,8 +413,16 @@ func (m *Manager) UpdateMetadataFromCache(inode int64) error {
 	}
 
 	if md.Hash != checksum {
+		now := time.Now()
+
+		if md.Size == 0 {
+			m.placeContent(db, md, fi.Size())
+		}
+
 		md.Size = fi.Size()
 		md.Hash = checksum
+		md.MTime = now
+		md.CTime = now
 		err = db.Update(md)
 		if err != nil {
 			m.cache.Delete(common.ToString(inode))
@@ -179,13 +430,14 @@ func (m *Manager) UpdateMetadataFromCache(inode int64) error {
 		}
 
 		m.notifyChangeInDatabase()
-		m.notifyChangeInFile(path, md.URL)
+		m.notifyChangeInFile(inode, path, md.URL)
 	}
 
 	return nil
 }
 
-// UpdateMetadata updates file metadata
+// UpdateMetadata updates file attributes and its change time.
+// Name and parent aren't changed, use Rename for them.
 func (m *Manager) UpdateMetadata(md *sqlite.Metadata) error {
 	m.db.wLock()
 	defer m.db.wUnlock()
@@ -196,6 +448,8 @@ func (m *Manager) UpdateMetadata(md *sqlite.Metadata) error {
 	}
 	defer db.Close()
 
+	md.CTime = time.Now()
+
 	err = db.Update(md)
 	if err != nil {
 		return fmt.Errorf("couldn't update file metadata: %v", err)
@@ -206,6 +460,121 @@ func (m *Manager) UpdateMetadata(md *sqlite.Metadata) error {
 	return nil
 }
 
+// Rename moves the entry 'name' under parent to 'newName' under newParent.
+// If the replaced file loses its last name, it is moved to the trash like
+// RemoveFile does, i.e. when an editor saves it by renaming a new file over it.
+// RENAME_NOREPLACE and RENAME_EXCHANGE aren't supported, the FUSE binding
+// doesn't pass the flags of rename2.
+func (m *Manager) Rename(parent int64, name string, newParent int64, newName string) error {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	dir, err := getPath(db, newParent)
+	if err != nil {
+		return fmt.Errorf("couldn't get path of directory %d: %v", newParent, err)
+	}
+
+	now := time.Now()
+
+	trashed, err := db.Rename(parent, name, newParent, newName, path.Join(dir, newName), m.device, now)
+	if err != nil {
+		switch err {
+		case common.ErrNotFound, common.ErrExists, common.ErrIsDir, common.ErrNotDir,
+			common.ErrDirNotEmpty, common.ErrSubdirectory:
+			return err
+		}
+
+		return fmt.Errorf("couldn't rename entry: %v", err)
+	}
+
+	touchDirectory(db, parent, now)
+	touchDirectory(db, newParent, now)
+
+	if md, err := db.Search(newParent, newName); err == nil {
+		touchInode(db, md.Inode, now)
+	}
+
+	if trashed != nil {
+		touchInode(db, trashed.Inode, now)
+	}
+
+	m.notifyChangeInDatabase()
+
+	return nil
+}
+
+// Link adds a new name to the file identified by inode
+func (m *Manager) Link(inode int64, parent int64, name string) (*sqlite.Metadata, error) {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Link(inode, parent, name); err != nil {
+		return nil, fmt.Errorf("couldn't link inode %d: %v", inode, err)
+	}
+
+	md, err := db.Search(parent, name)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get metadata of new link: %v", err)
+	}
+
+	now := time.Now()
+
+	md.CTime = now
+
+	if err := db.Update(md); err != nil {
+		return nil, fmt.Errorf("couldn't update file metadata: %v", err)
+	}
+
+	touchDirectory(db, parent, now)
+
+	m.notifyChangeInDatabase()
+
+	return md, nil
+}
+
+// Truncate changes size of the file. The cached file is truncated, or
+// extended with zeros, and the change is uploaded like any other write.
+func (m *Manager) Truncate(md *sqlite.Metadata, size int64) error {
+	// no need to download the content if it will be discarded anyway
+	if _, found := m.cache.Get(common.ToString(md.Inode)); !found && size == 0 {
+		tmpfile, err := common.NewTempCacheFile(m.cacheDir)
+		if err != nil {
+			return fmt.Errorf("couldn't create cached file: %v", err)
+		}
+		tmpfile.Close()
+
+		m.cache.Set(common.ToString(md.Inode), newCacheEntry(tmpfile.Name(), fileAvailable, ""), cacheExpiration)
+
+		return m.UpdateMetadataFromCache(md.Inode)
+	}
+
+	file, err := m.OpenFile(md, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+
+	err = file.Truncate(size)
+	file.Close()
+
+	if err != nil {
+		return fmt.Errorf("couldn't truncate cached file: %v", err)
+	}
+
+	return m.UpdateMetadataFromCache(md.Inode)
+}
+
 // GetDirectoryContent returns files and folders in the directory identified
 // by inode. It doesn't include '.' and '..'.
 func (m *Manager) GetDirectoryContent(parent int64) ([]sqlite.Metadata, error) {
@@ -239,8 +608,8 @@ func (m *Manager) GetDirectoryContent(parent int64) ([]sqlite.Metadata, error) {
 	return mdList, nil
 }
 
-// RemoveDirectory removes all of the directory contents and then
-// removes the directory itself.
+// RemoveDirectory removes the directory if it is empty. Use
+// RemoveTree to remove it along with its contents.
 func (m *Manager) RemoveDirectory(ino int64) error {
 	m.db.wLock()
 	defer m.db.wUnlock()
@@ -260,24 +629,126 @@ func (m *Manager) RemoveDirectory(ino int64) error {
 		return common.ErrDirNotEmpty
 	}
 
+	md, err := db.Get(ino)
+	if err != nil {
+		return fmt.Errorf("couldn't get metadata of %d: %v", ino, err)
+	}
+
 	err = db.Delete(ino)
 	if err != nil {
 		return fmt.Errorf("children are removed but couldn't delete the parent itself of inode %d: %v", ino, err)
 	}
 
+	touchDirectory(db, md.Parent, time.Now())
+
 	m.notifyChangeInDatabase()
 
 	return nil
 }
 
-// RemoveFile deletes file
-func (m *Manager) RemoveFile(md *sqlite.Metadata) error {
+// RemoveTree removes the entry 'name' under parent and, if it is a directory,
+// all of its contents in a single transaction. Remote files are deleted by the
+// upload workers. Returns the number of removed files and directories. Entries
+// in the trash are purged with sqlite.TrashParent as parent and their ids.
+func (m *Manager) RemoveTree(parent int64, name string) (int, error) {
 	m.db.wLock()
 	defer m.db.wUnlock()
 
-	m.cache.Delete(common.ToString(md.Inode))
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
 
-	go m.deleteRemoteFile(md)
+	removed, err := db.DeleteTree(parent, name)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return 0, err
+		}
+
+		return 0, fmt.Errorf("couldn't delete tree: %v", err)
+	}
+
+	if parent != sqlite.TrashParent {
+		touchDirectory(db, parent, time.Now())
+	}
+
+	m.notifyChangeInDatabase()
+
+	// earlier versions are kept while a file is in the trash,
+	// they are only deleted along with it
+	for i := range removed {
+		m.removeContent(db, &removed[i])
+		m.removeVersions(db, &removed[i])
+	}
+
+	return len(removed), nil
+}
+
+// RemovePath moves the file or directory at path, which is relative to the
+// root of the filesystem, to the trash. Directories are only removed if
+// recursive is true. Returns the trash entry of the removed one.
+func (m *Manager) RemovePath(path string, recursive bool) (*sqlite.TrashEntry, error) {
+	md, err := m.LookupPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if md.Inode == rootInode {
+		return nil, fmt.Errorf("root directory can't be removed")
+	}
+
+	if md.Type == common.DrvFolder && !recursive {
+		return nil, common.ErrIsDir
+	}
+
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	return m.trash(db, md.Parent, md.Name)
+}
+
+// LookupPath returns metadata of the file at path, which
+// is relative to the root of the filesystem
+func (m *Manager) LookupPath(path string) (*sqlite.Metadata, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	md, err := db.Get(rootInode)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get root directory: %v", err)
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+
+		if md, err = db.Search(md.Inode, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return md, nil
+}
+
+// RemoveFile removes the name of the file identified by md.Name and md.Parent.
+// When the last name of the file is removed, the file is moved to the trash.
+func (m *Manager) RemoveFile(md *sqlite.Metadata) error {
+	m.db.wLock()
+	defer m.db.wUnlock()
 
 	db, err := m.getSqliteClient()
 	if err != nil {
@@ -285,16 +756,95 @@ func (m *Manager) RemoveFile(md *sqlite.Metadata) error {
 	}
 	defer db.Close()
 
-	err = db.Delete(md.Inode)
+	links, err := db.GetLinks(md.Inode)
 	if err != nil {
+		return fmt.Errorf("couldn't get names of file: %v", err)
+	}
+
+	// the last name is moved to the trash with the content
+	if len(links) <= 1 {
+		_, err := m.trash(db, md.Parent, md.Name)
+
+		return err
+	}
+
+	if _, err := db.Unlink(md.Parent, md.Name); err != nil {
 		return fmt.Errorf("couldn't delete file: %v", err)
 	}
 
+	now := time.Now()
+
+	touchDirectory(db, md.Parent, now)
+	touchInode(db, md.Inode, now)
+
 	m.notifyChangeInDatabase()
 
 	return nil
 }
 
+// removeContent removes cached and remote copies of the file which is removed
+// from database. Pending uploads of it are cancelled. Its earlier versions are
+// removed with removeVersions. It should be called with the database locked.
+func (m *Manager) removeContent(db *sqlite.Client, md *sqlite.Metadata) {
+	if e, found := m.cache.Get(common.ToString(md.Inode)); found {
+		path := e.(cacheEntry).path
+
+		m.tracker.Delete(path)
+		m.journal.remove(path)
+	}
+
+	m.cache.Delete(common.ToString(md.Inode))
+
+	// symbolic links and directories don't have remote content
+	if md.Type != common.DrvFile {
+		return
+	}
+
+	m.scheduleDeletion(md.Inode, md.URL)
+}
+
+// removeVersions removes earlier versions of the file which is removed from
+// database. It should be called with the database locked.
+func (m *Manager) removeVersions(db *sqlite.Client, md *sqlite.Metadata) {
+	if md.Type != common.DrvFile {
+		return
+	}
+
+	versions, err := db.DeleteVersions(md.Inode)
+	if err != nil {
+		log.Warningf("couldn't delete versions of inode %d: %v", md.Inode, err)
+		return
+	}
+
+	for _, v := range versions {
+		if v.URL != md.URL {
+			m.scheduleDeletion(md.Inode, v.URL)
+		}
+	}
+}
+
+// moveInode is called when a local inode is moved to a new number while
+// merging databases. The entries kept by inode number are moved as well.
+func (m *Manager) moveInode(inode int64, newInode int64) {
+	if e, found := m.cache.Get(common.ToString(inode)); found {
+		m.cache.Set(common.ToString(newInode), e, cacheExpiration)
+	}
+
+	// the cached file isn't removed since the new entry refers to it
+	m.cache.Delete(common.ToString(inode))
+
+	m.journal.moveInode(inode, newInode)
+	m.handles.moveInode(inode, newInode)
+}
+
+// renameRemote is called when the url of a local file is changed to the one
+// in the remote database while merging databases, i.e. another client moved
+// it. Pending uploads follow the file and the local copy is deleted.
+func (m *Manager) renameRemote(url string, newURL string) {
+	m.journal.renameRemote(url, newURL)
+	m.scheduleDelayedDeletion(url)
+}
+
 // OpenFile opens file with provided flag. If the file isn't cached already,
 // it first fetches file from remote drive
 func (m *Manager) OpenFile(md *sqlite.Metadata, flag int) (*os.File, error) {
@@ -312,6 +862,7 @@ func (m *Manager) OpenFile(md *sqlite.Metadata, flag int) (*os.File, error) {
 		path = p
 
 		m.cache.Set(common.ToString(md.Inode), newCacheEntry(path, fileAvailable, md.Hash), cacheExpiration)
+		m.notifyCacheGrown()
 	} else {
 		for {
 			entry := e.(cacheEntry)
@@ -344,12 +895,15 @@ func (m *Manager) AddDirectory(parent int64, name string, mode int) (*sqlite.Met
 	if err != nil {
 		return nil, fmt.Errorf("couldn't connect to database: %v", err)
 	}
+	defer db.Close()
 
 	md, err := db.AddDirectory(parent, name, mode)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create directory in database: %v", err)
 	}
 
+	touchDirectory(db, parent, md.CrTime)
+
 	m.notifyChangeInDatabase()
 
 	return md, nil
@@ -364,10 +918,17 @@ func (m *Manager) CreateFile(parent int64, name string, mode int) (*sqlite.Metad
 	if err != nil {
 		return nil, fmt.Errorf("couldn't connect to database: %v", err)
 	}
+	defer db.Close()
+
+	path, err := getPath(db, parent)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get path of parent directory: %v", err)
+	}
 
-	u := drive.GetURL(m.selectDrive(), common.ObfuscateFileName(name))
+	drv := m.placeFile(strings.TrimSuffix(path, "/")+"/"+name, 0)
+	u := drive.GetURL(drv, common.ObfuscateFileName(name))
 
-	tmpfile, err := common.NewTempCacheFile()
+	tmpfile, err := common.NewTempCacheFile(m.cacheDir)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create cached file: %v", err)
 	}
@@ -389,30 +950,52 @@ func (m *Manager) CreateFile(parent int64, name string, mode int) (*sqlite.Metad
 		return nil, fmt.Errorf("couldn't create file in database: %v", err)
 	}
 
+	touchDirectory(db, parent, md.CrTime)
+
 	m.cache.Set(common.ToString(md.Inode), newCacheEntry(tmpfile.Name(), fileAvailable, checksum), cacheExpiration)
 
+	m.notifyChangeInDatabase()
+
 	return md, nil
 }
 
-// GetTotalAvailableSpace returns total available space in all drives
-func (m *Manager) GetTotalAvailableSpace() int64 {
-	if m.availableSpace > 0 {
-		return m.availableSpace
+// CreateSymlink creates a new symbolic link pointing to target
+func (m *Manager) CreateSymlink(parent int64, name string, target string) (*sqlite.Metadata, error) {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
 	}
+	defer db.Close()
 
-	var tSpace int64 = 0
+	md, err := db.CreateSymlink(parent, name, target)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create symlink in database: %v", err)
+	}
 
-	for _, drv := range m.drives {
-		space, err := drv.GetAvailableSpace()
-		if err != nil {
-			log.Warningf("couldn't get available space for %s: %v, ignoring...", drv.GetProviderName(), err)
-			continue
-		}
+	touchDirectory(db, parent, md.CrTime)
+
+	m.notifyChangeInDatabase()
+
+	return md, nil
+}
+
+// GetTotalAvailableSpace returns total available space in all drives for
+// the content of files, excluding the space of their replicas or parity shards
+func (m *Manager) GetTotalAvailableSpace() int64 {
+	var tSpace int64 = 0
 
+	for _, space := range m.quotas.get(m.drives) {
 		tSpace += space
 	}
 
-	m.availableSpace = tSpace
+	if m.erasure != nil {
+		tSpace = tSpace * int64(m.erasure.Data) / int64(m.erasure.Shards())
+	} else {
+		tSpace /= int64(m.replicas)
+	}
 
 	return tSpace
 }
@@ -436,10 +1019,45 @@ func (m *Manager) getSqliteClient() (*sqlite.Client, error) {
 	return sqlite.NewClient(m.db.path)
 }
 
-// getDriveClient returns drive driver of the provided scheme
+// getPath returns path of the file identified by inode
+// relative to the root of the filesystem
+func getPath(db *sqlite.Client, inode int64) (string, error) {
+	names := []string{}
+
+	for inode != rootInode {
+		md, err := db.Get(inode)
+		if err != nil {
+			return "", err
+		}
+
+		names = append([]string{md.Name}, names...)
+		inode = md.Parent
+	}
+
+	return "/" + strings.Join(names, "/"), nil
+}
+
+// touchDirectory sets modification and change times of the directory
+// to t. It is called when an entry is added to or removed from it.
+func touchDirectory(db *sqlite.Client, inode int64, t time.Time) {
+	md, err := db.Get(inode)
+	if err != nil {
+		log.Warningf("couldn't get metadata of directory %d: %v", inode, err)
+		return
+	}
+
+	md.MTime = t
+	md.CTime = t
+
+	if err := db.Update(md); err != nil {
+		log.Warningf("couldn't update times of directory %d: %v", inode, err)
+	}
+}
+
+// getDriveClient returns drive driver of the provided scheme, i.e. the drive id
 func (m *Manager) getDriveClient(scheme string) (drive.Drive, error) {
 	for _, drv := range m.drives {
-		if drv.GetProviderName() == scheme {
+		if drv.GetID() == scheme {
 			return drv, nil
 		}
 	}
@@ -450,29 +1068,99 @@ func (m *Manager) getDriveClient(scheme string) (drive.Drive, error) {
 // downloadFile downloads remote file to current hosts temp directory
 // and returns it's local path
 func (m *Manager) downloadFile(md *sqlite.Metadata) (string, error) {
-	u, err := common.ParseURL(md.URL)
+	return m.downloadURL(md.URL, md.Inode, md.Size)
+}
+
+// downloadURL downloads and decrypts the content at url into a new file
+// in the cache directory and returns its path. inode and size are only used
+// to report progress.
+func (m *Manager) downloadURL(url string, inode int64, size int64) (string, error) {
+	chunks, err := m.getChunkList(url)
 	if err != nil {
-		return "", fmt.Errorf("couldn't parse file url %s: %v", md.URL, err)
+		return "", err
+	}
+
+	if len(chunks) > 0 {
+		return m.downloadReader(&chunkReader{m: m, chunks: chunks}, inode, size)
 	}
 
-	drv, err := m.getDriveClient(u.Scheme)
+	sharded, err := m.isSharded(url)
 	if err != nil {
 		return "", err
 	}
 
-	reader, err := drv.GetFile(u.Name)
+	// content of a snapshot may be moved to keep it, shards aren't
+	if l, ok := m.locations[url]; ok && !sharded {
+		url = l
+	}
+
+	return m.downloadBlob(url, inode, size)
+}
+
+// downloadBlob downloads and decrypts the remote file at url
+// into a new file in the cache directory and returns its path
+func (m *Manager) downloadBlob(url string, inode int64, size int64) (string, error) {
+	reader, err := m.getFile(url)
 	if err != nil {
-		return "", fmt.Errorf("couldn't get file '%s' from storage: %v", md.URL, err)
+		return "", fmt.Errorf("couldn't get file '%s' from storage: %v", url, err)
 	}
 	defer reader.Close()
 
-	tmpfile, err := common.NewTempCacheFile()
+	r, err := m.decodeReader(reader)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read file '%s': %v", url, err)
+	}
+
+	return m.downloadReader(r, inode, size)
+}
+
+// encodeReader returns a reader of the content of r as it is stored: compressed
+// if compression is enabled and the content compresses well, and encrypted
+func (m *Manager) encodeReader(r io.Reader) (io.Reader, error) {
+	if !m.compression {
+		return m.cipher.NewEncryptReader(r), nil
+	}
+
+	cr, compressed, err := compress.NewCompressReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't compress content: %v", err)
+	}
+
+	if !compressed {
+		return m.cipher.NewEncryptReader(cr), nil
+	}
+
+	return compress.WriteHeader(m.cipher.NewEncryptReader(cr)), nil
+}
+
+// decodeReader returns a reader of the content of a remote file read
+// from r. Compressed files are read even if compression is disabled.
+func (m *Manager) decodeReader(r io.Reader) (io.Reader, error) {
+	r, compressed, err := compress.ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !compressed {
+		return m.cipher.NewDecryptReader(r), nil
+	}
+
+	return compress.NewDecompressReader(m.cipher.NewDecryptReader(r))
+}
+
+// downloadReader copies the content read from reader into a new
+// file in the cache directory and returns its path
+func (m *Manager) downloadReader(reader io.Reader, inode int64, size int64) (string, error) {
+	tmpfile, err := common.NewTempCacheFile(m.cacheDir)
 	if err != nil {
 		return "", fmt.Errorf("couldn't create cached file: %v", err)
 	}
 	defer tmpfile.Close()
 
-	_, err = io.Copy(tmpfile, m.cipher.NewDecryptReader(reader))
+	r, done := m.progress.track(reader, inode, directionDownload, size)
+	defer done()
+
+	_, err = io.Copy(tmpfile, r)
 	if err != nil && err != io.EOF {
 		return "", fmt.Errorf("couldn't copy contents of downloaded file to cache: %v", err)
 	}
@@ -480,61 +1168,100 @@ func (m *Manager) downloadFile(md *sqlite.Metadata) (string, error) {
 	return tmpfile.Name(), nil
 }
 
-func (m *Manager) deleteRemoteFile(md *sqlite.Metadata) {
-	u, err := common.ParseURL(md.URL)
-	if err != nil {
-		log.Errorf("couldn't parse URL '%s': %v", md.URL, err)
-		return
+// scheduleDeletion adds deletion of the remote file at url to the journal,
+// it is done by the upload workers and retried like uploads if it fails
+func (m *Manager) scheduleDeletion(inode int64, url string) {
+	m.journal.add(trackerEntry{
+		inode:      inode,
+		remotePath: url,
+		accessTime: time.Now(),
+		delete:     true,
+	})
+}
+
+// deletionDelay is how long a remote file which may still be used by other
+// clients is kept after the database without it is uploaded. They stop using
+// it once they fetch the database.
+const deletionDelay = time.Hour
+
+// scheduleDelayedDeletion adds deletion of a remote file which isn't referenced
+// anymore but may still be used by other clients to the journal, i.e. the
+// original of a moved file or a released chunk. It waits for the database
+// without it to be uploaded and it is skipped if the file is referenced again.
+// It should be called with the database locked, before the database is uploaded.
+func (m *Manager) scheduleDelayedDeletion(url string) {
+	m.journal.add(trackerEntry{
+		remotePath: url,
+		accessTime: time.Now(),
+		delete:     true,
+		delayed:    true,
+	})
+}
+
+// selectDrive returns the drive with the most available space
+func (m *Manager) selectDrive() drive.Drive {
+	return MostFree{}.Place(PlacedFile{}, m.driveSpaces())
+}
+
+// setOffline marks remote drives as unreachable or reachable again
+func (m *Manager) setOffline(offline bool) {
+	var v int32
+	if offline {
+		v = 1
 	}
 
-	drv, err := m.getDriveClient(u.Scheme)
-	if err != nil {
-		log.Errorf("couldn't find drive '%s': %v", u.Scheme, err)
+	if atomic.SwapInt32(&m.offline, v) == v {
 		return
 	}
 
-	if err := drv.DeleteFile(u.Name); err != nil {
-		log.Errorf("couldn't delete file from remote drive '%s': %v", md.URL, err)
-		return
+	if offline {
+		log.Warning("remote drives are unreachable, switching to offline mode")
+	} else {
+		log.Info("remote drives are reachable again, switching to online mode")
 	}
 }
 
-func (m *Manager) selectDrive() drive.Drive {
-	var max int64 = 0
-	idx := 0
-
-	for i, drv := range m.drives {
-		space, err := drv.GetAvailableSpace()
-		if err != nil {
-			log.Warningf("couldn't get available space for %s: %v, ignoring...", drv.GetProviderName(), err)
-			continue
-		}
-
-		if space > max {
-			max = space
-			idx = i
-		}
+// hasPendingUpload returns whether the local file has changes
+// which aren't uploaded yet
+func (m *Manager) hasPendingUpload(cachePath string) bool {
+	if _, found := m.tracker.Get(cachePath); found {
+		return true
 	}
 
-	return m.drives[idx]
+	return m.journal.has(cachePath)
 }
 
 // notifyChangeInFile is called when file content is changed
-// It adds file to the tracker for later processing
-func (m *Manager) notifyChangeInFile(cachePath string, remotePath string) {
-	m.tracker.Set(cachePath, trackerEntry{
+// It adds file to the journal and to the tracker for later processing
+func (m *Manager) notifyChangeInFile(inode int64, cachePath string, remotePath string) {
+	entry := trackerEntry{
+		inode:      inode,
 		cachePath:  cachePath,
 		remotePath: remotePath,
 		accessTime: time.Now(),
-	}, cacheForever)
+	}
+
+	m.journal.add(entry)
+	m.tracker.Set(cachePath, entry, cacheForever)
 }
 
 // notifyChangeInDatabase is called when database is changed
-// It adds database to the tracker for later processing
+// It marks database as dirty and adds it to the tracker for later processing
 func (m *Manager) notifyChangeInDatabase() {
-	m.tracker.Set(m.db.path, trackerEntry{
+	if !m.db.dirty {
+		m.db.dirty = true
+
+		if err := m.db.saveState(); err != nil {
+			log.Warningf("couldn't save database state: %v", err)
+		}
+	}
+
+	entry := trackerEntry{
 		cachePath:  m.db.path,
 		remotePath: drive.GetURL(m.db.extDrive, common.DatabaseFileName),
 		accessTime: time.Now(),
-	}, cacheForever)
+	}
+
+	m.journal.add(entry)
+	m.tracker.Set(m.db.path, entry, cacheForever)
 }
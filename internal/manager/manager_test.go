@@ -0,0 +1,193 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/crypto"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+)
+
+const testRootInode = 1
+
+// memDrive is a drive which keeps the files in memory
+type memDrive struct {
+	name  string
+	id    string // name is used as the id if it isn't set
+	space int64
+	files map[string][]byte
+	onPut func(name string) // called after a file is stored, if set
+	mu    sync.Mutex
+}
+
+func newMemDrive(name string) *memDrive {
+	return &memDrive{
+		name:  name,
+		space: 1 << 30,
+		files: map[string][]byte{},
+	}
+}
+
+func (d *memDrive) GetID() string {
+	if d.id == "" {
+		return d.name
+	}
+
+	return d.id
+}
+
+func (d *memDrive) GetProviderName() string {
+	return d.name
+}
+
+func (d *memDrive) GetFile(name string) (io.ReadCloser, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, ok := d.files[name]
+	if !ok {
+		return nil, common.ErrNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (d *memDrive) PutFile(name string, content io.Reader) error {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.files[name] = data
+	d.mu.Unlock()
+
+	if d.onPut != nil {
+		d.onPut(name)
+	}
+
+	return nil
+}
+
+func (d *memDrive) GetFileMetadata(name string) (*drive.Metadata, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, ok := d.files[name]
+	if !ok {
+		return nil, common.ErrNotFound
+	}
+
+	return &drive.Metadata{Name: name, Size: uint64(len(data)), Hash: fmt.Sprintf("%x", md5.Sum(data))}, nil
+}
+
+func (d *memDrive) DeleteFile(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.files[name]; !ok {
+		return common.ErrNotFound
+	}
+
+	delete(d.files, name)
+
+	return nil
+}
+
+func (d *memDrive) MoveFile(name string, newName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, ok := d.files[name]
+	if !ok {
+		return common.ErrNotFound
+	}
+
+	delete(d.files, name)
+	d.files[newName] = data
+
+	return nil
+}
+
+func (d *memDrive) Lock() error {
+	return nil
+}
+
+func (d *memDrive) Unlock() error {
+	return nil
+}
+
+func (d *memDrive) ComputeHash(r io.Reader, hchan chan string, echan chan error) {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		echan <- err
+		return
+	}
+
+	hchan <- fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func (d *memDrive) GetAvailableSpace() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	space := d.space
+	for _, data := range d.files {
+		space -= int64(len(data))
+	}
+
+	return space, nil
+}
+
+// has returns whether the remote file at url is in the drive
+func (d *memDrive) has(url string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.files[strings.TrimPrefix(url, d.GetID()+"://")]
+
+	return ok
+}
+
+// newTestManager returns a manager with a new database on drv. Background
+// processes aren't started, changes are uploaded by calling processChanges.
+func newTestManager(t *testing.T, drv *memDrive) *Manager {
+	dir, err := ioutil.TempDir("", "cloudstash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cipher := crypto.NewCipher(strings.Repeat("ab", 32))
+
+	m, err := newManager([]drive.Drive{drv}, cipher, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.db, err = newDB(drv, cipher, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+// cachedPath returns the path of the cached file of inode
+func cachedPath(t *testing.T, m *Manager, inode int64) string {
+	e, found := m.cache.Get(common.ToString(inode))
+	if !found {
+		t.Fatalf("inode %d isn't cached", inode)
+	}
+
+	return e.(cacheEntry).path
+}
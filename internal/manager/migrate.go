@@ -0,0 +1,571 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/crypto"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errBusy is returned when a remote file can't be moved since it has a pending change
+var errBusy = errors.New("remote file has a pending change")
+
+// Migration is the result of moving remote files between drives. Files which
+// are skipped or failed are moved when the migration is run again.
+type Migration struct {
+	Moved    int  // remote files moved
+	Skipped  int  // remote files with pending changes
+	Failed   int  // remote files which couldn't be moved
+	Database bool // whether the database is moved
+}
+
+// moves keeps urls of the remote files being moved, they aren't
+// uploaded until they are moved
+type moves struct {
+	mu   sync.Mutex
+	urls map[string]bool
+}
+
+func newMoves() *moves {
+	return &moves{urls: map[string]bool{}}
+}
+
+func (mv *moves) has(url string) bool {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+
+	return mv.urls[url]
+}
+
+func (mv *moves) set(url string, moving bool) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+
+	if moving {
+		mv.urls[url] = true
+	} else {
+		delete(mv.urls, url)
+	}
+}
+
+// MigrateDrive moves all remote files in the drive named from to the drive
+// named to, including the replicas, the shards and the database. Each file
+// is copied and verified before its url is changed, so an interrupted migration
+// can be continued by running it again. The originals are deleted a while
+// after the database with the new urls is uploaded.
+func (m *Manager) MigrateDrive(from string, to string) (*Migration, error) {
+	if from == to {
+		return nil, fmt.Errorf("source and destination drives are the same")
+	}
+
+	src, err := m.getDriveByName(from)
+	if err != nil {
+		return nil, fmt.Errorf("drive %s isn't configured", from)
+	}
+
+	dst, err := m.getDriveByName(to)
+	if err != nil {
+		return nil, fmt.Errorf("drive %s isn't configured", to)
+	}
+
+	if m.IsOffline() {
+		return nil, fmt.Errorf("remote drives are unreachable")
+	}
+
+	res := &Migration{}
+
+	// remote files are referred to by the id of their drive
+	id := src.GetID()
+
+	urls, err := m.queryURLs(func(db *sqlite.Client) ([]string, error) { return db.GetDriveURLs(id) })
+	if err != nil {
+		return nil, err
+	}
+
+	for _, url := range urls {
+		res.add(m.moveURL(url, dst), url)
+	}
+
+	replicas, err := m.queryURLs(func(db *sqlite.Client) ([]string, error) { return db.GetDriveReplicas(id) })
+	if err != nil {
+		return nil, err
+	}
+
+	for _, url := range replicas {
+		res.add(m.moveReplica(url, src, dst), url)
+	}
+
+	if m.db.extDrive == src {
+		if err := m.moveDatabase(dst); err != nil {
+			return res, fmt.Errorf("couldn't move database: %v", err)
+		}
+
+		res.Database = true
+	}
+
+	m.quotas.refresh(m.drives)
+
+	return res, nil
+}
+
+// Rebalance moves remote files from the drives with less available space to
+// the ones with more, until the difference can't be reduced anymore. Shards
+// aren't moved since they should stay in separate drives.
+func (m *Manager) Rebalance() (*Migration, error) {
+	if m.IsOffline() {
+		return nil, fmt.Errorf("remote drives are unreachable")
+	}
+
+	res := &Migration{}
+
+	space := m.quotas.refresh(m.drives)
+
+	// remote files of each drive and the index of the next one to try
+	urls := map[string][]string{}
+	next := map[string]int{}
+
+	for {
+		drives := []drive.Drive{}
+		for _, drv := range m.drives {
+			if _, ok := space[drv.GetID()]; ok {
+				drives = append(drives, drv)
+			}
+		}
+
+		if len(drives) < 2 {
+			break
+		}
+
+		sort.SliceStable(drives, func(a, b int) bool {
+			return space[drives[a].GetID()] < space[drives[b].GetID()]
+		})
+
+		src, dst := drives[0], drives[len(drives)-1]
+		gap := space[dst.GetID()] - space[src.GetID()]
+
+		name := src.GetID()
+
+		if _, ok := urls[name]; !ok {
+			list, err := m.queryURLs(func(db *sqlite.Client) ([]string, error) { return db.GetDriveBlobURLs(name) })
+			if err != nil {
+				return res, err
+			}
+
+			urls[name] = list
+		}
+
+		moved := false
+
+		// the gap only gets smaller, the files which don't fit aren't tried again
+		for ; next[name] < len(urls[name]) && !moved; next[name]++ {
+			url := urls[name][next[name]]
+
+			size, ok := m.fitsIn(url, src, dst, gap)
+			if !ok {
+				continue
+			}
+
+			err := m.moveURL(url, dst)
+			res.add(err, url)
+
+			if err == nil {
+				space[name] += size
+				space[dst.GetID()] -= size
+				moved = true
+			}
+		}
+
+		if !moved {
+			break
+		}
+	}
+
+	m.quotas.refresh(m.drives)
+
+	return res, nil
+}
+
+// fitsIn returns the size of the remote file at url in src and whether
+// moving it to dst reduces the gap between their available space
+func (m *Manager) fitsIn(url string, src drive.Drive, dst drive.Drive, gap int64) (int64, bool) {
+	u, err := common.ParseURL(url)
+	if err != nil {
+		return 0, false
+	}
+
+	replicas, err := m.getReplicas(url)
+	if err != nil {
+		log.Warningf("couldn't get replicas of %s: %v", url, err)
+		return 0, false
+	}
+
+	// it wouldn't free any space
+	for _, r := range replicas {
+		if r == dst.GetID() {
+			return 0, false
+		}
+	}
+
+	md, err := src.GetFileMetadata(u.Name)
+	if err != nil {
+		if err != common.ErrNotFound {
+			log.Warningf("couldn't get metadata of %s: %v", url, err)
+		}
+
+		return 0, false
+	}
+
+	size := int64(md.Size)
+
+	return size, size > 0 && 2*size <= gap
+}
+
+func (res *Migration) add(err error, url string) {
+	switch err {
+	case nil:
+		res.Moved++
+	case errBusy:
+		log.Infof("%s has a pending change, it isn't moved", url)
+		res.Skipped++
+	default:
+		log.Warningf("couldn't move %s: %v", url, err)
+		res.Failed++
+	}
+}
+
+// moveURL copies the remote file at url to dst and changes its url wherever
+// it is referenced. The original is deleted after the database with the new
+// url is uploaded, unless it is referenced again by then. Urls
+// of chunk lists and sharded contents are only changed since they aren't
+// remote files, as well as the ones of files which aren't uploaded yet.
+func (m *Manager) moveURL(url string, dst drive.Drive) error {
+	u, err := common.ParseURL(url)
+	if err != nil {
+		return fmt.Errorf("couldn't parse url %s: %v", url, err)
+	}
+
+	newURL := drive.GetURL(dst, u.Name)
+
+	m.moves.set(url, true)
+	defer m.moves.set(url, false)
+
+	// an upload in progress would overwrite the original after it is copied,
+	// a deletion of a previous original would delete the copy
+	if m.journal.hasRemote(url) || m.journal.hasRemote(newURL) {
+		return errBusy
+	}
+
+	key, err := m.isContentKey(url)
+	if err != nil {
+		return err
+	}
+
+	copied := false
+
+	if !key {
+		replicas, err := m.getReplicas(url)
+		if err != nil {
+			return err
+		}
+
+		if !containsString(replicas, dst.GetID()) {
+			err = m.copyFile(url, dst, u.Name)
+			if err != nil && err != common.ErrNotFound {
+				return err
+			}
+
+			copied = err == nil
+		}
+	}
+
+	m.db.wLock()
+
+	// changes made while it is copied are uploaded to the original
+	if m.journal.hasRemote(url) {
+		m.db.wUnlock()
+
+		if copied {
+			dst.DeleteFile(u.Name)
+		}
+
+		return errBusy
+	}
+
+	found, err := m.renameURL(url, newURL)
+
+	// it is scheduled before the database can be uploaded, so that the
+	// upload carrying the new url releases it
+	if err == nil && found && !key {
+		m.scheduleDelayedDeletion(url)
+	}
+
+	m.db.wUnlock()
+
+	if err != nil || !found {
+		// it is removed while it is copied
+		if copied {
+			dst.DeleteFile(u.Name)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// moveReplica moves the replica of the remote file at url in src to dst.
+// If dst already has the file, the replica is only deleted.
+func (m *Manager) moveReplica(url string, src drive.Drive, dst drive.Drive) error {
+	u, err := common.ParseURL(url)
+	if err != nil {
+		return fmt.Errorf("couldn't parse url %s: %v", url, err)
+	}
+
+	m.moves.set(url, true)
+	defer m.moves.set(url, false)
+
+	if m.journal.hasRemote(url) {
+		return errBusy
+	}
+
+	replicas, err := m.getReplicas(url)
+	if err != nil {
+		return err
+	}
+
+	copied := false
+
+	if u.Scheme != dst.GetID() && !containsString(replicas, dst.GetID()) {
+		reader, err := src.GetFile(u.Name)
+		if err != nil {
+			return fmt.Errorf("couldn't get replica: %v", err)
+		}
+
+		_, err = putVerified(dst, u.Name, reader)
+		reader.Close()
+
+		if err != nil {
+			return err
+		}
+
+		copied = true
+	}
+
+	stored := []string{}
+	for _, r := range replicas {
+		if r != src.GetID() {
+			stored = append(stored, r)
+		}
+	}
+
+	if copied {
+		stored = append(stored, dst.GetID())
+	}
+
+	// uploads made after it are stored in the new replicas
+	if err := m.setReplicas(url, replicas, stored); err != nil {
+		return err
+	}
+
+	m.scheduleDelayedDeletion(drive.GetURL(src, u.Name))
+
+	return nil
+}
+
+// copyFile copies the remote file at url to dst as name. It is copied as it
+// is, already encrypted. Returns common.ErrNotFound if it isn't uploaded yet.
+func (m *Manager) copyFile(url string, dst drive.Drive, name string) error {
+	reader, err := m.getFile(url)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return err
+		}
+
+		return fmt.Errorf("couldn't get %s: %v", url, err)
+	}
+	defer reader.Close()
+
+	_, err = putVerified(dst, name, reader)
+
+	return err
+}
+
+// putVerified uploads the content read from r to drv as name and checks
+// that the hash of the uploaded file matches the one of the content.
+// Returns the hash computed by drv.
+func putVerified(drv drive.Drive, name string, r io.Reader) (string, error) {
+	hs := crypto.NewHashStream(drv)
+
+	if err := drv.PutFile(name, hs.NewHashReader(r)); err != nil {
+		return "", fmt.Errorf("couldn't upload to %s: %v", drv.GetProviderName(), err)
+	}
+
+	hash, err := hs.GetComputedHash()
+	if err != nil {
+		drv.DeleteFile(name)
+
+		return "", fmt.Errorf("couldn't compute hash: %v", err)
+	}
+
+	md, err := drv.GetFileMetadata(name)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get metadata of the copy in %s: %v", drv.GetProviderName(), err)
+	}
+
+	if md.Hash != hash {
+		drv.DeleteFile(name)
+
+		return "", fmt.Errorf("hash of the copy in %s doesn't match", drv.GetProviderName())
+	}
+
+	return hash, nil
+}
+
+// moveDatabase uploads the database to dst and deletes it from its drive.
+// Other clients find it in dst when it disappears from its previous drive.
+func (m *Manager) moveDatabase(dst drive.Drive) error {
+	src := m.db.extDrive
+
+	if err := src.Lock(); err != nil {
+		return fmt.Errorf("couldn't acquire remote lock: %v", err)
+	}
+
+	defer func() {
+		if err := src.Unlock(); err != nil {
+			log.Errorf("couldn't release remote lock: %v", err)
+		}
+	}()
+
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	md, err := src.GetFileMetadata(common.DatabaseFileName)
+	if err != nil {
+		return fmt.Errorf("couldn't get metadata of DB file: %v", err)
+	}
+
+	// changes of other clients aren't lost
+	if md.Hash != m.db.hash {
+		if err := mergeRemoteDatabase(m, md.Hash); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(m.db.path)
+	if err != nil {
+		return fmt.Errorf("couldn't open file %s: %v", m.db.path, err)
+	}
+	defer file.Close()
+
+	hash, err := putVerified(dst, common.DatabaseFileName, m.cipher.NewEncryptReader(file))
+	if err != nil {
+		return err
+	}
+
+	m.db.extDrive = dst
+	m.db.hash = hash
+	m.db.dirty = false
+
+	if err := m.db.saveState(); err != nil {
+		log.Warningf("couldn't save database state: %v", err)
+	}
+
+	m.journal.release(deletionDelay)
+
+	if err := src.DeleteFile(common.DatabaseFileName); err != nil {
+		log.Warningf("couldn't delete DB file from %s: %v", src.GetProviderName(), err)
+	}
+
+	return nil
+}
+
+// isContentKey returns whether url is the key of a chunk list or
+// a sharded content rather than a remote file
+func (m *Manager) isContentKey(url string) (bool, error) {
+	chunks, err := m.getChunkList(url)
+	if err != nil {
+		return false, err
+	}
+
+	if len(chunks) > 0 {
+		return true, nil
+	}
+
+	return m.isSharded(url)
+}
+
+// renameURL changes url of the remote file to newURL. Caller should hold the write lock.
+func (m *Manager) renameURL(url string, newURL string) (bool, error) {
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return false, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	found, err := db.RenameURL(url, newURL)
+	if err != nil {
+		return false, err
+	}
+
+	if found {
+		m.notifyChangeInDatabase()
+	}
+
+	return found, nil
+}
+
+// isReferenced returns whether the remote file at url is referenced by the database
+func (m *Manager) isReferenced(url string) (bool, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return false, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	found, err := db.IsReferenced(url)
+	if err != nil {
+		return false, fmt.Errorf("couldn't check references of %s: %v", url, err)
+	}
+
+	return found, nil
+}
+
+func (m *Manager) queryURLs(query func(db *sqlite.Client) ([]string, error)) ([]string, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	urls, err := query(db)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get remote files: %v", err)
+	}
+
+	return urls, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,206 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+)
+
+// newTestMigrationManager returns a manager with a file stored in the first
+// of its two drives, along with the url of the file
+func newTestMigrationManager(t *testing.T) (*Manager, *memDrive, *memDrive, string) {
+	a := newMemDrive("a")
+	b := newMemDrive("b")
+
+	m := newTestManager(t, a)
+
+	inode := writeTestFile(t, m, "file", []byte("moved"))
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.drives = []drive.Drive{a, b}
+	m.quotas.refresh(m.drives)
+
+	return m, a, b, md.URL
+}
+
+// expireDeletions makes the delayed deletions in the journal ready
+func expireDeletions(m *Manager) {
+	m.journal.mu.Lock()
+	defer m.journal.mu.Unlock()
+
+	for key, u := range m.journal.entries {
+		u.NextAttempt = time.Time{}
+		m.journal.entries[key] = u
+	}
+}
+
+// pendingDeletion returns the deletion of url in the journal
+func pendingDeletion(m *Manager, url string) (PendingUpload, bool) {
+	for _, u := range m.journal.list() {
+		if u.Delete && u.RemotePath == url {
+			return u, true
+		}
+	}
+
+	return PendingUpload{}, false
+}
+
+func TestMigrateDrive(t *testing.T) {
+	m, a, b, url := newTestMigrationManager(t)
+
+	res, err := m.MigrateDrive("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Moved != 1 || res.Skipped != 0 || res.Failed != 0 || !res.Database {
+		t.Errorf("unexpected migration result: %+v", res)
+	}
+
+	md, err := m.LookupPath("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := common.ParseURL(md.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Scheme != "b" || !b.has(md.URL) {
+		t.Errorf("file isn't moved to b: %s", md.URL)
+	}
+
+	if content := readTestFile(t, m, "file"); content != "moved" {
+		t.Errorf("content of moved file is '%s'", content)
+	}
+
+	if m.db.extDrive != b || !b.has("b://"+common.DatabaseFileName) || a.has("a://"+common.DatabaseFileName) {
+		t.Errorf("database isn't moved to b")
+	}
+
+	// other clients may still read the original until they fetch the database
+	processChanges(m, forceAll)
+
+	if !a.has(url) {
+		t.Fatalf("original is deleted right after the database is uploaded")
+	}
+
+	expireDeletions(m)
+	processChanges(m, forceAll)
+
+	if a.has(url) {
+		t.Errorf("original isn't deleted after the delay")
+	}
+}
+
+func TestMovedOriginalWaitsForDatabase(t *testing.T) {
+	m, a, _, url := newTestMigrationManager(t)
+
+	// the database stays in a, only the file is moved
+	if err := m.moveURL(url, m.drives[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	u, found := pendingDeletion(m, url)
+	if !found || !u.Delayed || !u.Deferred {
+		t.Fatalf("deletion of the original isn't deferred: %+v", u)
+	}
+
+	// the database is uploaded, and the deletion is scheduled after that
+	expireDeletions(m)
+	processChanges(m, forceAll)
+
+	if !a.has(url) {
+		t.Fatalf("original is deleted before the database is uploaded")
+	}
+
+	u, found = pendingDeletion(m, url)
+	if !found || u.Deferred || time.Until(u.NextAttempt) < deletionDelay-time.Minute {
+		t.Fatalf("deletion of the original isn't delayed: %+v", u)
+	}
+
+	expireDeletions(m)
+	processChanges(m, forceAll)
+
+	if a.has(url) {
+		t.Errorf("original isn't deleted after the database is uploaded")
+	}
+}
+
+func TestMovedOriginalReferencedAgain(t *testing.T) {
+	m, a, b, url := newTestMigrationManager(t)
+
+	if _, err := m.MigrateDrive("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// moving it back would be deleted along with the original
+	res, err := m.MigrateDrive("b", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Moved != 0 || res.Skipped != 1 {
+		t.Errorf("file is moved back while its original is deleted: %+v", res)
+	}
+
+	md, err := m.LookupPath("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// i.e. a merged database still uses the original
+	if _, err := m.renameURL(md.URL, url); err != nil {
+		t.Fatal(err)
+	}
+
+	expireDeletions(m)
+	processChanges(m, forceAll)
+
+	if !a.has(url) {
+		t.Errorf("original is deleted while it is referenced")
+	}
+
+	if !b.has(md.URL) {
+		t.Errorf("copy is deleted")
+	}
+}
+
+func TestMergeRemoteMove(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	crtime := time.Now()
+
+	insertTestRows(t, local, sqlite.Metadata{Inode: 2, Name: "a", Parent: 1, Type: common.DrvFile, URL: "a://file", CrTime: crtime})
+	insertTestRows(t, remote, sqlite.Metadata{Inode: 2, Name: "a", Parent: 1, Type: common.DrvFile, URL: "b://file", CrTime: crtime})
+
+	renames := map[string]string{}
+	onRename := func(url string, newURL string) {
+		renames[url] = newURL
+	}
+
+	db := &database{path: local}
+	if err := db.merge(remote, func(int64, int64) {}, onRename); err != nil {
+		t.Fatal(err)
+	}
+
+	merged := openTestDatabase(t, local)
+	defer merged.Close()
+
+	md, err := merged.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.URL != "b://file" || renames["a://file"] != "b://file" {
+		t.Errorf("file moved by the other client isn't renamed: %+v, renames: %v", md, renames)
+	}
+}
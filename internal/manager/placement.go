@@ -0,0 +1,311 @@
+package manager
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const quotaRefreshInterval = 10 * time.Minute
+
+// PlacementPolicy chooses the drive to store the content of a file in
+type PlacementPolicy interface {
+	// Place returns one of drives for the file, drives isn't empty
+	Place(file PlacedFile, drives []DriveSpace) drive.Drive
+}
+
+// PlacedFile is the file whose drive is chosen
+type PlacedFile struct {
+	Path string // path of the file in the filesystem, like /photos/a.jpg
+	Size int64
+}
+
+// DriveSpace is a drive and its available space, -1 if it is unknown
+type DriveSpace struct {
+	Drive     drive.Drive
+	Available int64
+}
+
+// MostFree places files in the drive with the most available space
+type MostFree struct{}
+
+func (MostFree) Place(file PlacedFile, drives []DriveSpace) drive.Drive {
+	best := drives[0]
+
+	for _, d := range drives[1:] {
+		if d.Available > best.Available {
+			best = d
+		}
+	}
+
+	return best.Drive
+}
+
+// RoundRobin places files in the drives in turn
+type RoundRobin struct {
+	next uint32 // accessed atomically
+}
+
+func (p *RoundRobin) Place(file PlacedFile, drives []DriveSpace) drive.Drive {
+	n := atomic.AddUint32(&p.next, 1) - 1
+
+	return drives[int(n%uint32(len(drives)))].Drive
+}
+
+// Weighted places files in the drives randomly in proportion to their
+// weights, which are keyed by drive names. Drives without a weight
+// have weight 1, the ones with zero weight aren't used unless all are.
+type Weighted struct {
+	Weights map[string]int
+}
+
+func (p Weighted) Place(file PlacedFile, drives []DriveSpace) drive.Drive {
+	total := 0
+	for _, d := range drives {
+		total += p.weight(d.Drive)
+	}
+
+	if total == 0 {
+		return drives[0].Drive
+	}
+
+	n := rand.Intn(total)
+
+	for _, d := range drives {
+		n -= p.weight(d.Drive)
+		if n < 0 {
+			return d.Drive
+		}
+	}
+
+	return drives[len(drives)-1].Drive
+}
+
+func (p Weighted) weight(drv drive.Drive) int {
+	w, ok := p.Weights[drv.GetProviderName()]
+	if !ok {
+		return 1
+	}
+
+	if w < 0 {
+		return 0
+	}
+
+	return w
+}
+
+// SizeClass is the drive of the files up to MaxSize bytes, 0 means any size
+type SizeClass struct {
+	MaxSize int64
+	Drive   string
+}
+
+// BySize places files in the drive of the first class they fit in.
+// Files which don't fit in any class are placed by Fallback.
+type BySize struct {
+	Classes  []SizeClass
+	Fallback PlacementPolicy
+}
+
+func (p BySize) Place(file PlacedFile, drives []DriveSpace) drive.Drive {
+	for _, c := range p.Classes {
+		if c.MaxSize > 0 && file.Size > c.MaxSize {
+			continue
+		}
+
+		if drv := findDrive(drives, c.Drive); drv != nil {
+			return drv
+		}
+	}
+
+	return p.Fallback.Place(file, drives)
+}
+
+// ByPath places files under a directory in the drive of that directory,
+// the longest matching one is used. Prefixes are paths like /photos.
+// Files which aren't under any of them are placed by Fallback.
+type ByPath struct {
+	Prefixes map[string]string
+	Fallback PlacementPolicy
+}
+
+func (p ByPath) Place(file PlacedFile, drives []DriveSpace) drive.Drive {
+	prefixes := make([]string, 0, len(p.Prefixes))
+	for prefix := range p.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+
+	sort.Slice(prefixes, func(a, b int) bool {
+		return len(prefixes[a]) > len(prefixes[b])
+	})
+
+	for _, prefix := range prefixes {
+		if !underPath(file.Path, prefix) {
+			continue
+		}
+
+		if drv := findDrive(drives, p.Prefixes[prefix]); drv != nil {
+			return drv
+		}
+	}
+
+	return p.Fallback.Place(file, drives)
+}
+
+// Pinned places all files in one drive, Fallback is used if it isn't available
+type Pinned struct {
+	Drive    string
+	Fallback PlacementPolicy
+}
+
+func (p Pinned) Place(file PlacedFile, drives []DriveSpace) drive.Drive {
+	if drv := findDrive(drives, p.Drive); drv != nil {
+		return drv
+	}
+
+	return p.Fallback.Place(file, drives)
+}
+
+func findDrive(drives []DriveSpace, name string) drive.Drive {
+	for _, d := range drives {
+		if d.Drive.GetProviderName() == name {
+			return d.Drive
+		}
+	}
+
+	return nil
+}
+
+// underPath returns whether path is dir or is under it
+func underPath(path string, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		return true
+	}
+
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// placeFile returns the drive chosen by the placement policy for the file
+func (m *Manager) placeFile(path string, size int64) drive.Drive {
+	return m.placement.Place(PlacedFile{Path: path, Size: size}, m.driveSpaces())
+}
+
+// driveSpaces returns the drives with their cached available space
+func (m *Manager) driveSpaces() []DriveSpace {
+	space := m.quotas.get(m.drives)
+
+	drives := make([]DriveSpace, len(m.drives))
+
+	for i, drv := range m.drives {
+		available, ok := space[drv.GetID()]
+		if !ok {
+			available = -1
+		}
+
+		drives[i] = DriveSpace{Drive: drv, Available: available}
+	}
+
+	return drives
+}
+
+// placeContent moves the url of the file to the drive chosen for its new
+// size if its previous content is empty. New files are placed when they
+// are created, before their size is known. Caller should hold the write lock.
+func (m *Manager) placeContent(db *sqlite.Client, md *sqlite.Metadata, size int64) {
+	// shards are spread over the drives regardless of the url
+	if m.erasure != nil || m.locations != nil {
+		return
+	}
+
+	u, err := common.ParseURL(md.URL)
+	if err != nil {
+		log.Warningf("couldn't parse url %s: %v", md.URL, err)
+		return
+	}
+
+	path, err := getPath(db, md.Inode)
+	if err != nil {
+		log.Warningf("couldn't get path of %d: %v", md.Inode, err)
+		return
+	}
+
+	drv := m.placeFile(path, size)
+	if drv.GetID() == u.Scheme {
+		return
+	}
+
+	// the empty content may have been uploaded already
+	m.scheduleDeletion(md.Inode, md.URL)
+
+	md.URL = drive.GetURL(drv, u.Name)
+}
+
+// quotaCache keeps available space of the drives, so that they aren't
+// asked for it whenever a file is placed. It is refreshed in the background.
+type quotaCache struct {
+	mu     sync.RWMutex
+	space  map[string]int64 // by drive names, unreachable drives are missing
+	filled bool
+}
+
+func newQuotaCache() *quotaCache {
+	return &quotaCache{space: map[string]int64{}}
+}
+
+// get returns the cached available space, it is looked up if it isn't cached yet
+func (q *quotaCache) get(drives []drive.Drive) map[string]int64 {
+	q.mu.RLock()
+	space, filled := q.space, q.filled
+	q.mu.RUnlock()
+
+	if !filled {
+		space = q.refresh(drives)
+	}
+
+	return space
+}
+
+// refresh looks up available space of the drives and returns it
+func (q *quotaCache) refresh(drives []drive.Drive) map[string]int64 {
+	space := map[string]int64{}
+
+	for _, drv := range drives {
+		available, err := drv.GetAvailableSpace()
+		if err != nil {
+			log.Warningf("couldn't get available space for %s: %v, ignoring...", drv.GetProviderName(), err)
+			continue
+		}
+
+		space[drv.GetID()] = available
+	}
+
+	q.mu.Lock()
+	q.space = space
+	q.filled = true
+	q.mu.Unlock()
+
+	return space
+}
+
+// refreshQuotas looks up available space of the drives periodically
+func refreshQuotas(m *Manager) {
+	for {
+		time.Sleep(quotaRefreshInterval)
+
+		if m.IsOffline() {
+			continue
+		}
+
+		m.quotas.refresh(m.drives)
+	}
+}
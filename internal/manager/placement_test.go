@@ -0,0 +1,96 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+)
+
+// testDriveSpaces returns drives a, b and c with the given available spaces
+func testDriveSpaces(spaces ...int64) []DriveSpace {
+	drives := []DriveSpace{}
+
+	for i, space := range spaces {
+		drives = append(drives, DriveSpace{
+			Drive:     newMemDrive(string(rune('a' + i))),
+			Available: space,
+		})
+	}
+
+	return drives
+}
+
+func TestPlacementPolicies(t *testing.T) {
+	drives := testDriveSpaces(10, 30, 20)
+	file := PlacedFile{Path: "/photos/2020/a.jpg", Size: 100}
+
+	tests := []struct {
+		name   string
+		policy PlacementPolicy
+		want   string
+	}{
+		{"most free", MostFree{}, "b"},
+		{"pinned", Pinned{Drive: "c", Fallback: MostFree{}}, "c"},
+		{"pinned to missing drive", Pinned{Drive: "x", Fallback: MostFree{}}, "b"},
+		{"small file", BySize{Classes: []SizeClass{{MaxSize: 1000, Drive: "a"}}, Fallback: MostFree{}}, "a"},
+		{"large file", BySize{Classes: []SizeClass{{MaxSize: 10, Drive: "a"}}, Fallback: MostFree{}}, "b"},
+		{"any size", BySize{Classes: []SizeClass{{MaxSize: 10, Drive: "a"}, {Drive: "c"}}, Fallback: MostFree{}}, "c"},
+		{"longest prefix", ByPath{Prefixes: map[string]string{"/photos": "a", "/photos/2020": "c"}, Fallback: MostFree{}}, "c"},
+		{"other path", ByPath{Prefixes: map[string]string{"/photo": "a"}, Fallback: MostFree{}}, "b"},
+		{"only weighted", Weighted{Weights: map[string]int{"a": 0, "b": 0}}, "c"},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.Place(file, drives).GetProviderName(); got != test.want {
+			t.Errorf("%s: file is placed in %s, expected %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	drives := testDriveSpaces(10, 30, 20)
+	p := &RoundRobin{}
+
+	for i, want := range []string{"a", "b", "c", "a"} {
+		if got := p.Place(PlacedFile{}, drives).GetProviderName(); got != want {
+			t.Errorf("file %d is placed in %s, expected %s", i, got, want)
+		}
+	}
+}
+
+func TestPlaceContent(t *testing.T) {
+	a := newMemDrive("a")
+	b := newMemDrive("b")
+
+	m := newTestManager(t, a)
+	m.drives = []drive.Drive{a, b}
+	m.placement = BySize{
+		Classes:  []SizeClass{{MaxSize: 4, Drive: "a"}},
+		Fallback: Pinned{Drive: "b", Fallback: MostFree{}},
+	}
+
+	// new files are empty, they are placed again when they are written
+	small := writeTestFile(t, m, "small", []byte("abc"))
+	large := writeTestFile(t, m, "large", []byte("larger content"))
+
+	for inode, want := range map[int64]string{small: "a", large: "b"} {
+		md, err := m.GetMetadata(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u, err := common.ParseURL(md.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if u.Scheme != want {
+			t.Errorf("%s is placed in %s, expected %s", md.Name, u.Scheme, want)
+		}
+
+		if !map[string]*memDrive{"a": a, "b": b}[want].has(md.URL) {
+			t.Errorf("%s isn't uploaded to %s", md.Name, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package manager
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	directionUpload   = "upload"
+	directionDownload = "download"
+)
+
+// Transfer is an upload or a download in progress
+type Transfer struct {
+	ID        int64
+	Inode     int64 // 0 for the database
+	Path      string
+	Direction string
+	Size      int64 // total size in bytes, 0 if unknown
+	Done      int64 // transferred bytes
+	Rate      float64
+	ETA       time.Duration // 0 if unknown
+	Started   time.Time
+}
+
+// Status is a snapshot of the transfers and the changes
+// waiting to be uploaded
+type Status struct {
+	Offline      bool
+	Transfers    []Transfer
+	Pending      []PendingUpload
+	PendingBytes int64 // total size of the pending uploads
+}
+
+// IsIdle returns whether there is nothing left to transfer,
+// i.e. it is safe to unmount
+func (s *Status) IsIdle() bool {
+	if len(s.Transfers) > 0 {
+		return false
+	}
+
+	// delayed deletions are made on the next run as well
+	for _, u := range s.Pending {
+		if !u.Delayed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// progress keeps track of the transfers in progress
+type progress struct {
+	nextID    int64
+	transfers map[int64]*progressReader
+	mu        sync.Mutex
+}
+
+func newProgress() *progress {
+	return &progress{
+		transfers: map[int64]*progressReader{},
+	}
+}
+
+// progressReader counts the bytes read through it
+type progressReader struct {
+	r       io.Reader
+	id      int64
+	inode   int64
+	dir     string
+	size    int64
+	done    int64 // accessed atomically
+	started time.Time
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+
+	atomic.AddInt64(&pr.done, int64(n))
+
+	return n, err
+}
+
+// track wraps r to keep track of the bytes transferred through it. The returned
+// function should be called when the transfer is finished, whether it fails or not.
+func (p *progress) track(r io.Reader, inode int64, direction string, size int64) (io.Reader, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nextID++
+
+	pr := &progressReader{
+		r:       r,
+		id:      p.nextID,
+		inode:   inode,
+		dir:     direction,
+		size:    size,
+		started: time.Now(),
+	}
+
+	p.transfers[pr.id] = pr
+
+	return pr, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		delete(p.transfers, pr.id)
+	}
+}
+
+// list returns the transfers in progress in the order they are started
+func (p *progress) list() []Transfer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+
+	transfers := make([]Transfer, 0, len(p.transfers))
+	for _, pr := range p.transfers {
+		t := Transfer{
+			ID:        pr.id,
+			Inode:     pr.inode,
+			Direction: pr.dir,
+			Size:      pr.size,
+			Done:      atomic.LoadInt64(&pr.done),
+			Started:   pr.started,
+		}
+
+		if elapsed := now.Sub(pr.started).Seconds(); elapsed > 0 {
+			t.Rate = float64(t.Done) / elapsed
+		}
+
+		if t.Rate > 0 && t.Size > t.Done {
+			t.ETA = time.Duration(float64(t.Size-t.Done) / t.Rate * float64(time.Second))
+		}
+
+		transfers = append(transfers, t)
+	}
+
+	sort.Slice(transfers, func(a, b int) bool {
+		return transfers[a].ID < transfers[b].ID
+	})
+
+	return transfers
+}
@@ -0,0 +1,49 @@
+package manager
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	p := newProgress()
+
+	upload, doneUpload := p.track(bytes.NewReader(make([]byte, 100)), 2, directionUpload, 100)
+	_, doneDownload := p.track(bytes.NewReader(nil), 3, directionDownload, 0)
+
+	if _, err := io.CopyN(ioutil.Discard, upload, 40); err != nil {
+		t.Fatal(err)
+	}
+
+	transfers := p.list()
+	if len(transfers) != 2 {
+		t.Fatalf("expected 2 transfers, got %d", len(transfers))
+	}
+
+	// transfers are listed in the order they are started
+	if transfers[0].Inode != 2 || transfers[1].Inode != 3 {
+		t.Errorf("transfers aren't in order: %+v", transfers)
+	}
+
+	if tr := transfers[0]; tr.Direction != directionUpload || tr.Size != 100 || tr.Done != 40 {
+		t.Errorf("upload progress is wrong: %+v", tr)
+	}
+
+	if tr := transfers[1]; tr.Direction != directionDownload || tr.ETA != 0 {
+		t.Errorf("download of unknown size has an ETA: %+v", tr)
+	}
+
+	doneUpload()
+
+	if transfers := p.list(); len(transfers) != 1 || transfers[0].Inode != 3 {
+		t.Errorf("finished transfer is still listed: %+v", transfers)
+	}
+
+	doneDownload()
+
+	if st := (Status{Transfers: p.list()}); !st.IsIdle() {
+		t.Errorf("status isn't idle without transfers: %+v", st)
+	}
+}
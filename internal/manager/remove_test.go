@@ -0,0 +1,107 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// hasDeletion reports whether deletion of the remote file url is journaled
+func hasDeletion(j *journal, url string) bool {
+	for _, u := range j.list() {
+		if u.Delete && u.RemotePath == url {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestRemoveTree(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+
+	dir, err := m.AddDirectory(testRootInode, "dir", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := m.AddDirectory(dir.Inode, "sub", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := writeTestFile(t, m, "inner", []byte("inner"))
+	if err := m.Rename(testRootInode, "inner", sub.Inode, "inner"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file which has a name outside the tree too
+	linked := writeTestFile(t, m, "linked", []byte("linked"))
+	if _, err := m.Link(linked, dir.Inode, "linked"); err != nil {
+		t.Fatal(err)
+	}
+
+	innerMd, err := m.GetMetadata(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	linkedMd, err := m.GetMetadata(linked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := m.RemoveTree(testRootInode, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dir, sub and inner, linked is kept by its other name
+	if removed != 3 {
+		t.Errorf("%d files are removed, expected 3", removed)
+	}
+
+	if _, err := m.Lookup(testRootInode, "dir"); err != common.ErrNotFound {
+		t.Errorf("removed directory is found: %v", err)
+	}
+
+	// the journal keeps the deletions until they are done
+	if !hasDeletion(reloadJournal(t, m.journal), innerMd.URL) {
+		t.Errorf("deletion of remote content isn't journaled")
+	}
+
+	processChanges(m, forceAll)
+
+	if drv.has(innerMd.URL) {
+		t.Errorf("remote content of removed file isn't deleted")
+	}
+
+	if !drv.has(linkedMd.URL) {
+		t.Errorf("remote content of a file linked outside the tree is deleted")
+	}
+
+	if _, err := m.Lookup(testRootInode, "linked"); err != nil {
+		t.Errorf("name outside the tree is removed: %v", err)
+	}
+}
+
+func TestRemovePathErrors(t *testing.T) {
+	m := newTestManager(t, newMemDrive("mem"))
+
+	if _, err := m.AddDirectory(testRootInode, "dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.RemovePath("/dir", false); err != common.ErrIsDir {
+		t.Errorf("directory is removed without recursive: %v", err)
+	}
+
+	if _, err := m.RemovePath("/missing", true); err != common.ErrNotFound {
+		t.Errorf("removing missing path returned %v", err)
+	}
+
+	if _, err := m.RemovePath("/", true); err == nil {
+		t.Errorf("root directory is removed")
+	}
+}
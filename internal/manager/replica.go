@@ -0,0 +1,517 @@
+package manager
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// replicaCheckInterval is how often the missing replicas are restored
+const replicaCheckInterval = time.Hour
+
+// putFile stores the content read from r as the remote file name in drv. If
+// erasure coding is enabled, it is split into shards in several drives instead.
+func (m *Manager) putFile(drv drive.Drive, name string, r io.Reader) error {
+	url := drive.GetURL(drv, name)
+
+	if m.erasure != nil {
+		if err := m.putShards(url, r); err != nil {
+			return err
+		}
+
+		// replicas of the previous content aren't needed anymore
+		return m.deleteReplicas(url)
+	}
+
+	if err := m.putReplicated(drv, name, r); err != nil {
+		return err
+	}
+
+	// content might be sharded before erasure coding is disabled
+	if _, err := m.releaseShards(url); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// putReplicated uploads the content read from r to name in drv, and to the
+// drives chosen for its replicas at the same time. It fails only if the upload
+// to drv fails, replicas which couldn't be uploaded are restored by repairReplicas.
+func (m *Manager) putReplicated(drv drive.Drive, name string, r io.Reader) error {
+	url := drive.GetURL(drv, name)
+
+	// existing replicas are overwritten even if the replication
+	// factor is lowered, otherwise they would be outdated
+	existing, err := m.getReplicas(url)
+	if err != nil {
+		return err
+	}
+
+	targets := m.replicaDrives(drv, existing, m.replicas-1)
+	if len(targets) == 0 && len(existing) == 0 {
+		return drv.PutFile(name, r)
+	}
+
+	errs := putFileAll(append([]drive.Drive{drv}, targets...), name, r)
+	if errs[0] != nil {
+		return errs[0]
+	}
+
+	stored := []string{}
+
+	for i, t := range targets {
+		if errs[i+1] != nil {
+			log.Warningf("couldn't upload replica of %s to %s: %v", url, t.GetProviderName(), errs[i+1])
+			continue
+		}
+
+		stored = append(stored, t.GetID())
+	}
+
+	return m.setReplicas(url, existing, stored)
+}
+
+// putFileAll uploads the content read from r to name in each of drives
+// at once. Returns the errors of the uploads in the order of drives.
+func putFileAll(drives []drive.Drive, name string, r io.Reader) []error {
+	errs := make([]error, len(drives))
+	writers := make([]*io.PipeWriter, len(drives))
+
+	wg := sync.WaitGroup{}
+
+	for i, drv := range drives {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+
+		wg.Add(1)
+		go func(i int, drv drive.Drive) {
+			defer wg.Done()
+
+			errs[i] = drv.PutFile(name, pr)
+
+			// the content isn't read anymore, the other uploads shouldn't wait for it
+			pr.CloseWithError(fmt.Errorf("upload is stopped"))
+		}(i, drv)
+	}
+
+	_, err := io.Copy(&fanout{writers: writers, failed: make([]bool, len(writers))}, r)
+
+	for _, w := range writers {
+		w.CloseWithError(err)
+	}
+
+	wg.Wait()
+
+	if err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = fmt.Errorf("couldn't read content: %v", err)
+			}
+		}
+	}
+
+	return errs
+}
+
+// fanout writes to all writers, the ones which fail are skipped afterwards.
+// It fails only if all of them fail.
+type fanout struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	ok := false
+
+	for i, w := range f.writers {
+		if f.failed[i] {
+			continue
+		}
+
+		if _, err := w.Write(p); err != nil {
+			f.failed[i] = true
+			continue
+		}
+
+		ok = true
+	}
+
+	if !ok {
+		return 0, fmt.Errorf("all uploads are failed")
+	}
+
+	return len(p), nil
+}
+
+// getFile returns a reader of the remote file at url. If it can't be read
+// from the drive in url, its replicas are tried in turn. Sharded content
+// is read from its shards.
+func (m *Manager) getFile(url string) (io.ReadCloser, error) {
+	u, err := common.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse url %s: %v", url, err)
+	}
+
+	s, err := m.getSharded(url)
+	if err == nil {
+		return m.openShards(s)
+	}
+
+	if err != common.ErrNotFound {
+		return nil, fmt.Errorf("couldn't get shards of %s: %v", url, err)
+	}
+
+	replicas, err := m.getReplicas(url)
+	if err != nil {
+		log.Warningf("couldn't get replicas of %s: %v", url, err)
+	}
+
+	var lastErr error
+
+	for _, name := range append([]string{u.Scheme}, replicas...) {
+		drv, err := m.getDriveClient(name)
+		if err != nil {
+			lastErr = fmt.Errorf("couldn't find drive client of %s: %v", name, err)
+			continue
+		}
+
+		reader, err := drv.GetFile(u.Name)
+		if err == nil {
+			return reader, nil
+		}
+
+		if len(replicas) > 0 {
+			log.Warningf("couldn't get %s from %s: %v", url, name, err)
+		}
+
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// moveReplicas renames the replicas of the remote file at url to newName.
+// Returns the drives whose replicas are moved and the ones which couldn't be.
+func (m *Manager) moveReplicas(url string, newName string) ([]string, []string, error) {
+	u, err := common.ParseURL(url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't parse url %s: %v", url, err)
+	}
+
+	replicas, err := m.getReplicas(url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	moved := []string{}
+	failed := []string{}
+
+	for _, name := range replicas {
+		drv, err := m.getDriveClient(name)
+		if err == nil {
+			err = drv.MoveFile(u.Name, newName)
+		}
+
+		if err != nil {
+			log.Warningf("couldn't move replica of %s in %s: %v", url, name, err)
+
+			failed = append(failed, name)
+			continue
+		}
+
+		moved = append(moved, name)
+	}
+
+	return moved, failed, nil
+}
+
+// deleteReplicas deletes the replicas of the remote file at url
+func (m *Manager) deleteReplicas(url string) error {
+	u, err := common.ParseURL(url)
+	if err != nil {
+		return fmt.Errorf("couldn't parse url %s: %v", url, err)
+	}
+
+	replicas, err := m.getReplicas(url)
+	if err != nil {
+		return err
+	}
+
+	if len(replicas) == 0 {
+		return nil
+	}
+
+	for _, name := range replicas {
+		drv, err := m.getDriveClient(name)
+		if err != nil {
+			log.Warningf("couldn't find drive client of %s, replica of %s isn't deleted", name, url)
+			continue
+		}
+
+		if err := drv.DeleteFile(u.Name); err != nil && err != common.ErrNotFound {
+			return fmt.Errorf("couldn't delete replica in %s: %v", name, err)
+		}
+	}
+
+	return m.setReplicas(url, replicas, nil)
+}
+
+// replicaDrives returns up to n drives other than primary to store the
+// replicas of a file in. The ones in existing, which already have a replica,
+// are returned first regardless of n, the others by their available space.
+func (m *Manager) replicaDrives(primary drive.Drive, existing []string, n int) []drive.Drive {
+	exclude := map[string]bool{primary.GetID(): true}
+	targets := []drive.Drive{}
+
+	for _, name := range existing {
+		if exclude[name] {
+			continue
+		}
+
+		exclude[name] = true
+
+		if drv, err := m.getDriveClient(name); err == nil {
+			targets = append(targets, drv)
+		}
+	}
+
+	if len(targets) >= n {
+		return targets
+	}
+
+	for _, drv := range m.drivesBySpace(exclude) {
+		if len(targets) == n {
+			break
+		}
+
+		targets = append(targets, drv)
+	}
+
+	return targets
+}
+
+// drivesBySpace returns the drives which aren't in exclude, the
+// ones with more available space first. Unreachable ones are skipped.
+func (m *Manager) drivesBySpace(exclude map[string]bool) []drive.Drive {
+	drives := []drive.Drive{}
+	spaces := m.quotas.get(m.drives)
+
+	for _, drv := range m.drives {
+		if _, ok := spaces[drv.GetID()]; !ok || exclude[drv.GetID()] {
+			continue
+		}
+
+		drives = append(drives, drv)
+	}
+
+	sort.SliceStable(drives, func(a, b int) bool {
+		return spaces[drives[a].GetID()] > spaces[drives[b].GetID()]
+	})
+
+	return drives
+}
+
+func (m *Manager) getReplicas(url string) ([]string, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	replicas, err := db.GetReplicas(url)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get replicas of %s: %v", url, err)
+	}
+
+	return replicas, nil
+}
+
+// setReplicas records drives as the replicas of url, old is the current ones
+func (m *Manager) setReplicas(url string, old []string, drives []string) error {
+	if equalStrings(old, drives) {
+		return nil
+	}
+
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.SetReplicas(url, drives); err != nil {
+		return err
+	}
+
+	m.notifyChangeInDatabase()
+
+	return nil
+}
+
+// equalStrings returns whether a and b have the same elements regardless of their order
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := map[string]int{}
+	for _, s := range a {
+		counts[s]++
+	}
+
+	for _, s := range b {
+		counts[s]--
+
+		if counts[s] < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// repairReplicas restores the missing replicas periodically
+func repairReplicas(m *Manager) {
+	if m.replicas <= 1 {
+		return
+	}
+
+	for {
+		time.Sleep(replicaCheckInterval)
+
+		n, err := m.RepairReplicas()
+		if err != nil {
+			log.Errorf("couldn't restore replicas: %v", err)
+		} else if n > 0 {
+			log.Infof("restored %d replicas", n)
+		}
+	}
+}
+
+// RepairReplicas copies the remote files which are in fewer available drives
+// than the replication factor to other drives. Returns the number of copies.
+func (m *Manager) RepairReplicas() (int, error) {
+	if m.IsOffline() {
+		return 0, nil
+	}
+
+	count := 0
+
+	for offset := 0; ; offset += mergeChunkSize {
+		urls, err := m.getBlobURLs(mergeChunkSize, offset)
+		if err != nil {
+			return count, err
+		}
+
+		if len(urls) == 0 {
+			break
+		}
+
+		for _, url := range urls {
+			n, err := m.repairReplica(url)
+			if err != nil {
+				log.Warningf("couldn't restore replicas of %s: %v", url, err)
+			}
+
+			count += n
+		}
+	}
+
+	return count, nil
+}
+
+// repairReplica copies the remote file at url to other drives if
+// it is in fewer available drives than the replication factor
+func (m *Manager) repairReplica(url string) (int, error) {
+	u, err := common.ParseURL(url)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't parse url %s: %v", url, err)
+	}
+
+	replicas, err := m.getReplicas(url)
+	if err != nil {
+		return 0, err
+	}
+
+	exclude := map[string]bool{}
+	available := 0
+
+	for _, name := range append([]string{u.Scheme}, replicas...) {
+		exclude[name] = true
+
+		if _, err := m.getDriveClient(name); err == nil {
+			available++
+		}
+	}
+
+	if available >= m.replicas {
+		return 0, nil
+	}
+
+	targets := m.drivesBySpace(exclude)
+	if len(targets) > m.replicas-available {
+		targets = targets[:m.replicas-available]
+	}
+
+	if len(targets) == 0 {
+		return 0, nil
+	}
+
+	reader, err := m.getFile(url)
+	if err != nil {
+		// i.e. it is waiting to be uploaded
+		if err == common.ErrNotFound {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+	defer reader.Close()
+
+	// content is copied as it is, it is already encrypted
+	errs := putFileAll(targets, u.Name, reader)
+
+	stored := append([]string{}, replicas...)
+
+	for i, t := range targets {
+		if errs[i] != nil {
+			log.Warningf("couldn't copy %s to %s: %v", url, t.GetProviderName(), errs[i])
+			continue
+		}
+
+		stored = append(stored, t.GetID())
+	}
+
+	return len(stored) - len(replicas), m.setReplicas(url, replicas, stored)
+}
+
+func (m *Manager) getBlobURLs(limit int, offset int) ([]string, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	urls, err := db.GetBlobURLs(limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get remote files: %v", err)
+	}
+
+	return urls, nil
+}
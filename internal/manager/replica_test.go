@@ -0,0 +1,111 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+)
+
+// newTestReplicaManager returns a manager storing each remote file in both drives
+func newTestReplicaManager(t *testing.T) (*Manager, *memDrive, *memDrive) {
+	a := newMemDrive("a")
+	b := newMemDrive("b")
+
+	m := newTestManager(t, a)
+	m.drives = []drive.Drive{a, b}
+	m.replicas = 2
+
+	return m, a, b
+}
+
+// remoteName returns the name of the remote file of inode in its drives
+func remoteName(t *testing.T, m *Manager, inode int64) string {
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := common.ParseURL(md.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u.Name
+}
+
+func TestReplicas(t *testing.T) {
+	m, a, b := newTestReplicaManager(t)
+
+	inode := writeTestFile(t, m, "file", []byte("replicated"))
+	name := remoteName(t, m, inode)
+
+	for _, d := range []*memDrive{a, b} {
+		if _, err := d.GetFileMetadata(name); err != nil {
+			t.Errorf("file isn't stored in %s: %v", d.name, err)
+		}
+	}
+
+	// the file is read from the other drive when one loses it
+	if err := a.DeleteFile(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if content := readTestFile(t, m, "file"); content != "replicated" {
+		t.Errorf("content read from replica is '%s'", content)
+	}
+}
+
+func TestRepairReplicas(t *testing.T) {
+	m, a, b := newTestReplicaManager(t)
+
+	// the second drive is added after the file is stored
+	m.drives = []drive.Drive{a}
+
+	inode := writeTestFile(t, m, "file", []byte("replicated"))
+	name := remoteName(t, m, inode)
+
+	m.drives = []drive.Drive{a, b}
+	m.quotas.refresh(m.drives)
+
+	n, err := m.RepairReplicas()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Errorf("%d replicas are restored, expected 1", n)
+	}
+
+	if _, err := b.GetFileMetadata(name); err != nil {
+		t.Errorf("replica isn't copied to the new drive: %v", err)
+	}
+
+	if n, err := m.RepairReplicas(); err != nil || n != 0 {
+		t.Errorf("%d replicas are restored again: %v", n, err)
+	}
+}
+
+func TestDeleteReplicas(t *testing.T) {
+	m, a, b := newTestReplicaManager(t)
+
+	inode := writeTestFile(t, m, "file", []byte("replicated"))
+	name := remoteName(t, m, inode)
+
+	e, err := m.RemovePath("/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.PurgeTrash(e.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	processChanges(m, forceAll)
+
+	for _, d := range []*memDrive{a, b} {
+		if _, err := d.GetFileMetadata(name); err != common.ErrNotFound {
+			t.Errorf("file isn't deleted from %s: %v", d.name, err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/crypto"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+)
+
+// NewSnapshotManager creates a Manager of the snapshot with id to be mounted
+// read-only. The database is fetched into dir, which should be an empty
+// directory different from the state directory of the vault, and the
+// snapshot is downloaded there. Background processes aren't started.
+func NewSnapshotManager(drives []drive.Drive, dbDrv drive.Drive, cipher *crypto.Cipher, dir string,
+	id string) (*Manager, error) {
+	m, err := newManager(drives, cipher, dir, Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	vault, err := fetchDB(dbDrv, cipher, dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch DB: %v", err)
+	}
+
+	db, err := sqlite.NewClient(vault.path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	s, err := db.GetSnapshot(id)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("couldn't get snapshot: %v", err)
+	}
+
+	m.locations, err = db.GetSnapshotLocations(id)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get files of snapshot: %v", err)
+	}
+
+	// replicas of the snapshot are in the database of the vault
+	m.db = vault
+
+	path, err := m.downloadBlob(s.URL, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't download snapshot: %v", err)
+	}
+
+	sdb, err := sqlite.NewClient(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to snapshot: %v", err)
+	}
+	defer sdb.Close()
+
+	if !sdb.IsValidDatabase() {
+		return nil, fmt.Errorf("couldn't verify the snapshot")
+	}
+
+	if err := sdb.Migrate(); err != nil {
+		return nil, fmt.Errorf("couldn't migrate the snapshot: %v", err)
+	}
+
+	m.db = &database{
+		path:     path,
+		extDrive: dbDrv,
+	}
+
+	return m, nil
+}
+
+// CreateSnapshot copies the database to the drive of the database. The remote
+// files referenced by the copy aren't deleted or overwritten until it is
+// deleted. Changes waiting to be uploaded aren't included in the snapshot.
+func (m *Manager) CreateSnapshot(name string) (*sqlite.Snapshot, error) {
+	now := time.Now()
+
+	s := &sqlite.Snapshot{
+		ID:      now.Format("20060102-150405"),
+		Name:    name,
+		Created: now,
+		Device:  m.device,
+	}
+
+	drv := m.db.extDrive
+	remoteName := common.ObfuscateFileName(s.ID)
+	s.URL = drive.GetURL(drv, remoteName)
+
+	path, err := m.addSnapshot(s)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		m.DeleteSnapshot(s.ID)
+
+		return nil, fmt.Errorf("couldn't open copy of database: %v", err)
+	}
+	defer file.Close()
+
+	r, err := m.encodeReader(file)
+	if err != nil {
+		m.DeleteSnapshot(s.ID)
+
+		return nil, err
+	}
+
+	if err := m.putFile(drv, remoteName, r); err != nil {
+		m.DeleteSnapshot(s.ID)
+
+		return nil, fmt.Errorf("couldn't upload snapshot: %v", err)
+	}
+
+	return s, nil
+}
+
+// addSnapshot copies the database and adds s to it. Returns path of the copy.
+func (m *Manager) addSnapshot(s *sqlite.Snapshot) (string, error) {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	path, err := m.db.backupDatabase()
+	if err != nil {
+		return "", fmt.Errorf("couldn't copy database: %v", err)
+	}
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		os.Remove(path)
+
+		return "", fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.AddSnapshot(s); err != nil {
+		os.Remove(path)
+
+		return "", fmt.Errorf("couldn't add snapshot: %v", err)
+	}
+
+	m.notifyChangeInDatabase()
+
+	return path, nil
+}
+
+// ListSnapshots returns the snapshots ordered by their creation times
+func (m *Manager) ListSnapshots() ([]sqlite.Snapshot, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	snapshots, err := db.GetSnapshots()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get snapshots: %v", err)
+	}
+
+	return snapshots, nil
+}
+
+// DeleteSnapshot removes the snapshot with id. The remote files which aren't
+// referenced anymore are deleted by the upload workers. Returns their number.
+func (m *Manager) DeleteSnapshot(id string) (int, error) {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	s, err := db.GetSnapshot(id)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return 0, err
+		}
+
+		return 0, fmt.Errorf("couldn't get snapshot: %v", err)
+	}
+
+	urls, err := db.DeleteSnapshot(id)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return 0, err
+		}
+
+		return 0, fmt.Errorf("couldn't delete snapshot: %v", err)
+	}
+
+	m.notifyChangeInDatabase()
+
+	m.scheduleDeletion(0, s.URL)
+
+	for _, url := range urls {
+		m.scheduleDeletion(0, url)
+	}
+
+	return len(urls), nil
+}
+
+// isSnapshotBlob returns whether the remote file at url is referenced by a snapshot
+func (m *Manager) isSnapshotBlob(url string) (bool, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return false, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	found, err := db.IsSnapshotBlob(url)
+	if err != nil {
+		return false, fmt.Errorf("couldn't check snapshots of %s: %v", url, err)
+	}
+
+	return found, nil
+}
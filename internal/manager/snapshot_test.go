@@ -0,0 +1,142 @@
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/crypto"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+)
+
+// openTestSnapshot returns a manager of the snapshot with id on drv
+func openTestSnapshot(t *testing.T, drv *memDrive, id string) *Manager {
+	dir, err := ioutil.TempDir("", "cloudstash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cipher := crypto.NewCipher(strings.Repeat("ab", 32))
+
+	sm, err := NewSnapshotManager([]drive.Drive{drv}, drv, cipher, dir, id)
+	if err != nil {
+		t.Fatalf("couldn't open snapshot: %v", err)
+	}
+
+	return sm
+}
+
+// readTestFile downloads the file name in the root directory and returns its content
+func readTestFile(t *testing.T, m *Manager, name string) string {
+	md, err := m.Lookup(testRootInode, name)
+	if err != nil {
+		t.Fatalf("couldn't find %s: %v", name, err)
+	}
+
+	path, err := m.downloadFile(md)
+	if err != nil {
+		t.Fatalf("couldn't download %s: %v", name, err)
+	}
+	defer os.Remove(path)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestSnapshot(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+
+	inode := writeTestFile(t, m, "file", []byte("old"))
+
+	s, err := m.CreateSnapshot("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// versions are disabled, the content is still kept for the snapshot
+	rewriteTestFile(t, m, inode, []byte("new"))
+
+	if _, err := m.RemovePath("/file", false); err != nil {
+		t.Fatal(err)
+	}
+
+	processChanges(m, forceAll)
+
+	sm := openTestSnapshot(t, drv, s.ID)
+
+	if content := readTestFile(t, sm, "file"); content != "old" {
+		t.Errorf("snapshot has '%s', expected 'old'", content)
+	}
+
+	snapshots, err := m.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshots) != 1 || snapshots[0].ID != s.ID || snapshots[0].Name != "test" {
+		t.Errorf("unexpected snapshots: %+v", snapshots)
+	}
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+
+	inode := writeTestFile(t, m, "file", []byte("content"))
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := m.CreateSnapshot("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := m.RemovePath("/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.PurgeTrash(e.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	processChanges(m, forceAll)
+
+	if !drv.has(md.URL) {
+		t.Fatalf("content referenced by snapshot is deleted")
+	}
+
+	n, err := m.DeleteSnapshot(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Errorf("%d files are released, expected 1", n)
+	}
+
+	processChanges(m, forceAll)
+
+	if drv.has(md.URL) {
+		t.Errorf("content isn't deleted with the snapshot")
+	}
+
+	if drv.has(s.URL) {
+		t.Errorf("copy of the database isn't deleted with the snapshot")
+	}
+
+	if _, err := m.DeleteSnapshot(s.ID); err == nil {
+		t.Errorf("deleted snapshot is deleted again")
+	}
+}
@@ -0,0 +1,60 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+)
+
+func TestSymlink(t *testing.T) {
+	m := newTestManager(t, newMemDrive("mem"))
+
+	md, err := m.CreateSymlink(testRootInode, "link", "../target")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := m.Lookup(testRootInode, "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if link.Inode != md.Inode || link.Type != common.DrvSymlink || link.Target != "../target" {
+		t.Errorf("symlink isn't stored: %+v", link)
+	}
+
+	attr, err := m.GetMetadata(md.Inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attr.Size != int64(len("../target")) || attr.URL != "" || attr.NLink != 1 {
+		t.Errorf("attributes of symlink are wrong: %+v", attr)
+	}
+
+	if err := m.RemoveFile(link); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Lookup(testRootInode, "link"); err != common.ErrNotFound {
+		t.Errorf("removed symlink is found: %v", err)
+	}
+}
+
+func TestMergeSymlink(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	insertTestRows(t, remote, sqlite.Metadata{Inode: 2, Name: "link", Parent: 1, Type: common.DrvSymlink, Target: "/tmp"})
+
+	db, _ := mergeTestDatabases(t, local, remote)
+
+	md, err := db.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.Type != common.DrvSymlink || md.Target != "/tmp" {
+		t.Errorf("target of remote symlink is lost: %+v", md)
+	}
+}
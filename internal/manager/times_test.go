@@ -0,0 +1,106 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+)
+
+func TestMergeTimes(t *testing.T) {
+	early := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.Add(time.Hour)
+
+	local := &sqlite.Metadata{ATime: late, MTime: early, CTime: early, CrTime: late}
+	remote := &sqlite.Metadata{ATime: early, MTime: late, CTime: late, CrTime: early}
+
+	if !mergeTimes(local, remote) {
+		t.Fatalf("later remote times aren't merged")
+	}
+
+	if !local.ATime.Equal(late) || !local.MTime.Equal(late) || !local.CTime.Equal(late) {
+		t.Errorf("latest times aren't kept: %+v", local)
+	}
+
+	if !local.CrTime.Equal(early) {
+		t.Errorf("earliest creation time isn't kept: %v", local.CrTime)
+	}
+
+	if mergeTimes(local, remote) {
+		t.Errorf("merged times are changed again")
+	}
+
+	// unknown creation time doesn't replace the known one
+	if mergeTimes(local, &sqlite.Metadata{}) || local.CrTime.IsZero() {
+		t.Errorf("zero times are merged")
+	}
+}
+
+func TestMergeTimesOfDatabases(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	early := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.Add(time.Hour)
+
+	insertTestRows(t, local, sqlite.Metadata{Inode: 2, Name: "file", Parent: 1, Type: common.DrvFile, MTime: early, CrTime: early})
+	insertTestRows(t, remote, sqlite.Metadata{Inode: 2, Name: "file", Parent: 1, Type: common.DrvFile, MTime: late, CrTime: late})
+
+	db, _ := mergeTestDatabases(t, local, remote)
+
+	md, err := db.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !md.MTime.Equal(late) || !md.CrTime.Equal(early) {
+		t.Errorf("times aren't merged: %v %v", md.MTime, md.CrTime)
+	}
+}
+
+func TestDirectoryTimes(t *testing.T) {
+	m := newTestManager(t, newMemDrive("mem"))
+
+	dir, err := m.AddDirectory(testRootInode, "dir", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+
+	// adding an entry changes the directory
+	md, err := m.CreateFile(dir.Inode, "file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d, err := m.GetMetadata(dir.Inode); err != nil || d.MTime.Before(before) {
+		t.Errorf("modification time of directory isn't updated on create: %v", d.MTime)
+	}
+
+	if md.CrTime.IsZero() || !md.MTime.Equal(md.CrTime) {
+		t.Errorf("times of new file aren't set: %+v", md)
+	}
+
+	before = time.Now()
+
+	// so does moving one out of it
+	if err := m.Rename(dir.Inode, "file", testRootInode, "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, inode := range []int64{dir.Inode, testRootInode} {
+		if d, err := m.GetMetadata(inode); err != nil || d.MTime.Before(before) {
+			t.Errorf("modification time of directory %d isn't updated on move", inode)
+		}
+	}
+
+	moved, err := m.GetMetadata(md.Inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if moved.CTime.Before(before) || moved.MTime.After(before) {
+		t.Errorf("move changes the wrong times: %+v", moved)
+	}
+}
@@ -0,0 +1,204 @@
+package manager
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const trashCheckInterval = time.Hour
+
+// trash moves the entry 'name' under parent to the trash. Its content is
+// kept, remote files are only deleted when the entry is purged.
+// It should be called with the database locked.
+func (m *Manager) trash(db *sqlite.Client, parent int64, name string) (*sqlite.TrashEntry, error) {
+	dir, err := getPath(db, parent)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get path of directory %d: %v", parent, err)
+	}
+
+	now := time.Now()
+
+	e, err := db.Trash(parent, name, path.Join(dir, name), m.device, now)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("couldn't move to trash: %v", err)
+	}
+
+	touchDirectory(db, parent, now)
+	touchInode(db, e.Inode, now)
+
+	m.notifyChangeInDatabase()
+
+	return e, nil
+}
+
+// ListTrash returns the entries in the trash ordered by their deletion times
+func (m *Manager) ListTrash() ([]sqlite.TrashEntry, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	entries, err := db.GetTrash()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get trash: %v", err)
+	}
+
+	return entries, nil
+}
+
+// RestoreTrash moves the entry with id out of the trash to its original path.
+// Missing directories of the path are created again. If there is another
+// file at the path, a conflicted name is used. Returns the restored path.
+func (m *Manager) RestoreTrash(id string) (string, error) {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return "", fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	e, err := db.GetTrashEntry(id)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return "", err
+		}
+
+		return "", fmt.Errorf("couldn't get trash entry: %v", err)
+	}
+
+	dir, name := path.Split(e.Path)
+
+	parent := e.Parent
+
+	// original directory may be removed or moved to the trash as well
+	if p, err := getPath(db, parent); err != nil || p != path.Clean(dir) {
+		parent, err = makeDirectories(db, dir)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := db.Search(parent, name); err == nil {
+		name = common.GenerateConflictedFileName(name)
+	} else if err != common.ErrNotFound {
+		return "", fmt.Errorf("couldn't search for '%s' under %d: %v", name, parent, err)
+	}
+
+	if err := db.Restore(id, parent, name); err != nil {
+		if err == common.ErrNotFound {
+			return "", err
+		}
+
+		return "", fmt.Errorf("couldn't restore trash entry: %v", err)
+	}
+
+	now := time.Now()
+
+	touchDirectory(db, parent, now)
+	touchInode(db, e.Inode, now)
+
+	m.notifyChangeInDatabase()
+
+	return path.Join(dir, name), nil
+}
+
+// PurgeTrash removes the entry with id from the trash permanently. Remote
+// files are deleted by the upload workers. Returns the number of removed
+// files and directories.
+func (m *Manager) PurgeTrash(id string) (int, error) {
+	return m.RemoveTree(sqlite.TrashParent, id)
+}
+
+// PurgeTrashBefore purges the entries moved to the trash before t
+func (m *Manager) PurgeTrashBefore(t time.Time) (int, error) {
+	entries, err := m.ListTrash()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+
+	for _, e := range entries {
+		if !e.Deleted.Before(t) {
+			continue
+		}
+
+		n, err := m.PurgeTrash(e.ID)
+		if err != nil && err != common.ErrNotFound {
+			return total, fmt.Errorf("couldn't purge %s: %v", e.Path, err)
+		}
+
+		total += n
+	}
+
+	return total, nil
+}
+
+// makeDirectories creates the missing directories of dir and
+// returns inode of the last one. It should be called with the
+// database locked.
+func makeDirectories(db *sqlite.Client, dir string) (int64, error) {
+	parent := int64(rootInode)
+
+	for _, name := range strings.Split(dir, "/") {
+		if name == "" {
+			continue
+		}
+
+		md, err := db.Search(parent, name)
+		if err != nil && err != common.ErrNotFound {
+			return 0, fmt.Errorf("couldn't search for '%s' under %d: %v", name, parent, err)
+		}
+
+		if err == common.ErrNotFound {
+			md, err = db.AddDirectory(parent, name, 0755)
+			if err != nil {
+				return 0, fmt.Errorf("couldn't create directory '%s': %v", name, err)
+			}
+
+			touchDirectory(db, parent, time.Now())
+		} else if md.Type != common.DrvFolder {
+			return 0, fmt.Errorf("'%s' isn't a directory", name)
+		}
+
+		parent = md.Inode
+	}
+
+	return parent, nil
+}
+
+// purgeExpiredTrash purges the entries which are in the trash longer than
+// the retention period. It does nothing if retention isn't positive.
+func purgeExpiredTrash(m *Manager) {
+	if m.retention.Trash <= 0 {
+		return
+	}
+
+	for {
+		n, err := m.PurgeTrashBefore(time.Now().Add(-m.retention.Trash))
+		if err != nil {
+			log.Errorf("couldn't purge trash: %v", err)
+		} else if n > 0 {
+			log.Infof("purged %d files from trash", n)
+		}
+
+		time.Sleep(trashCheckInterval)
+	}
+}
@@ -0,0 +1,237 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+)
+
+// trashTestRow moves the entry 'name' under parent of the database at path
+// to the trash at t, as the manager of another client does
+func trashTestRow(t *testing.T, path string, parent int64, name string, tm time.Time) *sqlite.TrashEntry {
+	db := openTestDatabase(t, path)
+	defer db.Close()
+
+	e, err := db.Trash(parent, name, "/"+name, "other", tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	touchInode(db, e.Inode, tm)
+
+	return e
+}
+
+func TestTrash(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+
+	inode := writeTestFile(t, m, "file", []byte("content"))
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RemoveFile(md); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Lookup(testRootInode, "file"); err != common.ErrNotFound {
+		t.Errorf("removed file is found: %v", err)
+	}
+
+	processChanges(m, forceAll)
+
+	if !drv.has(md.URL) {
+		t.Fatalf("remote content of trashed file is deleted")
+	}
+
+	entries, err := m.ListTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Inode != inode || entries[0].Path != "/file" {
+		t.Fatalf("unexpected trash entries: %+v", entries)
+	}
+
+	// a new file took the name in the meantime
+	writeTestFile(t, m, "file", []byte("new"))
+
+	restored, err := m.RestoreTrash(entries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored == "/file" {
+		t.Errorf("restored file replaced the new one")
+	}
+
+	if _, err := m.LookupPath(restored); err != nil {
+		t.Errorf("restored file isn't found at %s: %v", restored, err)
+	}
+
+	if _, err := m.RestoreTrash(entries[0].ID); err != common.ErrNotFound {
+		t.Errorf("restored entry is restored again: %v", err)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+
+	inode := writeTestFile(t, m, "file", []byte("content"))
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := m.RemovePath("/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := m.PurgeTrashBefore(e.Deleted); err != nil || n != 0 {
+		t.Fatalf("entry is purged before its time: %d, %v", n, err)
+	}
+
+	if n, err := m.PurgeTrashBefore(e.Deleted.Add(time.Second)); err != nil || n != 1 {
+		t.Fatalf("%d entries are purged, expected 1: %v", n, err)
+	}
+
+	processChanges(m, forceAll)
+
+	if drv.has(md.URL) {
+		t.Errorf("remote content of purged file isn't deleted")
+	}
+
+	if entries, err := m.ListTrash(); err != nil || len(entries) != 0 {
+		t.Errorf("trash isn't empty: %+v, %v", entries, err)
+	}
+}
+
+func TestRenameMovesReplacedToTrash(t *testing.T) {
+	m := newTestManager(t, newMemDrive("mem"))
+
+	old := writeTestFile(t, m, "file", []byte("old"))
+	writeTestFile(t, m, "file.tmp", []byte("new"))
+
+	if err := m.Rename(testRootInode, "file.tmp", testRootInode, "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := m.ListTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Inode != old || entries[0].Path != "/file" {
+		t.Errorf("replaced file isn't in the trash: %+v", entries)
+	}
+}
+
+func TestMergeRemoteRemove(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	created := time.Unix(1600000000, 0)
+
+	for _, path := range []string{local, remote} {
+		insertTestRows(t, path, sqlite.Metadata{Inode: 2, Name: "a", Parent: 1, Type: common.DrvFile,
+			URL: "drive://a", CTime: created})
+	}
+
+	// local database has another change when remote client removes the file
+	insertTestRows(t, local, sqlite.Metadata{Inode: 3, Name: "b", Parent: 1, Type: common.DrvFile,
+		URL: "drive://b", CTime: created.Add(time.Minute)})
+
+	e := trashTestRow(t, remote, 1, "a", created.Add(2*time.Minute))
+
+	db, _ := mergeTestDatabases(t, local, remote)
+
+	if _, err := db.Search(1, "a"); err != common.ErrNotFound {
+		t.Errorf("file removed remotely is still found: %v", err)
+	}
+
+	if _, err := db.Search(1, "b"); err != nil {
+		t.Errorf("local change is lost: %v", err)
+	}
+
+	entries, err := db.GetTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].ID != e.ID {
+		t.Errorf("remote trash entry isn't merged: %+v", entries)
+	}
+}
+
+func TestMergeKeepsNewerLocalChange(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	created := time.Unix(1600000000, 0)
+
+	for _, path := range []string{local, remote} {
+		insertTestRows(t, path, sqlite.Metadata{Inode: 2, Name: "a", Parent: 1, Type: common.DrvFile,
+			URL: "drive://a", CTime: created})
+	}
+
+	// remote client removes the file, and local one restores it later
+	trashTestRow(t, remote, 1, "a", created.Add(time.Minute))
+
+	e := trashTestRow(t, local, 1, "a", created.Add(time.Minute))
+
+	ldb := openTestDatabase(t, local)
+	if err := ldb.Restore(e.ID, 1, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	touchInode(ldb, 2, created.Add(2*time.Minute))
+	ldb.Close()
+
+	db, _ := mergeTestDatabases(t, local, remote)
+
+	if _, err := db.Search(1, "a"); err != nil {
+		t.Errorf("file restored locally is lost: %v", err)
+	}
+
+	if entries, err := db.GetTrash(); err != nil || len(entries) != 0 {
+		t.Errorf("trash isn't empty: %+v, %v", entries, err)
+	}
+}
+
+func TestMergeRemoteRestore(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	created := time.Unix(1600000000, 0)
+
+	for _, path := range []string{local, remote} {
+		insertTestRows(t, path, sqlite.Metadata{Inode: 2, Name: "a", Parent: 1, Type: common.DrvFile,
+			URL: "drive://a", CTime: created})
+	}
+
+	// local client removes the file, and remote one moves it later
+	trashTestRow(t, local, 1, "a", created.Add(time.Minute))
+
+	rdb := openTestDatabase(t, remote)
+	if _, err := rdb.Rename(1, "a", 1, "b", "/b", "other", created); err != nil {
+		t.Fatal(err)
+	}
+
+	touchInode(rdb, 2, created.Add(2*time.Minute))
+	rdb.Close()
+
+	db, _ := mergeTestDatabases(t, local, remote)
+
+	if _, err := db.Search(1, "b"); err != nil {
+		t.Errorf("file moved remotely isn't found: %v", err)
+	}
+
+	if entries, err := db.GetTrash(); err != nil || len(entries) != 0 {
+		t.Errorf("stale trash entry is kept: %+v, %v", entries, err)
+	}
+}
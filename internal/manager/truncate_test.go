@@ -0,0 +1,113 @@
+package manager
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// writeTestFile creates a file with data in the root directory
+// and uploads it
+func writeTestFile(t *testing.T, m *Manager, name string, data []byte) int64 {
+	md, err := m.CreateFile(testRootInode, name, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(cachedPath(t, m, md.Inode), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.UpdateMetadataFromCache(md.Inode); err != nil {
+		t.Fatal(err)
+	}
+
+	processChanges(m, forceAll)
+
+	return md.Inode
+}
+
+func TestTruncate(t *testing.T) {
+	m := newTestManager(t, newMemDrive("mem"))
+
+	inode := writeTestFile(t, m, "file", []byte("hello world"))
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Truncate(md, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(cachedPath(t, m, inode))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "hello" {
+		t.Errorf("truncated content is %q", data)
+	}
+
+	// extended with zeros
+	if err := m.Truncate(md, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err = m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.Size != 8 {
+		t.Errorf("size after extension is %d", md.Size)
+	}
+
+	data, err = ioutil.ReadFile(cachedPath(t, m, inode))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, []byte("hello\x00\x00\x00")) {
+		t.Errorf("extended content is %q", data)
+	}
+
+	if !m.hasPendingUpload(cachedPath(t, m, inode)) {
+		t.Errorf("truncated file isn't scheduled to be uploaded")
+	}
+}
+
+func TestTruncateUncachedToZero(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+
+	inode := writeTestFile(t, m, "file", []byte("hello world"))
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the content would fail to download if it was needed
+	m.cache.Delete(common.ToString(inode))
+
+	if err := drv.DeleteFile(md.URL[len("mem://"):]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Truncate(md, 0); err != nil {
+		t.Fatalf("couldn't truncate uncached file: %v", err)
+	}
+
+	md, err = m.GetMetadata(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.Size != 0 {
+		t.Errorf("size after truncation is %d", md.Size)
+	}
+}
@@ -0,0 +1,373 @@
+package manager
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Retention tells how long removed files and earlier versions of files are kept
+type Retention struct {
+	Trash      time.Duration // removed files are purged after it, never if it isn't positive
+	Versions   int           // number of earlier versions kept for each file
+	VersionAge time.Duration // earlier versions newer than it are kept regardless of their number
+}
+
+// keepsVersions returns whether earlier versions of files are kept
+func (r Retention) keepsVersions() bool {
+	return r.Versions > 0 || r.VersionAge > 0
+}
+
+// archiveContent moves the remote file, its replicas, or the chunks or shards at url,
+// if it exists, to a new name so that it isn't overwritten by the upload of the
+// new content. Its version and the snapshots referencing it are updated with
+// the new name, which is returned.
+// If version is false, it isn't added as a version when there isn't one.
+// Returns an empty string if there isn't a remote file yet.
+func (m *Manager) archiveContent(drv drive.Drive, inode int64, url string, version bool) (string, error) {
+	u, err := common.ParseURL(url)
+	if err != nil {
+		return "", fmt.Errorf("couldn't parse url %s: %v", url, err)
+	}
+
+	chunks, err := m.getChunkList(url)
+	if err != nil {
+		return "", err
+	}
+
+	sharded, err := m.isSharded(url)
+	if err != nil {
+		return "", err
+	}
+
+	// chunked and sharded contents are moved in the database
+	chunked := len(chunks) > 0
+
+	name := common.ObfuscateFileName(u.Name)
+	vurl := drive.GetURL(drv, name)
+
+	if !chunked && !sharded {
+		if _, err := drv.GetFileMetadata(u.Name); err != nil {
+			if err == common.ErrNotFound {
+				return "", nil
+			}
+
+			return "", fmt.Errorf("couldn't get metadata of remote file: %v", err)
+		}
+
+		if err := drv.MoveFile(u.Name, name); err != nil {
+			return "", fmt.Errorf("couldn't move remote file: %v", err)
+		}
+	}
+
+	// replicas which couldn't be moved stay at url to be overwritten by the upload
+	moved, failed, err := m.moveReplicas(url, name)
+	if err != nil {
+		log.Warningf("couldn't move replicas of %s: %v", url, err)
+	}
+
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return vurl, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	if chunked {
+		if _, err := db.MoveChunkList(url, vurl); err != nil {
+			return "", err
+		}
+	}
+
+	if sharded {
+		if _, err := db.MoveSharded(url, vurl); err != nil {
+			return "", err
+		}
+	}
+
+	if len(moved) > 0 || len(failed) > 0 {
+		if err := db.SetReplicas(vurl, moved); err != nil {
+			return vurl, err
+		}
+
+		if err := db.SetReplicas(url, failed); err != nil {
+			return vurl, err
+		}
+	}
+
+	if err := db.MoveSnapshotBlobs(url, vurl); err != nil {
+		return vurl, err
+	}
+
+	found, err := db.MoveVersion(url, vurl)
+	if err != nil {
+		return vurl, err
+	}
+
+	// uploaded by an older version, size and hash of the content are unknown
+	if !found && version {
+		err := db.SetVersion(&sqlite.Version{URL: vurl, Inode: inode, Time: time.Now()})
+		if err != nil {
+			return vurl, err
+		}
+	}
+
+	m.notifyChangeInDatabase()
+
+	return vurl, nil
+}
+
+// unarchiveContent moves the content archived by archiveContent back to
+// url. It is called when the upload of the new content fails.
+func (m *Manager) unarchiveContent(drv drive.Drive, url string, vurl string) {
+	u, err := common.ParseURL(url)
+	if err != nil {
+		log.Errorf("couldn't parse url %s: %v", url, err)
+		return
+	}
+
+	vu, err := common.ParseURL(vurl)
+	if err != nil {
+		log.Errorf("couldn't parse url %s: %v", vurl, err)
+		return
+	}
+
+	chunks, err := m.getChunkList(vurl)
+	if err != nil {
+		log.Errorf("couldn't get chunks of %s: %v", vurl, err)
+		return
+	}
+
+	sharded, err := m.isSharded(vurl)
+	if err != nil {
+		log.Errorf("couldn't get shards of %s: %v", vurl, err)
+		return
+	}
+
+	if len(chunks) == 0 && !sharded {
+		if err := drv.MoveFile(vu.Name, u.Name); err != nil {
+			log.Errorf("couldn't move version %s back to %s: %v", vurl, url, err)
+			return
+		}
+	}
+
+	moved, failed, err := m.moveReplicas(vurl, u.Name)
+	if err != nil {
+		log.Warningf("couldn't move replicas of %s: %v", vurl, err)
+	}
+
+	current, err := m.getReplicas(url)
+	if err != nil {
+		log.Warningf("couldn't get replicas of %s: %v", url, err)
+	}
+
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		log.Errorf("couldn't connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if len(chunks) > 0 {
+		if _, err := db.MoveChunkList(vurl, url); err != nil {
+			log.Errorf("couldn't move chunks of %s back to %s: %v", vurl, url, err)
+			return
+		}
+	}
+
+	if sharded {
+		if _, err := db.MoveSharded(vurl, url); err != nil {
+			log.Errorf("couldn't move shards of %s back to %s: %v", vurl, url, err)
+			return
+		}
+	}
+
+	if len(moved) > 0 || len(failed) > 0 {
+		if err := db.SetReplicas(url, append(current, moved...)); err != nil {
+			log.Errorf("couldn't update replicas of %s: %v", url, err)
+		}
+
+		if err := db.SetReplicas(vurl, failed); err != nil {
+			log.Errorf("couldn't update replicas of %s: %v", vurl, err)
+		}
+	}
+
+	if _, err := db.MoveVersion(vurl, url); err != nil {
+		log.Errorf("couldn't update version %s: %v", vurl, err)
+	}
+
+	if err := db.MoveSnapshotBlobs(vurl, url); err != nil {
+		log.Errorf("couldn't update snapshots of %s: %v", vurl, err)
+	}
+
+	m.notifyChangeInDatabase()
+}
+
+// recordVersion records the content uploaded to url and removes
+// the earlier versions of the file which aren't kept anymore
+func (m *Manager) recordVersion(inode int64, url string, size int64, hash string) {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		log.Errorf("couldn't connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	// file may be removed while it is uploaded
+	if _, err := db.GetInode(inode); err != nil {
+		return
+	}
+
+	v := &sqlite.Version{
+		URL:   url,
+		Inode: inode,
+		Size:  size,
+		Hash:  hash,
+		Time:  time.Now(),
+	}
+
+	if err := db.SetVersion(v); err != nil {
+		log.Errorf("couldn't record version of inode %d: %v", inode, err)
+		return
+	}
+
+	versions, err := db.GetVersions(inode)
+	if err != nil {
+		log.Errorf("couldn't get versions of inode %d: %v", inode, err)
+		return
+	}
+
+	for i, v := range versions {
+		if i < m.retention.Versions || time.Since(v.Time) < m.retention.VersionAge {
+			continue
+		}
+
+		if err := db.DeleteVersion(v.URL); err != nil {
+			log.Errorf("couldn't delete version %s: %v", v.URL, err)
+			continue
+		}
+
+		m.scheduleDeletion(inode, v.URL)
+	}
+
+	m.notifyChangeInDatabase()
+}
+
+// ListVersions returns the earlier versions of the file identified
+// by inode, newest ones come first
+func (m *Manager) ListVersions(inode int64) ([]sqlite.Version, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	versions, err := db.GetVersions(inode)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get versions: %v", err)
+	}
+
+	return versions, nil
+}
+
+// GetVersion returns the earlier version of the file identified by inode with id
+func (m *Manager) GetVersion(inode int64, id string) (*sqlite.Version, error) {
+	versions, err := m.ListVersions(inode)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range versions {
+		if versions[i].ID() == id {
+			return &versions[i], nil
+		}
+	}
+
+	return nil, common.ErrNotFound
+}
+
+// RestoreVersion replaces content of the file identified by inode with its
+// earlier version with id. The current content becomes a version as well.
+func (m *Manager) RestoreVersion(inode int64, id string) error {
+	v, err := m.GetVersion(inode, id)
+	if err != nil {
+		return err
+	}
+
+	md, err := m.GetMetadata(inode)
+	if err != nil {
+		return err
+	}
+
+	path, err := m.downloadURL(v.URL, inode, v.Size)
+	if err != nil {
+		return fmt.Errorf("couldn't download version: %v", err)
+	}
+	defer os.Remove(path)
+
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("couldn't open downloaded version: %v", err)
+	}
+	defer src.Close()
+
+	dst, err := m.OpenFile(md, os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("couldn't open file: %v", err)
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+
+		return fmt.Errorf("couldn't copy version to file: %v", err)
+	}
+
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("couldn't write file: %v", err)
+	}
+
+	return m.UpdateMetadataFromCache(inode)
+}
+
+// OpenVersionHandle downloads the earlier version of the file identified by
+// inode with id and returns a read-only handle to it. The downloaded copy is
+// removed when the handle is released.
+func (m *Manager) OpenVersionHandle(inode int64, id string) (uint64, error) {
+	v, err := m.GetVersion(inode, id)
+	if err != nil {
+		return 0, err
+	}
+
+	path, err := m.downloadURL(v.URL, inode, v.Size)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't download version: %v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		os.Remove(path)
+
+		return 0, fmt.Errorf("couldn't open downloaded version: %v", err)
+	}
+
+	// it isn't the cached file of inode, so it doesn't keep the cache entry
+	return m.handles.add(&fileHandle{file: file, temporary: true}), nil
+}
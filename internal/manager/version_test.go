@@ -0,0 +1,136 @@
+package manager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// rewriteTestFile replaces content of the file with data and uploads it
+func rewriteTestFile(t *testing.T, m *Manager, inode int64, data []byte) {
+	if err := ioutil.WriteFile(cachedPath(t, m, inode), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.UpdateMetadataFromCache(inode); err != nil {
+		t.Fatal(err)
+	}
+
+	processChanges(m, forceAll)
+}
+
+func TestVersions(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+	m.retention = Retention{Versions: 2}
+
+	inode := writeTestFile(t, m, "file", []byte("content 0"))
+
+	for i := 1; i < 4; i++ {
+		rewriteTestFile(t, m, inode, []byte(fmt.Sprintf("content %d", i)))
+	}
+
+	versions, err := m.ListVersions(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 2 {
+		t.Fatalf("%d versions are kept, expected 2", len(versions))
+	}
+
+	for _, v := range versions {
+		if !drv.has(v.URL) {
+			t.Errorf("remote file of version %s is missing", v.ID())
+		}
+	}
+
+	// versions[1] is the oldest one kept, content 1
+	if err := m.RestoreVersion(inode, versions[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	processChanges(m, forceAll)
+
+	data, err := ioutil.ReadFile(cachedPath(t, m, inode))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "content 1" {
+		t.Errorf("restored content is '%s', expected 'content 1'", data)
+	}
+
+	// content 3 became a version and content 1 is dropped since
+	// the others are newer
+	versions, err = m.ListVersions(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 2 {
+		t.Errorf("%d versions are kept after restore, expected 2", len(versions))
+	}
+}
+
+func TestVersionsDisabled(t *testing.T) {
+	m := newTestManager(t, newMemDrive("mem"))
+
+	inode := writeTestFile(t, m, "file", []byte("old"))
+	rewriteTestFile(t, m, inode, []byte("new"))
+
+	versions, err := m.ListVersions(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 0 {
+		t.Errorf("versions are kept while disabled: %+v", versions)
+	}
+}
+
+func TestVersionsOfTrashedFile(t *testing.T) {
+	drv := newMemDrive("mem")
+	m := newTestManager(t, drv)
+	m.retention = Retention{Versions: 10}
+
+	old := writeTestFile(t, m, "file", []byte("old"))
+	rewriteTestFile(t, m, old, []byte("older"))
+
+	// replaced by an editor saving through a temporary file
+	writeTestFile(t, m, "file.tmp", []byte("new"))
+
+	if err := m.Rename(testRootInode, "file.tmp", testRootInode, "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	processChanges(m, forceAll)
+
+	versions, err := m.ListVersions(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 1 || !drv.has(versions[0].URL) {
+		t.Fatalf("versions of replaced file aren't kept: %+v", versions)
+	}
+
+	entries, err := m.ListTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("%d trash entries, expected 1", len(entries))
+	}
+
+	if _, err := m.PurgeTrash(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	processChanges(m, forceAll)
+
+	if drv.has(versions[0].URL) {
+		t.Errorf("version of purged file isn't deleted")
+	}
+}
@@ -0,0 +1,139 @@
+package manager
+
+import (
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/drive"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	driveConcurrency = 4 // maximum number of simultaneous uploads per drive
+	maxAttempts      = 10
+
+	minBackoff = 2 * time.Second
+	maxBackoff = 10 * time.Minute
+)
+
+// permanentError is an upload error which won't be resolved by retrying,
+// i.e. the cached file is missing. Uploads failed with it aren't retried.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// runUploads uploads entries with a pool of workers per drive and waits
+// for them to finish. In each drive, the database is uploaded first and
+// the files are uploaded in the order of their sizes, so that metadata
+// and small files aren't blocked by large ones.
+func runUploads(m *Manager, entries []trackerEntry) {
+	sizes := map[string]int64{}
+	for _, entry := range entries {
+		if entry.cachePath == m.db.path {
+			sizes[entry.cachePath] = -1
+			continue
+		}
+
+		if fi, err := os.Stat(entry.cachePath); err == nil {
+			sizes[entry.cachePath] = fi.Size()
+		}
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return sizes[entries[a].cachePath] < sizes[entries[b].cachePath]
+	})
+
+	queues := map[string][]trackerEntry{}
+	for _, entry := range entries {
+		scheme := ""
+		if u, err := common.ParseURL(entry.remotePath); err == nil {
+			scheme = u.Scheme
+		}
+
+		queues[scheme] = append(queues[scheme], entry)
+	}
+
+	wg := sync.WaitGroup{}
+
+	for scheme, queue := range queues {
+		// uploads to drives which aren't configured anymore aren't limited
+		drv, _ := m.getDriveClient(scheme)
+
+		ch := make(chan trackerEntry, len(queue))
+		for _, entry := range queue {
+			ch <- entry
+		}
+		close(ch)
+
+		workers := driveConcurrency
+		if len(queue) < workers {
+			workers = len(queue)
+		}
+
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go uploadWorker(m, drv, ch, &wg)
+		}
+	}
+
+	wg.Wait()
+}
+
+// uploadWorker processes the entries of the queue of drv. Each entry takes
+// an upload slot of the account of drv, which is shared with other vaults
+// using the account. Replicas and shards uploaded to other drives along
+// with it don't take slots, so that an entry never waits for a slot while
+// holding one.
+func uploadWorker(m *Manager, drv drive.Drive, ch chan trackerEntry, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for entry := range ch {
+		release := func() {}
+		if drv != nil {
+			release = drive.AcquireUpload(drv)
+		}
+
+		processItem(entry, m)
+
+		release()
+	}
+}
+
+// backoff returns the time to wait before the next attempt after
+// the provided number of failed attempts. It grows exponentially
+// and is randomized so that the retries don't happen all at once.
+func backoff(attempts int) time.Duration {
+	d := maxBackoff
+	if attempts < 20 {
+		d = minBackoff << uint(attempts-1)
+	}
+
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+
+	// jitter between d/2 and d
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isPermanent returns whether err shouldn't be retried
+func isPermanent(err error) bool {
+	_, ok := err.(permanentError)
+
+	return ok
+}
+
+// logFailure surfaces an upload which won't be retried anymore
+func logFailure(u PendingUpload) {
+	log.Errorf("giving up uploading %s after %d attempts: %s. run `cloudstash status` for details",
+		u.RemotePath, u.Attempts, u.LastError)
+}
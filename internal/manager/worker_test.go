@@ -0,0 +1,81 @@
+package manager
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempts := 1; attempts <= 30; attempts++ {
+		max := maxBackoff
+		if attempts < 20 && minBackoff<<uint(attempts-1) < maxBackoff {
+			max = minBackoff << uint(attempts-1)
+		}
+
+		d := backoff(attempts)
+		if d < max/2 || d > max {
+			t.Errorf("backoff of %d attempts is %v, expected between %v and %v", attempts, d, max/2, max)
+		}
+	}
+}
+
+func readyPaths(j *journal, force bool) map[string]bool {
+	paths := map[string]bool{}
+	for _, e := range j.getReady(force) {
+		paths[e.cachePath] = true
+	}
+
+	return paths
+}
+
+func TestRetryAfterBackoff(t *testing.T) {
+	j := newTestJournal(t)
+
+	j.add(trackerEntry{inode: 2, cachePath: "/cache/a", remotePath: "drive://a", accessTime: time.Now()})
+	j.fail("/cache/a", errors.New("drive is unreachable"))
+
+	if readyPaths(j, false)["/cache/a"] {
+		t.Errorf("failed upload is retried before its backoff")
+	}
+
+	if !readyPaths(j, true)["/cache/a"] {
+		t.Errorf("failed upload isn't retried when forced")
+	}
+
+	u := j.entries["/cache/a"]
+	u.NextAttempt = time.Now().Add(-time.Second)
+	j.entries["/cache/a"] = u
+
+	if !readyPaths(j, false)["/cache/a"] {
+		t.Errorf("failed upload isn't retried after its backoff")
+	}
+}
+
+func TestGiveUpUpload(t *testing.T) {
+	j := newTestJournal(t)
+
+	j.add(trackerEntry{inode: 2, cachePath: "/cache/a", remotePath: "drive://a", accessTime: time.Now()})
+	j.add(trackerEntry{inode: 3, cachePath: "/cache/b", remotePath: "drive://b", accessTime: time.Now()})
+
+	j.fail("/cache/a", permanentError{errors.New("cached file is lost")})
+
+	for i := 0; i < maxAttempts; i++ {
+		j.fail("/cache/b", errors.New("drive is unreachable"))
+	}
+
+	for _, path := range []string{"/cache/a", "/cache/b"} {
+		u := reloadJournal(t, j).entries[path]
+		if !u.Failed {
+			t.Errorf("upload of %s isn't given up: %+v", path, u)
+		}
+	}
+
+	// a new change is uploaded again
+	j.add(trackerEntry{inode: 3, cachePath: "/cache/b", remotePath: "drive://b", accessTime: time.Now()})
+
+	u := reloadJournal(t, j).entries["/cache/b"]
+	if u.Failed || u.Attempts != 0 || !readyPaths(j, false)["/cache/b"] {
+		t.Errorf("changed file isn't retried: %+v", u)
+	}
+}
@@ -0,0 +1,124 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// GetXAttr returns value of the extended attribute of the file identified
+// by inode. Returns common.ErrNotFound if there is no such attribute.
+func (m *Manager) GetXAttr(inode int64, name string) ([]byte, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	value, err := db.GetXAttr(inode, name)
+	if err != nil {
+		if err == common.ErrNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("couldn't get extended attribute: %v", err)
+	}
+
+	return value, nil
+}
+
+// ListXAttrs returns names of the extended attributes of the file identified by inode
+func (m *Manager) ListXAttrs(inode int64) ([]string, error) {
+	m.db.rLock()
+	defer m.db.rUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	names, err := db.ListXAttrs(inode)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list extended attributes: %v", err)
+	}
+
+	return names, nil
+}
+
+// SetXAttr sets value of the extended attribute of the file identified by inode.
+// flags are the ones of sqlite.SetXAttr; common.ErrExists or common.ErrNotFound
+// is returned if they can't be satisfied.
+func (m *Manager) SetXAttr(inode int64, name string, value []byte, flags int) error {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.SetXAttr(inode, name, value, flags); err != nil {
+		if err == common.ErrExists || err == common.ErrNotFound {
+			return err
+		}
+
+		return fmt.Errorf("couldn't set extended attribute: %v", err)
+	}
+
+	touchInode(db, inode, time.Now())
+
+	m.notifyChangeInDatabase()
+
+	return nil
+}
+
+// RemoveXAttr removes the extended attribute of the file identified by inode.
+// Returns common.ErrNotFound if there is no such attribute.
+func (m *Manager) RemoveXAttr(inode int64, name string) error {
+	m.db.wLock()
+	defer m.db.wUnlock()
+
+	db, err := m.getSqliteClient()
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.RemoveXAttr(inode, name); err != nil {
+		if err == common.ErrNotFound {
+			return err
+		}
+
+		return fmt.Errorf("couldn't remove extended attribute: %v", err)
+	}
+
+	touchInode(db, inode, time.Now())
+
+	m.notifyChangeInDatabase()
+
+	return nil
+}
+
+// touchInode sets change time of the inode to t
+func touchInode(db *sqlite.Client, inode int64, t time.Time) {
+	md, err := db.GetInode(inode)
+	if err != nil {
+		log.Warningf("couldn't get metadata of inode %d: %v", inode, err)
+		return
+	}
+
+	md.CTime = t
+
+	if err := db.Update(md); err != nil {
+		log.Warningf("couldn't update change time of inode %d: %v", inode, err)
+	}
+}
@@ -0,0 +1,54 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+	"github.com/paddlesteamer/cloudstash/internal/sqlite"
+)
+
+func setTestXAttr(t *testing.T, path string, inode int64, name string, value string) {
+	db := openTestDatabase(t, path)
+	defer db.Close()
+
+	if err := db.SetXAttr(inode, name, []byte(value), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeXAttrs(t *testing.T) {
+	local, remote := newTestDatabases(t)
+
+	file := sqlite.Metadata{Inode: 2, Name: "file", Parent: 1, Type: common.DrvFile, URL: "drive://file"}
+
+	insertTestRows(t, local, file)
+	insertTestRows(t, remote, file,
+		sqlite.Metadata{Inode: 3, Name: "remote", Parent: 1, Type: common.DrvFile, URL: "drive://remote"})
+
+	setTestXAttr(t, local, 2, "user.both", "local")
+	setTestXAttr(t, remote, 2, "user.both", "remote")
+	setTestXAttr(t, remote, 2, "user.new", "remote")
+	setTestXAttr(t, remote, 3, "user.added", "remote")
+
+	db, _ := mergeTestDatabases(t, local, remote)
+
+	for _, x := range []struct {
+		inode int64
+		name  string
+		value string
+	}{
+		{2, "user.both", "local"},
+		{2, "user.new", "remote"},
+		{3, "user.added", "remote"},
+	} {
+		value, err := db.GetXAttr(x.inode, x.name)
+		if err != nil {
+			t.Errorf("attribute %s of %d is missing: %v", x.name, x.inode, err)
+			continue
+		}
+
+		if string(value) != x.value {
+			t.Errorf("attribute %s of %d is %q, expected %q", x.name, x.inode, value, x.value)
+		}
+	}
+}
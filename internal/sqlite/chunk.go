@@ -0,0 +1,344 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// GetChunk returns the chunk with specified id
+func (c *Client) GetChunk(id string) (*Chunk, error) {
+	ch := &Chunk{}
+
+	err := c.db.QueryRow("SELECT id, url, size FROM chunks WHERE id=?", id).Scan(&ch.ID, &ch.URL, &ch.Size)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, common.ErrNotFound
+		}
+
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	return ch, nil
+}
+
+// InsertChunk inserts ch if there isn't a chunk with the same id.
+// Returns false if there is one already.
+func (c *Client) InsertChunk(ch *Chunk) (bool, error) {
+	res, err := c.db.Exec("INSERT OR IGNORE INTO chunks(id, url, size) VALUES(?, ?, ?)", ch.ID, ch.URL, ch.Size)
+	if err != nil {
+		return false, fmt.Errorf("couldn't insert chunk: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("couldn't get number of inserted chunks: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// usedChunkQuery selects the chunks which are referenced by a chunk list
+const usedChunkQuery = "FROM chunks c WHERE EXISTS(SELECT 1 FROM file_chunks f WHERE f.chunk = c.id)"
+
+// GetUsedChunks returns limit chunks which are referenced by a chunk list starting from offset
+func (c *Client) GetUsedChunks(limit int, offset int) ([]Chunk, error) {
+	row, err := c.db.Query("SELECT c.id, c.url, c.size "+usedChunkQuery+" ORDER BY c.id LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	return parseChunkRows(row)
+}
+
+// GetUsedChunkCount returns the number of chunks which are referenced by a chunk list
+func (c *Client) GetUsedChunkCount() (int, error) {
+	return c.count("SELECT count(*) " + usedChunkQuery)
+}
+
+// ReleaseUnusedChunks removes the chunks which aren't referenced by any chunk
+// list, i.e. the ones left by an upload which failed before its chunk list is
+// set. Returns them, they should be deleted.
+func (c *Client) ReleaseUnusedChunks() ([]Chunk, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	row, err := tx.Query("SELECT id FROM chunks c WHERE NOT EXISTS(SELECT 1 FROM file_chunks f WHERE f.chunk = c.id)")
+	if err != nil {
+		tx.Rollback()
+
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	ids := []string{}
+
+	for row.Next() {
+		var id string
+
+		if err := row.Scan(&id); err != nil {
+			row.Close()
+			tx.Rollback()
+
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	row.Close()
+
+	released, err := txReleaseChunks(tx, ids)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return released, nil
+}
+
+// ReleaseChunks removes the chunks with ids which aren't referenced by any
+// chunk list. Returns them, they should be deleted.
+func (c *Client) ReleaseChunks(ids []string) ([]Chunk, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	released, err := txReleaseChunks(tx, ids)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return released, nil
+}
+
+// GetChunkList returns the chunks of the content at url in order.
+// Returns an empty list if the content isn't chunked.
+func (c *Client) GetChunkList(url string) ([]Chunk, error) {
+	row, err := c.db.Query("SELECT c.id, c.url, c.size FROM file_chunks f "+
+		"JOIN chunks c ON c.id = f.chunk WHERE f.url=? ORDER BY f.seq", url)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	return parseChunkRows(row)
+}
+
+// GetChunkListURLs returns limit urls of chunked contents starting from offset
+func (c *Client) GetChunkListURLs(limit int, offset int) ([]string, error) {
+	row, err := c.db.Query("SELECT DISTINCT url FROM file_chunks ORDER BY url LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	urls := []string{}
+
+	for row.Next() {
+		var url string
+
+		if err := row.Scan(&url); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		urls = append(urls, url)
+	}
+
+	return urls, nil
+}
+
+// GetChunkListCount returns the number of chunked contents
+func (c *Client) GetChunkListCount() (int, error) {
+	return c.count("SELECT count(DISTINCT url) FROM file_chunks")
+}
+
+// SetChunkList replaces the chunks of the content at url with the ones with
+// ids. Returns common.ErrNotFound if a chunk doesn't exist. Returns the chunks
+// which aren't referenced anymore, they are removed and should be deleted.
+func (c *Client) SetChunkList(url string, ids []string) ([]Chunk, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	// a chunk may be released while the others are uploaded
+	for _, id := range ids {
+		var found bool
+
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM chunks WHERE id=?)", id).Scan(&found); err != nil {
+			tx.Rollback()
+
+			return nil, fmt.Errorf("there is an error in query: %v", err)
+		}
+
+		if !found {
+			tx.Rollback()
+
+			return nil, common.ErrNotFound
+		}
+	}
+
+	old, err := txDeleteChunkList(tx, url)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, err
+	}
+
+	for seq, id := range ids {
+		_, err := tx.Exec("INSERT INTO file_chunks(url, seq, chunk) VALUES(?, ?, ?)", url, seq, id)
+		if err != nil {
+			tx.Rollback()
+
+			return nil, fmt.Errorf("couldn't insert chunk of %s: %v", url, err)
+		}
+	}
+
+	released, err := txReleaseChunks(tx, old)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return released, nil
+}
+
+// MoveChunkList changes url of the chunked content. Returns false if the content at url isn't chunked.
+func (c *Client) MoveChunkList(url string, newURL string) (bool, error) {
+	res, err := c.db.Exec("UPDATE file_chunks SET url=? WHERE url=?", newURL, url)
+	if err != nil {
+		return false, fmt.Errorf("couldn't update chunks of %s: %v", url, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("couldn't get affected rows: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// DeleteChunkList removes the chunk list of the content at url. Returns
+// false if the content isn't chunked. Returns the chunks which aren't
+// referenced anymore, they are removed and should be deleted.
+func (c *Client) DeleteChunkList(url string) ([]Chunk, bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	old, err := txDeleteChunkList(tx, url)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, false, err
+	}
+
+	released, err := txReleaseChunks(tx, old)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return released, len(old) > 0, nil
+}
+
+// txDeleteChunkList removes the chunk list of url and returns ids of its chunks
+func txDeleteChunkList(tx *sql.Tx, url string) ([]string, error) {
+	row, err := tx.Query("SELECT DISTINCT chunk FROM file_chunks WHERE url=?", url)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	ids := []string{}
+
+	for row.Next() {
+		var id string
+
+		if err := row.Scan(&id); err != nil {
+			row.Close()
+
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	row.Close()
+
+	if _, err := tx.Exec("DELETE FROM file_chunks WHERE url=?", url); err != nil {
+		return nil, fmt.Errorf("couldn't delete chunks of %s: %v", url, err)
+	}
+
+	return ids, nil
+}
+
+// txReleaseChunks removes the chunks with ids which aren't referenced by any
+// chunk list and returns them
+func txReleaseChunks(tx *sql.Tx, ids []string) ([]Chunk, error) {
+	released := []Chunk{}
+
+	for _, id := range ids {
+		ch := Chunk{}
+
+		err := tx.QueryRow("SELECT id, url, size FROM chunks c WHERE id=? and "+
+			"NOT EXISTS(SELECT 1 FROM file_chunks f WHERE f.chunk = c.id)", id).Scan(&ch.ID, &ch.URL, &ch.Size)
+		if err == sql.ErrNoRows {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("there is an error in query: %v", err)
+		}
+
+		if _, err := tx.Exec("DELETE FROM chunks WHERE id=?", id); err != nil {
+			return nil, fmt.Errorf("couldn't delete chunk: %v", err)
+		}
+
+		released = append(released, ch)
+	}
+
+	return released, nil
+}
+
+func parseChunkRows(row *sql.Rows) ([]Chunk, error) {
+	chunks := []Chunk{}
+
+	for row.Next() {
+		ch := Chunk{}
+
+		if err := row.Scan(&ch.ID, &ch.URL, &ch.Size); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		chunks = append(chunks, ch)
+	}
+
+	return chunks, nil
+}
@@ -0,0 +1,200 @@
+package sqlite
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+func insertChunks(t *testing.T, c *Client, ids ...string) {
+	for _, id := range ids {
+		if _, err := c.InsertChunk(&Chunk{ID: id, URL: "drive://" + id, Size: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func chunkIDs(chunks []Chunk) []string {
+	ids := []string{}
+	for _, ch := range chunks {
+		ids = append(ids, ch.ID)
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+func equalIDs(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestChunkDedup(t *testing.T) {
+	c := newTestClient(t)
+	insertChunks(t, c, "a", "b", "c")
+
+	if _, err := c.SetChunkList("drive://one", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second content uses b as well
+	if _, err := c.SetChunkList("drive://two", []string{"b", "c", "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := c.GetChunkList("drive://two")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, ch := range chunks {
+		ids = append(ids, ch.ID)
+	}
+
+	if !equalIDs(ids, "b", "c", "b") {
+		t.Errorf("chunk list isn't kept in order: %v", ids)
+	}
+
+	released, found, err := c.DeleteChunkList("drive://one")
+	if err != nil || !found {
+		t.Fatalf("couldn't delete chunk list: %v", err)
+	}
+
+	if ids := chunkIDs(released); !equalIDs(ids, "a") {
+		t.Errorf("released %v, expected only a", ids)
+	}
+
+	if _, err := c.GetChunk("b"); err != nil {
+		t.Errorf("chunk used by another content is removed: %v", err)
+	}
+
+	released, _, err = c.DeleteChunkList("drive://two")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := chunkIDs(released); !equalIDs(ids, "b", "c") {
+		t.Errorf("released %v, expected b and c", ids)
+	}
+
+	if count, _ := c.count("SELECT count(*) FROM chunks"); count != 0 {
+		t.Errorf("%d chunks are left", count)
+	}
+}
+
+func TestSetChunkListReleases(t *testing.T) {
+	c := newTestClient(t)
+	insertChunks(t, c, "a", "b", "c")
+
+	if _, err := c.SetChunkList("drive://one", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	released, err := c.SetChunkList("drive://one", []string{"b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := chunkIDs(released); !equalIDs(ids, "a") {
+		t.Errorf("released %v, expected only a", ids)
+	}
+
+	// a chunk released while the content is uploaded
+	if _, err := c.SetChunkList("drive://one", []string{"a"}); err != common.ErrNotFound {
+		t.Errorf("chunk list with a missing chunk is set: %v", err)
+	}
+
+	chunks, err := c.GetChunkList("drive://one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := chunkIDs(chunks); !equalIDs(ids, "b", "c") {
+		t.Errorf("chunk list is changed by a failed update: %v", ids)
+	}
+}
+
+func TestInsertChunkTwice(t *testing.T) {
+	c := newTestClient(t)
+
+	inserted, err := c.InsertChunk(&Chunk{ID: "a", URL: "drive://first", Size: 1})
+	if err != nil || !inserted {
+		t.Fatalf("new chunk isn't inserted: %v", err)
+	}
+
+	// the same content uploaded by another upload at the same time
+	inserted, err = c.InsertChunk(&Chunk{ID: "a", URL: "drive://second", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inserted {
+		t.Errorf("existing chunk is inserted again")
+	}
+
+	ch, err := c.GetChunk("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ch.URL != "drive://first" {
+		t.Errorf("chunk is at %s, expected drive://first", ch.URL)
+	}
+}
+
+func TestReleaseUnusedChunks(t *testing.T) {
+	c := newTestClient(t)
+	insertChunks(t, c, "a", "b", "c")
+
+	// chunks of an upload which failed before its chunk list is set
+	if _, err := c.SetChunkList("drive://one", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, _ := c.GetUsedChunkCount(); count != 1 {
+		t.Errorf("%d chunks are used, expected 1", count)
+	}
+
+	used, err := c.GetUsedChunks(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := chunkIDs(used); !equalIDs(ids, "a") {
+		t.Errorf("used chunks are %v, expected only a", ids)
+	}
+
+	released, err := c.ReleaseChunks([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := chunkIDs(released); !equalIDs(ids, "b") {
+		t.Errorf("released %v, expected only b", ids)
+	}
+
+	released, err = c.ReleaseUnusedChunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := chunkIDs(released); !equalIDs(ids, "c") {
+		t.Errorf("released %v, expected only c", ids)
+	}
+
+	if count, _ := c.count("SELECT count(*) FROM chunks"); count != 1 {
+		t.Errorf("%d chunks are left, expected 1", count)
+	}
+}
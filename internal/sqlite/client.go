@@ -3,6 +3,7 @@ package sqlite
 import (
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/paddlesteamer/cloudstash/internal/common"
 
@@ -16,47 +17,6 @@ type Client struct {
 	db *sql.DB
 }
 
-var (
-	tableSchemas = [...]string{
-		`CREATE TABLE files (
-		"inode"  INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-		"name"   TEXT NOT NULL,
-		"url"    TEXT NOT NULL DEFAULT "",
-		"size"   INTEGER NOT NULL DEFAULT 0,
-		"mode"   INTEGER NOT NULL,
-		"parent" INTEGER NOT NULL,
-		"type"   INTEGER NOT NULL,
-		"hash"   TEXT NOT NULL DEFAULT "",
-		UNIQUE("name", "parent"),
-		FOREIGN KEY("parent") REFERENCES folders("id")
-	);`,
-		fmt.Sprintf(`INSERT INTO files(inode, name, mode, parent, type) VALUES (1, "", 493, 0, %d);`, common.DrvFolder), // root folder with mode 0755
-	}
-)
-
-// InitDB initializes tables. Supposed to be called on the very first run.
-func InitDB(path string) error {
-	db, err := sql.Open("sqlite3", path)
-	if err != nil {
-		return fmt.Errorf("couldn't open db at %s: %v", path, err)
-	}
-	defer db.Close()
-
-	for _, sqlStr := range tableSchemas {
-		st, err := db.Prepare(sqlStr)
-		if err != nil {
-			return fmt.Errorf("error in query `%s`: %v", sqlStr, err)
-		}
-
-		_, err = st.Exec()
-		if err != nil {
-			return fmt.Errorf("couldn't execute initialization query: %v", err)
-		}
-	}
-
-	return nil
-}
-
 // NewClient returns a new database connection.
 func NewClient(filePath string) (*Client, error) {
 	db, err := sql.Open("sqlite3", filePath)
@@ -72,6 +32,12 @@ func (c *Client) Close() {
 	c.db.Close()
 }
 
+// Migrate upgrades the database schema to the current version. It should
+// be called on every database which may be created by an older version.
+func (c *Client) Migrate() error {
+	return migrate(c.db)
+}
+
 // IsValidDatabase checks whether `files` table exists
 func (c *Client) IsValidDatabase() bool {
 	query, _ := c.db.Prepare("SELECT * FROM files LIMIT 1")
@@ -102,7 +68,17 @@ func (c *Client) Search(parent int64, name string) (*Metadata, error) {
 		return nil, common.ErrNotFound
 	}
 
-	return c.parseRow(row)
+	md, err := c.parseRow(row)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.fillNLink(md)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get nlink count: %v", err)
+	}
+
+	return md, nil
 }
 
 // Get returns file metadata with specified inode
@@ -135,16 +111,444 @@ func (c *Client) Get(inode int64) (*Metadata, error) {
 	return md, nil
 }
 
-// Delete removes file with specified inode from database
+// Delete removes file with specified inode and all of its names from database
 func (c *Client) Delete(inode int64) error {
-	query, err := c.db.Prepare("DELETE FROM files WHERE inode=?")
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM dentries WHERE inode=?", inode); err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("couldn't delete entries: %v", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM xattrs WHERE inode=?", inode); err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("couldn't delete extended attributes: %v", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM inodes WHERE inode=?", inode); err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("couldn't delete inode: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// Unlink removes the entry with specified name under specified inode. If it
+// is the last name of the file, the file is removed too and true is returned.
+func (c *Client) Unlink(parent int64, name string) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	var inode int64
+
+	err = tx.QueryRow("SELECT inode FROM dentries WHERE parent=? and name=?", parent, name).Scan(&inode)
+	if err != nil {
+		tx.Rollback()
+
+		if err == sql.ErrNoRows {
+			return false, common.ErrNotFound
+		}
+
+		return false, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM dentries WHERE parent=? and name=?", parent, name); err != nil {
+		tx.Rollback()
+
+		return false, fmt.Errorf("couldn't delete entry: %v", err)
+	}
+
+	var links int
+
+	if err := tx.QueryRow("SELECT COUNT(*) FROM dentries WHERE inode=?", inode).Scan(&links); err != nil {
+		tx.Rollback()
+
+		return false, fmt.Errorf("couldn't get link count: %v", err)
+	}
+
+	if links == 0 {
+		if _, err := tx.Exec("DELETE FROM inodes WHERE inode=?", inode); err != nil {
+			tx.Rollback()
+
+			return false, fmt.Errorf("couldn't delete inode: %v", err)
+		}
+
+		if _, err := tx.Exec("DELETE FROM xattrs WHERE inode=?", inode); err != nil {
+			tx.Rollback()
+
+			return false, fmt.Errorf("couldn't delete extended attributes: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return links == 0, nil
+}
+
+// DeleteTree removes the entry with specified name under specified inode and,
+// if it is a directory, everything under it in a single transaction. Files
+// which have other names outside of the tree are kept. Returns the removed files.
+// Entries in the trash are purged with TrashParent as parent and their ids.
+func (c *Client) DeleteTree(parent int64, name string) ([]Metadata, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	removed, err := c.deleteTree(tx, parent, name)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return removed, nil
+}
+
+func (c *Client) deleteTree(tx *sql.Tx, parent int64, name string) ([]Metadata, error) {
+	top, err := c.txGetEntry(tx, parent, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// directories in the tree, including the top one
+	tree := fmt.Sprintf(`WITH RECURSIVE tree(inode) AS (
+		SELECT %d
+		UNION
+		SELECT d.inode FROM dentries d JOIN tree t ON d.parent = t.inode
+		JOIN inodes i ON i.inode = d.inode WHERE i.type = %d
+	) `, top.Inode, common.DrvFolder)
+
+	row, err := tx.Query(tree + "SELECT DISTINCT inode FROM dentries WHERE parent IN tree")
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	inodes := []int64{top.Inode}
+
+	for row.Next() {
+		var inode int64
+
+		if err := row.Scan(&inode); err != nil {
+			row.Close()
+
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		inodes = append(inodes, inode)
+	}
+	row.Close()
+
+	if _, err := tx.Exec(tree + "DELETE FROM dentries WHERE parent IN tree"); err != nil {
+		return nil, fmt.Errorf("couldn't delete entries: %v", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM dentries WHERE parent=? and name=?", parent, name); err != nil {
+		return nil, fmt.Errorf("couldn't delete entry: %v", err)
+	}
+
+	if parent == TrashParent {
+		if _, err := tx.Exec("DELETE FROM trash WHERE id=?", name); err != nil {
+			return nil, fmt.Errorf("couldn't delete trash entry: %v", err)
+		}
+	}
+
+	removed := []Metadata{}
+
+	for _, inode := range inodes {
+		var links int
+
+		if err := tx.QueryRow("SELECT COUNT(*) FROM dentries WHERE inode=?", inode).Scan(&links); err != nil {
+			return nil, fmt.Errorf("couldn't get link count: %v", err)
+		}
+
+		if links > 0 {
+			continue
+		}
+
+		row, err := tx.Query("SELECT * FROM inodes WHERE inode=?", inode)
+		if err != nil {
+			return nil, fmt.Errorf("there is an error in query: %v", err)
+		}
+
+		if !row.Next() {
+			row.Close()
+			continue
+		}
+
+		md, err := c.parseInodeRow(row)
+		row.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sqlStr := range []string{
+			"DELETE FROM xattrs WHERE inode=?",
+			"DELETE FROM inodes WHERE inode=?",
+		} {
+			if _, err := tx.Exec(sqlStr, inode); err != nil {
+				return nil, fmt.Errorf("couldn't delete inode %d: %v", inode, err)
+			}
+		}
+
+		removed = append(removed, *md)
+	}
+
+	return removed, nil
+}
+
+// Link adds a new name to the file with specified inode
+func (c *Client) Link(inode int64, parent int64, name string) error {
+	query, err := c.db.Prepare("INSERT INTO dentries(parent, name, inode) VALUES(?, ?, ?)")
 	if err != nil {
 		return fmt.Errorf("couldn't prepare statement: %v", err)
 	}
 
-	_, err = query.Exec(inode)
+	if _, err := query.Exec(parent, name, inode); err != nil {
+		return fmt.Errorf("couldn't insert entry: %v", err)
+	}
+
+	return nil
+}
+
+// ReplaceLinks replaces all names of the file with specified inode with links
+// in a single transaction. A name which is taken by another file gets a
+// conflicted name. Trash entries of the names which are removed are deleted.
+// Returns common.ErrSubdirectory if a directory would be moved under itself.
+func (c *Client) ReplaceLinks(inode int64, links []Dentry) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	if err := c.replaceLinks(tx, inode, links); err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) replaceLinks(tx *sql.Tx, inode int64, links []Dentry) error {
+	if _, err := tx.Exec("DELETE FROM dentries WHERE inode=?", inode); err != nil {
+		return fmt.Errorf("couldn't delete entries: %v", err)
+	}
+
+	var typ int
+
+	if err := tx.QueryRow("SELECT type FROM inodes WHERE inode=?", inode).Scan(&typ); err != nil {
+		if err == sql.ErrNoRows {
+			return common.ErrNotFound
+		}
+
+		return fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	for _, l := range links {
+		if err := txCheckMove(tx, &Metadata{Inode: inode, Type: typ}, l.Parent); err != nil {
+			return err
+		}
+
+		name := l.Name
+
+		if _, err := c.txGetEntry(tx, l.Parent, name); err == nil {
+			name = common.GenerateConflictedFileName(name)
+		} else if err != common.ErrNotFound {
+			return err
+		}
+
+		if _, err := tx.Exec("INSERT INTO dentries(parent, name, inode) VALUES(?, ?, ?)", l.Parent, name, inode); err != nil {
+			return fmt.Errorf("couldn't insert entry: %v", err)
+		}
+	}
+
+	_, err := tx.Exec("DELETE FROM trash WHERE inode=? AND id NOT IN "+
+		"(SELECT name FROM dentries WHERE parent=? AND inode=?)", inode, TrashParent, inode)
+	if err != nil {
+		return fmt.Errorf("couldn't delete trash entries: %v", err)
+	}
+
+	return nil
+}
+
+// Rename moves the entry with specified name under specified inode to newName
+// under newParent. An existing target is replaced atomically. If the replaced
+// file loses its last name, it is moved to the trash with path as its original
+// path and device as the host replacing it, and its trash entry is returned.
+// A replaced directory, which can only be empty, is removed.
+func (c *Client) Rename(parent int64, name string, newParent int64, newName string,
+	path string, device string, t time.Time) (*TrashEntry, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	trashed, err := c.rename(tx, parent, name, newParent, newName, path, device, t)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return trashed, nil
+}
+
+func (c *Client) rename(tx *sql.Tx, parent int64, name string, newParent int64, newName string,
+	path string, device string, t time.Time) (*TrashEntry, error) {
+	src, err := c.txGetEntry(tx, parent, name)
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := c.txGetEntry(tx, newParent, newName)
+	if err != nil && err != common.ErrNotFound {
+		return nil, err
+	}
+
+	exists := err == nil
+
+	if exists {
+		// both names refer to the same file, nothing to do
+		if src.Inode == dst.Inode {
+			return nil, nil
+		}
+
+		if src.Type == common.DrvFolder && dst.Type != common.DrvFolder {
+			return nil, common.ErrNotDir
+		}
+
+		if src.Type != common.DrvFolder && dst.Type == common.DrvFolder {
+			return nil, common.ErrIsDir
+		}
+	}
+
+	if err := txCheckMove(tx, src, newParent); err != nil {
+		return nil, err
+	}
+
+	var trashed *TrashEntry
+
+	if exists {
+		var links int
+
+		if err := tx.QueryRow("SELECT COUNT(*) FROM dentries WHERE inode=?", dst.Inode).Scan(&links); err != nil {
+			return nil, fmt.Errorf("couldn't get link count: %v", err)
+		}
+
+		switch {
+		case dst.Type == common.DrvFolder:
+			if err := txDeleteEmptyDirectory(tx, dst); err != nil {
+				return nil, err
+			}
+		case links > 1:
+			if _, err := tx.Exec("DELETE FROM dentries WHERE parent=? and name=?", newParent, newName); err != nil {
+				return nil, fmt.Errorf("couldn't delete entry: %v", err)
+			}
+		default:
+			// the content of the file is kept like the removed ones
+			if trashed, err = txTrash(tx, dst, path, device, t); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	_, err = tx.Exec("UPDATE dentries SET parent=?, name=? WHERE parent=? and name=?", newParent, newName, parent, name)
 	if err != nil {
-		return fmt.Errorf("couldn't delete entry: %v", err)
+		return nil, fmt.Errorf("couldn't update entry: %v", err)
+	}
+
+	return trashed, nil
+}
+
+// txDeleteEmptyDirectory deletes the directory md if it doesn't have any entries
+func txDeleteEmptyDirectory(tx *sql.Tx, md *Metadata) error {
+	var children int
+
+	if err := tx.QueryRow("SELECT COUNT(*) FROM dentries WHERE parent=?", md.Inode).Scan(&children); err != nil {
+		return fmt.Errorf("couldn't get child count: %v", err)
+	}
+
+	if children > 0 {
+		return common.ErrDirNotEmpty
+	}
+
+	for _, sqlStr := range []string{
+		"DELETE FROM dentries WHERE inode=?",
+		"DELETE FROM xattrs WHERE inode=?",
+		"DELETE FROM inodes WHERE inode=?",
+	} {
+		if _, err := tx.Exec(sqlStr, md.Inode); err != nil {
+			return fmt.Errorf("couldn't delete replaced directory: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// txGetEntry returns metadata of the file with specified name under specified inode
+func (c *Client) txGetEntry(tx *sql.Tx, parent int64, name string) (*Metadata, error) {
+	row, err := tx.Query("SELECT * FROM files WHERE parent=? and name=?", parent, name)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	if !row.Next() {
+		return nil, common.ErrNotFound
+	}
+
+	return c.parseRow(row)
+}
+
+// txCheckMove returns common.ErrSubdirectory if md is a directory and
+// newParent is the directory itself or one of its descendants
+func txCheckMove(tx *sql.Tx, md *Metadata, newParent int64) error {
+	if md.Type != common.DrvFolder {
+		return nil
+	}
+
+	// directories have a single name, walk up to the root
+	for inode := newParent; inode != 0; {
+		if inode == md.Inode {
+			return common.ErrSubdirectory
+		}
+
+		err := tx.QueryRow("SELECT parent FROM dentries WHERE inode=?", inode).Scan(&inode)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+
+			return fmt.Errorf("couldn't get parent of %d: %v", inode, err)
+		}
 	}
 
 	return nil
@@ -183,86 +587,125 @@ func (c *Client) GetChildren(parent int64) ([]Metadata, error) {
 
 // AddDirectory insert row with type folder into the database
 func (c *Client) AddDirectory(parent int64, name string, mode int) (*Metadata, error) {
-	query, err := c.db.Prepare("INSERT INTO files(name, mode, parent, type) VALUES(?, ?, ?, ?)")
-	if err != nil {
-		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
-	}
-
-	_, err = query.Exec(name, mode, parent, common.DrvFolder)
+	now := time.Now()
+
+	md, err := c.create(parent, name, &Metadata{
+		Mode:   mode,
+		Type:   common.DrvFolder,
+		UID:    -1,
+		GID:    -1,
+		MTime:  now,
+		CTime:  now,
+		CrTime: now,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("couldn't insert directory: %v", err)
 	}
 
-	query, err = c.db.Prepare("SELECT * FROM files WHERE name=? and parent=?")
-	if err != nil {
-		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
-	}
+	// since the directory has just been created, there are only '.' and '..'
+	md.NLink = 2
+	return md, nil
+}
 
-	row, err := query.Query(name, parent)
+// CreateFile insert row with type file into the database
+func (c *Client) CreateFile(parent int64, name string, mode int, url string, hash string) (*Metadata, error) {
+	now := time.Now()
+
+	md, err := c.create(parent, name, &Metadata{
+		URL:    url,
+		Mode:   mode,
+		Type:   common.DrvFile,
+		Hash:   hash,
+		UID:    -1,
+		GID:    -1,
+		MTime:  now,
+		CTime:  now,
+		CrTime: now,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("there is an error in query: %v", err)
+		return nil, fmt.Errorf("couldn't insert file: %v", err)
 	}
-	defer row.Close()
 
-	if !row.Next() {
-		return nil, fmt.Errorf("row should be inserted but apparently it didn't")
-	}
+	// the file has just been created, there isn't any other link
+	md.NLink = 1
+	return md, nil
+}
 
-	md, err := c.parseRow(row)
+// CreateSymlink insert row with type symlink into the database. Symbolic
+// links don't have any content on remote drives, target is kept in the row.
+func (c *Client) CreateSymlink(parent int64, name string, target string) (*Metadata, error) {
+	now := time.Now()
+
+	md, err := c.create(parent, name, &Metadata{
+		Size:   int64(len(target)),
+		Mode:   0777,
+		Type:   common.DrvSymlink,
+		UID:    -1,
+		GID:    -1,
+		MTime:  now,
+		CTime:  now,
+		CrTime: now,
+		Target: target,
+	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("couldn't insert symlink: %v", err)
 	}
 
-	// since the directory has just been created, there are only '.' and '..'
-	md.NLink = 2
+	md.NLink = 1
 	return md, nil
 }
 
-// CreateFile insert row with type file into the database
-func (c *Client) CreateFile(parent int64, name string, mode int, url string, hash string) (*Metadata, error) {
-	query, err := c.db.Prepare("INSERT INTO files(name, url, size, mode, parent, type, hash) VALUES(?, ?, ?, ?, ?, ?, ?)")
+// create inserts a new inode with attributes of md and its entry
+// with specified name under specified inode
+func (c *Client) create(parent int64, name string, md *Metadata) (*Metadata, error) {
+	tx, err := c.db.Begin()
 	if err != nil {
-		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
+		return nil, fmt.Errorf("couldn't begin transaction: %v", err)
 	}
 
-	_, err = query.Exec(name, url, 0, mode, parent, common.DrvFile, hash)
+	res, err := tx.Exec("INSERT INTO inodes(url, size, mode, type, hash, uid, gid, atime, mtime, ctime, crtime, target) "+
+		"VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", inodeValues(md)...)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't insert file: %v", err)
+		tx.Rollback()
+
+		return nil, fmt.Errorf("couldn't insert inode: %v", err)
 	}
 
-	query, err = c.db.Prepare("SELECT * FROM files WHERE name=? and parent=?")
+	inode, err := res.LastInsertId()
 	if err != nil {
-		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
+		tx.Rollback()
+
+		return nil, fmt.Errorf("couldn't get inserted inode: %v", err)
 	}
 
-	row, err := query.Query(name, parent)
+	_, err = tx.Exec("INSERT INTO dentries(parent, name, inode) VALUES(?, ?, ?)", parent, name, inode)
 	if err != nil {
-		return nil, fmt.Errorf("there is an error in query: %v", err)
-	}
-	defer row.Close()
+		tx.Rollback()
 
-	if !row.Next() {
-		return nil, fmt.Errorf("row should be inserted but apparently it didn't")
+		return nil, fmt.Errorf("couldn't insert entry: %v", err)
 	}
 
-	md, err := c.parseRow(row)
-	if err != nil {
-		return nil, err
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("couldn't commit transaction: %v", err)
 	}
 
-	// it's file and hardlink isn't supported
-	md.NLink = 1
+	md.Inode = inode
+	md.Parent = parent
+	md.Name = name
+
 	return md, nil
 }
 
-// Update updates related row with new metadata
+// Update updates attributes of the file with new metadata. Name and parent
+// aren't changed since a file may have several, use Rename for them.
 func (c *Client) Update(md *Metadata) error {
-	query, err := c.db.Prepare("UPDATE files SET name=?, url=?, size=?, mode=?, parent=?, type=?, hash=? WHERE inode=?")
+	query, err := c.db.Prepare("UPDATE inodes SET url=?, size=?, mode=?, type=?, hash=?, " +
+		"uid=?, gid=?, atime=?, mtime=?, ctime=?, crtime=?, target=? WHERE inode=?")
 	if err != nil {
 		return fmt.Errorf("couldn't prepare statement: %v", err)
 	}
 
-	_, err = query.Exec(md.Name, md.URL, md.Size, md.Mode, md.Parent, md.Type, md.Hash, md.Inode)
+	_, err = query.Exec(append(inodeValues(md), md.Inode)...)
 	if err != nil {
 		return fmt.Errorf("couldn't update file: %v", err)
 	}
@@ -270,14 +713,36 @@ func (c *Client) Update(md *Metadata) error {
 	return nil
 }
 
-// GetRows returns rows starting from specified offset with specified limit
-func (c *Client) GetRows(limit int, offset int) ([]Metadata, error) {
-	query, err := c.db.Prepare("SELECT * FROM files LIMIT ? OFFSET ?")
+// GetInode returns attributes of the file with specified inode. Unlike Get,
+// it doesn't need the file to have a name, Name and Parent are left empty.
+func (c *Client) GetInode(inode int64) (*Metadata, error) {
+	query, err := c.db.Prepare("SELECT * FROM inodes WHERE inode=?")
 	if err != nil {
 		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
 	}
 
-	row, err := query.Query()
+	row, err := query.Query(inode)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	if !row.Next() {
+		return nil, common.ErrNotFound
+	}
+
+	return c.parseInodeRow(row)
+}
+
+// GetInodes returns inodes ordered by number starting from
+// specified offset with specified limit
+func (c *Client) GetInodes(limit int, offset int) ([]Metadata, error) {
+	query, err := c.db.Prepare("SELECT * FROM inodes ORDER BY inode LIMIT ? OFFSET ?")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
+	}
+
+	row, err := query.Query(limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("there is an error in query: %v", err)
 	}
@@ -285,49 +750,74 @@ func (c *Client) GetRows(limit int, offset int) ([]Metadata, error) {
 
 	mdList := []Metadata{}
 	for row.Next() {
-		md, err := c.parseRow(row)
+		md, err := c.parseInodeRow(row)
 		if err != nil {
 			return nil, err
 		}
 
-		err = c.fillNLink(md)
-		if err != nil {
-			return nil, fmt.Errorf("couldn't get nlink count: %v", err)
-		}
-
 		mdList = append(mdList, *md)
 	}
 
 	return mdList, nil
 }
 
-// GetRowCount returns total number of rows
-func (c *Client) GetRowCount() (int, error) {
-	query, err := c.db.Prepare("SELECT count(*) FROM files")
+// GetInodeCount returns total number of inodes
+func (c *Client) GetInodeCount() (int, error) {
+	return c.count("SELECT count(*) FROM inodes")
+}
+
+// GetMaxInode returns the largest inode number in use
+func (c *Client) GetMaxInode() (int64, error) {
+	var max int64
+
+	if err := c.db.QueryRow("SELECT IFNULL(MAX(inode), 0) FROM inodes").Scan(&max); err != nil {
+		return 0, fmt.Errorf("couldn't get max inode: %v", err)
+	}
+
+	return max, nil
+}
+
+// GetLinks returns all names of the file with specified inode
+func (c *Client) GetLinks(inode int64) ([]Dentry, error) {
+	query, err := c.db.Prepare("SELECT parent, name, inode FROM dentries WHERE inode=?")
 	if err != nil {
-		return 0, fmt.Errorf("couldn't prepare statement: %v", err)
+		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
 	}
 
-	row, err := query.Query()
+	row, err := query.Query(inode)
 	if err != nil {
-		return 0, fmt.Errorf("there is an error in query: %v", err)
+		return nil, fmt.Errorf("there is an error in query: %v", err)
 	}
 	defer row.Close()
 
-	var count int
+	return parseDentryRows(row)
+}
 
-	row.Next() // no need to check return value
+// GetDentries returns directory entries ordered by parent and name
+// starting from specified offset with specified limit
+func (c *Client) GetDentries(limit int, offset int) ([]Dentry, error) {
+	query, err := c.db.Prepare("SELECT parent, name, inode FROM dentries ORDER BY parent, name LIMIT ? OFFSET ?")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
+	}
 
-	if err := row.Scan(&count); err != nil {
-		return 0, fmt.Errorf("couldn't get row count: %v", err)
+	row, err := query.Query(limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
 	}
+	defer row.Close()
 
-	return count, nil
+	return parseDentryRows(row)
 }
 
-// GetFileCount returns number of rows of type common.DrvFile
+// GetDentryCount returns total number of directory entries
+func (c *Client) GetDentryCount() (int, error) {
+	return c.count("SELECT count(*) FROM dentries")
+}
+
+// GetFileCount returns number of files of type common.DrvFile
 func (c *Client) GetFileCount() (int64, error) {
-	query, err := c.db.Prepare("SELECT count(*) FROM files where type=?")
+	query, err := c.db.Prepare("SELECT count(*) FROM inodes where type=?")
 	if err != nil {
 		return 0, fmt.Errorf("couldn't prepare statement: %v", err)
 	}
@@ -350,7 +840,7 @@ func (c *Client) GetFileCount() (int64, error) {
 }
 
 func (c *Client) GetTotalSize() (int64, error) {
-	query, err := c.db.Prepare("SELECT sum(size) FROM files where type=?")
+	query, err := c.db.Prepare("SELECT IFNULL(sum(size), 0) FROM inodes where type=?")
 	if err != nil {
 		return 0, fmt.Errorf("couldn't prepare statement: %v", err)
 	}
@@ -372,37 +862,71 @@ func (c *Client) GetTotalSize() (int64, error) {
 	return size, nil
 }
 
-// Insert inserts metadata to database
-func (c *Client) Insert(md *Metadata) error {
-	query, err := c.db.Prepare("INSERT INTO files(name, url, size, mode, parent, type, hash) VALUES(?, ?, ?, ?, ?, ?, ?)")
+// ForceInsertInode inserts inode with attributes of md,
+// doesn't rely on autoincrement. No name is added.
+func (c *Client) ForceInsertInode(md *Metadata) error {
+	query, err := c.db.Prepare("INSERT INTO inodes(url, size, mode, type, hash, " +
+		"uid, gid, atime, mtime, ctime, crtime, target, inode) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return fmt.Errorf("couldn't prepare statement: %v", err)
 	}
 
-	if _, err := query.Exec(md.Name, md.URL, md.Size, md.Mode, md.Parent, md.Type, md.Hash); err != nil {
-		return fmt.Errorf("couldn't insert file: %v", err)
+	if _, err := query.Exec(append(inodeValues(md), md.Inode)...); err != nil {
+		return fmt.Errorf("couldn't insert inode: %v", err)
 	}
 
 	return nil
 }
 
-// ForceInsert inserts metadata with provided inode, doesn't rely on autoincrement
-func (c *Client) ForceInsert(md *Metadata) error {
-	query, err := c.db.Prepare("INSERT INTO files(inode, name, url, size, mode, parent, type, hash) VALUES(?, ?, ?, ?, ?, ?, ?, ?)")
+// MoveInode changes number of the inode. Its names, its children, its extended
+// attributes, its trash entries and its versions are moved to the new number as well
+func (c *Client) MoveInode(inode int64, newInode int64) error {
+	tx, err := c.db.Begin()
 	if err != nil {
-		return fmt.Errorf("couldn't prepare statement: %v", err)
+		return fmt.Errorf("couldn't begin transaction: %v", err)
 	}
 
-	if _, err := query.Exec(md.Inode, md.Name, md.URL, md.Size, md.Mode, md.Parent, md.Type, md.Hash); err != nil {
-		return fmt.Errorf("couldn't insert file: %v", err)
+	for _, sqlStr := range []string{
+		"UPDATE inodes SET inode=? WHERE inode=?",
+		"UPDATE dentries SET inode=? WHERE inode=?",
+		"UPDATE dentries SET parent=? WHERE parent=?",
+		"UPDATE xattrs SET inode=? WHERE inode=?",
+		"UPDATE trash SET inode=? WHERE inode=?",
+		"UPDATE trash SET parent=? WHERE parent=?",
+		"UPDATE versions SET inode=? WHERE inode=?",
+	} {
+		if _, err := tx.Exec(sqlStr, newInode, inode); err != nil {
+			tx.Rollback()
+
+			return fmt.Errorf("couldn't move inode: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %v", err)
 	}
 
 	return nil
 }
 
+func (c *Client) count(sqlStr string, args ...interface{}) (int, error) {
+	var count int
+
+	if err := c.db.QueryRow(sqlStr, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("couldn't get row count: %v", err)
+	}
+
+	return count, nil
+}
+
 func (c *Client) fillNLink(md *Metadata) error {
-	if md.Type == common.DrvFile {
-		md.NLink = 1
+	if md.Type != common.DrvFolder {
+		count, err := c.count("SELECT COUNT(*) FROM dentries WHERE inode=?", md.Inode)
+		if err != nil {
+			return err
+		}
+
+		md.NLink = count
 		return nil
 	}
 
@@ -431,12 +955,85 @@ func (c *Client) fillNLink(md *Metadata) error {
 	return nil
 }
 
+// parseRow parses a row of `files` view
 func (c *Client) parseRow(row *sql.Rows) (*Metadata, error) {
 	md := &Metadata{}
-	err := row.Scan(&md.Inode, &md.Name, &md.URL, &md.Size, &md.Mode, &md.Parent, &md.Type, &md.Hash)
+
+	var atime, mtime, ctime, crtime int64
+
+	err := row.Scan(&md.Inode, &md.Name, &md.URL, &md.Size, &md.Mode, &md.Parent, &md.Type, &md.Hash,
+		&md.UID, &md.GID, &atime, &mtime, &ctime, &crtime, &md.Target)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse row: %v", err)
+	}
+
+	md.ATime = fromTimestamp(atime)
+	md.MTime = fromTimestamp(mtime)
+	md.CTime = fromTimestamp(ctime)
+	md.CrTime = fromTimestamp(crtime)
+
+	return md, nil
+}
+
+// parseInodeRow parses a row of `inodes` table
+func (c *Client) parseInodeRow(row *sql.Rows) (*Metadata, error) {
+	md := &Metadata{}
+
+	var atime, mtime, ctime, crtime int64
+
+	err := row.Scan(&md.Inode, &md.URL, &md.Size, &md.Mode, &md.Type, &md.Hash,
+		&md.UID, &md.GID, &atime, &mtime, &ctime, &crtime, &md.Target)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't parse row: %v", err)
 	}
 
+	md.ATime = fromTimestamp(atime)
+	md.MTime = fromTimestamp(mtime)
+	md.CTime = fromTimestamp(ctime)
+	md.CrTime = fromTimestamp(crtime)
+
 	return md, nil
 }
+
+func parseDentryRows(row *sql.Rows) ([]Dentry, error) {
+	dentries := []Dentry{}
+
+	for row.Next() {
+		d := Dentry{}
+
+		if err := row.Scan(&d.Parent, &d.Name, &d.Inode); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		dentries = append(dentries, d)
+	}
+
+	return dentries, nil
+}
+
+// inodeValues returns the values of inode columns in the order of
+// url, size, mode, type, hash, uid, gid, atime, mtime, ctime, crtime, target
+func inodeValues(md *Metadata) []interface{} {
+	return []interface{}{
+		md.URL, md.Size, md.Mode, md.Type, md.Hash, md.UID, md.GID,
+		toTimestamp(md.ATime), toTimestamp(md.MTime), toTimestamp(md.CTime), toTimestamp(md.CrTime),
+		md.Target,
+	}
+}
+
+// toTimestamp converts t to nanoseconds since epoch, zero time is stored as 0
+func toTimestamp(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+func fromTimestamp(ts int64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ts)
+}
@@ -0,0 +1,138 @@
+package sqlite
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// newTestClient returns a client of a new database in a temporary directory
+func newTestClient(t *testing.T) *Client {
+	dir, err := ioutil.TempDir("", "cloudstash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "test.sqlite3")
+	if err := InitDB(path); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudstash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "old.sqlite3")
+
+	// a database created before the migrations
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sqlStr := range tableSchemas {
+		if _, err := db.Exec(sqlStr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := db.Exec("INSERT INTO files(inode, name, mode, parent, type) VALUES (2, 'old', 420, 1, ?)", common.DrvFile); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	c, err := NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Migrate(); err != nil {
+		t.Fatalf("couldn't migrate database: %v", err)
+	}
+
+	// migrations aren't applied twice
+	if err := c.Migrate(); err != nil {
+		t.Fatalf("couldn't migrate database again: %v", err)
+	}
+
+	md, err := c.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.Name != "old" || md.UID != -1 || md.GID != -1 {
+		t.Errorf("migrated row is wrong: %+v", md)
+	}
+
+	// existing files get the time of migration
+	if md.MTime.IsZero() || !md.CTime.Equal(md.MTime) || !md.CrTime.Equal(md.MTime) {
+		t.Errorf("times of migrated row are wrong: %v %v %v", md.MTime, md.CTime, md.CrTime)
+	}
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	c := newTestClient(t)
+
+	if _, err := c.db.Exec("PRAGMA user_version = 1000"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Migrate(); err == nil {
+		t.Errorf("database of a newer version is migrated")
+	}
+}
+
+func TestUpdateAttributes(t *testing.T) {
+	c := newTestClient(t)
+
+	md, err := c.CreateFile(1, "file", 0644, "drive://file", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 1, time.UTC)
+
+	md.UID = 1000
+	md.GID = 100
+	md.ATime = mtime.Add(time.Hour)
+	md.MTime = mtime
+
+	if err := c.Update(md); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := c.Get(md.Inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.UID != 1000 || updated.GID != 100 {
+		t.Errorf("ownership isn't updated: %+v", updated)
+	}
+
+	if !updated.MTime.Equal(mtime) || !updated.ATime.Equal(mtime.Add(time.Hour)) {
+		t.Errorf("times aren't updated: %v %v", updated.ATime, updated.MTime)
+	}
+}
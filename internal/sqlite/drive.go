@@ -0,0 +1,220 @@
+package sqlite
+
+import (
+	"fmt"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// urlQuery selects all urls referenced by the database, including the ones
+// which are only keys of chunk lists and sharded contents and the shards
+const urlQuery = `SELECT url FROM (
+	SELECT url FROM inodes WHERE url != ""
+	UNION SELECT url FROM versions
+	UNION SELECT location AS url FROM snapshot_blobs
+	UNION SELECT url FROM snapshots
+	UNION SELECT url FROM chunks
+	UNION SELECT url FROM file_chunks
+	UNION SELECT url FROM sharded
+	UNION SELECT location AS url FROM shards)`
+
+// renames are the columns which refer to a remote file by its url
+var renames = []string{
+	"UPDATE inodes SET url=? WHERE url=?",
+	"UPDATE versions SET url=? WHERE url=?",
+	"UPDATE snapshot_blobs SET location=? WHERE location=?",
+	"UPDATE snapshots SET url=? WHERE url=?",
+	"UPDATE chunks SET url=? WHERE url=?",
+	"UPDATE file_chunks SET url=? WHERE url=?",
+	"UPDATE sharded SET url=? WHERE url=?",
+	"UPDATE shards SET url=? WHERE url=?",
+	"UPDATE shards SET location=? WHERE location=?",
+	"UPDATE replicas SET url=? WHERE url=?",
+}
+
+// urlColumns are the columns which refer to a remote file by its url, as table and column.
+// Urls in snapshot_blobs.url are the ones in the snapshots, they aren't changed.
+var urlColumns = [][2]string{
+	{"inodes", "url"},
+	{"versions", "url"},
+	{"snapshot_blobs", "location"},
+	{"snapshots", "url"},
+	{"chunks", "url"},
+	{"file_chunks", "url"},
+	{"sharded", "url"},
+	{"shards", "url"},
+	{"shards", "location"},
+	{"replicas", "url"},
+}
+
+// GetDriveURLs returns the urls in drive referenced by the database
+func (c *Client) GetDriveURLs(drive string) ([]string, error) {
+	prefix := drive + "://"
+
+	return c.queryURLs(urlQuery+" WHERE substr(url, 1, length(?)) = ? ORDER BY url", prefix, prefix)
+}
+
+// GetDriveBlobURLs returns the urls of the remote files in drive which can be
+// moved to another drive on their own, i.e. they aren't shards of a content
+func (c *Client) GetDriveBlobURLs(drive string) ([]string, error) {
+	prefix := drive + "://"
+
+	return c.queryURLs(blobQuery+" AND substr(url, 1, length(?)) = ? ORDER BY url", common.DrvFile, prefix, prefix)
+}
+
+// GetDriveURLCount returns the number of urls in drive referenced by the database
+func (c *Client) GetDriveURLCount(drive string) (int, error) {
+	prefix := drive + "://"
+
+	return c.count("SELECT count(*) FROM ("+urlQuery+" WHERE substr(url, 1, length(?)) = ?)", prefix, prefix)
+}
+
+// GetDriveReplicaCount returns the number of replicas in drive
+func (c *Client) GetDriveReplicaCount(drive string) (int, error) {
+	return c.count("SELECT count(*) FROM replicas WHERE drive=?", drive)
+}
+
+// GetDriveReplicas returns the urls of the remote files which have a replica in drive
+func (c *Client) GetDriveReplicas(drive string) ([]string, error) {
+	return c.queryURLs("SELECT url FROM replicas WHERE drive=? ORDER BY url", drive)
+}
+
+// RenameURL changes url of the remote file to newURL wherever it is referenced.
+// The replica in the drive of newURL is dropped since the file itself is there.
+// Returns false if url isn't referenced.
+func (c *Client) RenameURL(url string, newURL string) (bool, error) {
+	u, err := common.ParseURL(newURL)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse url %s: %v", newURL, err)
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	var n int64
+
+	for _, query := range renames {
+		res, err := tx.Exec(query, newURL, url)
+		if err != nil {
+			tx.Rollback()
+
+			return false, fmt.Errorf("couldn't rename %s: %v", url, err)
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+
+			return false, fmt.Errorf("couldn't get affected rows: %v", err)
+		}
+
+		n += affected
+	}
+
+	if _, err := tx.Exec("DELETE FROM replicas WHERE url=? AND drive=?", newURL, u.Scheme); err != nil {
+		tx.Rollback()
+
+		return false, fmt.Errorf("couldn't delete replica: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// IsReferenced returns whether the remote file at url is referenced by the
+// database, either by its url or as the replica of a file with the same name
+func (c *Client) IsReferenced(url string) (bool, error) {
+	u, err := common.ParseURL(url)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse url %s: %v", url, err)
+	}
+
+	var found bool
+
+	err = c.db.QueryRow("SELECT EXISTS("+urlQuery+" WHERE url=?) OR "+
+		"EXISTS(SELECT 1 FROM replicas WHERE drive=? AND substr(url, instr(url, '://') + 3)=?)",
+		url, u.Scheme, u.Name).Scan(&found)
+	if err != nil {
+		return false, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	return found, nil
+}
+
+// RenameDrive changes the scheme of the urls in drive to id, along with
+// the replicas in drive. Returns the number of changed rows.
+func (c *Client) RenameDrive(drive string, id string) (int64, error) {
+	prefix := drive + "://"
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	var n int64
+
+	exec := func(query string, args ...interface{}) error {
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("couldn't rename urls of %s: %v", drive, err)
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("couldn't get affected rows: %v", err)
+		}
+
+		n += affected
+
+		return nil
+	}
+
+	for _, col := range urlColumns {
+		query := fmt.Sprintf("UPDATE %[1]s SET %[2]s = ? || substr(%[2]s, ?) WHERE substr(%[2]s, 1, ?) = ?", col[0], col[1])
+
+		if err := exec(query, id+"://", len(prefix)+1, len(prefix), prefix); err != nil {
+			tx.Rollback()
+
+			return 0, err
+		}
+	}
+
+	if err := exec("UPDATE replicas SET drive=? WHERE drive=?", id, drive); err != nil {
+		tx.Rollback()
+
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return n, nil
+}
+
+func (c *Client) queryURLs(query string, args ...interface{}) ([]string, error) {
+	row, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	urls := []string{}
+
+	for row.Next() {
+		var url string
+
+		if err := row.Scan(&url); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		urls = append(urls, url)
+	}
+
+	return urls, nil
+}
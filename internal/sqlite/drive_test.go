@@ -0,0 +1,68 @@
+package sqlite
+
+import (
+	"testing"
+)
+
+func TestRenameDrive(t *testing.T) {
+	c := newTestClient(t)
+
+	f, err := c.CreateFile(1, "f", 0644, "dropbox://f", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := c.CreateFile(1, "g", 0644, "gdrive://g", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.AddReplica(g.URL, "dropbox"); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the scheme is compared, not a prefix of it
+	if n, err := c.RenameDrive("drop", "d0"); err != nil || n != 0 {
+		t.Fatalf("%d references of another drive are renamed: %v", n, err)
+	}
+
+	n, err := c.RenameDrive("dropbox", "d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Errorf("%d references are renamed, expected 2", n)
+	}
+
+	md, err := c.Get(f.Inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.URL != "d1://f" {
+		t.Errorf("url isn't renamed: %s", md.URL)
+	}
+
+	md, err = c.Get(g.Inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.URL != "gdrive://g" {
+		t.Errorf("url of another drive is renamed: %s", md.URL)
+	}
+
+	replicas, err := c.GetReplicas(g.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(replicas) != 1 || replicas[0] != "d1" {
+		t.Errorf("replica isn't renamed: %v", replicas)
+	}
+
+	if n, err := c.RenameDrive("dropbox", "d1"); err != nil || n != 0 {
+		t.Errorf("%d references are renamed again: %v", n, err)
+	}
+}
@@ -1,5 +1,7 @@
 package sqlite
 
+import "time"
+
 type Metadata struct {
 	Inode  int64
 	Name   string
@@ -10,4 +12,90 @@ type Metadata struct {
 	Parent int64
 	NLink  int
 	Hash   string
+	UID    int       // -1 if not set, owner of the mount is used
+	GID    int       // -1 if not set
+	ATime  time.Time // last access, only changed explicitly
+	MTime  time.Time // last content change
+	CTime  time.Time // last metadata change
+	CrTime time.Time // creation
+	Target string    // target of symbolic link
+}
+
+// Dentry is a name of a file in a directory. A file may have several.
+type Dentry struct {
+	Parent int64
+	Name   string
+	Inode  int64
+}
+
+// XAttr is an extended attribute of a file
+type XAttr struct {
+	Inode int64
+	Name  string
+	Value []byte
+}
+
+// TrashEntry is a removed file or directory kept in the trash
+type TrashEntry struct {
+	ID      string // name of the entry under TrashParent
+	Inode   int64
+	Parent  int64  // original parent
+	Path    string // original path
+	Deleted time.Time
+	Device  string // host which removed the entry
+	Type    int
+	Size    int64
+}
+
+// Version is a content of a file uploaded to the remote drive
+type Version struct {
+	URL   string
+	Inode int64
+	Size  int64
+	Hash  string
+	Time  time.Time // upload time
+}
+
+// ID returns the name of the version, which is unique among the versions of a file
+func (v *Version) ID() string {
+	return v.Time.Format("2006-01-02T15.04.05.000")
+}
+
+// Snapshot is a copy of the database at a moment, kept in the remote drive
+type Snapshot struct {
+	ID      string
+	Name    string
+	URL     string // remote file of the copy
+	Created time.Time
+	Device  string // host which created the snapshot
+	Files   int    // number of remote files referenced by the snapshot
+}
+
+// SnapshotBlob is a remote file referenced by a snapshot
+type SnapshotBlob struct {
+	Snapshot string
+	URL      string // url in the snapshot
+	Location string // current url of the content
+}
+
+// Chunk is a part of the content of files, stored once in the remote drive
+type Chunk struct {
+	ID   string // keyed hash of the content
+	URL  string
+	Size int64
+}
+
+// Replica is a copy of the remote file at URL in another drive
+type Replica struct {
+	URL   string
+	Drive string // id of the drive
+}
+
+// Sharded is content split into erasure coded shards
+type Sharded struct {
+	URL       string
+	Size      int64 // size of the encrypted content
+	Data      int   // number of data shards
+	Parity    int   // number of parity shards
+	Locations []string
 }
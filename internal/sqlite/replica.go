@@ -0,0 +1,131 @@
+package sqlite
+
+import (
+	"fmt"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// blobQuery selects urls of the remote files referenced by the database.
+// Chunked contents don't have a remote file, their chunks do. Sharded
+// contents are made redundant by their parity shards instead of replicas.
+const blobQuery = `SELECT url FROM (
+	SELECT url FROM inodes WHERE type=? AND url != ""
+	UNION SELECT url FROM versions
+	UNION SELECT location AS url FROM snapshot_blobs
+	UNION SELECT url FROM snapshots
+	UNION SELECT url FROM chunks)
+	WHERE url NOT IN (SELECT url FROM file_chunks) AND url NOT IN (SELECT url FROM sharded)`
+
+// GetReplicas returns the drives which have a replica of the remote file at url
+func (c *Client) GetReplicas(url string) ([]string, error) {
+	row, err := c.db.Query("SELECT drive FROM replicas WHERE url=? ORDER BY drive", url)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	drives := []string{}
+
+	for row.Next() {
+		var drive string
+
+		if err := row.Scan(&drive); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		drives = append(drives, drive)
+	}
+
+	return drives, nil
+}
+
+// AddReplica records the replica of the remote file at url in drive
+func (c *Client) AddReplica(url string, drive string) error {
+	_, err := c.db.Exec("INSERT OR IGNORE INTO replicas(url, drive) VALUES(?, ?)", url, drive)
+	if err != nil {
+		return fmt.Errorf("couldn't insert replica: %v", err)
+	}
+
+	return nil
+}
+
+// SetReplicas replaces the replicas of the remote file at url with the ones in drives
+func (c *Client) SetReplicas(url string, drives []string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM replicas WHERE url=?", url); err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("couldn't delete replicas of %s: %v", url, err)
+	}
+
+	for _, drive := range drives {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO replicas(url, drive) VALUES(?, ?)", url, drive); err != nil {
+			tx.Rollback()
+
+			return fmt.Errorf("couldn't insert replica: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// GetReplicaRows returns limit replicas starting from offset
+func (c *Client) GetReplicaRows(limit int, offset int) ([]Replica, error) {
+	row, err := c.db.Query("SELECT url, drive FROM replicas ORDER BY url, drive LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	replicas := []Replica{}
+
+	for row.Next() {
+		r := Replica{}
+
+		if err := row.Scan(&r.URL, &r.Drive); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		replicas = append(replicas, r)
+	}
+
+	return replicas, nil
+}
+
+// GetReplicaCount returns the number of replicas
+func (c *Client) GetReplicaCount() (int, error) {
+	return c.count("SELECT count(*) FROM replicas")
+}
+
+// GetBlobURLs returns limit urls of the remote files referenced by the database
+// starting from offset, i.e. the contents of files, their versions and chunks
+func (c *Client) GetBlobURLs(limit int, offset int) ([]string, error) {
+	row, err := c.db.Query(blobQuery+" ORDER BY url LIMIT ? OFFSET ?", common.DrvFile, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	urls := []string{}
+
+	for row.Next() {
+		var url string
+
+		if err := row.Scan(&url); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		urls = append(urls, url)
+	}
+
+	return urls, nil
+}
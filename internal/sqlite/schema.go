@@ -0,0 +1,250 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+var (
+	tableSchemas = [...]string{
+		`CREATE TABLE files (
+		"inode"  INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"name"   TEXT NOT NULL,
+		"url"    TEXT NOT NULL DEFAULT "",
+		"size"   INTEGER NOT NULL DEFAULT 0,
+		"mode"   INTEGER NOT NULL,
+		"parent" INTEGER NOT NULL,
+		"type"   INTEGER NOT NULL,
+		"hash"   TEXT NOT NULL DEFAULT "",
+		UNIQUE("name", "parent"),
+		FOREIGN KEY("parent") REFERENCES folders("id")
+	);`,
+		fmt.Sprintf(`INSERT INTO files(inode, name, mode, parent, type) VALUES (1, "", 493, 0, %d);`, common.DrvFolder), // root folder with mode 0755
+	}
+
+	// migrations are applied in order on top of tableSchemas. The number of
+	// applied migrations is kept in `user_version` of the database. Columns
+	// of `files` must only be appended, rows are parsed by their position.
+	migrations = [...][]string{
+		// 1: ownership, access and modification times
+		{
+			`ALTER TABLE files ADD COLUMN "uid" INTEGER NOT NULL DEFAULT -1;`,
+			`ALTER TABLE files ADD COLUMN "gid" INTEGER NOT NULL DEFAULT -1;`,
+			`ALTER TABLE files ADD COLUMN "atime" INTEGER NOT NULL DEFAULT 0;`,
+			`ALTER TABLE files ADD COLUMN "mtime" INTEGER NOT NULL DEFAULT 0;`,
+		},
+		// 2: change and creation times, existing files get the time of migration
+		{
+			`ALTER TABLE files ADD COLUMN "ctime" INTEGER NOT NULL DEFAULT 0;`,
+			`ALTER TABLE files ADD COLUMN "crtime" INTEGER NOT NULL DEFAULT 0;`,
+			`UPDATE files SET mtime = CAST(strftime('%s', 'now') AS INTEGER) * 1000000000 WHERE mtime = 0;`,
+			`UPDATE files SET ctime = mtime, crtime = mtime;`,
+		},
+		// 3: symbolic links
+		{
+			`ALTER TABLE files ADD COLUMN "target" TEXT NOT NULL DEFAULT "";`,
+		},
+		// 4: hard links, `files` is split into inodes and directory entries.
+		// `files` is kept as a view with the same columns, new columns of
+		// inodes should be added to the view as well.
+		{
+			`CREATE TABLE inodes (
+			"inode"  INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			"url"    TEXT NOT NULL DEFAULT "",
+			"size"   INTEGER NOT NULL DEFAULT 0,
+			"mode"   INTEGER NOT NULL,
+			"type"   INTEGER NOT NULL,
+			"hash"   TEXT NOT NULL DEFAULT "",
+			"uid"    INTEGER NOT NULL DEFAULT -1,
+			"gid"    INTEGER NOT NULL DEFAULT -1,
+			"atime"  INTEGER NOT NULL DEFAULT 0,
+			"mtime"  INTEGER NOT NULL DEFAULT 0,
+			"ctime"  INTEGER NOT NULL DEFAULT 0,
+			"crtime" INTEGER NOT NULL DEFAULT 0,
+			"target" TEXT NOT NULL DEFAULT ""
+		);`,
+			`CREATE TABLE dentries (
+			"parent" INTEGER NOT NULL,
+			"name"   TEXT NOT NULL,
+			"inode"  INTEGER NOT NULL,
+			PRIMARY KEY("parent", "name"),
+			FOREIGN KEY("inode") REFERENCES inodes("inode")
+		);`,
+			`CREATE INDEX dentries_inode ON dentries("inode");`,
+			`INSERT INTO inodes(inode, url, size, mode, type, hash, uid, gid, atime, mtime, ctime, crtime, target)
+			SELECT inode, url, size, mode, type, hash, uid, gid, atime, mtime, ctime, crtime, target FROM files;`,
+			`INSERT INTO dentries(parent, name, inode) SELECT parent, name, inode FROM files;`,
+			`DROP TABLE files;`,
+			`CREATE VIEW files AS
+			SELECT i.inode, d.name, i.url, i.size, i.mode, d.parent, i.type, i.hash,
+				i.uid, i.gid, i.atime, i.mtime, i.ctime, i.crtime, i.target
+			FROM dentries d JOIN inodes i ON i.inode = d.inode;`,
+		},
+		// 5: extended attributes
+		{
+			`CREATE TABLE xattrs (
+			"inode" INTEGER NOT NULL,
+			"name"  TEXT NOT NULL,
+			"value" BLOB NOT NULL,
+			PRIMARY KEY("inode", "name"),
+			FOREIGN KEY("inode") REFERENCES inodes("inode")
+		);`,
+		},
+		// 6: trash, removed entries are kept under TrashParent until purged
+		{
+			`CREATE TABLE trash (
+			"id"      TEXT NOT NULL PRIMARY KEY,
+			"inode"   INTEGER NOT NULL,
+			"parent"  INTEGER NOT NULL,
+			"path"    TEXT NOT NULL,
+			"deleted" INTEGER NOT NULL,
+			"device"  TEXT NOT NULL DEFAULT "",
+			FOREIGN KEY("inode") REFERENCES inodes("inode")
+		);`,
+		},
+		// 7: version history, the row whose url is the one of the inode
+		// is the last uploaded content, the others are the earlier ones
+		{
+			`CREATE TABLE versions (
+			"url"   TEXT NOT NULL PRIMARY KEY,
+			"inode" INTEGER NOT NULL,
+			"size"  INTEGER NOT NULL DEFAULT 0,
+			"hash"  TEXT NOT NULL DEFAULT "",
+			"time"  INTEGER NOT NULL,
+			FOREIGN KEY("inode") REFERENCES inodes("inode")
+		);`,
+			`CREATE INDEX versions_inode ON versions("inode");`,
+		},
+		// 8: snapshots, copies of the database kept in the remote drive.
+		// location is where the content of url referenced by the snapshot
+		// is, it changes when the content is moved to keep it.
+		{
+			`CREATE TABLE snapshots (
+			"id"      TEXT NOT NULL PRIMARY KEY,
+			"name"    TEXT NOT NULL DEFAULT "",
+			"url"     TEXT NOT NULL,
+			"created" INTEGER NOT NULL,
+			"device"  TEXT NOT NULL DEFAULT ""
+		);`,
+			`CREATE TABLE snapshot_blobs (
+			"snapshot" TEXT NOT NULL,
+			"url"      TEXT NOT NULL,
+			"location" TEXT NOT NULL,
+			PRIMARY KEY("snapshot", "url"),
+			FOREIGN KEY("snapshot") REFERENCES snapshots("id")
+		);`,
+			`CREATE INDEX snapshot_blobs_location ON snapshot_blobs("location");`,
+			`CREATE INDEX inodes_url ON inodes("url");`,
+		},
+		// 9: chunked content, content at url is the chunks listed for it in
+		// seq order if there is a list, otherwise the remote file at url
+		{
+			`CREATE TABLE chunks (
+			"id"   TEXT NOT NULL PRIMARY KEY,
+			"url"  TEXT NOT NULL,
+			"size" INTEGER NOT NULL
+		);`,
+			`CREATE TABLE file_chunks (
+			"url"   TEXT NOT NULL,
+			"seq"   INTEGER NOT NULL,
+			"chunk" TEXT NOT NULL,
+			PRIMARY KEY("url", "seq"),
+			FOREIGN KEY("chunk") REFERENCES chunks("id")
+		);`,
+			`CREATE INDEX file_chunks_chunk ON file_chunks("chunk");`,
+		},
+		// 10: replicas, copies of the remote file at url with the same
+		// name in other drives. The drive in url isn't listed.
+		{
+			`CREATE TABLE replicas (
+			"url"   TEXT NOT NULL,
+			"drive" TEXT NOT NULL,
+			PRIMARY KEY("url", "drive")
+		);`,
+		},
+		// 11: erasure coded content, content at url is split into shards
+		// stored in separate remote files if there is a row for it
+		{
+			`CREATE TABLE sharded (
+			"url"    TEXT NOT NULL PRIMARY KEY,
+			"size"   INTEGER NOT NULL,
+			"data"   INTEGER NOT NULL,
+			"parity" INTEGER NOT NULL
+		);`,
+			`CREATE TABLE shards (
+			"url"      TEXT NOT NULL,
+			"idx"      INTEGER NOT NULL,
+			"location" TEXT NOT NULL,
+			PRIMARY KEY("url", "idx"),
+			FOREIGN KEY("url") REFERENCES sharded("url")
+		);`,
+		},
+	}
+)
+
+// InitDB initializes tables. Supposed to be called on the very first run.
+func InitDB(path string) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return fmt.Errorf("couldn't open db at %s: %v", path, err)
+	}
+	defer db.Close()
+
+	for _, sqlStr := range tableSchemas {
+		st, err := db.Prepare(sqlStr)
+		if err != nil {
+			return fmt.Errorf("error in query `%s`: %v", sqlStr, err)
+		}
+
+		_, err = st.Exec()
+		if err != nil {
+			return fmt.Errorf("couldn't execute initialization query: %v", err)
+		}
+	}
+
+	return migrate(db)
+}
+
+// migrate applies the migrations which aren't applied to db yet
+func migrate(db *sql.DB) error {
+	var version int
+
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("couldn't get schema version: %v", err)
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d, "+
+			"please upgrade cloudstash", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("couldn't begin transaction: %v", err)
+		}
+
+		for _, sqlStr := range migrations[version] {
+			if _, err := tx.Exec(sqlStr); err != nil {
+				tx.Rollback()
+
+				return fmt.Errorf("couldn't execute migration query `%s`: %v", sqlStr, err)
+			}
+		}
+
+		// pragma doesn't accept parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+
+			return fmt.Errorf("couldn't set schema version: %v", err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("couldn't commit migration %d: %v", version+1, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,274 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// GetSharded returns the shards of the content at url.
+// Returns common.ErrNotFound if the content isn't sharded.
+func (c *Client) GetSharded(url string) (*Sharded, error) {
+	s := &Sharded{URL: url}
+
+	err := c.db.QueryRow("SELECT size, data, parity FROM sharded WHERE url=?", url).Scan(&s.Size, &s.Data, &s.Parity)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, common.ErrNotFound
+		}
+
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	if err := c.fillShardLocations(s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// SetSharded replaces the content at s.URL with its shards. Returns
+// locations of the shards of the previous content, which should be deleted.
+func (c *Client) SetSharded(s *Sharded) ([]string, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	old, err := txDeleteSharded(tx, s.URL)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, err
+	}
+
+	if err := txInsertSharded(tx, s); err != nil {
+		tx.Rollback()
+
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return old, nil
+}
+
+// InsertSharded inserts s if the content at s.URL isn't sharded
+func (c *Client) InsertSharded(s *Sharded) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	var found bool
+
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM sharded WHERE url=?)", s.URL).Scan(&found); err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	if found {
+		tx.Rollback()
+
+		return nil
+	}
+
+	if err := txInsertSharded(tx, s); err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// MoveSharded changes url of the sharded content. Returns false if the content at url isn't sharded.
+func (c *Client) MoveSharded(url string, newURL string) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	res, err := tx.Exec("UPDATE sharded SET url=? WHERE url=?", newURL, url)
+	if err != nil {
+		tx.Rollback()
+
+		return false, fmt.Errorf("couldn't update sharded content %s: %v", url, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+
+		return false, fmt.Errorf("couldn't get affected rows: %v", err)
+	}
+
+	if _, err := tx.Exec("UPDATE shards SET url=? WHERE url=?", newURL, url); err != nil {
+		tx.Rollback()
+
+		return false, fmt.Errorf("couldn't update shards of %s: %v", url, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// DeleteSharded removes the shards of the content at url and returns their
+// locations, which should be deleted. Returns false if the content isn't sharded.
+func (c *Client) DeleteSharded(url string) ([]string, bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	old, err := txDeleteSharded(tx, url)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return old, old != nil, nil
+}
+
+// GetShardedRows returns limit sharded contents starting from offset
+func (c *Client) GetShardedRows(limit int, offset int) ([]Sharded, error) {
+	row, err := c.db.Query("SELECT url, size, data, parity FROM sharded ORDER BY url LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	contents := []Sharded{}
+
+	for row.Next() {
+		s := Sharded{}
+
+		if err := row.Scan(&s.URL, &s.Size, &s.Data, &s.Parity); err != nil {
+			row.Close()
+
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		contents = append(contents, s)
+	}
+
+	row.Close()
+
+	for i := range contents {
+		if err := c.fillShardLocations(&contents[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return contents, nil
+}
+
+// GetShardedCount returns the number of sharded contents
+func (c *Client) GetShardedCount() (int, error) {
+	return c.count("SELECT count(*) FROM sharded")
+}
+
+func (c *Client) fillShardLocations(s *Sharded) error {
+	row, err := c.db.Query("SELECT idx, location FROM shards WHERE url=?", s.URL)
+	if err != nil {
+		return fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	// missing shards have empty locations
+	s.Locations = make([]string, s.Data+s.Parity)
+
+	for row.Next() {
+		var idx int
+		var location string
+
+		if err := row.Scan(&idx, &location); err != nil {
+			return fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		if idx >= 0 && idx < len(s.Locations) {
+			s.Locations[idx] = location
+		}
+	}
+
+	return nil
+}
+
+func txInsertSharded(tx *sql.Tx, s *Sharded) error {
+	_, err := tx.Exec("INSERT INTO sharded(url, size, data, parity) VALUES(?, ?, ?, ?)", s.URL, s.Size, s.Data, s.Parity)
+	if err != nil {
+		return fmt.Errorf("couldn't insert sharded content: %v", err)
+	}
+
+	for idx, location := range s.Locations {
+		if location == "" {
+			continue
+		}
+
+		_, err := tx.Exec("INSERT INTO shards(url, idx, location) VALUES(?, ?, ?)", s.URL, idx, location)
+		if err != nil {
+			return fmt.Errorf("couldn't insert shard: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// txDeleteSharded removes the shards of url and returns their locations, nil if it isn't sharded
+func txDeleteSharded(tx *sql.Tx, url string) ([]string, error) {
+	var found bool
+
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM sharded WHERE url=?)", url).Scan(&found); err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	row, err := tx.Query("SELECT location FROM shards WHERE url=?", url)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	locations := []string{}
+
+	for row.Next() {
+		var location string
+
+		if err := row.Scan(&location); err != nil {
+			row.Close()
+
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		locations = append(locations, location)
+	}
+
+	row.Close()
+
+	if _, err := tx.Exec("DELETE FROM shards WHERE url=?", url); err != nil {
+		return nil, fmt.Errorf("couldn't delete shards of %s: %v", url, err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM sharded WHERE url=?", url); err != nil {
+		return nil, fmt.Errorf("couldn't delete sharded content %s: %v", url, err)
+	}
+
+	return locations, nil
+}
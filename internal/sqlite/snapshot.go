@@ -0,0 +1,264 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// AddSnapshot adds s and references the remote files of the files and
+// their versions from it, so that they aren't deleted while it exists
+func (c *Client) AddSnapshot(s *Snapshot) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	_, err = tx.Exec("INSERT INTO snapshots(id, name, url, created, device) VALUES(?, ?, ?, ?, ?)",
+		s.ID, s.Name, s.URL, toTimestamp(s.Created), s.Device)
+	if err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("couldn't insert snapshot: %v", err)
+	}
+
+	res, err := tx.Exec("INSERT INTO snapshot_blobs(snapshot, url, location) SELECT ?, url, url FROM "+
+		"(SELECT url FROM inodes WHERE type=? and url != '' UNION SELECT url FROM versions)", s.ID, common.DrvFile)
+	if err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("couldn't insert snapshot files: %v", err)
+	}
+
+	if n, err := res.RowsAffected(); err == nil {
+		s.Files = int(n)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// InsertSnapshot inserts s if there isn't a snapshot with the same id.
+// Its files should be inserted with InsertSnapshotBlob.
+func (c *Client) InsertSnapshot(s *Snapshot) error {
+	_, err := c.db.Exec("INSERT OR IGNORE INTO snapshots(id, name, url, created, device) VALUES(?, ?, ?, ?, ?)",
+		s.ID, s.Name, s.URL, toTimestamp(s.Created), s.Device)
+	if err != nil {
+		return fmt.Errorf("couldn't insert snapshot: %v", err)
+	}
+
+	return nil
+}
+
+// InsertSnapshotBlob inserts b if the snapshot doesn't reference its url yet.
+// Otherwise location is updated if the content is moved in b but not here.
+func (c *Client) InsertSnapshotBlob(b *SnapshotBlob) error {
+	_, err := c.db.Exec("INSERT OR IGNORE INTO snapshot_blobs(snapshot, url, location) VALUES(?, ?, ?)",
+		b.Snapshot, b.URL, b.Location)
+	if err != nil {
+		return fmt.Errorf("couldn't insert snapshot file: %v", err)
+	}
+
+	_, err = c.db.Exec("UPDATE snapshot_blobs SET location=? WHERE snapshot=? and url=? and location=url",
+		b.Location, b.Snapshot, b.URL)
+	if err != nil {
+		return fmt.Errorf("couldn't update snapshot file: %v", err)
+	}
+
+	return nil
+}
+
+// GetSnapshots returns the snapshots ordered by their creation times
+func (c *Client) GetSnapshots() ([]Snapshot, error) {
+	query, err := c.db.Prepare("SELECT s.id, s.name, s.url, s.created, s.device, " +
+		"(SELECT count(*) FROM snapshot_blobs b WHERE b.snapshot = s.id) FROM snapshots s ORDER BY s.created")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
+	}
+
+	row, err := query.Query()
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	snapshots := []Snapshot{}
+
+	for row.Next() {
+		s := Snapshot{}
+
+		var created int64
+
+		if err := row.Scan(&s.ID, &s.Name, &s.URL, &created, &s.Device, &s.Files); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		s.Created = fromTimestamp(created)
+
+		snapshots = append(snapshots, s)
+	}
+
+	return snapshots, nil
+}
+
+// GetSnapshot returns the snapshot with specified id
+func (c *Client) GetSnapshot(id string) (*Snapshot, error) {
+	s := &Snapshot{}
+
+	var created int64
+
+	err := c.db.QueryRow("SELECT s.id, s.name, s.url, s.created, s.device, "+
+		"(SELECT count(*) FROM snapshot_blobs b WHERE b.snapshot = s.id) FROM snapshots s WHERE s.id=?", id).
+		Scan(&s.ID, &s.Name, &s.URL, &created, &s.Device, &s.Files)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, common.ErrNotFound
+		}
+
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	s.Created = fromTimestamp(created)
+
+	return s, nil
+}
+
+// GetSnapshotLocations returns the current urls of the remote
+// files referenced by the snapshot, keyed by their urls in it
+func (c *Client) GetSnapshotLocations(id string) (map[string]string, error) {
+	row, err := c.db.Query("SELECT url, location FROM snapshot_blobs WHERE snapshot=?", id)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	locations := map[string]string{}
+
+	for row.Next() {
+		var url, location string
+
+		if err := row.Scan(&url, &location); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		locations[url] = location
+	}
+
+	return locations, nil
+}
+
+// GetSnapshotBlobs returns limit snapshot files starting from offset
+func (c *Client) GetSnapshotBlobs(limit int, offset int) ([]SnapshotBlob, error) {
+	row, err := c.db.Query("SELECT snapshot, url, location FROM snapshot_blobs "+
+		"ORDER BY snapshot, url LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	blobs := []SnapshotBlob{}
+
+	for row.Next() {
+		b := SnapshotBlob{}
+
+		if err := row.Scan(&b.Snapshot, &b.URL, &b.Location); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		blobs = append(blobs, b)
+	}
+
+	return blobs, nil
+}
+
+// GetSnapshotBlobCount returns the number of snapshot files
+func (c *Client) GetSnapshotBlobCount() (int, error) {
+	return c.count("SELECT count(*) FROM snapshot_blobs")
+}
+
+// IsSnapshotBlob returns whether the content at url is referenced by a snapshot
+func (c *Client) IsSnapshotBlob(url string) (bool, error) {
+	var found bool
+
+	err := c.db.QueryRow("SELECT EXISTS(SELECT 1 FROM snapshot_blobs WHERE location=?)", url).Scan(&found)
+	if err != nil {
+		return false, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	return found, nil
+}
+
+// MoveSnapshotBlobs changes location of the content at url referenced by snapshots
+func (c *Client) MoveSnapshotBlobs(url string, newURL string) error {
+	if _, err := c.db.Exec("UPDATE snapshot_blobs SET location=? WHERE location=?", newURL, url); err != nil {
+		return fmt.Errorf("couldn't update snapshot files: %v", err)
+	}
+
+	return nil
+}
+
+// DeleteSnapshot removes the snapshot with specified id. Returns the urls
+// of the remote files which aren't referenced anymore, they should be
+// deleted along with the copy of the database.
+func (c *Client) DeleteSnapshot(id string) ([]string, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	row, err := tx.Query("SELECT DISTINCT b.location FROM snapshot_blobs b WHERE b.snapshot=? "+
+		"and NOT EXISTS(SELECT 1 FROM snapshot_blobs o WHERE o.location = b.location and o.snapshot != b.snapshot) "+
+		"and NOT EXISTS(SELECT 1 FROM inodes i WHERE i.url = b.location) "+
+		"and NOT EXISTS(SELECT 1 FROM versions v WHERE v.url = b.location)", id)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	urls := []string{}
+
+	for row.Next() {
+		var url string
+
+		if err := row.Scan(&url); err != nil {
+			row.Close()
+			tx.Rollback()
+
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		urls = append(urls, url)
+	}
+
+	row.Close()
+
+	if _, err := tx.Exec("DELETE FROM snapshot_blobs WHERE snapshot=?", id); err != nil {
+		tx.Rollback()
+
+		return nil, fmt.Errorf("couldn't delete snapshot files: %v", err)
+	}
+
+	res, err := tx.Exec("DELETE FROM snapshots WHERE id=?", id)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, fmt.Errorf("couldn't delete snapshot: %v", err)
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		tx.Rollback()
+
+		return nil, common.ErrNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return urls, nil
+}
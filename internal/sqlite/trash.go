@@ -0,0 +1,171 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// TrashParent is the parent of the entries in the trash. They are kept out
+// of the tree of the root directory, so they aren't visible in the filesystem.
+const TrashParent = 0
+
+// Trash moves the entry with specified name under specified inode to the trash.
+// path is the original path of the entry, device is the host removing it.
+func (c *Client) Trash(parent int64, name string, path string, device string, t time.Time) (*TrashEntry, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	md, err := c.txGetEntry(tx, parent, name)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, err
+	}
+
+	e, err := txTrash(tx, md, path, device, t)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return e, nil
+}
+
+// txTrash moves the entry of md to the trash
+func txTrash(tx *sql.Tx, md *Metadata, path string, device string, t time.Time) (*TrashEntry, error) {
+	e := &TrashEntry{
+		ID:      fmt.Sprintf("%d-%d", md.Inode, t.UnixNano()),
+		Inode:   md.Inode,
+		Parent:  md.Parent,
+		Path:    path,
+		Deleted: t,
+		Device:  device,
+		Type:    md.Type,
+		Size:    md.Size,
+	}
+
+	_, err := tx.Exec("UPDATE dentries SET parent=?, name=? WHERE parent=? and name=?", TrashParent, e.ID, md.Parent, md.Name)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't move entry to trash: %v", err)
+	}
+
+	_, err = tx.Exec("INSERT INTO trash(id, inode, parent, path, deleted, device) VALUES(?, ?, ?, ?, ?, ?)",
+		e.ID, e.Inode, e.Parent, e.Path, toTimestamp(e.Deleted), e.Device)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't insert trash entry: %v", err)
+	}
+
+	return e, nil
+}
+
+// GetTrash returns the entries in the trash ordered by their deletion times
+func (c *Client) GetTrash() ([]TrashEntry, error) {
+	query, err := c.db.Prepare("SELECT t.id, t.inode, t.parent, t.path, t.deleted, t.device, i.type, i.size " +
+		"FROM trash t JOIN inodes i ON i.inode = t.inode ORDER BY t.deleted")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
+	}
+
+	row, err := query.Query()
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	entries := []TrashEntry{}
+
+	for row.Next() {
+		e := TrashEntry{}
+
+		var deleted int64
+
+		err := row.Scan(&e.ID, &e.Inode, &e.Parent, &e.Path, &deleted, &e.Device, &e.Type, &e.Size)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		e.Deleted = fromTimestamp(deleted)
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// GetTrashEntry returns the entry in the trash with specified id
+func (c *Client) GetTrashEntry(id string) (*TrashEntry, error) {
+	e := &TrashEntry{}
+
+	var deleted int64
+
+	err := c.db.QueryRow("SELECT t.id, t.inode, t.parent, t.path, t.deleted, t.device, i.type, i.size "+
+		"FROM trash t JOIN inodes i ON i.inode = t.inode WHERE t.id=?", id).
+		Scan(&e.ID, &e.Inode, &e.Parent, &e.Path, &deleted, &e.Device, &e.Type, &e.Size)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, common.ErrNotFound
+		}
+
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	e.Deleted = fromTimestamp(deleted)
+
+	return e, nil
+}
+
+// InsertTrashEntry adds e to the trash if there isn't an entry with the same
+// id. The entry under TrashParent should already exist.
+func (c *Client) InsertTrashEntry(e *TrashEntry) error {
+	_, err := c.db.Exec("INSERT OR IGNORE INTO trash(id, inode, parent, path, deleted, device) VALUES(?, ?, ?, ?, ?, ?)",
+		e.ID, e.Inode, e.Parent, e.Path, toTimestamp(e.Deleted), e.Device)
+	if err != nil {
+		return fmt.Errorf("couldn't insert trash entry: %v", err)
+	}
+
+	return nil
+}
+
+// Restore moves the entry with specified id out of the trash
+// to the specified name under specified inode
+func (c *Client) Restore(id string, parent int64, name string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	res, err := tx.Exec("UPDATE dentries SET parent=?, name=? WHERE parent=? and name=?", parent, name, TrashParent, id)
+	if err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("couldn't restore entry: %v", err)
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		tx.Rollback()
+
+		return common.ErrNotFound
+	}
+
+	if _, err := tx.Exec("DELETE FROM trash WHERE id=?", id); err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("couldn't delete trash entry: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package sqlite
+
+import (
+	"testing"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+func TestReplaceLinks(t *testing.T) {
+	c := newTestClient(t)
+
+	a, err := c.AddDirectory(1, "a", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := c.AddDirectory(a.Inode, "b", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := c.CreateFile(1, "f", 0644, "drive://f", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.CreateFile(b.Inode, "taken", 0644, "drive://taken", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory can't be moved under itself
+	if err := c.ReplaceLinks(a.Inode, []Dentry{{Parent: b.Inode, Name: "a"}}); err != common.ErrSubdirectory {
+		t.Errorf("directory is moved under itself: %v", err)
+	}
+
+	if _, err := c.Search(1, "a"); err != nil {
+		t.Errorf("names aren't kept after failure: %v", err)
+	}
+
+	e, err := c.Trash(1, "f", "/f", "host", f.CTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.ReplaceLinks(f.Inode, []Dentry{{Parent: b.Inode, Name: "taken"}, {Parent: 1, Name: "g"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := c.GetLinks(f.Inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(links) != 2 {
+		t.Fatalf("file has %d names, expected 2", len(links))
+	}
+
+	for _, l := range links {
+		if l.Parent == b.Inode && l.Name == "taken" {
+			t.Errorf("name of another file is taken")
+		}
+	}
+
+	if _, err := c.GetTrashEntry(e.ID); err != common.ErrNotFound {
+		t.Errorf("trash entry of removed name is kept: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SetVersion inserts v or updates the version with the same URL
+func (c *Client) SetVersion(v *Version) error {
+	query, err := c.db.Prepare("INSERT OR REPLACE INTO versions(url, inode, size, hash, time) VALUES(?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("couldn't prepare statement: %v", err)
+	}
+
+	if _, err := query.Exec(v.URL, v.Inode, v.Size, v.Hash, toTimestamp(v.Time)); err != nil {
+		return fmt.Errorf("couldn't set version: %v", err)
+	}
+
+	return nil
+}
+
+// InsertVersion inserts v if there isn't a version with the same URL
+func (c *Client) InsertVersion(v *Version) error {
+	query, err := c.db.Prepare("INSERT OR IGNORE INTO versions(url, inode, size, hash, time) VALUES(?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("couldn't prepare statement: %v", err)
+	}
+
+	if _, err := query.Exec(v.URL, v.Inode, v.Size, v.Hash, toTimestamp(v.Time)); err != nil {
+		return fmt.Errorf("couldn't insert version: %v", err)
+	}
+
+	return nil
+}
+
+// MoveVersion changes URL of the version. Returns false if there isn't a version with url.
+func (c *Client) MoveVersion(url string, newURL string) (bool, error) {
+	query, err := c.db.Prepare("UPDATE versions SET url=? WHERE url=?")
+	if err != nil {
+		return false, fmt.Errorf("couldn't prepare statement: %v", err)
+	}
+
+	res, err := query.Exec(newURL, url)
+	if err != nil {
+		return false, fmt.Errorf("couldn't update version: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("couldn't get affected rows: %v", err)
+	}
+
+	return n > 0, nil
+}
+
+// DeleteVersion removes the version with specified url
+func (c *Client) DeleteVersion(url string) error {
+	if _, err := c.db.Exec("DELETE FROM versions WHERE url=?", url); err != nil {
+		return fmt.Errorf("couldn't delete version: %v", err)
+	}
+
+	return nil
+}
+
+// GetVersions returns the earlier versions of the file with specified inode,
+// the last uploaded content isn't included. Newest ones come first.
+func (c *Client) GetVersions(inode int64) ([]Version, error) {
+	query, err := c.db.Prepare("SELECT v.url, v.inode, v.size, v.hash, v.time FROM versions v " +
+		"JOIN inodes i ON i.inode = v.inode WHERE v.inode=? and v.url != i.url ORDER BY v.time DESC")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
+	}
+
+	row, err := query.Query(inode)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	return parseVersionRows(row)
+}
+
+// DeleteVersions removes all versions of the file with specified inode
+// and returns them
+func (c *Client) DeleteVersions(inode int64) ([]Version, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	row, err := tx.Query("SELECT url, inode, size, hash, time FROM versions WHERE inode=?", inode)
+	if err != nil {
+		tx.Rollback()
+
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	versions, err := parseVersionRows(row)
+	row.Close()
+
+	if err != nil {
+		tx.Rollback()
+
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM versions WHERE inode=?", inode); err != nil {
+		tx.Rollback()
+
+		return nil, fmt.Errorf("couldn't delete versions: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return versions, nil
+}
+
+// GetVersionRows returns versions of all files ordered by URL
+// starting from specified offset with specified limit
+func (c *Client) GetVersionRows(limit int, offset int) ([]Version, error) {
+	query, err := c.db.Prepare("SELECT url, inode, size, hash, time FROM versions ORDER BY url LIMIT ? OFFSET ?")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
+	}
+
+	row, err := query.Query(limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	return parseVersionRows(row)
+}
+
+// GetVersionCount returns total number of versions
+func (c *Client) GetVersionCount() (int, error) {
+	return c.count("SELECT count(*) FROM versions")
+}
+
+func parseVersionRows(row *sql.Rows) ([]Version, error) {
+	versions := []Version{}
+
+	for row.Next() {
+		v := Version{}
+
+		var t int64
+
+		if err := row.Scan(&v.URL, &v.Inode, &v.Size, &v.Hash, &t); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		v.Time = fromTimestamp(t)
+
+		versions = append(versions, v)
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,162 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/paddlesteamer/cloudstash/internal/common"
+)
+
+// Flags of SetXAttr, same as the ones of setxattr(2)
+const (
+	XAttrCreate  = 1 // fail if the attribute exists
+	XAttrReplace = 2 // fail if the attribute doesn't exist
+)
+
+// GetXAttr returns value of the extended attribute of the file with
+// specified inode. Returns common.ErrNotFound if there is no such attribute.
+func (c *Client) GetXAttr(inode int64, name string) ([]byte, error) {
+	var value []byte
+
+	err := c.db.QueryRow("SELECT value FROM xattrs WHERE inode=? and name=?", inode, name).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, common.ErrNotFound
+		}
+
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	return value, nil
+}
+
+// ListXAttrs returns names of the extended attributes of the file with specified inode
+func (c *Client) ListXAttrs(inode int64) ([]string, error) {
+	query, err := c.db.Prepare("SELECT name FROM xattrs WHERE inode=? ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
+	}
+
+	row, err := query.Query(inode)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	names := []string{}
+
+	for row.Next() {
+		var name string
+
+		if err := row.Scan(&name); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// SetXAttr sets value of the extended attribute of the file with specified inode.
+// With XAttrCreate, common.ErrExists is returned if the attribute exists. With
+// XAttrReplace, common.ErrNotFound is returned if it doesn't.
+func (c *Client) SetXAttr(inode int64, name string, value []byte, flags int) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %v", err)
+	}
+
+	var exists int
+
+	err = tx.QueryRow("SELECT COUNT(*) FROM xattrs WHERE inode=? and name=?", inode, name).Scan(&exists)
+	if err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("there is an error in query: %v", err)
+	}
+
+	if flags&XAttrCreate != 0 && exists > 0 {
+		tx.Rollback()
+
+		return common.ErrExists
+	}
+
+	if flags&XAttrReplace != 0 && exists == 0 {
+		tx.Rollback()
+
+		return common.ErrNotFound
+	}
+
+	// value can't be nil, column is NOT NULL
+	if value == nil {
+		value = []byte{}
+	}
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO xattrs(inode, name, value) VALUES(?, ?, ?)", inode, name, value)
+	if err != nil {
+		tx.Rollback()
+
+		return fmt.Errorf("couldn't set extended attribute: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// RemoveXAttr removes the extended attribute of the file with specified inode.
+// Returns common.ErrNotFound if there is no such attribute.
+func (c *Client) RemoveXAttr(inode int64, name string) error {
+	query, err := c.db.Prepare("DELETE FROM xattrs WHERE inode=? and name=?")
+	if err != nil {
+		return fmt.Errorf("couldn't prepare statement: %v", err)
+	}
+
+	res, err := query.Exec(inode, name)
+	if err != nil {
+		return fmt.Errorf("couldn't delete extended attribute: %v", err)
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return common.ErrNotFound
+	}
+
+	return nil
+}
+
+// GetXAttrs returns extended attributes of all files ordered by inode
+// and name starting from specified offset with specified limit
+func (c *Client) GetXAttrs(limit int, offset int) ([]XAttr, error) {
+	query, err := c.db.Prepare("SELECT inode, name, value FROM xattrs ORDER BY inode, name LIMIT ? OFFSET ?")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't prepare statement: %v", err)
+	}
+
+	row, err := query.Query(limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("there is an error in query: %v", err)
+	}
+	defer row.Close()
+
+	xattrs := []XAttr{}
+
+	for row.Next() {
+		x := XAttr{}
+
+		if err := row.Scan(&x.Inode, &x.Name, &x.Value); err != nil {
+			return nil, fmt.Errorf("couldn't parse row: %v", err)
+		}
+
+		xattrs = append(xattrs, x)
+	}
+
+	return xattrs, nil
+}
+
+// GetXAttrCount returns total number of extended attributes
+func (c *Client) GetXAttrCount() (int, error) {
+	return c.count("SELECT count(*) FROM xattrs")
+}